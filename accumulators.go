@@ -0,0 +1,254 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// Limits of the legs of an accumulator.
+const (
+	minAccumulatorLegs = 2
+	maxAccumulatorLegs = 10
+)
+
+// Statuses of an accumulator: pending until the match of every leg is
+// settled, then won when every leg scored, lost otherwise.
+const (
+	AccumulatorPending = "pending"
+	AccumulatorWon     = "won"
+	AccumulatorLost    = "lost"
+)
+
+// Accumulator is a bet on several matches of a championship at once. Its
+// legs are bets of their own, scored as any other and sharing the id of
+// the accumulator; when every leg scores, the player earns the bonus of
+// the scoring rules on top of their points, per leg.
+type Accumulator struct {
+	ID             string `json:"id,omitempty"`
+	Tenant         string `json:"tenant,omitempty"`
+	Email          string `json:"email,omitempty"`
+	ChampionshipID string `json:"championshipId,omitempty"`
+	Status         string `json:"status"`
+	Bonus          int    `json:"bonus"`
+	Legs           []*Bet `json:"legs"`
+	DryRun         bool   `json:"dryRun,omitempty"`
+}
+
+// accumulatorOf tells how an accumulator stands from its legs.
+func accumulatorOf(legs []*Bet) *Accumulator {
+	first := legs[0]
+	a := &Accumulator{
+		ID:             first.AccumulatorID,
+		Tenant:         first.Tenant,
+		Email:          first.Email,
+		ChampionshipID: first.ChampionshipID,
+		Status:         AccumulatorWon,
+		Legs:           legs,
+	}
+	for _, b := range legs {
+		if b.Settlement == nil || b.Settlement.Status != SettlementSettled {
+			a.Status = AccumulatorPending
+			return a
+		}
+		if b.Settlement.Points == 0 {
+			a.Status = AccumulatorLost
+		}
+	}
+	if a.Status == AccumulatorWon {
+		a.Bonus = scoring(a.Tenant).accumulatorBonus() * len(legs)
+	}
+	return a
+}
+
+// validateAccumulator checks the legs requested before any is placed.
+func validateAccumulator(bet *Bet) error {
+	if bet.Match != "" || bet.HomeTeamScore != "" || bet.AwayTeamScore != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "an accumulator predicts the scores of its legs only")
+	}
+	if len(bet.Legs) < minAccumulatorLegs || len(bet.Legs) > maxAccumulatorLegs {
+		return echo.NewHTTPError(http.StatusBadRequest, "an accumulator has "+strconv.Itoa(minAccumulatorLegs)+" to "+strconv.Itoa(maxAccumulatorLegs)+" legs")
+	}
+	matches := map[string]bool{}
+	for _, leg := range bet.Legs {
+		if leg == nil || len(leg.Legs) > 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "the legs of an accumulator are single bets")
+		}
+		if matches[leg.Match] {
+			return echo.NewHTTPError(http.StatusBadRequest, "the legs of an accumulator are on different matches")
+		}
+		matches[leg.Match] = true
+		if leg.Championship == "" {
+			leg.Championship = bet.Championship
+		}
+		if err := validateBet(leg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeAccumulator places every leg of the requested accumulator, or none:
+// each is validated as a bet of its own first, their matches open and in
+// the same championship, then the legs are stored one after the other,
+// those already stored being deleted again when storing another fails. The
+// accumulator takes one bet of the quota, and its legs are announced once
+// all of them are stored.
+func placeAccumulator(c echo.Context, bet *Bet, dryRun bool) (*Accumulator, []Warning, error) {
+	if err := validateAccumulator(bet); err != nil {
+		return nil, nil, err
+	}
+	var warnings []Warning
+	legs := make([]*Bet, 0, len(bet.Legs))
+	for _, leg := range bet.Legs {
+		b, w, err := buildBet(c, leg, betOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(legs) > 0 && b.ChampionshipID != legs[0].ChampionshipID {
+			return nil, nil, echo.NewHTTPError(http.StatusUnprocessableEntity, "the legs of an accumulator are in the same championship")
+		}
+		legs = append(legs, b)
+		warnings = append(warnings, w...)
+	}
+	if dryRun {
+		for _, b := range legs {
+			b.ID = ""
+			if err := checkExternalRef(b); err != nil {
+				return nil, nil, err
+			}
+		}
+		a := accumulatorOf(legs)
+		a.DryRun = true
+		return a, warnings, nil
+	}
+	if err := quotas.take(c); err != nil {
+		return nil, nil, err
+	}
+	id := newUUIDv7()
+	var legEvents []*OutboxEntry
+	for i, b := range legs {
+		b.AccumulatorID = id
+		opts := betOptions{accumulator: id, lastLeg: i == len(legs)-1, legEvents: legEvents}
+		if err := storeBet(c, b, opts); err != nil {
+			discardLegs(c, legs[:i])
+			return nil, nil, err
+		}
+		if opts.lastLeg {
+			break
+		}
+		e, err := betCreated(b)
+		if err != nil {
+			discardLegs(c, legs[:i+1])
+			return nil, nil, err
+		}
+		if e != nil {
+			legEvents = append(legEvents, e)
+		}
+	}
+	ids := make([]string, len(legs))
+	for i, b := range legs {
+		announceBet(c, b, false)
+		ids[i] = b.ID
+	}
+	a := accumulatorOf(legs)
+	audit.record(auditActor(c), "accumulator.created", id, map[string]interface{}{"legs": ids})
+	return a, warnings, nil
+}
+
+// discardLegs soft deletes the legs, not announced yet, of an accumulator
+// that could not be placed whole.
+func discardLegs(c echo.Context, legs []*Bet) {
+	now := requestClock(c).Now()
+	for _, b := range legs {
+		b.DeletedAt = &now
+		if err := bets.Save(b); err != nil {
+			log.Error().Err(err).Str("bet", b.ID).Msg("failed to delete the leg of an accumulator not placed")
+			continue
+		}
+		audit.record(auditActor(c), "bet.deleted", b.ID, map[string]string{"reason": "accumulator not placed"})
+	}
+}
+
+// CreatedAccumulator is a new accumulator with the enrichments of its legs
+// that couldn't be applied.
+type CreatedAccumulator struct {
+	*Accumulator
+	Degraded bool      `json:"degraded,omitempty"`
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+// createAccumulator places the bet posted with legs, within the dedup
+// window of CreateBet.
+func createAccumulator(c echo.Context, bet *Bet) (replayFunc, error) {
+	a, warnings, err := placeAccumulator(c, bet, false)
+	if err != nil {
+		return nil, betError(err)
+	}
+	created := &CreatedAccumulator{Accumulator: a, Degraded: len(warnings) > 0, Warnings: warnings}
+	return func(c echo.Context) error { return respondOwned(c, http.StatusCreated, created, a.Email) }, nil
+}
+
+// dryRunAccumulator answers the accumulator the legs posted would make.
+func dryRunAccumulator(c echo.Context, bet *Bet) error {
+	a, warnings, err := placeAccumulator(c, bet, true)
+	if err != nil {
+		return betError(err)
+	}
+	return respondOwned(c, http.StatusOK, &CreatedAccumulator{Accumulator: a, Degraded: len(warnings) > 0, Warnings: warnings}, a.Email)
+}
+
+// GetAccumulator reports an accumulator and its legs.
+func GetAccumulator(c echo.Context) error {
+	legs, err := bets.List(BetFilter{Tenant: tenant(c), AccumulatorID: c.Param("id")})
+	if err != nil {
+		return err
+	}
+	if len(legs) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "accumulator not found")
+	}
+	return respond(c, http.StatusOK, accumulatorOf(legs))
+}
+
+// settleAccumulators announces the accumulators whose last leg was just
+// settled, or settled again with another result.
+func settleAccumulators(settled []*Bet) {
+	seen := map[string]bool{}
+	for _, b := range settled {
+		if b.AccumulatorID == "" || seen[b.AccumulatorID] {
+			continue
+		}
+		seen[b.AccumulatorID] = true
+		legs, err := bets.List(BetFilter{Tenant: b.Tenant, AccumulatorID: b.AccumulatorID})
+		if err != nil {
+			log.Error().Err(err).Str("accumulator", b.AccumulatorID).Msg("failed to list the legs of the accumulator")
+			continue
+		}
+		a := accumulatorOf(legs)
+		if a.Status == AccumulatorPending {
+			continue
+		}
+		audit.record("settlement", "accumulator.settled", a.ID, map[string]interface{}{"status": a.Status, "bonus": a.Bonus})
+		notifier.Notify(a.Tenant, "accumulator.settled", a)
+	}
+}
+
+// accumulatorBonuses adds to the entries the bonuses of the accumulators
+// won among the bets, those of a whole championship: the legs of an
+// accumulator may span its rounds.
+func accumulatorBonuses(entries map[string]*Entry, list []*Bet) {
+	byID := map[string][]*Bet{}
+	for _, b := range list {
+		if b.AccumulatorID != "" {
+			byID[b.AccumulatorID] = append(byID[b.AccumulatorID], b)
+		}
+	}
+	for _, legs := range byID {
+		a := accumulatorOf(legs)
+		if e := entries[normalizeEmail(a.Email)]; e != nil && a.Bonus > 0 {
+			e.Bonus += a.Bonus
+			e.Points += a.Bonus
+		}
+	}
+}
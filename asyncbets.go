@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AsyncBetsConfig places bets in the background: POST /api/bets answers
+// 202 once the bet is validated, and a job calls the services and stores
+// it. Default makes every bet asynchronous, otherwise clients ask for it
+// with Prefer: respond-async. Attempts bounds the retries of bets failing
+// with a 5xx, as when a service is down.
+type AsyncBetsConfig struct {
+	Default  bool
+	Attempts int
+}
+
+type BetRequestStatus string
+
+const (
+	BetRequestPending BetRequestStatus = "pending"
+	BetRequestCreated BetRequestStatus = "created"
+	BetRequestFailed  BetRequestStatus = "failed"
+)
+
+var errBetRequestNotFound = errors.New("bet request not found")
+
+// errBetRequestLost fails the requests whose job was lost with its
+// replica: the bet may have been placed before it went down.
+var errBetRequestLost = errors.New("the bet request was interrupted, check the bets before placing it again")
+
+const (
+	// betRequestTTL is how long the memory driver keeps a bet request
+	// after it last changed.
+	betRequestTTL = 24 * time.Hour
+	// betRequestStale is how long a pending request goes without an
+	// attempt before it is taken for lost, if its replica is gone.
+	betRequestStale = 10 * time.Minute
+	// betRequestLease is the lease each replica holds while up, telling
+	// the others the jobs of its requests are still queued.
+	betRequestLease = time.Minute
+)
+
+// BetRequest is a bet placed in the background. Result, set once it is no
+// longer pending, is what placing it synchronously would have answered.
+// Owner is the replica whose job places it.
+type BetRequest struct {
+	ID        string           `json:"id"`
+	Tenant    string           `json:"tenant"`
+	Status    BetRequestStatus `json:"status"`
+	Attempts  int              `json:"attempts"`
+	Result    *BatchResult     `json:"result,omitempty"`
+	CreatedAt time.Time        `json:"createdAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	Location  string           `json:"location,omitempty"`
+	Owner     string           `json:"-"`
+}
+
+type BetRequestStore interface {
+	Get(id string) (*BetRequest, error)
+	Put(r *BetRequest) error
+	// Pending returns the requests still pending, last updated before.
+	Pending(before time.Time) ([]*BetRequest, error)
+}
+
+var betRequests BetRequestStore
+
+var asyncBets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "async",
+	Name:      "requests_total",
+	Help:      "Bets placed in the background, per final status.",
+}, []string{"status"})
+
+func init() {
+	registry.MustRegister(asyncBets)
+}
+
+// respondAsync tells whether the bet is placed in the background; dry runs
+// never are.
+func respondAsync(c echo.Context) bool {
+	if c.QueryParam("dryRun") == "true" {
+		return false
+	}
+	if config.AsyncBets.Default {
+		return true
+	}
+	for _, p := range strings.Split(c.Request().Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBet checks what needs no other service, so bad bets are rejected
+// before they are accepted in the background.
+func validateBet(bet *Bet) error {
+	if !validScore(bet.HomeTeamScore) || !validScore(bet.AwayTeamScore) {
+		return echo.NewHTTPError(http.StatusBadRequest, "scores must be non-negative integers")
+	}
+	if len(bet.ExternalRef) > maxExternalRef {
+		return echo.NewHTTPError(http.StatusBadRequest, "externalRef is limited to 128 characters")
+	}
+	if bet.Shootout != "" && bet.Shootout != shootoutHome && bet.Shootout != shootoutAway {
+		return echo.NewHTTPError(http.StatusBadRequest, "shootout must be home or away")
+	}
+	return nil
+}
+
+// acceptBet validates the bet and queues placing it; the response is 202
+// with the request, whose Location reports how it went. The bet takes its
+// quota now, once, however many attempts placing it takes.
+func acceptBet(c echo.Context, bet *Bet) (replayFunc, error) {
+	if err := validateBet(bet); err != nil {
+		return nil, err
+	}
+	if err := checkMatchOpen(tenant(c), bet.Match); err != nil {
+		return nil, err
+	}
+	if err := quotas.take(c); err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+	r := &BetRequest{ID: newID(), Tenant: tenant(c), Status: BetRequestPending, CreatedAt: now, UpdatedAt: now, Owner: lockOwner}
+	if err := betRequests.Put(r); err != nil {
+		log.Error().Err(err).Msg("failed to store the bet request")
+		return nil, err
+	}
+	location := link(c.Path() + "/requests/" + r.ID)
+	accepted := *r
+	accepted.Location = location
+	bc := detach(c)
+	attempts := config.AsyncBets.Attempts
+	jobs.Enqueue("bet-request", attempts, func(ctx context.Context) error {
+		bc.SetRequest(bc.Request().WithContext(ctx))
+		b, warnings, err := placeBet(bc, bet, betOptions{queued: true})
+		result := batchResult(b, warnings, err)
+		r.Attempts++
+		r.UpdatedAt = clock.Now()
+		if result.Status >= http.StatusInternalServerError && r.Attempts < attempts {
+			if perr := betRequests.Put(r); perr != nil {
+				log.Error().Err(perr).Str("request", r.ID).Msg("failed to store the bet request")
+			}
+			return errors.New(result.Error)
+		}
+		r.Result = &result
+		r.Status = BetRequestFailed
+		if err == nil {
+			r.Status = BetRequestCreated
+		}
+		asyncBets.WithLabelValues(string(r.Status)).Inc()
+		// the bet is placed already, another attempt would place it twice
+		if err := betRequests.Put(r); err != nil {
+			log.Error().Err(err).Str("request", r.ID).Msg("failed to store the bet request")
+		}
+		return nil
+	})
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderLocation, location)
+		return c.JSON(http.StatusAccepted, &accepted)
+	}, nil
+}
+
+// watchBetRequests holds the lease of this replica, renewed for as long
+// as it runs, and every betRequestStale fails the requests of the replicas
+// gone down.
+func watchBetRequests(ctx context.Context) {
+	go func() {
+		for ctx.Err() == nil {
+			err := withLock("bet-requests", lockOwner, betRequestLease, func(lease context.Context) error {
+				select {
+				case <-lease.Done():
+				case <-ctx.Done():
+				}
+				return nil
+			})
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to hold the lease of the bet requests, retrying")
+				time.Sleep(betRequestLease / 3)
+			}
+		}
+	}()
+	t := time.NewTicker(betRequestStale)
+	defer t.Stop()
+	for {
+		failLostBetRequests()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// replicaGone tells whether the replica owning bet requests is down: its
+// lease has expired. Requests stored before they had an owner have none.
+func replicaGone(owner string) (bool, error) {
+	if owner == lockOwner {
+		return false, nil
+	}
+	if owner == "" {
+		return true, nil
+	}
+	name, probe := "bet-requests:"+owner, lockOwner+"-probe"
+	gone, err := locks.Acquire(name, probe, betRequestLease)
+	if gone {
+		locks.Release(name, probe)
+	}
+	return gone, err
+}
+
+// failLostBetRequests fails the requests left pending by replicas gone
+// down with their jobs, which were queued in memory; callers polling them
+// would wait forever otherwise. The requests of replicas still up are left
+// alone, queued or backing off as they may be.
+func failLostBetRequests() {
+	pending, err := betRequests.Pending(clock.Now().Add(-betRequestStale))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list the pending bet requests")
+		return
+	}
+	gone := map[string]bool{}
+	var lost []*BetRequest
+	for _, r := range pending {
+		g, seen := gone[r.Owner]
+		if !seen {
+			if g, err = replicaGone(r.Owner); err != nil {
+				log.Error().Err(err).Str("replica", r.Owner).Msg("failed to tell whether the replica is up")
+				continue
+			}
+			gone[r.Owner] = g
+		}
+		if g {
+			lost = append(lost, r)
+		}
+	}
+	for _, r := range lost {
+		r.Status, r.UpdatedAt = BetRequestFailed, clock.Now()
+		r.Result = &BatchResult{Status: http.StatusInternalServerError, Error: errBetRequestLost.Error()}
+		if err := betRequests.Put(r); err != nil {
+			log.Error().Err(err).Str("request", r.ID).Msg("failed to store the bet request")
+			continue
+		}
+		asyncBets.WithLabelValues(string(r.Status)).Inc()
+	}
+	if len(lost) > 0 {
+		log.Warn().Int("requests", len(lost)).Msg("failed the bet requests left pending")
+	}
+}
+
+// GetBetRequest reports a bet placed in the background: pending, created
+// with the bet, or failed with the error placing it answered.
+func GetBetRequest(c echo.Context) error {
+	r, err := betRequests.Get(c.Param("id"))
+	if err == nil && r.Tenant != tenant(c) {
+		err = errBetRequestNotFound
+	}
+	if err == errBetRequestNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	if r.Status == BetRequestPending {
+		c.Response().Header().Set("Retry-After", "1")
+	}
+	owner := ""
+	if r.Result != nil {
+		r.Result.Error = localize(c, r.Result.Error)
+		if r.Result.Bet != nil {
+			owner = r.Result.Bet.Email
+		}
+	}
+	return respondOwned(c, http.StatusOK, r, owner)
+}
+
+// detach copies what placing a bet reads off the request, its headers and
+// the values set by the middlewares, into a context outliving it.
+func detach(c echo.Context) echo.Context {
+	req := c.Request().WithContext(context.Background())
+	req.Header = c.Request().Header.Clone()
+	d := c.Echo().NewContext(req, &discardResponse{header: http.Header{}})
+	for _, key := range []string{identityKey, tenantKey, domainKey, apiVersionKey, clockKey} {
+		if v := c.Get(key); v != nil {
+			d.Set(key, v)
+		}
+	}
+	return d
+}
+
+// discardResponse is the response of a detached context, which nobody
+// reads.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(int)             {}
+
+// memoryBetRequests drops the requests betRequestTTL after they last
+// changed, sweeping at most once a minute.
+type memoryBetRequests struct {
+	mu       sync.Mutex
+	requests map[string]BetRequest
+	swept    time.Time
+}
+
+func newMemoryBetRequests() *memoryBetRequests {
+	return &memoryBetRequests{requests: map[string]BetRequest{}}
+}
+
+func (m *memoryBetRequests) Get(id string) (*BetRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.requests[id]
+	if !ok {
+		return nil, errBetRequestNotFound
+	}
+	return &r, nil
+}
+
+func (m *memoryBetRequests) Put(r *BetRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(time.Now())
+	m.requests[r.ID] = *r
+	return nil
+}
+
+func (m *memoryBetRequests) Pending(before time.Time) ([]*BetRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*BetRequest{}
+	for _, req := range m.requests {
+		if req.Status == BetRequestPending && req.UpdatedAt.Before(before) {
+			c := req
+			r = append(r, &c)
+		}
+	}
+	return r, nil
+}
+
+// sweep drops the expired requests; callers hold the lock.
+func (m *memoryBetRequests) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+	for id, r := range m.requests {
+		if now.Sub(r.UpdatedAt) > betRequestTTL {
+			delete(m.requests, id)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// AuditEntry records one change to a bet. Entries form a chain: each hash
+// covers the entry and the hash of the one before, so editing or removing
+// a historical entry breaks every hash after it.
+type AuditEntry struct {
+	Seq      int64           `json:"seq"`
+	At       time.Time       `json:"at"`
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	BetID    string          `json:"betId"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	PrevHash string          `json:"prevHash"`
+	Hash     string          `json:"hash"`
+}
+
+type AuditStore interface {
+	// Append stores e after the latest entry. seal is called with the latest
+	// entry's sequence and hash (zero values for the first entry) while the
+	// store is locked, so concurrent appends can't fork the chain.
+	Append(e *AuditEntry, seal func(prevSeq int64, prevHash string)) error
+	// List returns the entries of the bet, or all of them when betID is
+	// empty, in sequence order.
+	List(betID string) ([]*AuditEntry, error)
+	// Range calls fn with the entries recorded in (after, until], in
+	// sequence order.
+	Range(after, until time.Time, fn func(*AuditEntry) error) error
+}
+
+// AuditLog seals entries with an HMAC when a key is configured, and a
+// plain SHA-256 otherwise.
+type AuditLog struct {
+	store AuditStore
+	key   []byte
+}
+
+func (a *AuditLog) mac() hash.Hash {
+	if len(a.key) == 0 {
+		return sha256.New()
+	}
+	return hmac.New(sha256.New, a.key)
+}
+
+func (a *AuditLog) digest(e *AuditEntry) string {
+	h := a.mac()
+	for _, part := range []string{
+		strconv.FormatInt(e.Seq, 10),
+		e.At.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.Action,
+		e.BetID,
+		string(e.Data),
+		e.PrevHash,
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Record appends an entry; data is stored as JSON and should not carry
+// personal data, which stays encrypted in the bets storage.
+func (a *AuditLog) Record(actor, action, betID string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	e := &AuditEntry{
+		At:     clock.Now().UTC().Truncate(time.Microsecond),
+		Actor:  actor,
+		Action: action,
+		BetID:  betID,
+		Data:   raw,
+	}
+	return a.store.Append(e, func(prevSeq int64, prevHash string) {
+		e.Seq = prevSeq + 1
+		e.PrevHash = prevHash
+		e.Hash = a.digest(e)
+	})
+}
+
+// record is Record for callers that shouldn't fail because of the audit
+// trail; the error is logged.
+func (a *AuditLog) record(actor, action, betID string, data interface{}) {
+	if err := a.Record(actor, action, betID, data); err != nil {
+		log.Error().Err(err).Str("bet", betID).Msg("failed to record audit entry " + action)
+	}
+}
+
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int    `json:"entries"`
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Verify walks the whole chain and reports the first entry that doesn't
+// match its hash or doesn't link to its predecessor.
+func (a *AuditLog) Verify() (*AuditVerification, error) {
+	entries, err := a.store.List("")
+	if err != nil {
+		return nil, err
+	}
+	v := &AuditVerification{Valid: true, Entries: len(entries)}
+	var prev *AuditEntry
+	for _, e := range entries {
+		switch {
+		case prev == nil && (e.Seq != 1 || e.PrevHash != ""):
+			v.Reason = "chain does not start at the first entry"
+		case prev != nil && e.Seq != prev.Seq+1:
+			v.Reason = "entry missing before this one"
+		case prev != nil && e.PrevHash != prev.Hash:
+			v.Reason = "previous hash does not match"
+		case a.digest(e) != e.Hash:
+			v.Reason = "entry does not match its hash"
+		}
+		if v.Reason != "" {
+			v.Valid = false
+			v.BrokenAt = e.Seq
+			return v, nil
+		}
+		prev = e
+	}
+	return v, nil
+}
+
+// auditActor names who made a change: the token subject, or anonymous.
+func auditActor(c echo.Context) string {
+	if id, ok := identity(c); ok && id.Subject != "" {
+		return id.Subject
+	}
+	return "anonymous"
+}
+
+func ListAudit(c echo.Context) error {
+	entries, err := audit.store.List(c.QueryParam("betId"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+func VerifyAudit(c echo.Context) error {
+	v, err := audit.Verify()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, v)
+}
+
+// memoryAudit keeps the chain in process memory.
+type memoryAudit struct {
+	mu      sync.Mutex
+	entries []*AuditEntry
+}
+
+func (m *memoryAudit) Append(e *AuditEntry, seal func(int64, string)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var prevSeq int64
+	var prevHash string
+	if n := len(m.entries); n > 0 {
+		prevSeq, prevHash = m.entries[n-1].Seq, m.entries[n-1].Hash
+	}
+	seal(prevSeq, prevHash)
+	c := *e
+	m.entries = append(m.entries, &c)
+	return nil
+}
+
+func (m *memoryAudit) List(betID string) ([]*AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*AuditEntry{}
+	for _, e := range m.entries {
+		if betID == "" || e.BetID == betID {
+			c := *e
+			r = append(r, &c)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Seq < r[j].Seq })
+	return r, nil
+}
+
+func (m *memoryAudit) Range(after, until time.Time, fn func(*AuditEntry) error) error {
+	entries, err := m.List("")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.At.After(after) && !e.At.After(until) {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runAudit implements `bets-app audit verify`.
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("usage: audit verify")
+	}
+	if err := initStorage(loadConfig()); err != nil {
+		return err
+	}
+	v, err := audit.Verify()
+	if err != nil {
+		return err
+	}
+	json.NewEncoder(os.Stdout).Encode(v)
+	if !v.Valid {
+		return fmt.Errorf("audit chain broken at entry %d: %s", v.BrokenAt, v.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+// Identity is the caller as asserted by the bearer token. Tokens are
+// verified by the gateway (Kong OIDC) before reaching us, so only the
+// claims are read here, unless TOKEN_VERIFY_KEY is set for deployments
+// without that gateway.
+type Identity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email"`
+	Roles   []string `json:"roles"`
+	Tenant  string   `json:"tenant,omitempty"`
+	// Session is the sid claim, or else the issue time, telling the
+	// logins of a player apart.
+	Session  string `json:"-"`
+	IssuedAt int64  `json:"-"`
+}
+
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// identityKey caches the caller of a request, resolved once.
+const identityKey = "identity"
+
+// identity is the caller as the identity provider sees them. Before the
+// storage is up, only bearer tokens are read.
+func identity(c echo.Context) (*Identity, bool) {
+	if id, ok := c.Get(identityKey).(*Identity); ok {
+		return id, id != nil
+	}
+	if identities == nil {
+		return tokenIdentity(c)
+	}
+	id, ok := identities.Identity(c)
+	if ok {
+		id.Email = normalizeEmail(id.Email)
+	} else {
+		id = nil
+	}
+	c.Set(identityKey, id)
+	return id, ok
+}
+
+// tokenKey verifies the signature of the bearer tokens; nil trusts the
+// gateway to have done it.
+var tokenKey interface{}
+
+// parseTokenKey reads TOKEN_VERIFY_KEY: a PEM RSA or ECDSA public key, or
+// else the secret of HMAC signed tokens.
+func parseTokenKey(key string) (interface{}, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(key, "-----BEGIN") {
+		return []byte(key), nil
+	}
+	if k, err := jwt.ParseRSAPublicKeyFromPEM([]byte(key)); err == nil {
+		return k, nil
+	}
+	if k, err := jwt.ParseECPublicKeyFromPEM([]byte(key)); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("TOKEN_VERIFY_KEY is not an RSA or ECDSA public key")
+}
+
+// verifyToken hands jwt the key of tokens signed the way tokenKey
+// verifies, refusing the others, "none" included.
+func verifyToken(t *jwt.Token) (interface{}, error) {
+	ok := false
+	switch tokenKey.(type) {
+	case []byte:
+		_, ok = t.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, ok = t.Method.(*jwt.SigningMethodRSA)
+		if !ok {
+			_, ok = t.Method.(*jwt.SigningMethodRSAPSS)
+		}
+	case *ecdsa.PublicKey:
+		_, ok = t.Method.(*jwt.SigningMethodECDSA)
+	}
+	if !ok {
+		return nil, errors.New("unexpected signing method " + t.Method.Alg())
+	}
+	return tokenKey, nil
+}
+
+// tokenIdentity reads the claims of the bearer token, checking its
+// signature and expiry first when there is a key to verify it with.
+func tokenIdentity(c echo.Context) (*Identity, bool) {
+	h := c.Request().Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, false
+	}
+	claims := jwt.MapClaims{}
+	raw := strings.TrimPrefix(h, "Bearer ")
+	var err error
+	if tokenKey != nil {
+		_, err = jwt.ParseWithClaims(raw, claims, verifyToken)
+	} else {
+		_, _, err = new(jwt.Parser).ParseUnverified(raw, claims)
+	}
+	if err != nil {
+		return nil, false
+	}
+	id := &Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.Tenant, _ = claims[config.Tenancy.Claim].(string)
+	if iat, ok := claims["iat"].(float64); ok {
+		id.IssuedAt = int64(iat)
+	}
+	if id.Session, _ = claims["sid"].(string); id.Session == "" && id.IssuedAt > 0 {
+		id.Session = strconv.FormatInt(id.IssuedAt, 10)
+	}
+	// keycloak puts realm roles under realm_access.roles
+	if ra, ok := claims["realm_access"].(map[string]interface{}); ok {
+		if roles, ok := ra["roles"].([]interface{}); ok {
+			for _, r := range roles {
+				if s, ok := r.(string); ok {
+					id.Roles = append(id.Roles, s)
+				}
+			}
+		}
+	}
+	return id, true
+}
+
+// RequireRole rejects callers without a token (401) or without the given
+// role (403).
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id, ok := identity(c)
+			if !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized, "missing or malformed credentials")
+			}
+			if !id.HasRole(role) {
+				return echo.NewHTTPError(http.StatusForbidden, "requires the "+role+" role")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of round awards.
+const (
+	AwardBestRoundScore = "bestRoundScore"
+	AwardAudaciousPick  = "audaciousPick"
+	AwardMVP            = "mvp"
+)
+
+// Award goes to a player for their bets in a round. Audacious picks carry
+// the pick and how likely its outcome was deemed before the match.
+type Award struct {
+	Kind        string  `json:"kind"`
+	Email       string  `json:"email"`
+	Points      int     `json:"points"`
+	MatchID     string  `json:"matchId,omitempty"`
+	Bet         string  `json:"bet,omitempty"`
+	Result      string  `json:"result,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+}
+
+// RoundAwards are computed once every bet of a round is settled.
+type RoundAwards struct {
+	Tenant         string    `json:"tenant"`
+	ChampionshipID string    `json:"championshipId"`
+	Round          string    `json:"round"`
+	Awards         []Award   `json:"awards"`
+	ComputedAt     time.Time `json:"computedAt"`
+}
+
+type AwardStore interface {
+	// Get returns nil for a round not awarded yet.
+	Get(tenant, championshipID, round string) (*RoundAwards, error)
+	Put(a *RoundAwards) error
+}
+
+type roundKey struct {
+	tenant, championshipID, round string
+}
+
+// awardRounds awards the rounds of the bets just settled, those whose bets
+// are now all settled. Settling a match again with another result awards
+// its round again; only awards that changed are announced.
+func awardRounds(settled []*Bet) {
+	seen := map[roundKey]bool{}
+	for _, b := range settled {
+		k := roundKey{b.Tenant, b.ChampionshipID, b.Round}
+		if seen[k] || k.championshipID == "" || k.round == "" {
+			continue
+		}
+		seen[k] = true
+		if err := awardRound(k); err != nil {
+			log.Error().Err(err).Str("championship", k.championshipID).Str("round", k.round).Msg("failed to award the round")
+		}
+	}
+}
+
+func awardRound(k roundKey) error {
+	in, err := bets.List(BetFilter{Tenant: k.tenant, ChampionshipID: k.championshipID, Round: k.round})
+	if err != nil {
+		return err
+	}
+	for _, b := range in {
+		if b.Settlement == nil || b.Settlement.Status != SettlementSettled {
+			return nil
+		}
+	}
+	previous, err := awards.Get(k.tenant, k.championshipID, k.round)
+	if err != nil {
+		return err
+	}
+	a := &RoundAwards{
+		Tenant:         k.tenant,
+		ChampionshipID: k.championshipID,
+		Round:          k.round,
+		Awards:         roundAwards(in),
+		ComputedAt:     clock.Now(),
+	}
+	if previous != nil && reflect.DeepEqual(previous.Awards, a.Awards) {
+		return nil
+	}
+	if err := awards.Put(a); err != nil {
+		return err
+	}
+	if summaryCache != nil {
+		summaryCache.Delete(k.tenant + "/" + k.championshipID + "/" + k.round)
+	}
+	notifier.Notify(k.tenant, "round.awarded", a)
+	log.Info().Str("championship", k.championshipID).Str("round", k.round).Int("awards", len(a.Awards)).Msg("round awarded")
+	return nil
+}
+
+// roundAwards computes the awards of a settled round:
+//   - the best round score to every player sharing the most points;
+//   - the most audacious pick to the hit whose outcome was the least
+//     likely, from the odds when the bet caught them, otherwise from the
+//     share of bets on the match calling that outcome;
+//   - the MVP to the one best scorer with the most exact scores, then the
+//     least likely hits.
+func roundAwards(in []*Bet) []Award {
+	r := []Award{}
+	entries := rank(in)
+	if len(entries) == 0 || entries[0].Points == 0 {
+		return r
+	}
+	for _, e := range entries {
+		if e.Points == entries[0].Points {
+			r = append(r, Award{Kind: AwardBestRoundScore, Email: e.Email, Points: e.Points})
+		}
+	}
+
+	byMatch := map[string][]*Bet{}
+	for _, b := range in {
+		byMatch[b.MatchID] = append(byMatch[b.MatchID], b)
+	}
+	var audacious *Award
+	surprise := map[string]float64{}
+	for _, b := range in {
+		p, ok := prediction(b)
+		if !ok || p.Points == 0 {
+			continue
+		}
+		probability := pickProbability(b, byMatch[b.MatchID])
+		surprise[b.Email] += 1 - probability
+		if audacious == nil || probability < audacious.Probability ||
+			probability == audacious.Probability && b.Email < audacious.Email {
+			audacious = &Award{Kind: AwardAudaciousPick, Email: b.Email, Points: p.Points, MatchID: b.MatchID, Bet: p.Bet, Result: p.Result, Probability: probability}
+		}
+	}
+	if audacious != nil {
+		r = append(r, *audacious)
+	}
+
+	// entries are ranked by points, then exact scores, then email
+	mvp := entries[0]
+	for _, e := range entries[1:] {
+		if e.Position != mvp.Position {
+			break
+		}
+		if surprise[e.Email] > surprise[mvp.Email] {
+			mvp = e
+		}
+	}
+	return append(r, Award{Kind: AwardMVP, Email: mvp.Email, Points: mvp.Points})
+}
+
+// pickProbability is how likely the outcome picked by b was: implied by
+// the decimal odds of the match, without the bookmaker's margin, or else
+// the share of the match's bets calling it.
+func pickProbability(b *Bet, match []*Bet) float64 {
+	outcome, ok := betOutcome(b)
+	if !ok {
+		return 0
+	}
+	if m := b.MatchInfo; m != nil && m.Odds != nil {
+		if p, ok := m.Odds.probability(outcome); ok {
+			return p
+		}
+	}
+	calls, total := 0, 0
+	for _, o := range match {
+		if oo, ok := betOutcome(o); ok {
+			total++
+			if oo == outcome {
+				calls++
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(calls) / float64(total)
+}
+
+// betOutcome is 1 for a home win, 0 for a draw and -1 for an away win.
+func betOutcome(b *Bet) (int, bool) {
+	home, herr := strconv.Atoi(b.HomeTeamScore)
+	away, aerr := strconv.Atoi(b.AwayTeamScore)
+	if herr != nil || aerr != nil {
+		return 0, false
+	}
+	return sign(home - away), true
+}
+
+// Odds are the decimal prices of a match's outcomes, as published by the
+// matches service when it has them.
+type Odds struct {
+	Home float64 `json:"home"`
+	Draw float64 `json:"draw"`
+	Away float64 `json:"away"`
+}
+
+// probability normalizes the implied probabilities, which add up to more
+// than one by the bookmaker's margin.
+func (o *Odds) probability(outcome int) (float64, bool) {
+	prices := map[int]float64{1: o.Home, 0: o.Draw, -1: o.Away}
+	total := 0.0
+	for _, price := range prices {
+		if price <= 1 {
+			return 0, false
+		}
+		total += 1 / price
+	}
+	return 1 / prices[outcome] / total, true
+}
+
+type memoryAwards struct {
+	mu     sync.Mutex
+	rounds map[roundKey]*RoundAwards
+}
+
+func newMemoryAwards() *memoryAwards {
+	return &memoryAwards{rounds: map[roundKey]*RoundAwards{}}
+}
+
+func (m *memoryAwards) Get(tenant, championshipID, round string) (*RoundAwards, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.rounds[roundKey{tenant, championshipID, round}]
+	if !ok {
+		return nil, nil
+	}
+	c := *a
+	c.Awards = append([]Award{}, a.Awards...)
+	return &c, nil
+}
+
+func (m *memoryAwards) Put(a *RoundAwards) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *a
+	c.Awards = append([]Award{}, a.Awards...)
+	m.rounds[roundKey{a.Tenant, a.ChampionshipID, a.Round}] = &c
+	return nil
+}
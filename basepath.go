@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// normalizeBasePath turns BASE_PATH into "/prefix", or "" when serving at
+// the root.
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// StripBasePath routes requests made under the base path as if made at
+// the root, so the routes are the same with or without one. Requests
+// without the prefix are still served, for gateways stripping it and for
+// probes hitting the replica directly. It must run before routing, i.e.
+// via Echo#Pre, and before any middleware looking at the path.
+func StripBasePath(base string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if base != "" && (req.URL.Path == base || strings.HasPrefix(req.URL.Path, base+"/")) {
+				req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, base), "/")
+				req.URL.RawPath = ""
+			}
+			return next(c)
+		}
+	}
+}
+
+// link is the path clients reach a route at, from behind the gateway.
+func link(path string) string {
+	return config.BasePath + path
+}
+
+var specServers = regexp.MustCompile(`(?m)^( *)servers:\n`)
+
+// APISpec serves the OpenAPI document with this deployment, as reached
+// through the base path, listed first among the servers.
+func APISpec(dir string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		spec, err := ioutil.ReadFile(filepath.Join(dir, "bets-api.yaml"))
+		if err != nil {
+			return err
+		}
+		if config.BasePath != "" {
+			spec = specServers.ReplaceAll(spec, []byte("${1}servers:\n${1}  -\n${1}    url: '"+link("/api/v1")+"'\n${1}    description: This deployment\n"))
+		}
+		return c.Blob(http.StatusOK, "application/yaml", spec)
+	}
+}
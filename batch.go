@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// BetBatch submits several predictions at once, typically a whole round.
+type BetBatch struct {
+	Round string `json:"round,omitempty"`
+	Bets  []*Bet `json:"bets"`
+}
+
+// BatchResult reports the outcome of each submitted bet, in order.
+type BatchResult struct {
+	Status   int            `json:"status"`
+	Bet      *Bet           `json:"bet,omitempty"`
+	Degraded bool           `json:"degraded,omitempty"`
+	Warnings []Warning      `json:"warnings,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Errors   map[string]int `json:"errors,omitempty"`
+	// Dependencies details the downstream calls behind a 503.
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+	// RetryAfterMs is set on 503s while a downstream breaker is open.
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+}
+
+const maxBatchSize = 50
+
+// CreateBets places every bet of the batch independently; one failing bet
+// doesn't reject the others. The response is 207 when any of them failed.
+func CreateBets(c echo.Context) error {
+	defer c.Request().Body.Close()
+	batch := &BetBatch{}
+	if err := decodeBody(c, batch, betBatchMessage); err != nil {
+		return err
+	}
+	if len(batch.Bets) == 0 || len(batch.Bets) > maxBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "a batch holds between 1 and 50 bets")
+	}
+	results := make([]BatchResult, len(batch.Bets))
+	status := http.StatusCreated
+	owner := ""
+	for i, bet := range batch.Bets {
+		b, warnings, err := placeBet(c, bet, betOptions{round: batch.Round})
+		results[i] = batchResult(b, warnings, err)
+		results[i].Error = localize(c, results[i].Error)
+		if err != nil {
+			status = http.StatusMultiStatus
+		} else {
+			owner = b.Email
+		}
+	}
+	return respondOwned(c, status, results, owner)
+}
+
+func batchResult(b *Bet, warnings []Warning, err error) BatchResult {
+	switch e := err.(type) {
+	case nil:
+		return BatchResult{Status: http.StatusCreated, Bet: b, Degraded: len(warnings) > 0, Warnings: warnings}
+	case *dependencyError:
+		p := betError(e).(*Problem)
+		return BatchResult{Status: p.Status, Error: p.Title, Errors: p.Errors, Dependencies: p.Dependencies, RetryAfterMs: p.RetryAfterMs}
+	case *echo.HTTPError:
+		return BatchResult{Status: e.Code, Error: fmt.Sprint(e.Message)}
+	case *Problem:
+		return BatchResult{Status: e.Status, Error: e.Title, RetryAfterMs: e.RetryAfterMs}
+	}
+	return BatchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// maxImportBytes bounds the body of an import, read as it streams in.
+const maxImportBytes = 64 << 20
+
+// maxImportErrors bounds the row errors reported by an import; the rows
+// failing beyond are only counted.
+const maxImportErrors = 1000
+
+// ImportError is a row that was not imported, numbered from 1 after the
+// CSV header, with the status placing it answered.
+type ImportError struct {
+	Row    int    `json:"row"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// ImportSettlement is the settlement of an imported match against the
+// result its rows gave.
+type ImportSettlement struct {
+	MatchID string `json:"matchId"`
+	Result  string `json:"result"`
+	Scored  int    `json:"scored"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ImportReport sums an import up: the rows read, imported and failed, the
+// errors of the failed ones and the settlements run.
+type ImportReport struct {
+	Rows        int                `json:"rows"`
+	Imported    int                `json:"imported"`
+	Failed      int                `json:"failed"`
+	DryRun      bool               `json:"dryRun,omitempty"`
+	Errors      []ImportError      `json:"errors"`
+	Settlements []ImportSettlement `json:"settlements,omitempty"`
+}
+
+func (r *ImportReport) fail(row, status int, err string) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportError{Row: row, Status: status, Error: err})
+	}
+}
+
+// rowReader reads the rows of an import one at a time, as column to value,
+// io.EOF after the last.
+type rowReader func() (map[string]string, error)
+
+// csvRows reads a CSV with a header row naming the columns.
+func csvRows(r io.Reader) (rowReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "request body is empty")
+	}
+	if err != nil {
+		return nil, importError(err, "CSV")
+	}
+	return func() (map[string]string, error) {
+		cells, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for i, cell := range cells {
+			if i < len(header) {
+				row[strings.TrimSpace(header[i])] = cell
+			}
+		}
+		return row, nil
+	}, nil
+}
+
+// jsonLinesRows reads a JSON object per line; values may be strings, as in
+// the ndjson exports, numbers or booleans.
+func jsonLinesRows(r io.Reader) rowReader {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	return func() (map[string]string, error) {
+		doc := map[string]interface{}{}
+		if err := d.Decode(&doc); err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for k, v := range doc {
+			switch v := v.(type) {
+			case string:
+				row[k] = v
+			case json.Number:
+				row[k] = v.String()
+			case bool:
+				row[k] = strconv.FormatBool(v)
+			case nil:
+			default:
+				row[k] = fmt.Sprint(v)
+			}
+		}
+		return row, nil
+	}
+}
+
+// importError is a 400 for a body that stopped parsing; rows already read
+// are not reported then.
+func importError(err error, format string) error {
+	if err == errBodyTooLarge {
+		return err
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "invalid "+format+": "+err.Error())
+}
+
+// ImportBets loads past bets, as of organizers migrating from
+// spreadsheets, from a CSV or JSON Lines body read row by row. Each row is
+// placed for its player as POST /bets would, except that its match may
+// have started, the betting window closed, and nobody is notified; rows
+// failing are reported, the others imported. With ?settle=true, the
+// matches whose rows gave a result are settled against it once the body is
+// read. ?dryRun=true validates the rows without storing them.
+func ImportBets(c echo.Context) error {
+	defer c.Request().Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	var next rowReader
+	format := "CSV"
+	switch mediaType {
+	case "text/csv":
+		var err error
+		if next, err = csvRows(c.Request().Body); err != nil {
+			return err
+		}
+	case "application/x-ndjson", "application/jsonl", "application/json-lines":
+		next, format = jsonLinesRows(c.Request().Body), "JSON Lines"
+	default:
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "an import is text/csv or application/x-ndjson")
+	}
+	dryRun := c.QueryParam("dryRun") == "true"
+	report := &ImportReport{Errors: []ImportError{}, DryRun: dryRun}
+	results := map[string]MatchResult{}
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if pe, ok := err.(*csv.ParseError); ok {
+			report.Rows++
+			report.fail(report.Rows, http.StatusBadRequest, "invalid CSV: "+pe.Err.Error())
+			continue
+		}
+		if err != nil {
+			return importError(err, format)
+		}
+		report.Rows++
+		bet, opts, result, err := importRow(row, requestClock(c).Now())
+		if known, ok := results[bet.Match]; err == nil && result != nil && ok && known != *result {
+			err = echo.NewHTTPError(http.StatusUnprocessableEntity, "result "+result.String()+" conflicts with "+known.String()+" given before")
+		}
+		if err == nil {
+			opts.dryRun = dryRun
+			_, _, err = placeBet(c, bet, opts)
+		}
+		if err == nil && result != nil {
+			results[bet.Match] = *result
+		}
+		if err != nil {
+			res := batchResult(nil, nil, err)
+			report.fail(report.Rows, res.Status, localize(c, res.Error))
+			continue
+		}
+		report.Imported++
+	}
+	if c.QueryParam("settle") == "true" && !dryRun {
+		trace, clk := traceID(c.Request()), requestClock(c)
+		ids := make([]string, 0, len(results))
+		for id := range results {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			r := results[id]
+			s := ImportSettlement{MatchID: id, Result: r.String()}
+			n, err := settle(tenant(c), id, r, settlementTriggerImport, trace, clk)
+			if s.Scored = n; err != nil {
+				s.Error = err.Error()
+			}
+			report.Settlements = append(report.Settlements, s)
+		}
+	}
+	log.Info().Int("rows", report.Rows).Int("imported", report.Imported).Int("failed", report.Failed).
+		Bool("dryRun", dryRun).Str("actor", auditActor(c)).Msg("bets imported")
+	status := http.StatusCreated
+	switch {
+	case dryRun:
+		status = http.StatusOK
+	case report.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+	return c.JSON(status, report)
+}
+
+// importRow reads the bet of a row, how to place it, and the match result
+// the row gives, if any. The columns are those of the bet exports, so an
+// export imports back; id, championship, match, matchDate, settlement and
+// points are ignored.
+func importRow(row map[string]string, now time.Time) (*Bet, betOptions, *MatchResult, error) {
+	bet := &Bet{
+		Match: row["matchId"], Championship: row["championshipId"], ExternalRef: row["externalRef"],
+		HomeTeamScore: row["homeTeamScore"], AwayTeamScore: row["awayTeamScore"], Shootout: row["shootout"],
+	}
+	opts := betOptions{round: row["round"], player: row["email"], imported: true}
+	for k := range row {
+		if !exportColumn(k) {
+			return bet, opts, nil, echo.NewHTTPError(http.StatusBadRequest, "unknown column "+k)
+		}
+	}
+	if opts.player == "" || bet.Match == "" {
+		return bet, opts, nil, echo.NewHTTPError(http.StatusBadRequest, "a bet needs an email and a matchId")
+	}
+	if s := row["stake"]; s != "" {
+		stake, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return bet, opts, nil, echo.NewHTTPError(http.StatusBadRequest, "stake must be an integer")
+		}
+		bet.Stake = stake
+	}
+	if s := row["createdAt"]; s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return bet, opts, nil, echo.NewHTTPError(http.StatusBadRequest, "createdAt must be an RFC 3339 timestamp")
+		}
+		if t.After(now) {
+			return bet, opts, nil, echo.NewHTTPError(http.StatusBadRequest, "createdAt must not be in the future")
+		}
+		opts.placedAt = t
+	}
+	if s := row["result"]; s != "" {
+		r := &MatchResult{}
+		if _, err := fmt.Sscanf(s, "%dx%d", &r.HomeScore, &r.AwayScore); err != nil || r.String() != s {
+			return bet, opts, nil, echo.NewHTTPError(http.StatusBadRequest, "result must be written as 2x1")
+		}
+		return bet, opts, r, nil
+	}
+	return bet, opts, nil, nil
+}
+
+func exportColumn(column string) bool {
+	for _, k := range betExportHeader {
+		if k == column {
+			return true
+		}
+	}
+	return false
+}
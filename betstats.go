@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// topScores is how many of the most predicted scores are listed per match.
+const topScores = 3
+
+// ScoreGroup counts the bets predicting one score of a match, and sums the
+// stakes of the Staked ones.
+type ScoreGroup struct {
+	ChampionshipID string
+	MatchID        string
+	HomeTeamScore  string
+	AwayTeamScore  string
+	Bets           int
+	Staked         int
+	Stakes         int64
+}
+
+// BetAggregate is what the storage aggregates for the statistics: bets per
+// predicted score and distinct players per championship.
+type BetAggregate struct {
+	Scores  []ScoreGroup
+	Players map[string]int
+}
+
+// playerOf identifies the player of a stored bet: the blind index when
+// emails are encrypted, since their ciphertexts all differ.
+func playerOf(b *Bet) string {
+	if b.EmailIndex != "" {
+		return b.EmailIndex
+	}
+	return b.Email
+}
+
+// aggregateBets is the in-memory aggregation of the memory store.
+func aggregateBets(list []*Bet) *BetAggregate {
+	type key struct{ championship, match, home, away string }
+	counts := map[key]*ScoreGroup{}
+	players := map[string]map[string]bool{}
+	for _, b := range list {
+		k := key{b.ChampionshipID, b.MatchID, b.HomeTeamScore, b.AwayTeamScore}
+		g := counts[k]
+		if g == nil {
+			g = &ScoreGroup{ChampionshipID: k.championship, MatchID: k.match, HomeTeamScore: k.home, AwayTeamScore: k.away}
+			counts[k] = g
+		}
+		g.Bets++
+		if b.Stake > 0 {
+			g.Staked++
+			g.Stakes += b.Stake
+		}
+		if players[b.ChampionshipID] == nil {
+			players[b.ChampionshipID] = map[string]bool{}
+		}
+		players[b.ChampionshipID][playerOf(b)] = true
+	}
+	a := &BetAggregate{Players: map[string]int{}}
+	for _, g := range counts {
+		a.Scores = append(a.Scores, *g)
+	}
+	for c, p := range players {
+		a.Players[c] = len(p)
+	}
+	return a
+}
+
+type ChampionshipStats struct {
+	Championship string       `json:"championship"`
+	Bets         int          `json:"bets"`
+	Players      int          `json:"players"`
+	Matches      []MatchStats `json:"matches"`
+	// Outcomes counts the predicted home wins, draws and away wins.
+	Outcomes map[string]int `json:"outcomes"`
+	// Goals counts the predictions by total goals, "7+" gathering the
+	// rest.
+	Goals map[string]int `json:"goals"`
+}
+
+type MatchStats struct {
+	MatchID   string       `json:"matchId"`
+	Bets      int          `json:"bets"`
+	TopScores []ScoreCount `json:"topScores"`
+}
+
+type ScoreCount struct {
+	Score string `json:"score"`
+	Bets  int    `json:"bets"`
+}
+
+// championshipStats assembles the statistics from the aggregated groups,
+// whose number is bounded by matches times distinct scores, not by bets.
+func championshipStats(a *BetAggregate) []*ChampionshipStats {
+	byChampionship := map[string]*ChampionshipStats{}
+	matches := map[string]map[string]*MatchStats{}
+	for _, g := range a.Scores {
+		cs, ok := byChampionship[g.ChampionshipID]
+		if !ok {
+			cs = &ChampionshipStats{
+				Championship: g.ChampionshipID,
+				Players:      a.Players[g.ChampionshipID],
+				Outcomes:     map[string]int{"home": 0, "draw": 0, "away": 0},
+				Goals:        map[string]int{},
+			}
+			byChampionship[g.ChampionshipID] = cs
+			matches[g.ChampionshipID] = map[string]*MatchStats{}
+		}
+		cs.Bets += g.Bets
+		ms, ok := matches[g.ChampionshipID][g.MatchID]
+		if !ok {
+			ms = &MatchStats{MatchID: g.MatchID}
+			matches[g.ChampionshipID][g.MatchID] = ms
+		}
+		ms.Bets += g.Bets
+		ms.TopScores = append(ms.TopScores, ScoreCount{g.HomeTeamScore + "x" + g.AwayTeamScore, g.Bets})
+		home, _ := strconv.Atoi(g.HomeTeamScore)
+		away, _ := strconv.Atoi(g.AwayTeamScore)
+		switch sign(home - away) {
+		case 1:
+			cs.Outcomes["home"] += g.Bets
+		case 0:
+			cs.Outcomes["draw"] += g.Bets
+		default:
+			cs.Outcomes["away"] += g.Bets
+		}
+		goals := strconv.Itoa(home + away)
+		if home+away >= 7 {
+			goals = "7+"
+		}
+		cs.Goals[goals] += g.Bets
+	}
+	r := []*ChampionshipStats{}
+	for id, cs := range byChampionship {
+		for _, ms := range matches[id] {
+			sort.Slice(ms.TopScores, func(i, j int) bool {
+				if ms.TopScores[i].Bets != ms.TopScores[j].Bets {
+					return ms.TopScores[i].Bets > ms.TopScores[j].Bets
+				}
+				return ms.TopScores[i].Score < ms.TopScores[j].Score
+			})
+			if len(ms.TopScores) > topScores {
+				ms.TopScores = ms.TopScores[:topScores]
+			}
+			cs.Matches = append(cs.Matches, *ms)
+		}
+		sort.Slice(cs.Matches, func(i, j int) bool { return cs.Matches[i].MatchID < cs.Matches[j].MatchID })
+		r = append(r, cs)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Championship < r[j].Championship })
+	return r
+}
+
+// GetBetStats reports per championship totals of the caller's tenant,
+// optionally only for ?championship=. The storage does the counting.
+func GetBetStats(c echo.Context) error {
+	a, err := bets.Aggregate(BetFilter{Tenant: tenant(c), ChampionshipID: c.QueryParam("championship")})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to aggregate bets")
+		return err
+	}
+	return c.JSON(http.StatusOK, championshipStats(a))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyLimits raises the body limit of the routes taking uploads.
+var bodyLimits = map[string]int64{
+	"/pools/:id/logo": maxLogoBytes + 64<<10,
+	"/admin/import":   maxImportBytes,
+}
+
+// BodyLimit rejects request bodies larger than max bytes with 413, either
+// upfront from Content-Length or once reading goes past the limit.
+func BodyLimit(max int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit := max
+			if l, ok := bodyLimits[apiRoute(c.Path())]; ok {
+				limit = l
+			}
+			req := c.Request()
+			if req.ContentLength > limit {
+				return tooLarge(limit)
+			}
+			req.Body = &limitedBody{ReadCloser: req.Body, left: limit}
+			err := next(c)
+			if err == errBodyTooLarge {
+				return tooLarge(limit)
+			}
+			return err
+		}
+	}
+}
+
+func tooLarge(limit int64) error {
+	return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "request body is limited to "+strconv.FormatInt(limit, 10)+" bytes")
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// decodeJSON reads exactly one JSON document from the request body into v,
+// rejecting unknown fields and anything after the document.
+func decodeJSON(c echo.Context, v interface{}) error {
+	return decodeStrict(c.Request().Body, v, "JSON")
+}
+
+// decodeStrict is decodeJSON reading from r; errors name the format the
+// document was converted from.
+func decodeStrict(r io.Reader, v interface{}, format string) error {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return jsonError(err, format)
+	}
+	if err := d.Decode(&struct{}{}); err != io.EOF {
+		if err == errBodyTooLarge {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must hold a single JSON document")
+	}
+	return nil
+}
+
+func jsonError(err error, format string) error {
+	if err == errBodyTooLarge {
+		return err
+	}
+	if err == io.EOF {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body is empty")
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "invalid "+format+": "+err.Error())
+}
+
+// decodeBody is decodeJSON for the routes also taking forms and, when m is
+// set, protobuf messages, picked by the media type of Content-Type. Forms
+// and messages are converted to their JSON document first, so the same
+// rules apply whatever the format. A missing Content-Type means JSON.
+func decodeBody(c echo.Context, v interface{}, m *protoMessage) error {
+	mediaType := echo.MIMEApplicationJSON
+	if ct := c.Request().Header.Get(echo.HeaderContentType); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid Content-Type: "+err.Error())
+		}
+	}
+	switch {
+	case isJSON(mediaType):
+		return decodeJSON(c, v)
+	case mediaType == echo.MIMEApplicationForm:
+		return decodeForm(c, v)
+	case isProtobuf(mediaType) && m != nil:
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		doc, err := decodeProto(m, body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid protobuf message: "+err.Error())
+		}
+		return decodeDocument(doc, v, "protobuf message")
+	}
+	accepted := echo.MIMEApplicationJSON + ", " + echo.MIMEApplicationForm
+	if m != nil {
+		accepted += ", " + MIMEApplicationProtobuf
+	}
+	return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be one of "+accepted)
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == echo.MIMEApplicationJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+func isProtobuf(mediaType string) bool {
+	return mediaType == MIMEApplicationProtobuf || mediaType == "application/x-protobuf"
+}
+
+// decodeForm reads a form of string fields, each given once.
+func decodeForm(c echo.Context, v interface{}) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid form: "+err.Error())
+	}
+	doc := map[string]interface{}{}
+	for k, values := range form {
+		if len(values) > 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "form field "+k+" is given more than once")
+		}
+		doc[k] = values[0]
+	}
+	return decodeDocument(doc, v, "form")
+}
+
+func decodeDocument(doc interface{}, v interface{}, format string) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(bytes.NewReader(b), v, format)
+}
+
+// negotiate picks the response media type from Accept: protobuf when
+// preferred and m is set, else JSON, which is also served when Accept
+// lists neither.
+func negotiate(c echo.Context, m *protoMessage) string {
+	if m == nil {
+		return echo.MIMEApplicationJSON
+	}
+	type option struct {
+		mediaType string
+		q         float64
+	}
+	var options []option
+	for _, part := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		options = append(options, option{mediaType, q})
+	}
+	sort.SliceStable(options, func(i, j int) bool { return options[i].q > options[j].q })
+	for _, o := range options {
+		switch {
+		case o.q <= 0:
+		case isProtobuf(o.mediaType):
+			return MIMEApplicationProtobuf
+		case isJSON(o.mediaType), o.mediaType == "*/*", o.mediaType == "application/*":
+			return echo.MIMEApplicationJSON
+		}
+	}
+	return echo.MIMEApplicationJSON
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	// breakerHalfOpen lets a single probe through; its outcome closes or
+	// reopens the breaker.
+	breakerHalfOpen
+)
+
+// Breaker stops calling a failing downstream host for a cooldown once
+// consecutive failures reach the threshold. A zero threshold never opens.
+type Breaker struct {
+	mu           sync.Mutex
+	threshold    int
+	cooldown     time.Duration
+	probeTimeout time.Duration
+	state        breakerState
+	failures     int
+	openedAt     time.Time
+	probeAt      time.Time
+}
+
+// Allow reports whether a call may go through and, when it may not, how
+// long until the breaker lets the next one through.
+func (b *Breaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+			return wait, false
+		}
+		b.state, b.probeAt = breakerHalfOpen, now
+	case breakerHalfOpen:
+		// a probe that never reports back is given up on after the call
+		// timeout
+		if wait := b.probeAt.Add(b.probeTimeout).Sub(now); wait > 0 {
+			return wait, false
+		}
+		b.probeAt = now
+	}
+	return 0, true
+}
+
+// Record reports the outcome of an allowed call.
+func (b *Breaker) Record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+}
+
+// wait is how long the breaker holds calls back, zero while closed.
+func (b *Breaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var wait time.Duration
+	switch b.state {
+	case breakerOpen:
+		wait = time.Until(b.openedAt.Add(b.cooldown))
+	case breakerHalfOpen:
+		wait = time.Until(b.probeAt.Add(b.probeTimeout))
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// breakerOpenError is returned instead of calling a host whose breaker is
+// open.
+type breakerOpenError struct {
+	service string
+	wait    time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return e.service + " circuit breaker is open"
+}
+
+type breakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+var breakers = &breakerSet{breakers: map[string]*Breaker{}}
+
+func (s *breakerSet) get(key string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &Breaker{
+			threshold:    config.Breaker.Failures,
+			cooldown:     config.Breaker.Cooldown,
+			probeTimeout: config.Transport.Timeout,
+		}
+		s.breakers[key] = b
+	}
+	return b
+}
+
+// wait is the longest any breaker of the service, one per host, holds
+// calls back.
+func (s *breakerSet) wait(service string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var wait time.Duration
+	for key, b := range s.breakers {
+		if strings.HasPrefix(key, service+" ") {
+			if w := b.wait(); w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait
+}
+
+// callService calls a downstream service through the breaker of its host,
+// tenants possibly having their own. Transport errors and 5xx answers count
+// as failures; requests left unsent for want of credentials do not.
+func callService(service string, req *http.Request) (*http.Response, error) {
+	if err := authenticateCall(service, req); err != nil {
+		return nil, err
+	}
+	b := breakers.get(service + " " + req.URL.Host)
+	if wait, ok := b.Allow(); !ok {
+		upstreamCalls.record(service, false)
+		return nil, &breakerOpenError{service: service, wait: wait}
+	}
+	res, err := chaos.upstream(service, req), error(nil)
+	if res == nil {
+		res, err = hedgedDo(service, req)
+	}
+	ok := err == nil && res.StatusCode < http.StatusInternalServerError
+	if err == nil {
+		rejectedCall(service, res)
+	}
+	b.Record(ok)
+	upstreamCalls.record(service, ok)
+	return res, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo"
+)
+
+// StaticChampionship stands in for the championships service of tenants
+// without CHAMPIONSHIP_SVC, for pools betting on a single competition.
+// Rounds, when listed, order the rounds in the summaries; Scoring applies
+// unless the tenant has its own.
+type StaticChampionship struct {
+	Championship
+	Scoring *ScoringRules `json:"scoring,omitempty"`
+}
+
+var errChampionshipNotFound = errors.New("404 Not Found")
+
+// loadStaticChampionship reads STATIC_CHAMPIONSHIP, the championship as
+// JSON, or the file named by STATIC_CHAMPIONSHIP_FILE.
+func loadStaticChampionship() *StaticChampionship {
+	b := []byte(os.Getenv("STATIC_CHAMPIONSHIP"))
+	var err error
+	if file := os.Getenv("STATIC_CHAMPIONSHIP_FILE"); len(b) == 0 && file != "" {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err == nil && len(b) == 0 {
+		return nil
+	}
+	s := &StaticChampionship{}
+	if err == nil {
+		err = json.Unmarshal(b, s)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the static championship")
+		return nil
+	}
+	return s
+}
+
+// staticChampionship is the championship served locally to the tenant,
+// nil when the tenant has a championships service or no such override.
+func staticChampionship(tenant string) *StaticChampionship {
+	if serviceURL(tenant, "CHAMPIONSHIP_SVC", "") != "" {
+		return nil
+	}
+	if t, ok := config.Tenancy.Tenants[tenant]; ok && t.Championship != nil {
+		return t.Championship
+	}
+	return config.Championship
+}
+
+// championship resolves a championship of the request's tenant through
+// the cache, or locally from its static championship. Asking for no
+// championship in particular gets the static one.
+func championship(ctx echo.Context, id string) (*Championship, int, error) {
+	if s := staticChampionship(tenant(ctx)); s != nil {
+		if id != "" && id != s.ID {
+			return nil, http.StatusNotFound, errChampionshipNotFound
+		}
+		ch := s.Championship
+		return &ch, http.StatusOK, nil
+	}
+	return fetchChampionship(ctx, serviceURL(tenant(ctx), "CHAMPIONSHIP_SVC", id))
+}
+
+// roundOrder orders the rounds of a championship: as listed by the static
+// championship, then numerically when both are numbers, otherwise by name.
+func roundOrder(tenant, championshipID string) func(a, b string) bool {
+	position := map[string]int{}
+	if s := staticChampionship(tenant); s != nil && s.ID == championshipID {
+		for i, r := range s.Rounds {
+			position[r] = i + 1
+		}
+	}
+	return func(a, b string) bool {
+		x, y := position[a], position[b]
+		if x > 0 && y > 0 {
+			return x < y
+		}
+		return roundBefore(a, b)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ChaosConfig injects faults, for resilience demos and tests; never enable
+// it in production. Delay holds back DelayPercent of the requests to the
+// API paths starting with one of Paths, and of the calls to the listed
+// Upstreams; AbortStatus answers AbortPercent of them instead. Requests
+// may also ask for their own faults with the x-chaos-* headers.
+type ChaosConfig struct {
+	Enabled      bool
+	Delay        time.Duration
+	DelayPercent float64
+	AbortStatus  int
+	AbortPercent float64
+	Paths        []string
+	Upstreams    []string
+}
+
+// The headers of requests asking for faults: x-chaos-delay, a duration,
+// and x-chaos-abort, a status, apply to x-chaos-percent of the requests
+// (default 100) at x-chaos-target, "api" (the default) or the names of
+// downstream services, comma separated.
+const (
+	chaosDelayHeader   = "X-Chaos-Delay"
+	chaosAbortHeader   = "X-Chaos-Abort"
+	chaosPercentHeader = "X-Chaos-Percent"
+	chaosTargetHeader  = "X-Chaos-Target"
+)
+
+var chaosHeaders = []string{chaosDelayHeader, chaosAbortHeader, chaosPercentHeader, chaosTargetHeader}
+
+var chaosFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "chaos",
+	Name:      "faults_total",
+	Help:      "Faults injected, per target and fault.",
+}, []string{"target", "fault"})
+
+func init() {
+	registry.MustRegister(chaosFaults)
+}
+
+// chaosFault is the delay and abort status to inject; a zero status lets
+// the request through once delayed.
+type chaosFault struct {
+	delay  time.Duration
+	status int
+}
+
+type chaosInjector struct {
+	cfg ChaosConfig
+}
+
+var chaos = &chaosInjector{}
+
+// configured rolls the configured faults for a request to the target.
+func (ch *chaosInjector) configured() chaosFault {
+	f := chaosFault{}
+	if ch.cfg.Delay > 0 && rand.Float64()*100 < ch.cfg.DelayPercent {
+		f.delay = ch.cfg.Delay
+	}
+	if ch.cfg.AbortStatus > 0 && rand.Float64()*100 < ch.cfg.AbortPercent {
+		f.status = ch.cfg.AbortStatus
+	}
+	return f
+}
+
+// requested reads the faults the headers ask for at the target, if any.
+func requested(h http.Header, target string) (chaosFault, bool) {
+	f := chaosFault{}
+	targets := h.Get(chaosTargetHeader)
+	if targets == "" {
+		targets = "api"
+	}
+	if !containsTrimmed(strings.Split(targets, ","), target) {
+		return f, false
+	}
+	if p, err := strconv.ParseFloat(h.Get(chaosPercentHeader), 64); err == nil && rand.Float64()*100 >= p {
+		return f, false
+	}
+	f.delay, _ = time.ParseDuration(h.Get(chaosDelayHeader))
+	if s, err := strconv.Atoi(h.Get(chaosAbortHeader)); err == nil && s >= 100 && s <= 599 {
+		f.status = s
+	}
+	return f, f.delay > 0 || f.status > 0
+}
+
+func containsTrimmed(list []string, s string) bool {
+	for _, v := range list {
+		if strings.TrimSpace(v) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch *chaosInjector) fault(h http.Header, target string, configured bool) chaosFault {
+	if f, ok := requested(h, target); ok {
+		return f
+	}
+	if configured {
+		return ch.configured()
+	}
+	return chaosFault{}
+}
+
+// inject waits out the delay and counts the faults.
+func (f chaosFault) inject(target string) {
+	if f.delay > 0 {
+		chaosFaults.WithLabelValues(target, "delay").Inc()
+		time.Sleep(f.delay)
+	}
+	if f.status > 0 {
+		chaosFaults.WithLabelValues(target, "abort").Inc()
+	}
+}
+
+// Middleware injects the faults of the API requests. Probes are left
+// alone.
+func (ch *chaosInjector) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		path := c.Request().URL.Path
+		if !ch.cfg.Enabled || isProbe(path) {
+			return next(c)
+		}
+		configured := false
+		for _, p := range ch.cfg.Paths {
+			if strings.HasPrefix(path, p) {
+				configured = true
+			}
+		}
+		f := ch.fault(c.Request().Header, "api", configured)
+		f.inject("api")
+		if f.status > 0 {
+			return echo.NewHTTPError(f.status, "fault injected")
+		}
+		return next(c)
+	}
+}
+
+// forward passes the chaos headers of the incoming request on to a
+// downstream call, for callService to act on.
+func (ch *chaosInjector) forward(from, to http.Header) {
+	if !ch.cfg.Enabled {
+		return
+	}
+	for _, name := range chaosHeaders {
+		if v := from.Get(name); v != "" {
+			to.Set(name, v)
+		}
+	}
+}
+
+// upstream injects the faults of a downstream call, which the service
+// never sees the chaos headers of. An aborted call answers as if the
+// service had.
+func (ch *chaosInjector) upstream(service string, req *http.Request) *http.Response {
+	if !ch.cfg.Enabled {
+		return nil
+	}
+	f := ch.fault(req.Header, service, containsTrimmed(ch.cfg.Upstreams, service))
+	for _, name := range chaosHeaders {
+		req.Header.Del(name)
+	}
+	f.inject(service)
+	if f.status == 0 {
+		return nil
+	}
+	return &http.Response{
+		Status:     strconv.Itoa(f.status) + " " + http.StatusText(f.status),
+		StatusCode: f.status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
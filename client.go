@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/motemen/go-loghttp"
+)
+
+func newClient(cfg *Config) (*http.Client, error) {
+	tlsConfig, err := upstreamTLS(cfg.UpstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+	t := cfg.Transport
+	base := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   t.DialTimeout,
+			KeepAlive: t.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     t.HTTP2,
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		IdleConnTimeout:       t.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !t.HTTP2 {
+		// a non-nil empty map is the documented way to turn HTTP/2 off
+		base.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	transport := &loghttp.Transport{
+		Transport: base,
+		LogRequest: func(req *http.Request) {
+			log.Debug().
+				Interface("headers", redactHeaders(req.Header)).
+				Msg("calling " + req.Method + " " + req.URL.String())
+		},
+		LogResponse: func(res *http.Response) {
+			req := res.Request
+			log.Debug().
+				Str("status", res.Status).
+				Interface("headers", redactHeaders(res.Header)).
+				Msg("call " + req.Method + " " + req.URL.String() + " answered")
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: t.Timeout}, nil
+}
+
+// drain discards what is left of a response body and closes it, so the
+// underlying connection goes back to the idle pool instead of being torn
+// down.
+func drain(res *http.Response) {
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
@@ -0,0 +1,345 @@
+// Package client calls the bets API from other Go services: typed methods
+// over the /api/v1 endpoints, retried on the failures worth retrying, with
+// the caller's trace propagated and the errors answered as *Error.
+//
+//	c := client.New("https://bets.example.com", client.WithToken(token))
+//	bet, err := c.CreateBet(ctx, &client.Bet{Match: "m1", HomeTeamScore: "2", AwayTeamScore: "1"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is safe for concurrent use.
+type Client struct {
+	base      *url.URL
+	http      *http.Client
+	token     func(ctx context.Context) (string, error)
+	tenant    string
+	userAgent string
+	attempts  int
+	backoff   time.Duration
+	maxWait   time.Duration
+	poll      time.Duration
+}
+
+// Option tunes a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the default client, which times calls out after
+// 30s.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+// WithToken authenticates the calls with a bearer token.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = func(context.Context) (string, error) { return token, nil }
+	}
+}
+
+// WithTokenSource authenticates each call with the token returned then,
+// for tokens that expire.
+func WithTokenSource(token func(ctx context.Context) (string, error)) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTenant sends the calls on behalf of a tenant, in X-Tenant-ID; the
+// API otherwise resolves it from the host or the token.
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithUserAgent names the calling service in the User-Agent.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// WithRetries makes up to attempts calls in all, waiting backoff, then
+// twice as long each time, with jitter, between them; one attempt turns
+// retries off. The defaults are 3 attempts and 200ms.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(c *Client) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		c.attempts, c.backoff = attempts, backoff
+	}
+}
+
+// WithMaxRetryWait caps the wait between attempts, Retry-After included;
+// a call told to wait longer fails with the error of its last attempt.
+// The default is 10s.
+func WithMaxRetryWait(d time.Duration) Option {
+	return func(c *Client) { c.maxWait = d }
+}
+
+// New returns a client of the API served at baseURL, base path included,
+// as "https://bets.example.com" or "https://example.com/bets".
+func New(baseURL string, opts ...Option) *Client {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		base = &url.URL{Path: baseURL}
+	}
+	c := &Client{
+		base:      base,
+		http:      &http.Client{Timeout: 30 * time.Second},
+		userAgent: "bets-client-go",
+		attempts:  3,
+		backoff:   200 * time.Millisecond,
+		maxWait:   10 * time.Second,
+		poll:      250 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CreateBet places a bet for the caller. It is retried only when the
+// bet was not placed: the connection could not be made, or the API
+// throttled the call or was unavailable and told when to call again; the
+// dedup window of the API is too short, and per replica, to answer a bet
+// placed twice with the first one. Bets the API places in the background
+// are waited for, until ctx is done.
+func (c *Client) CreateBet(ctx context.Context, bet *Bet) (*CreatedBet, error) {
+	var body json.RawMessage
+	res, err := c.do(ctx, http.MethodPost, "/bets", nil, bet, &body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusAccepted {
+		r := &betRequest{}
+		if err := json.Unmarshal(body, r); err != nil {
+			return nil, err
+		}
+		return c.waitBet(ctx, res.Header.Get("Location"), r.ID)
+	}
+	created := &CreatedBet{}
+	if err := json.Unmarshal(body, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// waitBet polls a bet request until the bet is placed, or has failed.
+func (c *Client) waitBet(ctx context.Context, location, id string) (*CreatedBet, error) {
+	path := "/bets/requests/" + url.PathEscape(id)
+	if location != "" {
+		path = location
+	}
+	for {
+		r := &betRequest{}
+		if _, err := c.do(ctx, http.MethodGet, path, nil, nil, r); err != nil {
+			return nil, err
+		}
+		switch {
+		case r.Status != "pending" && r.Result == nil:
+			return nil, &Error{Status: http.StatusInternalServerError, Message: "bet request " + r.ID + " " + r.Status + " without a result"}
+		case r.Result != nil && r.Result.Bet != nil:
+			return &CreatedBet{Bet: *r.Result.Bet, Degraded: r.Result.Degraded, Warnings: r.Result.Warnings}, nil
+		case r.Result != nil:
+			return nil, &Error{Status: r.Result.Status, Message: r.Result.Error, Errors: r.Result.Errors}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.poll):
+		}
+	}
+}
+
+// ListBets lists the bets of a player, the caller's when opts has no
+// email.
+func (c *Client) ListBets(ctx context.Context, opts ListBetsOptions) (*PlayerBets, error) {
+	path := "/me/bets"
+	if opts.Email != "" {
+		path = "/players/" + url.PathEscape(opts.Email) + "/bets"
+	}
+	q := url.Values{}
+	if opts.Championship != "" {
+		q.Set("championship", opts.Championship)
+	}
+	if opts.Round != "" {
+		q.Set("round", opts.Round)
+	}
+	if !opts.From.IsZero() {
+		q.Set("from", opts.From.Format(time.RFC3339))
+	}
+	if !opts.To.IsZero() {
+		q.Set("to", opts.To.Format(time.RFC3339))
+	}
+	bets := &PlayerBets{}
+	if _, err := c.do(ctx, http.MethodGet, path, q, nil, bets); err != nil {
+		return nil, err
+	}
+	return bets, nil
+}
+
+// GetLeaderboard ranks the players of a championship, of one round unless
+// round is empty.
+func (c *Client) GetLeaderboard(ctx context.Context, championshipID, round string) (*Leaderboard, error) {
+	q := url.Values{}
+	if round != "" {
+		q.Set("round", round)
+	}
+	lb := &Leaderboard{}
+	if _, err := c.do(ctx, http.MethodGet, "/championships/"+url.PathEscape(championshipID)+"/leaderboard", q, nil, lb); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// do calls the API, retrying, and decodes a 2xx body into out. Paths are
+// relative to /api/v1, except those starting with it, as the Location of
+// the API's responses.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, in, out interface{}) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	u := *c.base
+	if !strings.HasPrefix(path, u.Path+"/api/") {
+		path = u.Path + "/api/v1" + path
+	}
+	u.Path, u.RawQuery = path, q.Encode()
+	trace := traceFrom(ctx)
+	idempotent := method != http.MethodPost
+	var err error
+	for attempt := 1; ; attempt++ {
+		var res *http.Response
+		var wait time.Duration
+		res, wait, err = c.attempt(ctx, method, u.String(), body, trace, idempotent, out)
+		if err == nil {
+			return res, nil
+		}
+		if wait < 0 || attempt >= c.attempts {
+			return nil, err
+		}
+		if backoff := c.backoff << uint(attempt-1); wait < backoff {
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+		if wait > c.maxWait {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt makes one call. The wait it returns is negative when the call
+// is not worth retrying, otherwise at least what the API asked for. Calls
+// that are not idempotent are only worth retrying when they surely did
+// nothing.
+func (c *Client) attempt(ctx context.Context, method, u string, body []byte, trace http.Header, idempotent bool, out interface{}) (*http.Response, time.Duration, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, -1, err
+	}
+	for k, v := range trace {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+	if c.token != nil {
+		token, err := c.token(ctx)
+		if err != nil {
+			return nil, -1, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, -1, ctx.Err()
+		}
+		if !idempotent && !dialFailed(err) {
+			// the request may have reached the API and been served
+			return nil, -1, err
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		if out != nil && res.StatusCode != http.StatusNoContent {
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				return nil, -1, err
+			}
+		}
+		return res, 0, nil
+	}
+	e := responseError(res, trace)
+	if !retryable(res.StatusCode) || !idempotent && !refused(res.StatusCode, e.RetryAfter) {
+		return nil, -1, e
+	}
+	return nil, e.RetryAfter, e
+}
+
+// retryable tells the statuses of a call worth making again: throttled,
+// or a gateway or the API itself unavailable.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// refused tells the statuses of a call the API turned down without
+// serving it: throttled, or unavailable, and told when to call again.
+func refused(status int, retryAfter time.Duration) bool {
+	return (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) && retryAfter > 0
+}
+
+// dialFailed tells the errors of a connection that could not be made, so
+// the request never left.
+func dialFailed(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// retryAfter reads Retry-After in seconds, or as a date.
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(h); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
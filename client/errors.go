@@ -0,0 +1,88 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is a call the API answered with a status other than 2xx.
+type Error struct {
+	Status  int
+	Message string
+	// Errors counts, on 503s, the statuses of the dependencies that
+	// failed the call.
+	Errors map[string]int
+	// RetryAfter is how long the API asked to wait before calling again.
+	RetryAfter time.Duration
+	// TraceID is the trace the call was made in, to find it in the logs of
+	// the API.
+	TraceID string
+}
+
+func (e *Error) Error() string {
+	msg := "bets api: " + strconv.Itoa(e.Status) + " " + http.StatusText(e.Status)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// IsNotFound tells whether err is a 404 of the API.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsConflict tells whether err is a 409 of the API, as an external
+// reference taken by another bet.
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+// IsRejected tells whether err is a bet the API refused to place, as a
+// match started or a score breaking the championship's policy.
+func IsRejected(err error) bool {
+	return hasStatus(err, http.StatusBadRequest) || hasStatus(err, http.StatusUnprocessableEntity) ||
+		hasStatus(err, http.StatusForbidden)
+}
+
+func hasStatus(err error, status int) bool {
+	e, ok := err.(*Error)
+	return ok && e.Status == status
+}
+
+// maxErrorBody bounds what is read of an error response.
+const maxErrorBody = 64 << 10
+
+// responseError reads the error of a response: an RFC 7807 problem, as
+// the API answers throttled and unavailable calls, or a {"message"}.
+func responseError(res *http.Response, trace http.Header) *Error {
+	e := &Error{Status: res.StatusCode, RetryAfter: retryAfter(res.Header.Get("Retry-After")), TraceID: trace.Get("x-b3-traceid")}
+	if parts := strings.Split(trace.Get(traceparentHeader), "-"); e.TraceID == "" && len(parts) == 4 {
+		e.TraceID = parts[1]
+	}
+	var body struct {
+		Message      string         `json:"message"`
+		Title        string         `json:"title"`
+		Detail       string         `json:"detail"`
+		RetryAfterMs int64          `json:"retryAfterMs"`
+		Errors       map[string]int `json:"errors"`
+	}
+	if json.NewDecoder(io.LimitReader(res.Body, maxErrorBody)).Decode(&body) != nil {
+		return e
+	}
+	e.Message, e.Errors = body.Message, body.Errors
+	if e.Message == "" {
+		e.Message = body.Title
+		if body.Detail != "" {
+			e.Message += ": " + body.Detail
+		}
+	}
+	if body.RetryAfterMs > 0 {
+		e.RetryAfter = time.Duration(body.RetryAfterMs) * time.Millisecond
+	}
+	return e
+}
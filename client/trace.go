@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const traceparentHeader = "Traceparent"
+
+// propagated are the trace headers the API joins, B3 and W3C.
+var propagated = []string{
+	"traceparent",
+	"tracestate",
+	"x-request-id",
+	"x-b3-traceid",
+	"x-b3-spanid",
+	"x-b3-parentspanid",
+	"x-b3-sampled",
+	"x-b3-flags",
+	"b3",
+}
+
+type traceKey struct{}
+
+// ContextWithTrace carries the trace of an incoming request into ctx, so
+// the calls made with it join that trace:
+//
+//	bets, err := c.ListBets(client.ContextWithTrace(r.Context(), r), opts)
+func ContextWithTrace(ctx context.Context, r *http.Request) context.Context {
+	h := http.Header{}
+	for _, k := range propagated {
+		if v := r.Header.Get(k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	return context.WithValue(ctx, traceKey{}, h)
+}
+
+// ContextWithTraceparent makes the calls made with ctx join the W3C trace
+// context given, as "00-<trace id>-<parent id>-01".
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	h := http.Header{}
+	h.Set(traceparentHeader, traceparent)
+	return context.WithValue(ctx, traceKey{}, h)
+}
+
+// traceFrom returns the trace headers of ctx; a call made outside of any
+// trace starts one, so its attempts share a trace id.
+func traceFrom(ctx context.Context) http.Header {
+	if h, ok := ctx.Value(traceKey{}).(http.Header); ok && len(h) > 0 {
+		return h
+	}
+	h := http.Header{}
+	h.Set(traceparentHeader, "00-"+randomHex(16)+"-"+randomHex(8)+"-01")
+	return h
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
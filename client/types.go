@@ -0,0 +1,93 @@
+package client
+
+import "time"
+
+// Bet is a score predicted on a match. Match, and Championship when the
+// match is not enough to find it, are the ids the bet is placed with; the
+// API answers them as titles, along with the ids in MatchID and
+// ChampionshipID.
+type Bet struct {
+	ID             string      `json:"id,omitempty"`
+	Tenant         string      `json:"tenant,omitempty"`
+	ExternalRef    string      `json:"externalRef,omitempty"`
+	HomeTeamScore  string      `json:"homeTeamScore,omitempty"`
+	AwayTeamScore  string      `json:"awayTeamScore,omitempty"`
+	Stake          int64       `json:"stake,omitempty"`
+	Shootout       string      `json:"shootout,omitempty"`
+	Championship   string      `json:"championship,omitempty"`
+	Match          string      `json:"match,omitempty"`
+	Email          string      `json:"email,omitempty"`
+	MatchID        string      `json:"matchId,omitempty"`
+	ChampionshipID string      `json:"championshipId,omitempty"`
+	Round          string      `json:"round,omitempty"`
+	CreatedAt      time.Time   `json:"createdAt,omitempty"`
+	UpdatedAt      time.Time   `json:"updatedAt,omitempty"`
+	Settlement     *Settlement `json:"settlement,omitempty"`
+}
+
+// Settlement is how a bet scored once its match finished.
+type Settlement struct {
+	Status    string     `json:"status"`
+	Result    string     `json:"result,omitempty"`
+	Points    int        `json:"points"`
+	SettledAt *time.Time `json:"settledAt,omitempty"`
+}
+
+// CreatedBet is a bet just placed. Degraded bets were placed while a
+// non-critical dependency failed; the warnings tell what is missing.
+type CreatedBet struct {
+	Bet
+	Degraded bool      `json:"degraded,omitempty"`
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ListBetsOptions narrows ListBets down; zero values don't.
+type ListBetsOptions struct {
+	Email        string
+	Championship string
+	Round        string
+	From         time.Time
+	To           time.Time
+}
+
+// PlayerBets are the bets of a player and the points they scored.
+type PlayerBets struct {
+	Email  string `json:"email"`
+	Points int    `json:"points"`
+	Bets   []*Bet `json:"bets"`
+}
+
+type Leaderboard struct {
+	Championship string   `json:"championship"`
+	Round        string   `json:"round,omitempty"`
+	Entries      []*Entry `json:"entries"`
+}
+
+type Entry struct {
+	Position    int    `json:"position"`
+	Email       string `json:"email"`
+	Points      int    `json:"points"`
+	Bets        int    `json:"bets"`
+	ExactScores int    `json:"exactScores"`
+	// Bonus is the part of the points earned by accumulators won.
+	Bonus int `json:"bonus"`
+}
+
+// betRequest is a bet the API places in the background.
+type betRequest struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Result *struct {
+		Status   int            `json:"status"`
+		Bet      *Bet           `json:"bet,omitempty"`
+		Degraded bool           `json:"degraded,omitempty"`
+		Warnings []Warning      `json:"warnings,omitempty"`
+		Error    string         `json:"error,omitempty"`
+		Errors   map[string]int `json:"errors,omitempty"`
+	} `json:"result,omitempty"`
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Clock is the source of domain time: bet and settlement timestamps, job
+// schedules, audit entries and kickoff windows. Cache TTLs, lock leases,
+// publish backoff and latencies stay on the wall clock, since faking them
+// can't showcase anything.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed on this
+	// clock.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	// Stop prevents the call, reporting false when it already happened or
+	// was stopped.
+	Stop() bool
+}
+
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// FakeClock is moved by hand. A frozen one (NewFakeClock) only moves on
+// Advance, for tests; a running one (NewDemoClock) follows the wall clock
+// and Advance jumps it ahead, so demos can fast-forward to kickoffs and
+// settlements. Timers due after an Advance fire right away, one after the
+// other in the order they were due, then set.
+type FakeClock struct {
+	mu      sync.Mutex
+	running bool
+	now     time.Time
+	offset  time.Duration
+	timers  map[*fakeTimer]bool
+	seq     uint64
+}
+
+type fakeTimer struct {
+	c   *FakeClock
+	at  time.Time
+	seq uint64
+	f   func()
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start, timers: map[*fakeTimer]bool{}}
+}
+
+func NewDemoClock() *FakeClock {
+	return &FakeClock{running: true, timers: map[*fakeTimer]bool{}}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nowLocked()
+}
+
+func (c *FakeClock) nowLocked() time.Time {
+	if c.running {
+		return time.Now().Add(c.offset)
+	}
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	c.seq++
+	t := &fakeTimer{c: c, at: c.nowLocked().Add(d), seq: c.seq, f: f}
+	c.timers[t] = true
+	c.mu.Unlock()
+	if c.running {
+		time.AfterFunc(d, c.fire)
+	} else if d <= 0 {
+		c.fire()
+	}
+	return t
+}
+
+// Advance moves the clock ahead by d and fires the timers now due.
+func (c *FakeClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	if c.running {
+		c.offset += d
+	} else {
+		c.now = c.now.Add(d)
+	}
+	now := c.nowLocked()
+	c.mu.Unlock()
+	c.fire()
+	return now
+}
+
+// Offset is how far ahead of the wall clock a running clock is.
+func (c *FakeClock) Offset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+func (c *FakeClock) fire() {
+	c.mu.Lock()
+	now := c.nowLocked()
+	var due []*fakeTimer
+	for t := range c.timers {
+		if !t.at.After(now) {
+			due = append(due, t)
+			delete(c.timers, t)
+		}
+	}
+	c.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].at.Equal(due[j].at) {
+			return due[i].at.Before(due[j].at)
+		}
+		return due[i].seq < due[j].seq
+	})
+	go func() {
+		for _, t := range due {
+			t.f()
+		}
+	}()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	pending := t.c.timers[t]
+	delete(t.c.timers, t)
+	return pending
+}
+
+// offsetClock runs a fixed offset ahead of, or behind, another clock.
+type offsetClock struct {
+	base   Clock
+	offset time.Duration
+}
+
+func (c offsetClock) Now() time.Time { return c.base.Now().Add(c.offset) }
+
+// AfterFunc waits on the base clock: the offset moves the start and the end
+// of a delay alike.
+func (c offsetClock) AfterFunc(d time.Duration, f func()) Timer { return c.base.AfterFunc(d, f) }
+
+// debugNowHeader simulates, with TIME_TRAVEL, the time of a request.
+const debugNowHeader = "X-Debug-Now"
+
+const clockKey = "clock"
+
+// TimeTravel lets a request set its "now" with X-Debug-Now, an RFC 3339
+// timestamp the request's clock starts from, so cutoffs and windows can be
+// tried without waiting for them or moving the clock of everyone else. The
+// time simulated is echoed back in the response. Without TIME_TRAVEL the
+// header is ignored.
+func TimeTravel(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := c.Request().Header.Get(debugNowHeader)
+		if !config.TimeTravel || h == "" {
+			return next(c)
+		}
+		at, err := time.Parse(time.RFC3339, h)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, debugNowHeader+" must be an RFC 3339 timestamp")
+		}
+		c.Set(clockKey, Clock(offsetClock{base: clock, offset: at.Sub(clock.Now())}))
+		c.Response().Header().Set(debugNowHeader, at.UTC().Format(time.RFC3339))
+		return next(c)
+	}
+}
+
+// requestClock is the clock of the request: the one X-Debug-Now simulates,
+// otherwise the app's.
+func requestClock(c echo.Context) Clock {
+	if c != nil {
+		if rc, ok := c.Get(clockKey).(Clock); ok {
+			return rc
+		}
+	}
+	return clock
+}
+
+type ClockState struct {
+	Now    time.Time `json:"now"`
+	Offset string    `json:"offset"`
+}
+
+func demoClock() (*FakeClock, error) {
+	fc, ok := clock.(*FakeClock)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusConflict, "the clock can only be moved in demo mode")
+	}
+	return fc, nil
+}
+
+// GetClock tells the time of the app, or of the request under
+// X-Debug-Now, and how far ahead of the wall clock it is.
+func GetClock(c echo.Context) error {
+	rc := requestClock(c)
+	state := ClockState{Now: rc.Now()}
+	var offset time.Duration
+	if fc, ok := clock.(*FakeClock); ok {
+		offset = fc.Offset()
+	}
+	if oc, ok := rc.(offsetClock); ok {
+		offset += oc.offset
+	}
+	state.Offset = offset.String()
+	return c.JSON(http.StatusOK, state)
+}
+
+// AdvanceClock fast-forwards the demo clock by {"by": "90m"}, running the
+// jobs that become due, e.g. scheduled settlements.
+func AdvanceClock(c echo.Context) error {
+	fc, err := demoClock()
+	if err != nil {
+		return err
+	}
+	req := struct {
+		By string `json:"by"`
+	}{}
+	if err := decodeJSON(c, &req); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(req.By)
+	if err != nil || d <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "by must be a positive duration, e.g. 90m")
+	}
+	now := fc.Advance(d)
+	log.Info().Str("by", d.String()).Time("now", now).Msg("demo clock advanced")
+	return c.JSON(http.StatusOK, ClockState{Now: now, Offset: fc.Offset().String()})
+}
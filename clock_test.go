@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var fakeStart = time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+
+// recorder collects the names of the timers fired, in the order they fire.
+func recorder() (func(name string) func(), <-chan string) {
+	fired := make(chan string, 10)
+	return func(name string) func() { return func() { fired <- name } }, fired
+}
+
+func expectFired(t *testing.T, fired <-chan string, want ...string) {
+	t.Helper()
+	for _, name := range want {
+		select {
+		case got := <-fired:
+			if got != name {
+				t.Fatalf("got timer %s, want %s", got, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timer %s didn't fire", name)
+		}
+	}
+	select {
+	case got := <-fired:
+		t.Fatalf("timer %s fired, want none", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestFakeClockAdvance(t *testing.T) {
+	c := NewFakeClock(fakeStart)
+	if now := c.Advance(time.Hour); !now.Equal(fakeStart.Add(time.Hour)) {
+		t.Errorf("got %v advancing an hour, want %v", now, fakeStart.Add(time.Hour))
+	}
+	if now := c.Now(); !now.Equal(fakeStart.Add(time.Hour)) {
+		t.Errorf("got %v after advancing, want %v", now, fakeStart.Add(time.Hour))
+	}
+	time.Sleep(time.Millisecond)
+	if now := c.Now(); !now.Equal(fakeStart.Add(time.Hour)) {
+		t.Errorf("got %v, want a frozen clock", now)
+	}
+}
+
+func TestFakeClockTimersFireInOrder(t *testing.T) {
+	c := NewFakeClock(fakeStart)
+	timer, fired := recorder()
+	c.AfterFunc(3*time.Minute, timer("c"))
+	c.AfterFunc(time.Minute, timer("a"))
+	c.AfterFunc(2*time.Minute, timer("b1"))
+	c.AfterFunc(2*time.Minute, timer("b2"))
+	c.AfterFunc(time.Hour, timer("late"))
+	expectFired(t, fired)
+	c.Advance(30 * time.Second)
+	expectFired(t, fired)
+	c.Advance(4 * time.Minute)
+	expectFired(t, fired, "a", "b1", "b2", "c")
+	c.Advance(time.Hour)
+	expectFired(t, fired, "late")
+}
+
+func TestFakeClockAfterFuncNow(t *testing.T) {
+	c := NewFakeClock(fakeStart)
+	timer, fired := recorder()
+	c.AfterFunc(0, timer("now"))
+	expectFired(t, fired, "now")
+	c.AfterFunc(-time.Minute, timer("past"))
+	expectFired(t, fired, "past")
+}
+
+func TestFakeClockStop(t *testing.T) {
+	c := NewFakeClock(fakeStart)
+	timer, fired := recorder()
+	stopped := c.AfterFunc(time.Minute, timer("stopped"))
+	done := c.AfterFunc(time.Minute, timer("done"))
+	if !stopped.Stop() {
+		t.Error("got false stopping a pending timer")
+	}
+	if stopped.Stop() {
+		t.Error("got true stopping a timer twice")
+	}
+	c.Advance(time.Minute)
+	expectFired(t, fired, "done")
+	if done.Stop() {
+		t.Error("got true stopping a timer fired")
+	}
+}
+
+// TestTimeTravelWindow places, under X-Debug-Now, bets in and out of the
+// window of a championship, the app's clock left where it is.
+func TestTimeTravelWindow(t *testing.T) {
+	defer func(cfg *Config, c Clock, w BetWindowStore) { config, clock, betWindows = cfg, c, w }(config, clock, betWindows)
+	config = &Config{TimeTravel: true}
+	clock = NewFakeClock(fakeStart)
+	betWindows = newMemoryBetWindows()
+	opens, closes := fakeStart.Add(time.Hour), fakeStart.Add(2*time.Hour)
+	betWindows.Put(&BetWindow{Tenant: "t1", ChampionshipID: "c1", OpensAt: &opens, ClosesAt: &closes})
+
+	e := echo.New()
+	handler := TimeTravel(func(c echo.Context) error {
+		if err := checkBetWindow("t1", "c1", "", requestClock(c).Now()); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusCreated)
+	})
+	for _, tc := range []struct {
+		now    string
+		status int
+	}{
+		{"", http.StatusConflict},
+		{fakeStart.Add(90 * time.Minute).Format(time.RFC3339), http.StatusCreated},
+		{fakeStart.Add(30 * time.Minute).Format(time.RFC3339), http.StatusConflict},
+		{fakeStart.Add(3 * time.Hour).Format(time.RFC3339), http.StatusConflict},
+		{"tomorrow", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/bets", nil)
+		if tc.now != "" {
+			req.Header.Set(debugNowHeader, tc.now)
+		}
+		rec := httptest.NewRecorder()
+		status := http.StatusCreated
+		if err := handler(e.NewContext(req, rec)); err != nil {
+			he, ok := err.(*echo.HTTPError)
+			if !ok {
+				t.Fatalf("got %v at %q", err, tc.now)
+			}
+			status = he.Code
+		}
+		if status != tc.status {
+			t.Errorf("got %d at %q, want %d", status, tc.now, tc.status)
+		}
+		if tc.status != http.StatusBadRequest && rec.Header().Get(debugNowHeader) != tc.now {
+			t.Errorf("got %s %q echoed, want %q", debugNowHeader, rec.Header().Get(debugNowHeader), tc.now)
+		}
+	}
+	if now := clock.Now(); !now.Equal(fakeStart) {
+		t.Errorf("got the app's clock at %v, want it left at %v", now, fakeStart)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QueueStats is a point in time view of a job queue.
+type QueueStats struct {
+	Depth     int
+	OldestAge time.Duration
+}
+
+// OutboxStats is a point in time view of events waiting to be published.
+type OutboxStats struct {
+	Backlog   int
+	OldestAge time.Duration
+	Dead      int
+}
+
+type cacheSource interface{ Stats() CacheStats }
+type queueSource interface{ Stats() QueueStats }
+type outboxSource interface{ Stats() OutboxStats }
+
+var (
+	cacheHitsDesc      = prometheus.NewDesc("bets_cache_hits_total", "Cache lookups answered from the cache.", []string{"cache"}, nil)
+	cacheMissesDesc    = prometheus.NewDesc("bets_cache_misses_total", "Cache lookups that fell through to the source.", []string{"cache"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("bets_cache_evictions_total", "Entries dropped on expiry or to make room.", []string{"cache"}, nil)
+	cacheSizeDesc      = prometheus.NewDesc("bets_cache_entries", "Entries currently held.", []string{"cache"}, nil)
+	cacheTTLDesc       = prometheus.NewDesc("bets_cache_ttl_seconds", "TTL of the entries set from now on.", []string{"cache"}, nil)
+	queueDepthDesc     = prometheus.NewDesc("bets_queue_depth", "Jobs waiting to run.", []string{"queue"}, nil)
+	queueAgeDesc       = prometheus.NewDesc("bets_queue_oldest_job_age_seconds", "Age of the oldest waiting job.", []string{"queue"}, nil)
+	outboxBacklogDesc  = prometheus.NewDesc("bets_outbox_backlog", "Events waiting to be published.", []string{"outbox"}, nil)
+	outboxAgeDesc      = prometheus.NewDesc("bets_outbox_oldest_event_age_seconds", "Age of the oldest unpublished event.", []string{"outbox"}, nil)
+	outboxDeadDesc     = prometheus.NewDesc("bets_outbox_dead_letters", "Events given up on after repeated publish failures.", []string{"outbox"}, nil)
+)
+
+// statsCollector reads the counters of the registered caches, queues and
+// outboxes at scrape time, so they cost nothing between scrapes.
+type statsCollector struct {
+	mu       sync.Mutex
+	caches   map[string]cacheSource
+	queues   map[string]queueSource
+	outboxes map[string]outboxSource
+}
+
+var stats = &statsCollector{
+	caches:   map[string]cacheSource{},
+	queues:   map[string]queueSource{},
+	outboxes: map[string]outboxSource{},
+}
+
+func init() {
+	registry.MustRegister(stats)
+}
+
+func (s *statsCollector) RegisterCache(name string, c cacheSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caches[name] = c
+}
+
+func (s *statsCollector) RegisterQueue(name string, q queueSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[name] = q
+}
+
+func (s *statsCollector) RegisterOutbox(name string, o outboxSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outboxes[name] = o
+}
+
+func (s *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		cacheHitsDesc, cacheMissesDesc, cacheEvictionsDesc, cacheSizeDesc, cacheTTLDesc,
+		queueDepthDesc, queueAgeDesc, outboxBacklogDesc, outboxAgeDesc, outboxDeadDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (s *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, c := range s.caches {
+		st := c.Stats()
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(st.Hits), name)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(st.Misses), name)
+		ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(st.Evictions), name)
+		ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(st.Size), name)
+		ch <- prometheus.MustNewConstMetric(cacheTTLDesc, prometheus.GaugeValue, st.TTL.Seconds(), name)
+	}
+	for name, q := range s.queues {
+		st := q.Stats()
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(st.Depth), name)
+		ch <- prometheus.MustNewConstMetric(queueAgeDesc, prometheus.GaugeValue, st.OldestAge.Seconds(), name)
+	}
+	for name, o := range s.outboxes {
+		st := o.Stats()
+		ch <- prometheus.MustNewConstMetric(outboxBacklogDesc, prometheus.GaugeValue, float64(st.Backlog), name)
+		ch <- prometheus.MustNewConstMetric(outboxAgeDesc, prometheus.GaugeValue, st.OldestAge.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(outboxDeadDesc, prometheus.GaugeValue, float64(st.Dead), name)
+	}
+}
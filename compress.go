@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo"
+)
+
+// CompressionConfig compresses the responses of text content types, with
+// brotli or gzip as the client accepts, once they reach MinSize bytes.
+type CompressionConfig struct {
+	Enabled bool
+	MinSize int
+}
+
+var (
+	gzipWriters   = sync.Pool{New: func() interface{} { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }}
+	brotliWriters = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, 5) }}
+)
+
+// compressible tells the content types worth compressing; images, archives
+// and profiles are compressed already.
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return strings.HasPrefix(ct, "text/") || strings.Contains(ct, "json") || strings.Contains(ct, "javascript") ||
+		strings.Contains(ct, "xml") || strings.Contains(ct, "yaml") || strings.Contains(ct, "graphql")
+}
+
+// acceptedEncoding picks brotli over gzip among the encodings the request
+// accepts, "" when neither.
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := ""
+		if len(fields) > 1 {
+			q = strings.Replace(strings.TrimSpace(fields[1]), " ", "", -1)
+		}
+		accepted[name] = q != "q=0" && q != "q=0.0"
+	}
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressWriter holds the start of the body back until it is known
+// whether it is worth compressing: MinSize bytes of a compressible type
+// not encoded already.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buf      []byte
+	decided  bool
+	enc      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressing when sized is true and the type
+// qualifies, then what was held back.
+func (w *compressWriter) decide(sized bool) error {
+	w.decided = true
+	h := w.Header()
+	if sized && w.status == http.StatusOK && h.Get(echo.HeaderContentEncoding) == "" && compressible(h.Get(echo.HeaderContentType)) {
+		h.Set(echo.HeaderContentEncoding, w.encoding)
+		h.Del(echo.HeaderContentLength)
+		if w.encoding == "br" {
+			bw := brotliWriters.Get().(*brotli.Writer)
+			bw.Reset(w.ResponseWriter)
+			w.enc = bw
+		} else {
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(w.ResponseWriter)
+			w.enc = gw
+		}
+	}
+	if w.status == 0 {
+		return nil
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Flush sends what was written so far, compressed if it qualifies
+// whatever its size, for streamed responses.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *compressWriter) close() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	switch e := w.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(e)
+	case *brotli.Writer:
+		brotliWriters.Put(e)
+	}
+	return err
+}
+
+// Compress encodes the responses for the clients accepting it. Ranges and
+// HEAD requests are served as they are.
+func Compress(cfg CompressionConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			encoding := acceptedEncoding(req.Header.Get(echo.HeaderAcceptEncoding))
+			if !cfg.Enabled || encoding == "" || req.Method == http.MethodHead || req.Header.Get("Range") != "" {
+				return next(c)
+			}
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			w := &compressWriter{ResponseWriter: res.Writer, encoding: encoding, minSize: cfg.MinSize}
+			res.Writer = w
+			err := next(c)
+			if cerr := w.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			res.Writer = w.ResponseWriter
+			return err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// etagWriter holds the response back until the handler is done, so the
+// ETag can be derived from the body.
+type etagWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// ConditionalGET tags 200 responses with an ETag hashing the body, as
+// rendered for the caller, and answers 304 without a body when the
+// request's If-None-Match lists it. Clients polling unchanged resources
+// only pay for the headers; the response is still computed.
+func ConditionalGET(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return next(c)
+		}
+		res := c.Response()
+		w := &etagWriter{ResponseWriter: res.Writer}
+		res.Writer = w
+		err := next(c)
+		res.Writer = w.ResponseWriter
+		if w.status == 0 {
+			// nothing written, the error handler renders err
+			return err
+		}
+		if w.status == http.StatusOK {
+			sum := sha256.Sum256(w.buf.Bytes())
+			etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			h := res.Header()
+			h.Set("ETag", etag)
+			if h.Get("Cache-Control") == "" {
+				// responses depend on the caller, see redaction
+				h.Set("Cache-Control", "private, no-cache")
+			}
+			if etagMatch(req.Header.Get("If-None-Match"), etag) {
+				h.Del(echo.HeaderContentType)
+				h.Del(echo.HeaderContentLength)
+				res.Status = http.StatusNotModified
+				w.ResponseWriter.WriteHeader(http.StatusNotModified)
+				return err
+			}
+		}
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, werr := w.ResponseWriter.Write(w.buf.Bytes()); werr != nil && err == nil {
+			err = werr
+		}
+		return err
+	}
+}
+
+// etagMatch applies the weak comparison of If-None-Match: any listed tag,
+// W/ prefix aside, or "*".
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
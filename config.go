@@ -0,0 +1,592 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from the environment at startup.
+type Config struct {
+	Server      ServerConfig
+	ServerTLS   ServerTLSConfig
+	UpstreamTLS UpstreamTLSConfig
+	Transport   TransportConfig
+	Cache       CacheConfig
+	Jobs        JobsConfig
+	AdminRole   string
+	Redaction   RedactionPolicy
+	Events      EventsConfig
+	PII         PIIConfig
+	Storage     StorageConfig
+	AuditKey    string
+	Webhooks    WebhooksConfig
+	BlobDir     string
+	CORS        CORSConfig
+	InviteURL   string
+	MaxBodySize int64
+	Prefetch    PrefetchConfig
+	DemoMode    bool
+	TimeTravel  bool
+	Tenancy     TenancyConfig
+	Breaker     BreakerConfig
+	Hedge       HedgeConfig
+	Drift       DriftConfig
+	Logging     LoggingConfig
+	MatchStatus MatchStatusConfig
+	Identity    IdentityConfig
+	RateLimit   RateLimitConfig
+	BetQuota    BetQuotaConfig
+	Shedding    SheddingConfig
+	Warehouse   WarehouseConfig
+	Degraded    DegradedConfig
+	Rollups     RollupConfig
+	// StartupTimeout is how long the storage and the event bus are
+	// retried on startup before giving up.
+	StartupTimeout time.Duration
+	// LegacySunset is the HTTP date announced for removing the
+	// unversioned routes; empty announces none.
+	LegacySunset string
+	// Championship is served to the tenants without a championships
+	// service, see StaticChampionship.
+	Championship *StaticChampionship
+	// BasePath is the path prefix the gateway mounts the app at, as
+	// "/prefix"; empty when served at the root.
+	BasePath string
+	// ListenAddr is the host and port the server binds to; an empty
+	// host binds every interface.
+	ListenAddr string
+	// ForwardHeaders are the incoming headers passed on to the
+	// services, see headerAllowlist.
+	ForwardHeaders []string
+	Flags          FlagsConfig
+	Reload         ReloadConfig
+	Chaos          ChaosConfig
+	Region         RegionConfig
+	// DiagnosticsAddr, when set, serves the profiles and the runtime
+	// statistics on their own listener instead of behind the admin role.
+	DiagnosticsAddr string
+	Static          StaticConfig
+	Compression     CompressionConfig
+	OutboundAuth    OutboundAuthConfig
+	Notifications   NotificationsConfig
+	Reminders       ReminderConfig
+	AsyncBets       AsyncBetsConfig
+	// DedupWindow is how long an identical bet of the same caller gets
+	// the first one's response; zero places every bet.
+	DedupWindow time.Duration
+	// GraphQLComplexity caps the fields a GraphQL query may ask for.
+	GraphQLComplexity int
+	// Locale is the language of the responses to requests without an
+	// Accept-Language the API speaks.
+	Locale string
+	// SettlementHistory is how many settlements, and apart failed ones,
+	// each replica reports on GET /api/admin/settlements.
+	SettlementHistory int
+}
+
+// ServerConfig tunes the listener. ReadHeaderTimeout bounds how long a
+// client may take to send the headers of a request, and ReadTimeout the
+// whole request, so slow clients don't hold connections forever; zero
+// disables them. WriteTimeout is off by default, since exports and long
+// polls keep writing for minutes. IdleTimeout closes the keep-alive
+// connections left unused. HTTP2 is negotiated over TLS only.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	KeepAlive         bool
+	HTTP2             bool
+}
+
+// ServerTLSConfig enables HTTPS on the listener. Either a cert/key pair or
+// a list of autocert hosts turns it on; a client CA bundle requires callers
+// to present a certificate signed by it.
+type ServerTLSConfig struct {
+	CertFile      string
+	KeyFile       string
+	AutocertHosts []string
+	AutocertCache string
+	ClientCAFile  string
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (c ServerTLSConfig) Enabled() bool {
+	return (c.CertFile != "" && c.KeyFile != "") || len(c.AutocertHosts) > 0
+}
+
+// validate rejects a half configured HTTPS, which would otherwise start
+// serving plain HTTP: a certificate without its key or the other way
+// round, or a client CA bundle with nothing turning HTTPS on. Nor may a
+// certificate be given along with autocert hosts, which would ignore it.
+func (c ServerTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.CertFile != "" && len(c.AutocertHosts) > 0 {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE can't be set with TLS_AUTOCERT_HOSTS")
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		return errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE, or TLS_AUTOCERT_HOSTS")
+	}
+	return nil
+}
+
+// UpstreamTLSConfig configures the certificate presented to, and the CA
+// bundle used to verify, the matches/players/championships services.
+type UpstreamTLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// TransportConfig tunes the connection pool shared by all outbound calls.
+type TransportConfig struct {
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	HTTP2               bool
+}
+
+// CacheConfig bounds the caches in front of the matches and championships
+// services, and the round summaries cache; PlayerTTL is how long player
+// profiles are trusted. A zero TTL turns caching off. Tuning, when
+// enabled, moves the TTL of the services' caches from there on.
+type CacheConfig struct {
+	TTL        time.Duration
+	MaxEntries int
+	SummaryTTL time.Duration
+	PlayerTTL  time.Duration
+	// Shards splits the match and championship caches, each shard with
+	// its own lock.
+	Shards int
+	Tuning TTLTuningConfig
+}
+
+// JobsConfig sizes the background job queue.
+type JobsConfig struct {
+	Workers int
+	History int
+}
+
+// PrefetchConfig drives the warming of the upstream caches before popular
+// kickoffs. A zero interval disables it.
+type PrefetchConfig struct {
+	Interval    time.Duration
+	Window      time.Duration
+	MinBets     int
+	Connections int
+}
+
+// BreakerConfig opens the breaker of a downstream host after Failures
+// consecutive failures, for Cooldown. Zero failures disables breakers.
+type BreakerConfig struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+// RateLimitConfig allows each caller Limit API requests per Window; a zero
+// limit disables rate limiting.
+type RateLimitConfig struct {
+	Limit  int
+	Window time.Duration
+}
+
+// BetQuotaConfig caps the bets each player creates or edits per minute and
+// per day; a zero limit lifts that cap. The counters are kept in Redis when
+// RedisURL is set, so the replicas share them, otherwise per replica.
+type BetQuotaConfig struct {
+	PerMinute int
+	PerDay    int
+	RedisURL  string
+}
+
+// WarehouseConfig schedules the incremental exports for analytics, written
+// as NDJSON under Dir/Prefix. A zero interval disables the schedule;
+// backfills can still be requested.
+type WarehouseConfig struct {
+	Interval time.Duration
+	Lag      time.Duration
+	Dir      string
+	Prefix   string
+}
+
+// RollupConfig schedules the recomputation of the daily statistics of the
+// last Lookback days, today included; a zero interval disables it.
+type RollupConfig struct {
+	Interval time.Duration
+	Lookback int
+}
+
+// EventsConfig points at the NATS event bus; an empty URL disables every
+// consumer and publisher.
+type EventsConfig struct {
+	URL             string
+	Group           string
+	SettlementTopic string
+	BetCreatedTopic string
+	// LeaderboardTopic carries the leaderboards published again once a
+	// match is resettled.
+	LeaderboardTopic string
+	MaxAttempts      int
+}
+
+// PIIConfig holds the keys encrypting personal data at rest, read from the
+// mounted secret files when the plain variables are unset.
+type PIIConfig struct {
+	Keys     []string
+	IndexKey string
+}
+
+// StorageConfig selects where bets are kept: "memory" (default),
+// "postgres" or "mongo". With the memory driver, SnapshotFile, when set,
+// keeps the bets across restarts, saved every SnapshotInterval and on
+// shutdown.
+type StorageConfig struct {
+	Driver           string
+	DatabaseURL      string
+	MigrateOnStart   bool
+	MongoURL         string
+	MongoDatabase    string
+	SnapshotFile     string
+	SnapshotInterval time.Duration
+}
+
+// WebhooksConfig holds the secrets shared with the senders of inbound
+// webhooks; a webhook without a secret is not exposed.
+type WebhooksConfig struct {
+	MatchResultsSecret string
+	Tolerance          time.Duration
+}
+
+func loadConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+			ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", time.Minute),
+			WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", 0),
+			IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+			MaxHeaderBytes:    envInt("SERVER_MAX_HEADER_BYTES", 64<<10),
+			KeepAlive:         envBool("SERVER_KEEP_ALIVE", true),
+			HTTP2:             envBool("SERVER_HTTP2", true),
+		},
+		ServerTLS: ServerTLSConfig{
+			CertFile:      os.Getenv("TLS_CERT_FILE"),
+			KeyFile:       os.Getenv("TLS_KEY_FILE"),
+			AutocertHosts: envList("TLS_AUTOCERT_HOSTS"),
+			AutocertCache: envOr("TLS_AUTOCERT_CACHE", "/tmp/autocert"),
+			ClientCAFile:  os.Getenv("TLS_CLIENT_CA_FILE"),
+		},
+		UpstreamTLS: UpstreamTLSConfig{
+			CertFile: os.Getenv("UPSTREAM_TLS_CERT_FILE"),
+			KeyFile:  os.Getenv("UPSTREAM_TLS_KEY_FILE"),
+			CAFile:   os.Getenv("UPSTREAM_TLS_CA_FILE"),
+		},
+		CORS: CORSConfig{
+			AllowOrigins:     envList("CORS_ALLOW_ORIGINS"),
+			AllowMethods:     envListOr("CORS_ALLOW_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE"),
+			AllowHeaders:     envListOr("CORS_ALLOW_HEADERS", "Authorization,Content-Type"),
+			ExposeHeaders:    envListOr("CORS_EXPOSE_HEADERS", "X-App-Version,X-App-Commit,X-API-Version,X-Region,Deprecation,Sunset,Link,Retry-After"),
+			AllowCredentials: envBool("CORS_ALLOW_CREDENTIALS", false),
+			MaxAge:           envDuration("CORS_MAX_AGE", 10*time.Minute),
+		},
+		Transport: TransportConfig{
+			Timeout:             envDuration("UPSTREAM_TIMEOUT", 10*time.Second),
+			DialTimeout:         envDuration("UPSTREAM_DIAL_TIMEOUT", 5*time.Second),
+			KeepAlive:           envDuration("UPSTREAM_KEEP_ALIVE", 30*time.Second),
+			IdleConnTimeout:     envDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second),
+			MaxIdleConns:        envInt("UPSTREAM_MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost: envInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 32),
+			MaxConnsPerHost:     envInt("UPSTREAM_MAX_CONNS_PER_HOST", 0),
+			HTTP2:               envBool("UPSTREAM_HTTP2", true),
+		},
+		Cache: CacheConfig{
+			TTL:        envDuration("CACHE_TTL", 30*time.Second),
+			MaxEntries: envInt("CACHE_MAX_ENTRIES", 1000),
+			SummaryTTL: envDuration("SUMMARY_CACHE_TTL", time.Minute),
+			PlayerTTL:  envDuration("PLAYER_CACHE_TTL", time.Hour),
+			Shards:     envInt("CACHE_SHARDS", 16),
+			Tuning: TTLTuningConfig{
+				Enabled:       envBool("CACHE_TTL_TUNING", false),
+				Interval:      envDuration("CACHE_TTL_TUNING_INTERVAL", time.Minute),
+				MinTTL:        envDuration("CACHE_MIN_TTL", 5*time.Second),
+				MaxTTL:        envDuration("CACHE_MAX_TTL", 10*time.Minute),
+				TargetHitRate: envFloat("CACHE_TARGET_HIT_RATE", 0.8),
+				ErrorRate:     envFloat("CACHE_FLAKY_ERROR_RATE", 0.1),
+			},
+		},
+		Prefetch: PrefetchConfig{
+			Interval:    envDuration("PREFETCH_INTERVAL", time.Minute),
+			Window:      envDuration("PREFETCH_WINDOW", 30*time.Minute),
+			MinBets:     envInt("PREFETCH_MIN_BETS", 20),
+			Connections: envInt("PREFETCH_CONNECTIONS", 4),
+		},
+		Breaker: BreakerConfig{
+			Failures: envInt("BREAKER_FAILURES", 5),
+			Cooldown: envDuration("BREAKER_COOLDOWN", 30*time.Second),
+		},
+		Hedge: HedgeConfig{
+			Delay:    envDuration("HEDGE_DELAY", 0),
+			Services: envListOr("HEDGE_SERVICES", "matches"),
+		},
+		Drift: DriftConfig{
+			Interval:       envDuration("DRIFT_INTERVAL", 0),
+			MatchID:        os.Getenv("DRIFT_MATCH_ID"),
+			ChampionshipID: os.Getenv("DRIFT_CHAMPIONSHIP_ID"),
+			Token:          secret("DRIFT_PLAYER_TOKEN"),
+		},
+		Logging: LoggingConfig{
+			Bodies:    envBool("LOG_BODIES", false),
+			BodyLimit: envInt("LOG_BODY_LIMIT", 4096),
+			Redact:    envListOr("LOG_REDACT", "authorization,cookie,set-cookie,x-webhook-signature,email"),
+		},
+		Identity: IdentityConfig{
+			Provider:      envOr("IDENTITY_PROVIDER", "service"),
+			AdminEmail:    os.Getenv("LOCAL_ADMIN_EMAIL"),
+			AdminPassword: secret("LOCAL_ADMIN_PASSWORD"),
+			TokenKey:      secret("TOKEN_VERIFY_KEY"),
+		},
+		MatchStatus: MatchStatusConfig{
+			Interval:     envDuration("MATCH_STATUS_INTERVAL", 30*time.Second),
+			Ahead:        envDuration("MATCH_STATUS_AHEAD", 15*time.Minute),
+			Behind:       envDuration("MATCH_STATUS_BEHIND", 4*time.Hour),
+			LockStatuses: envListOr("MATCH_LOCK_STATUSES", "live,finished"),
+		},
+		RateLimit: RateLimitConfig{
+			Limit:  envInt("RATE_LIMIT", 0),
+			Window: envDuration("RATE_LIMIT_WINDOW", time.Minute),
+		},
+		BetQuota: BetQuotaConfig{
+			PerMinute: envInt("BET_QUOTA_PER_MINUTE", 0),
+			PerDay:    envInt("BET_QUOTA_PER_DAY", 0),
+			RedisURL:  secret("REDIS_URL"),
+		},
+		Shedding: SheddingConfig{
+			Limit:         envInt("MAX_CONCURRENT_REQUESTS", 0),
+			Adaptive:      envBool("ADAPTIVE_CONCURRENCY", false),
+			MinLimit:      envInt("MIN_CONCURRENT_REQUESTS", 4),
+			MaxLimit:      envInt("MAX_ADAPTIVE_CONCURRENT_REQUESTS", 1000),
+			TargetLatency: envDuration("TARGET_LATENCY", 250*time.Millisecond),
+			RetryAfter:    envDuration("SHED_RETRY_AFTER", time.Second),
+		},
+		Warehouse: WarehouseConfig{
+			Interval: envDuration("WAREHOUSE_INTERVAL", 0),
+			Lag:      envDuration("WAREHOUSE_LAG", time.Minute),
+			Dir:      envOr("WAREHOUSE_DIR", filepath.Join(os.TempDir(), "bets-warehouse")),
+			Prefix:   envOr("WAREHOUSE_PREFIX", "analytics"),
+		},
+		Degraded: DegradedConfig{
+			Critical:     envListOr("CRITICAL_DEPENDENCIES", "matches,players"),
+			LastKnownTTL: envDuration("LAST_KNOWN_TTL", 24*time.Hour),
+		},
+		Rollups: RollupConfig{
+			Interval: envDuration("ROLLUP_INTERVAL", 24*time.Hour),
+			Lookback: envInt("ROLLUP_LOOKBACK_DAYS", 2),
+		},
+		Jobs: JobsConfig{
+			Workers: envInt("JOB_WORKERS", 2),
+			History: envInt("JOB_HISTORY", 500),
+		},
+		AdminRole:      envOr("ADMIN_ROLE", "admin"),
+		DemoMode:       envBool("DEMO_MODE", false),
+		TimeTravel:     envBool("TIME_TRAVEL", false),
+		Championship:   loadStaticChampionship(),
+		BasePath:       normalizeBasePath(os.Getenv("BASE_PATH")),
+		ListenAddr:     listenAddress(os.Getenv("HTTP_ADDR"), envOr("HTTP_PORT", "9999")),
+		ForwardHeaders: append(envListOr("FORWARD_HEADERS", strings.Join(defaultForwardHeaders, ",")), envList("FORWARD_HEADERS_EXTRA")...),
+		Flags: FlagsConfig{
+			Env:  envList("FEATURE_FLAGS"),
+			File: os.Getenv("FEATURE_FLAGS_FILE"),
+			Poll: envDuration("FEATURE_FLAGS_POLL", 10*time.Second),
+		},
+		Reload: ReloadConfig{
+			File: os.Getenv("CONFIG_FILE"),
+			Poll: envDuration("CONFIG_POLL", 10*time.Second),
+		},
+		Chaos: ChaosConfig{
+			Enabled:      envBool("CHAOS_ENABLED", false),
+			Delay:        envDuration("CHAOS_DELAY", 0),
+			DelayPercent: envFloat("CHAOS_DELAY_PERCENT", 0),
+			AbortStatus:  envInt("CHAOS_ABORT_STATUS", 503),
+			AbortPercent: envFloat("CHAOS_ABORT_PERCENT", 0),
+			Paths:        envListOr("CHAOS_PATHS", "/api/bets,/api/v1/bets"),
+			Upstreams:    envList("CHAOS_UPSTREAMS"),
+		},
+		Region: RegionConfig{
+			Name: os.Getenv("REGION"),
+			Zone: os.Getenv("ZONE"),
+		},
+		DiagnosticsAddr: os.Getenv("DIAGNOSTICS_ADDR"),
+		Static: StaticConfig{
+			SPADir:  os.Getenv("SPA_DIR"),
+			SPAPath: normalizeBasePath(os.Getenv("SPA_PATH")),
+			CSP:     envOr("CONTENT_SECURITY_POLICY", "default-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'self'; frame-ancestors 'none'"),
+		},
+		Compression: CompressionConfig{
+			Enabled: envBool("COMPRESSION", true),
+			MinSize: envInt("COMPRESSION_MIN_SIZE", 1024),
+		},
+		OutboundAuth: loadOutboundAuth(),
+		Notifications: NotificationsConfig{
+			Provider:     os.Getenv("NOTIFICATIONS_PROVIDER"),
+			From:         envOr("NOTIFICATIONS_FROM", "Bets <no-reply@bets.com>"),
+			SMTPAddr:     os.Getenv("SMTP_ADDR"),
+			SMTPUser:     os.Getenv("SMTP_USERNAME"),
+			SMTPPassword: secret("SMTP_PASSWORD"),
+			Templates:    os.Getenv("NOTIFICATIONS_TEMPLATES_DIR"),
+			Attempts:     envInt("NOTIFICATIONS_ATTEMPTS", 5),
+		},
+		Reminders: ReminderConfig{
+			Interval: envDuration("REMINDER_INTERVAL", 0),
+			Ahead:    envDuration("REMINDER_AHEAD", 3*time.Hour),
+			Topic:    envOr("REMINDER_TOPIC", "bet.reminder"),
+		},
+		AsyncBets: AsyncBetsConfig{
+			Default:  envBool("ASYNC_BETS", false),
+			Attempts: envInt("ASYNC_BETS_ATTEMPTS", 3),
+		},
+		DedupWindow:       envDuration("DEDUP_WINDOW", 5*time.Second),
+		GraphQLComplexity: envInt("GRAPHQL_MAX_COMPLEXITY", 200),
+		Locale:            envOr("DEFAULT_LOCALE", englishTag),
+		SettlementHistory: envInt("SETTLEMENT_HISTORY", 100),
+		LegacySunset:      os.Getenv("API_LEGACY_SUNSET"),
+		StartupTimeout:    envDuration("STARTUP_TIMEOUT", 2*time.Minute),
+		Tenancy: TenancyConfig{
+			Header:  envOr("TENANT_HEADER", "X-Tenant-ID"),
+			Claim:   envOr("TENANT_CLAIM", "tenant"),
+			Default: envOr("DEFAULT_TENANT", "default"),
+			Tenants: loadTenants(os.Getenv("TENANTS_FILE")),
+		},
+		Events: EventsConfig{
+			URL:              os.Getenv("EVENTS_URL"),
+			Group:            envOr("EVENTS_GROUP", "bets"),
+			SettlementTopic:  envOr("SETTLEMENT_TOPIC", "match.finished"),
+			BetCreatedTopic:  envOr("BET_CREATED_TOPIC", "bet.created"),
+			LeaderboardTopic: envOr("LEADERBOARD_TOPIC", "leaderboard.updated"),
+			MaxAttempts:      envInt("PUBLISH_MAX_ATTEMPTS", 10),
+		},
+		Storage: StorageConfig{
+			Driver:           envOr("STORAGE_DRIVER", "memory"),
+			DatabaseURL:      secret("DATABASE_URL"),
+			MigrateOnStart:   envBool("MIGRATE_ON_START", false),
+			MongoURL:         secret("MONGODB_URL"),
+			MongoDatabase:    envOr("MONGODB_DATABASE", "bets"),
+			SnapshotFile:     os.Getenv("SNAPSHOT_FILE"),
+			SnapshotInterval: envDuration("SNAPSHOT_INTERVAL", 30*time.Second),
+		},
+		AuditKey:    secret("AUDIT_KEY"),
+		MaxBodySize: int64(envInt("MAX_BODY_SIZE", 1<<20)),
+		InviteURL:   envOr("INVITE_URL", "https://bets.com/pools/{pool}/join"),
+		BlobDir:     envOr("BLOB_DIR", filepath.Join(os.TempDir(), "bets-blobs")),
+		Webhooks: WebhooksConfig{
+			MatchResultsSecret: secret("WEBHOOK_MATCH_RESULTS_SECRET"),
+			Tolerance:          envDuration("WEBHOOK_TOLERANCE", 5*time.Minute),
+		},
+		PII: PIIConfig{
+			Keys:     strings.Fields(strings.Replace(secret("PII_KEYS"), ",", " ", -1)),
+			IndexKey: secret("PII_INDEX_KEY"),
+		},
+		Redaction: RedactionPolicy{
+			AudienceSelf:       parseRedaction(envList("REDACT_SELF")),
+			AudiencePoolMember: parseRedaction(envListOr("REDACT_POOL_MEMBER", "~email")),
+			AudienceAdmin:      parseRedaction(envList("REDACT_ADMIN")),
+			AudiencePublic:     parseRedaction(envListOr("REDACT_PUBLIC", "email")),
+		},
+	}
+}
+
+// secret reads key from the environment, or from the file named by
+// key_FILE, which is how Kubernetes secrets are usually mounted.
+func secret(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	if file := os.Getenv(key + "_FILE"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read secret " + key)
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	}
+	return ""
+}
+
+// listenAddress joins HTTP_ADDR and HTTP_PORT, unless the address carries
+// its own port.
+func listenAddress(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envList(key string) []string {
+	return envListOr(key, "")
+}
+
+// envListOr splits a comma separated variable, using def when it is unset.
+// Setting it to an empty value yields an empty list.
+func envListOr(key, def string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		v = def
+	}
+	var r []string
+	for _, v := range strings.Split(v, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
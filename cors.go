@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// CORSConfig controls which browser origins may call the API. Origins are
+// exact matches, "*" for any origin, or regular expressions when they start
+// with "^", e.g. "^https://[a-z]+\.bets\.com$". No origin is allowed by
+// default.
+type CORSConfig struct {
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS answers preflight requests and sets the CORS headers on responses to
+// allowed origins; other origins get no CORS headers and so are blocked by
+// the browser.
+func CORS(cfg CORSConfig) (echo.MiddlewareFunc, error) {
+	any := false
+	exact := map[string]bool{}
+	var patterns []*regexp.Regexp
+	for _, o := range cfg.AllowOrigins {
+		switch {
+		case o == "*":
+			any = true
+		case strings.HasPrefix(o, "^"):
+			re, err := regexp.Compile(o)
+			if err != nil {
+				return nil, errors.New("invalid CORS origin pattern " + o + ": " + err.Error())
+			}
+			patterns = append(patterns, re)
+		default:
+			exact[strings.ToLower(o)] = true
+		}
+	}
+	if any && cfg.AllowCredentials {
+		return nil, errors.New("CORS credentials can't be allowed for any origin")
+	}
+	allowed := func(origin string) bool {
+		if any || exact[strings.ToLower(origin)] {
+			return true
+		}
+		for _, re := range patterns {
+			if re.MatchString(origin) {
+				return true
+			}
+		}
+		return false
+	}
+	methods := strings.Join(cfg.AllowMethods, ",")
+	headers := strings.Join(cfg.AllowHeaders, ",")
+	expose := strings.Join(cfg.ExposeHeaders, ",")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			h := c.Response().Header()
+			origin := req.Header.Get(echo.HeaderOrigin)
+			h.Add(echo.HeaderVary, echo.HeaderOrigin)
+			preflight := req.Method == http.MethodOptions && req.Header.Get(echo.HeaderAccessControlRequestMethod) != ""
+			if origin == "" || !allowed(origin) {
+				if preflight {
+					return c.NoContent(http.StatusForbidden)
+				}
+				return next(c)
+			}
+			if any {
+				h.Set(echo.HeaderAccessControlAllowOrigin, "*")
+			} else {
+				h.Set(echo.HeaderAccessControlAllowOrigin, origin)
+			}
+			if cfg.AllowCredentials {
+				h.Set(echo.HeaderAccessControlAllowCredentials, "true")
+			}
+			if !preflight {
+				if expose != "" {
+					h.Set(echo.HeaderAccessControlExposeHeaders, expose)
+				}
+				return next(c)
+			}
+			h.Add(echo.HeaderVary, echo.HeaderAccessControlRequestMethod)
+			h.Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
+			h.Set(echo.HeaderAccessControlAllowMethods, methods)
+			if headers != "" {
+				h.Set(echo.HeaderAccessControlAllowHeaders, headers)
+			}
+			if cfg.MaxAge > 0 {
+				h.Set(echo.HeaderAccessControlMaxAge, maxAge)
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+	}, nil
+}
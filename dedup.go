@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// replayedHeader marks the responses answered with the result of an
+// identical bet placed moments before.
+const replayedHeader = "Idempotent-Replayed"
+
+var dedupHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "dedup",
+	Name:      "hits_total",
+	Help:      "Bets answered with the result of an identical bet of the same caller.",
+})
+
+func init() {
+	registry.MustRegister(dedupHits)
+}
+
+// replayFunc writes the response of a placed bet, to its own request and
+// to the identical ones following it.
+type replayFunc func(c echo.Context) error
+
+// dedupWindow absorbs double submissions: an identical bet of the same
+// caller, while the first is being placed or within the window after it
+// was, gets the first one's response instead of placing another bet.
+// Failed bets are forgotten, so retrying them places them again. The window
+// is kept per replica.
+type dedupWindow struct {
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	swept   time.Time
+}
+
+type dedupEntry struct {
+	done    chan struct{}
+	replay  replayFunc
+	expires time.Time
+}
+
+var recentBets *dedupWindow
+
+// newDedupWindow returns nil, deduplicating nothing, for a zero window.
+func newDedupWindow(window time.Duration) *dedupWindow {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupWindow{window: window, entries: map[string]*dedupEntry{}}
+}
+
+// do places the bet with fn, unless an identical one is, waiting for it
+// then. It tells whether the response is another bet's.
+func (d *dedupWindow) do(ctx context.Context, key string, fn func() (replayFunc, error)) (replayFunc, bool, error) {
+	if d == nil || key == "" {
+		r, err := fn()
+		return r, false, err
+	}
+	for {
+		now := time.Now()
+		d.mu.Lock()
+		d.sweep(now)
+		e, ok := d.entries[key]
+		if ok && e.replay != nil && now.After(e.expires) {
+			ok = false
+		}
+		if !ok {
+			e = &dedupEntry{done: make(chan struct{})}
+			d.entries[key] = e
+			d.mu.Unlock()
+			r, err := d.lead(key, e, fn)
+			return r, false, err
+		}
+		d.mu.Unlock()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if e.replay != nil {
+			dedupHits.Inc()
+			return e.replay, true, nil
+		}
+		// the first bet failed, this one is placed on its own
+	}
+}
+
+// lead places the first of identical bets, keeping its response for the
+// window when it succeeds.
+func (d *dedupWindow) lead(key string, e *dedupEntry, fn func() (replayFunc, error)) (r replayFunc, err error) {
+	defer func() {
+		d.mu.Lock()
+		if r != nil && err == nil {
+			e.replay, e.expires = r, time.Now().Add(d.window)
+		} else if d.entries[key] == e {
+			delete(d.entries, key)
+		}
+		close(e.done)
+		d.mu.Unlock()
+	}()
+	return fn()
+}
+
+// sweep drops the expired entries, at most once per window; callers hold
+// the lock.
+func (d *dedupWindow) sweep(now time.Time) {
+	if now.Sub(d.swept) < d.window {
+		return
+	}
+	d.swept = now
+	for key, e := range d.entries {
+		if e.replay != nil && now.After(e.expires) {
+			delete(d.entries, key)
+		}
+	}
+}
+
+// dedupKey hashes the caller and the bet as decoded, so the same bet sent
+// as JSON, a form or protobuf is the same, the legs of an accumulator
+// included. Anonymous callers have no key.
+func dedupKey(c echo.Context, bet *Bet, async bool) string {
+	id, ok := identity(c)
+	if !ok {
+		return ""
+	}
+	caller := id.Subject
+	if caller == "" {
+		caller = id.Email
+	}
+	if caller == "" {
+		return ""
+	}
+	fields := append([]string{tenant(c), caller, strconv.FormatBool(async)}, dedupFields(bet)...)
+	for _, leg := range bet.Legs {
+		if leg != nil {
+			fields = append(append(fields, "leg"), dedupFields(leg)...)
+		}
+	}
+	h := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+func dedupFields(bet *Bet) []string {
+	return []string{
+		bet.Match, bet.Championship, bet.HomeTeamScore, bet.AwayTeamScore,
+		strconv.FormatInt(bet.Stake, 10), bet.Shootout, bet.ExternalRef,
+	}
+}
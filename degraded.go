@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// lastKnown keeps the upstream answers for much longer than the caches,
+// to place bets with when a non-critical dependency is down.
+var lastKnown *Cache
+
+// DegradedConfig names the dependencies a bet can't be placed without;
+// the others fall back to their last known answer, or a placeholder, and
+// the bet is accepted as degraded. LastKnownTTL bounds how old a fallback
+// answer can be.
+type DegradedConfig struct {
+	Critical     []string
+	LastKnownTTL time.Duration
+}
+
+func critical(service string) bool {
+	for _, s := range config.Degraded.Critical {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// outage tells a failing service from one rejecting the request: only
+// unreachable services and 5xx answers fall back.
+func outage(status int) bool {
+	return status == 0 || status >= 500
+}
+
+// degradedWarning tells which service failed and what the bet was placed
+// with instead.
+func degradedWarning(code, service string, status int, fallback string) Warning {
+	reason := "is unreachable"
+	if status != 0 {
+		reason = fmt.Sprintf("answered %d", status)
+	}
+	return Warning{Code: code, Message: "the " + service + " service " + reason + "; " + fallback}
+}
+
+// matchFallback is the last known match, when the matches service isn't
+// critical.
+func matchFallback(c echo.Context, id string) (*Match, bool) {
+	if critical("matches") {
+		return nil, false
+	}
+	m, ok := lastKnown.Get(serviceURL(tenant(c), "MATCH_SVC", id))
+	if !ok {
+		return nil, false
+	}
+	return m.(*Match), true
+}
+
+// playerFallback is the email claim of the token, when the players service
+// isn't critical.
+func playerFallback(c echo.Context) (string, bool) {
+	if critical("players") {
+		return "", false
+	}
+	id, ok := identity(c)
+	if !ok || id.Email == "" {
+		return "", false
+	}
+	return id.Email, true
+}
+
+// championshipFallback is the last known championship, or one titled
+// after the match.
+func championshipFallback(c echo.Context, id string, match *Match) (*Championship, string) {
+	if ch, ok := lastKnown.Get(serviceURL(tenant(c), "CHAMPIONSHIP_SVC", id)); ok {
+		return ch.(*Championship), "the championship is the last one known"
+	}
+	return &Championship{Title: match.Championship.Name}, "the championship is the requested one and its title comes from the match"
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// dependencyCall is the outcome of calling a downstream service: the
+// status it answered, 0 when it didn't, and how long it took. Optional
+// calls were fallen back from, so their failures don't hold retries back.
+type dependencyCall struct {
+	status   int
+	err      error
+	elapsed  time.Duration
+	optional bool
+}
+
+// callSince completes a call started at start.
+func callSince(start time.Time, status int, err error) dependencyCall {
+	return dependencyCall{status: status, err: err, elapsed: time.Since(start)}
+}
+
+// DependencyStatus tells a client how a downstream service failed, if it
+// did, and whether the request is worth retrying because of it.
+type DependencyStatus struct {
+	Status       int    `json:"status"`
+	Error        string `json:"error,omitempty"`
+	ElapsedMs    int64  `json:"elapsedMs"`
+	Retryable    bool   `json:"retryable"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
+// dependencyError reports the calls made to the downstream services when
+// at least one of them failed.
+type dependencyError struct {
+	calls map[string]dependencyCall
+}
+
+func (e *dependencyError) Error() string {
+	return "downstream services unavailable"
+}
+
+// statuses are the status answered by each service, as in the errors of
+// a problem.
+func (e *dependencyError) statuses() map[string]int {
+	statuses := map[string]int{}
+	for service, call := range e.calls {
+		statuses[service] = call.status
+	}
+	return statuses
+}
+
+// retryAfter is the longest wait imposed by the breakers of the failed
+// services, including those the failures just opened; zero when none is.
+func (e *dependencyError) retryAfter() time.Duration {
+	var wait time.Duration
+	for service, call := range e.calls {
+		if w := call.retryAfter(service); w > wait && !call.optional {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// retryAfter is how long the breaker of a failed service holds calls back.
+func (call dependencyCall) retryAfter(service string) time.Duration {
+	if call.err == nil {
+		return 0
+	}
+	if be, ok := call.err.(*breakerOpenError); ok {
+		return be.wait
+	}
+	return breakers.wait(service)
+}
+
+// failure names how a call failed: the breaker was open, the service timed
+// out, refused the connection or couldn't be reached otherwise, answered
+// 5xx or 4xx, or answered something unreadable.
+func (call dependencyCall) failure() string {
+	var ne net.Error
+	switch {
+	case call.err == nil:
+		return ""
+	case isBreakerOpen(call.err):
+		return "circuit_open"
+	case errors.As(call.err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(call.err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case call.status >= 500:
+		return "server_error"
+	case call.status >= 400:
+		return "client_error"
+	case call.status == 0:
+		return "unreachable"
+	}
+	return "bad_response"
+}
+
+func isBreakerOpen(err error) bool {
+	_, ok := err.(*breakerOpenError)
+	return ok
+}
+
+// retryable tells whether the same request can succeed later: the service
+// was down rather than refusing it.
+func (call dependencyCall) retryable() bool {
+	switch call.failure() {
+	case "circuit_open", "timeout", "connection_refused", "unreachable":
+		return true
+	case "server_error":
+		return call.status != http.StatusNotImplemented
+	case "client_error":
+		return call.status == http.StatusRequestTimeout || call.status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+func (e *dependencyError) dependencies() map[string]DependencyStatus {
+	deps := map[string]DependencyStatus{}
+	for service, call := range e.calls {
+		s := DependencyStatus{
+			Status:    call.status,
+			Error:     call.failure(),
+			ElapsedMs: int64(call.elapsed / time.Millisecond),
+			Retryable: call.retryable(),
+		}
+		if wait := call.retryAfter(service); wait > 0 {
+			s.RetryAfterMs = int64((wait + time.Millisecond - 1) / time.Millisecond)
+		}
+		deps[service] = s
+	}
+	return deps
+}
+
+// betError renders the errors returned by placeBet. A dependency error is
+// a 503 with the status of every service called, failed or not.
+func betError(err error) error {
+	if de, ok := err.(*dependencyError); ok {
+		return (&Problem{
+			Title:        de.Error(),
+			Status:       http.StatusServiceUnavailable,
+			Errors:       de.statuses(),
+			Dependencies: de.dependencies(),
+		}).retryAfter(de.retryAfter())
+	}
+	return err
+}
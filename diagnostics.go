@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var processStart = time.Now()
+
+// diagnosticsRoutes registers the pprof profiles and the runtime view on
+// a /debug group.
+func diagnosticsRoutes(g *echo.Group) {
+	g.GET("/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// the index serves the named profiles too, as heap or goroutine
+	g.GET("/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	g.GET("/runtime", GetRuntime)
+}
+
+// serveDiagnostics serves the diagnostics on their own listener, without
+// auth: keep the address off the load balancer.
+func serveDiagnostics(addr string) {
+	d := echo.New()
+	d.HideBanner = true
+	d.HidePort = true
+	diagnosticsRoutes(d.Group("/debug"))
+	// profiles take as long as they are asked to
+	srv := config.Server
+	srv.WriteTimeout = 0
+	tuneServer(d.Server, srv)
+	log.Info().Str("address", addr).Msg("serving diagnostics")
+	if err := d.Start(addr); err != nil {
+		log.Error().Err(err).Msg("diagnostics listener stopped")
+	}
+}
+
+// RuntimeStats is the process seen from the inside: the scheduler, the
+// heap and the garbage collector, and the breakers, caches, queues and
+// outboxes of the app.
+type RuntimeStats struct {
+	GoVersion  string                `json:"goVersion"`
+	Uptime     string                `json:"uptime"`
+	CPUs       int                   `json:"cpus"`
+	GOMAXPROCS int                   `json:"gomaxprocs"`
+	Goroutines int                   `json:"goroutines"`
+	Memory     MemoryStats           `json:"memory"`
+	GC         GCStats               `json:"gc"`
+	Breakers   []BreakerStats        `json:"breakers"`
+	Caches     map[string]CacheView  `json:"caches"`
+	Queues     map[string]QueueView  `json:"queues"`
+	Outboxes   map[string]OutboxView `json:"outboxes"`
+}
+
+type MemoryStats struct {
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	HeapInuseBytes uint64 `json:"heapInuseBytes"`
+	HeapObjects    uint64 `json:"heapObjects"`
+	StackBytes     uint64 `json:"stackBytes"`
+	SysBytes       uint64 `json:"sysBytes"`
+}
+
+type GCStats struct {
+	Cycles       uint32     `json:"cycles"`
+	LastAt       *time.Time `json:"lastAt,omitempty"`
+	LastPauseMs  float64    `json:"lastPauseMs"`
+	TotalPauseMs float64    `json:"totalPauseMs"`
+	CPUFraction  float64    `json:"cpuFraction"`
+	NextHeapGoal uint64     `json:"nextHeapGoalBytes"`
+}
+
+// BreakerStats is a breaker of a downstream host, keyed as "service host".
+type BreakerStats struct {
+	Key          string `json:"key"`
+	State        string `json:"state"`
+	Failures     int    `json:"failures"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
+type CacheView struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRate   float64 `json:"hitRate"`
+	Evictions uint64  `json:"evictions"`
+	Entries   int     `json:"entries"`
+	TTL       string  `json:"ttl"`
+}
+
+type QueueView struct {
+	Depth     int    `json:"depth"`
+	OldestAge string `json:"oldestAge"`
+}
+
+type OutboxView struct {
+	Backlog   int    `json:"backlog"`
+	OldestAge string `json:"oldestAge"`
+	Dead      int    `json:"dead"`
+}
+
+var breakerStates = map[breakerState]string{breakerClosed: "closed", breakerOpen: "open", breakerHalfOpen: "half-open"}
+
+func (b *Breaker) stats(key string) BreakerStats {
+	wait := b.wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{Key: key, State: breakerStates[b.state], Failures: b.failures, RetryAfterMs: wait.Milliseconds()}
+}
+
+func (s *breakerSet) stats() []BreakerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]BreakerStats, 0, len(s.breakers))
+	for key, b := range s.breakers {
+		list = append(list, b.stats(key))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+func (s *statsCollector) views() (map[string]CacheView, map[string]QueueView, map[string]OutboxView) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	caches := map[string]CacheView{}
+	for name, c := range s.caches {
+		st := c.Stats()
+		v := CacheView{Hits: st.Hits, Misses: st.Misses, Evictions: st.Evictions, Entries: st.Size, TTL: st.TTL.String()}
+		if st.Hits+st.Misses > 0 {
+			v.HitRate = float64(st.Hits) / float64(st.Hits+st.Misses)
+		}
+		caches[name] = v
+	}
+	queues := map[string]QueueView{}
+	for name, q := range s.queues {
+		st := q.Stats()
+		queues[name] = QueueView{Depth: st.Depth, OldestAge: st.OldestAge.String()}
+	}
+	outboxes := map[string]OutboxView{}
+	for name, o := range s.outboxes {
+		st := o.Stats()
+		outboxes[name] = OutboxView{Backlog: st.Backlog, OldestAge: st.OldestAge.String(), Dead: st.Dead}
+	}
+	return caches, queues, outboxes
+}
+
+// GetRuntime serves the runtime statistics; reading the memory ones stops
+// the world briefly.
+func GetRuntime(c echo.Context) error {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := &RuntimeStats{
+		GoVersion:  strings.TrimPrefix(runtime.Version(), "go"),
+		Uptime:     time.Since(processStart).Round(time.Second).String(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryStats{
+			HeapAllocBytes: m.HeapAlloc,
+			HeapInuseBytes: m.HeapInuse,
+			HeapObjects:    m.HeapObjects,
+			StackBytes:     m.StackInuse,
+			SysBytes:       m.Sys,
+		},
+		GC: GCStats{
+			Cycles:       m.NumGC,
+			TotalPauseMs: float64(m.PauseTotalNs) / 1e6,
+			CPUFraction:  m.GCCPUFraction,
+			NextHeapGoal: m.NextGC,
+		},
+		Breakers: breakers.stats(),
+	}
+	if m.NumGC > 0 {
+		last := time.Unix(0, int64(m.LastGC)).UTC()
+		s.GC.LastAt = &last
+		s.GC.LastPauseMs = float64(m.PauseNs[(m.NumGC+255)%256]) / 1e6
+	}
+	s.Caches, s.Queues, s.Outboxes = stats.views()
+	return c.JSON(http.StatusOK, s)
+}
@@ -1,5 +1,8 @@
 #!/usr/bin/env bash
 
-docker build -t gcr.io/mvp-mesh-pre-testing/bet .
+docker build \
+  --build-arg VERSION="$(git describe --tags --always)" \
+  --build-arg COMMIT="$(git rev-parse --short HEAD)" \
+  -t gcr.io/mvp-mesh-pre-testing/bet .
 
 docker push gcr.io/mvp-mesh-pre-testing/bet:latest
\ No newline at end of file
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const domainKey = "domain"
+
+var (
+	errDomainNotFound = errors.New("domain not found")
+	errDomainTaken    = errors.New("domain is mapped by another tenant")
+	validHost         = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+)
+
+// PoolDomain maps a custom hostname to a pool, whose public widgets are
+// then served at the root of that host. Certificate files are optional;
+// without them the host gets the server certificate, or one from ACME.
+type PoolDomain struct {
+	Host         string    `json:"host"`
+	Tenant       string    `json:"tenant"`
+	Pool         string    `json:"pool"`
+	Championship string    `json:"championship"`
+	Title        string    `json:"title,omitempty"`
+	CertFile     string    `json:"certFile,omitempty"`
+	KeyFile      string    `json:"keyFile,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type DomainStore interface {
+	Put(d *PoolDomain) error
+	Get(host string) (*PoolDomain, error)
+	List(tenant string) ([]*PoolDomain, error)
+	Delete(host string) error
+}
+
+// domainTable is the Host routing table, read through a cache since every
+// request looks its host up. Unmapped hosts are cached too.
+type domainTable struct {
+	store DomainStore
+	hosts *Cache
+	certs *Cache
+}
+
+func newDomainTable(store DomainStore, cfg CacheConfig) *domainTable {
+	return &domainTable{store: store, hosts: NewCache(cfg.TTL, cfg.MaxEntries), certs: NewCache(cfg.TTL, cfg.MaxEntries)}
+}
+
+// lookup returns the mapping of host, nil when it has none.
+func (t *domainTable) lookup(host string) (*PoolDomain, error) {
+	if cached, ok := t.hosts.Get(host); ok {
+		return cached.(*PoolDomain), nil
+	}
+	d, err := t.store.Get(host)
+	if err == errDomainNotFound {
+		d, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.hosts.Set(host, d)
+	return d, nil
+}
+
+// forget drops host from this replica's caches; other replicas see the
+// change once their entries expire.
+func (t *domainTable) forget(host string) {
+	t.hosts.Delete(host)
+	t.certs.Delete(host)
+}
+
+// Middleware routes the requests of mapped hosts to the widget routes
+// under /domain, and runs them as the pool's tenant. It must run before
+// routing, i.e. via Echo#Pre.
+func (t *domainTable) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		d, err := t.lookup(requestHost(req))
+		if err != nil {
+			log.Error().Err(err).Str("host", req.Host).Msg("failed to look the domain up")
+			return next(c)
+		}
+		if d != nil {
+			c.Set(domainKey, d)
+			req.URL.Path = "/domain" + req.URL.Path
+			req.URL.RawPath = ""
+		}
+		return next(c)
+	}
+}
+
+// certificate loads the certificate configured for the SNI host; nil
+// leaves the choice to the server defaults.
+func (t *domainTable) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if cached, ok := t.certs.Get(host); ok {
+		return cached.(*tls.Certificate), nil
+	}
+	d, err := t.lookup(host)
+	if err != nil || d == nil || d.CertFile == "" {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(d.CertFile, d.KeyFile)
+	if err != nil {
+		log.Error().Err(err).Str("host", host).Msg("failed to load the domain certificate")
+		return nil, nil
+	}
+	t.certs.Set(host, &cert)
+	return &cert, nil
+}
+
+// requestHost is the lowercased Host header without the port.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// poolDomain is the mapping the request came through; the widget routes
+// are not served on other hosts.
+func poolDomain(c echo.Context) (*PoolDomain, error) {
+	d, ok := c.Get(domainKey).(*PoolDomain)
+	if !ok {
+		return nil, echo.ErrNotFound
+	}
+	return d, nil
+}
+
+// domainRoutes registers the public widgets of custom domains.
+func domainRoutes(e *echo.Echo) {
+	g := e.Group("/domain")
+	g.GET("/", DomainLeaderboardWidget)
+	g.GET("/leaderboard.json", DomainLeaderboard)
+	g.GET("/logo.png", poolParam(GetPoolLogo))
+	g.GET("/invite.png", poolParam(InviteQR))
+}
+
+// poolParam serves a pool route with the domain's pool as :id.
+func poolParam(h echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		d, err := poolDomain(c)
+		if err != nil {
+			return err
+		}
+		c.SetParamNames("id")
+		c.SetParamValues(d.Pool)
+		return h(c)
+	}
+}
+
+func DomainLeaderboard(c echo.Context) error {
+	d, err := poolDomain(c)
+	if err != nil {
+		return err
+	}
+	lb, err := leaderboard(BetFilter{Tenant: d.Tenant, ChampionshipID: d.Championship})
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=60")
+	return respond(c, http.StatusOK, lb)
+}
+
+var widgetTemplate = template.Must(template.New("widget").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: .3em .6em; text-align: left; border-bottom: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1><img src="logo.png?size=64" alt="" onerror="this.remove()"> {{.Title}}</h1>
+<table>
+<tr><th>#</th><th>Player</th><th>Points</th><th>Exact scores</th></tr>
+{{range .Entries}}<tr><td>{{.Position}}</td><td>{{.Player}}</td><td>{{.Points}}</td><td>{{.ExactScores}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type widgetEntry struct {
+	*Entry
+	Player string
+}
+
+// DomainLeaderboardWidget renders the pool leaderboard as an embeddable
+// page. Players are shown as the public audience sees their email.
+func DomainLeaderboardWidget(c echo.Context) error {
+	d, err := poolDomain(c)
+	if err != nil {
+		return err
+	}
+	lb, err := leaderboard(BetFilter{Tenant: d.Tenant, ChampionshipID: d.Championship})
+	if err != nil {
+		return err
+	}
+	page := struct {
+		Title   string
+		Entries []widgetEntry
+	}{Title: d.Title, Entries: make([]widgetEntry, len(lb.Entries))}
+	if page.Title == "" {
+		page.Title = d.Pool
+	}
+	for i, e := range lb.Entries {
+		page.Entries[i] = widgetEntry{Entry: e, Player: publicEmail(e.Email)}
+	}
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	h.Set("Cache-Control", "public, max-age=60")
+	c.Response().WriteHeader(http.StatusOK)
+	return widgetTemplate.Execute(c.Response(), page)
+}
+
+// publicEmail applies the public redaction of emails to a single value.
+func publicEmail(email string) string {
+	if s := redactField(AudiencePublic, "email", email); s != "" {
+		return s
+	}
+	return "—"
+}
+
+type domainRequest struct {
+	Pool         string `json:"pool"`
+	Championship string `json:"championship"`
+	Title        string `json:"title"`
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+}
+
+// PutDomain maps the host in the path to a pool of the caller's tenant.
+func PutDomain(c echo.Context) error {
+	host := strings.ToLower(c.Param("host"))
+	if !validHost.MatchString(host) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid host "+host)
+	}
+	req := &domainRequest{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	if req.Pool == "" || req.Championship == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "pool and championship are required")
+	}
+	if (req.CertFile == "") != (req.KeyFile == "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "certFile and keyFile go together")
+	}
+	if req.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(req.CertFile, req.KeyFile); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "unusable certificate: "+err.Error())
+		}
+	}
+	existing, err := domains.store.Get(host)
+	if err != nil && err != errDomainNotFound {
+		return err
+	}
+	if existing != nil && existing.Tenant != tenant(c) {
+		return echo.NewHTTPError(http.StatusConflict, errDomainTaken.Error())
+	}
+	d := &PoolDomain{
+		Host:         host,
+		Tenant:       tenant(c),
+		Pool:         req.Pool,
+		Championship: req.Championship,
+		Title:        req.Title,
+		CertFile:     req.CertFile,
+		KeyFile:      req.KeyFile,
+		CreatedAt:    clock.Now(),
+	}
+	if existing != nil {
+		d.CreatedAt = existing.CreatedAt
+	}
+	if err := domains.store.Put(d); err != nil {
+		return err
+	}
+	domains.forget(host)
+	return c.JSON(http.StatusOK, d)
+}
+
+func ListDomains(c echo.Context) error {
+	list, err := domains.store.List(tenant(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func DeleteDomain(c echo.Context) error {
+	host := strings.ToLower(c.Param("host"))
+	d, err := domains.store.Get(host)
+	if err == nil && d.Tenant != tenant(c) {
+		err = errDomainNotFound
+	}
+	if err == errDomainNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if err := domains.store.Delete(host); err != nil {
+		return err
+	}
+	domains.forget(host)
+	return c.NoContent(http.StatusNoContent)
+}
+
+type memoryDomains struct {
+	mu    sync.Mutex
+	hosts map[string]*PoolDomain
+}
+
+func newMemoryDomains() *memoryDomains {
+	return &memoryDomains{hosts: map[string]*PoolDomain{}}
+}
+
+func (m *memoryDomains) Put(d *PoolDomain) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *d
+	m.hosts[d.Host] = &c
+	return nil
+}
+
+func (m *memoryDomains) Get(host string) (*PoolDomain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.hosts[host]
+	if !ok {
+		return nil, errDomainNotFound
+	}
+	c := *d
+	return &c, nil
+}
+
+func (m *memoryDomains) List(tenant string) ([]*PoolDomain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*PoolDomain{}
+	for _, d := range m.hosts {
+		if d.Tenant == tenant {
+			c := *d
+			r = append(r, &c)
+		}
+	}
+	return r, nil
+}
+
+func (m *memoryDomains) Delete(host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hosts, host)
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// DriftConfig schedules the checks of the upstream contracts, fetching the
+// sample match and championship, and the player of Token. A zero interval
+// disables them; a service without a sample is skipped.
+type DriftConfig struct {
+	Interval       time.Duration
+	MatchID        string
+	ChampionshipID string
+	Token          string
+}
+
+// playerContract is what player() reads from the players service.
+type playerContract struct {
+	Email string `json:"email"`
+}
+
+// driftProbe checks one service against the struct its answers are
+// decoded into.
+type driftProbe struct {
+	service  string
+	env      string
+	id       string
+	contract reflect.Type
+}
+
+// DriftReport lists the fields an upstream answer has that the decoder
+// ignores, and those the decoder expects that the answer lacks, as dotted
+// paths.
+type DriftReport struct {
+	Service   string    `json:"service"`
+	CheckedAt time.Time `json:"checkedAt"`
+	New       []string  `json:"new"`
+	Missing   []string  `json:"missing"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type driftDetector struct {
+	mu      sync.Mutex
+	probes  []driftProbe
+	token   string
+	reports map[string]*DriftReport
+}
+
+var drift = &driftDetector{reports: map[string]*DriftReport{}}
+
+func newDriftProbes(cfg DriftConfig) []driftProbe {
+	var probes []driftProbe
+	if cfg.MatchID != "" {
+		probes = append(probes, driftProbe{"matches", "MATCH_SVC", cfg.MatchID, reflect.TypeOf(Match{})})
+	}
+	if cfg.ChampionshipID != "" {
+		probes = append(probes, driftProbe{"championships", "CHAMPIONSHIP_SVC", cfg.ChampionshipID, reflect.TypeOf(Championship{})})
+	}
+	if cfg.Token != "" {
+		probes = append(probes, driftProbe{"players", "PLAYER_SVC", "", reflect.TypeOf(playerContract{})})
+	}
+	return probes
+}
+
+// Run checks every probe each interval, the first time right away.
+func (d *driftDetector) Run(ctx context.Context, cfg DriftConfig) {
+	d.probes, d.token = newDriftProbes(cfg), cfg.Token
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		for _, p := range d.probes {
+			d.check(p)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (d *driftDetector) check(p driftProbe) {
+	r := &DriftReport{Service: p.service, CheckedAt: clock.Now(), New: []string{}, Missing: []string{}}
+	sample, err := d.fetch(p)
+	if err != nil {
+		r.Error = err.Error()
+		log.Warn().Err(err).Str("service", p.service).Msg("failed to fetch the contract sample")
+	} else {
+		expected := map[string]bool{}
+		contractFields(p.contract, "", expected)
+		observed := map[string]bool{}
+		sampleFields(sample, "", observed)
+		r.New = difference(observed, expected)
+		r.Missing = difference(expected, observed)
+		schemaDrift.WithLabelValues(p.service, "new").Set(float64(len(r.New)))
+		schemaDrift.WithLabelValues(p.service, "missing").Set(float64(len(r.Missing)))
+		if len(r.New) > 0 || len(r.Missing) > 0 {
+			log.Warn().Str("service", p.service).Strs("new", r.New).Strs("missing", r.Missing).Msg("upstream contract drifted")
+		}
+	}
+	d.mu.Lock()
+	d.reports[p.service] = r
+	d.mu.Unlock()
+}
+
+func (d *driftDetector) fetch(p driftProbe) (interface{}, error) {
+	req, err := http.NewRequest("GET", serviceURL(config.Tenancy.Default, p.env, p.id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.service == "players" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+	res, err := callService(p.service, req)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+	if !is2xx(res.StatusCode) {
+		return nil, errors.New(res.Status)
+	}
+	var sample interface{}
+	return sample, json.NewDecoder(res.Body).Decode(&sample)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// contractFields collects the JSON paths a struct decodes, nested structs
+// included; slices of structs add their element fields under "path[]".
+func contractFields(t reflect.Type, prefix string, into map[string]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		if t.Kind() == reflect.Slice {
+			prefix += "[]"
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		path := joinPath(prefix, name)
+		into[path] = true
+		contractFields(f.Type, path, into)
+	}
+}
+
+// sampleFields collects the JSON paths of a decoded answer.
+func sampleFields(v interface{}, prefix string, into map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			path := joinPath(prefix, k)
+			into[path] = true
+			sampleFields(child, path, into)
+		}
+	case []interface{}:
+		for _, child := range v {
+			sampleFields(child, prefix+"[]", into)
+		}
+	}
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// difference is the sorted paths of a missing from b. Decoding is case
+// insensitive, so the comparison is as well.
+func difference(a, b map[string]bool) []string {
+	folded := map[string]bool{}
+	for k := range b {
+		folded[strings.ToLower(k)] = true
+	}
+	r := []string{}
+	for k := range a {
+		if !folded[strings.ToLower(k)] {
+			r = append(r, k)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// GetDrift reports the last check of each upstream contract.
+func GetDrift(c echo.Context) error {
+	drift.mu.Lock()
+	defer drift.mu.Unlock()
+	r := []*DriftReport{}
+	for _, rep := range drift.reports {
+		r = append(r, rep)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Service < r[j].Service })
+	return c.JSON(http.StatusOK, r)
+}
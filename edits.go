@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// editableBet loads the bet in the path for a change by its owner or an
+// admin. Bets of other tenants are not found.
+func editableBet(c echo.Context) (*Bet, error) {
+	b, err := bets.Get(c.Param("id"))
+	if err == nil && b.Tenant != tenant(c) {
+		err = errBetNotFound
+	}
+	if err == errBetNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, ok := identity(c)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "missing or malformed credentials")
+	}
+	if !id.HasRole(config.AdminRole) && (id.Email == "" || id.Email != b.Email) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "only the owner or an admin may change the bet")
+	}
+	return b, nil
+}
+
+type betUpdate struct {
+	HomeTeamScore string `json:"homeTeamScore"`
+	AwayTeamScore string `json:"awayTeamScore"`
+	Shootout      string `json:"shootout,omitempty"`
+}
+
+// UpdateBet changes the predicted score of a bet not settled yet, within
+// the betting window and the score policy of its championship. The previous and new scores go to
+// the audit log.
+func UpdateBet(c echo.Context) error {
+	u := &betUpdate{}
+	if err := decodeBody(c, u, betUpdateMessage); err != nil {
+		return err
+	}
+	if !validScore(u.HomeTeamScore) || !validScore(u.AwayTeamScore) {
+		return echo.NewHTTPError(http.StatusBadRequest, "scores must be non-negative integers")
+	}
+	if u.Shootout != "" && u.Shootout != shootoutHome && u.Shootout != shootoutAway {
+		return echo.NewHTTPError(http.StatusBadRequest, "shootout must be home or away")
+	}
+	b, err := editableBet(c)
+	if err != nil {
+		return err
+	}
+	if b.DeletedAt != nil {
+		return echo.NewHTTPError(http.StatusConflict, "bet is deleted")
+	}
+	if b.Settlement != nil && b.Settlement.Status == SettlementSettled {
+		return echo.NewHTTPError(http.StatusConflict, "bet is already settled")
+	}
+	if err := checkMatchOpen(b.Tenant, b.MatchID); err != nil {
+		return err
+	}
+	if err := checkBetWindow(b.Tenant, b.ChampionshipID, b.Round, requestClock(c).Now()); err != nil {
+		return err
+	}
+	// the policy is not enforced while the championships are unavailable
+	if champ, _, err := championship(c, b.ChampionshipID); err == nil {
+		if err := checkScorePolicy(u.HomeTeamScore, u.AwayTeamScore, u.Shootout, champ.Policy, b.MatchInfo); err != nil {
+			return err
+		}
+	}
+	if err := quotas.take(c); err != nil {
+		return err
+	}
+	before := betUpdate{HomeTeamScore: b.HomeTeamScore, AwayTeamScore: b.AwayTeamScore, Shootout: b.Shootout}
+	b.HomeTeamScore, b.AwayTeamScore, b.Shootout = u.HomeTeamScore, u.AwayTeamScore, u.Shootout
+	if err := bets.Save(b); err != nil {
+		log.Error().Err(err).Msg("failed to store the bet")
+		return err
+	}
+	audit.record(auditActor(c), "bet.updated", b.ID, map[string]betUpdate{"before": before, "after": *u})
+	return respondOwned(c, http.StatusOK, b, b.Email)
+}
+
+// DeleteBet soft deletes a bet: it leaves listings, leaderboards and
+// settlements but is kept, with its change log, for disputes.
+func DeleteBet(c echo.Context) error {
+	b, err := editableBet(c)
+	if err != nil {
+		return err
+	}
+	if b.DeletedAt != nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	if b.AccumulatorID != "" {
+		return echo.NewHTTPError(http.StatusConflict, "the legs of an accumulator are not deleted one by one")
+	}
+	if err := checkMatchOpen(b.Tenant, b.MatchID); err != nil {
+		return err
+	}
+	now := requestClock(c).Now()
+	b.DeletedAt = &now
+	if err := bets.Save(b); err != nil {
+		log.Error().Err(err).Msg("failed to store the bet")
+		return err
+	}
+	audit.record(auditActor(c), "bet.deleted", b.ID, map[string]string{"reason": c.QueryParam("reason")})
+	return c.NoContent(http.StatusNoContent)
+}
+
+// BetChangeLog lists the audit entries of a bet, deleted or not: who
+// created, changed, settled or deleted it and when.
+func BetChangeLog(c echo.Context) error {
+	b, err := editableBet(c)
+	if err != nil {
+		return err
+	}
+	entries, err := audit.store.List(b.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Event is the envelope of every message exchanged on the bus.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	OccurredAt time.Time       `json:"occurredAt"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// EventHandler processes one event. Handlers must tolerate redelivery.
+type EventHandler func(Event) error
+
+// connectBus dials the NATS server backing the event bus.
+func connectBus(cfg EventsConfig) (*nats.Conn, error) {
+	return nats.Connect(cfg.URL,
+		nats.Name("bets"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("event bus disconnected")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Info().Msg("event bus reconnected to " + nc.ConnectedUrl())
+		}),
+	)
+}
+
+// subscribe consumes subject as part of the queue group, so replicas share
+// the load instead of each receiving every event.
+func subscribe(nc *nats.Conn, subject, group string, h EventHandler) (*nats.Subscription, error) {
+	return nc.QueueSubscribe(subject, group, func(m *nats.Msg) {
+		e := Event{}
+		if err := json.Unmarshal(m.Data, &e); err != nil {
+			log.Error().Err(err).Str("subject", subject).Msg("dropping malformed event")
+			return
+		}
+		if err := h(e); err != nil {
+			log.Error().Err(err).Str("subject", subject).Str("event", e.ID).Msg("failed to handle event")
+		}
+	})
+}
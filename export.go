@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// exportFlushRows is how many rows are buffered before flushing the
+// response, so large exports reach the client as they are read.
+const exportFlushRows = 500
+
+// tableWriter writes a spreadsheet row by row.
+type tableWriter interface {
+	Write(cells []string) error
+	Close() error
+}
+
+type csvTable struct {
+	w *csv.Writer
+}
+
+// Write neutralizes cells a spreadsheet would run as formulas.
+func (t *csvTable) Write(cells []string) error {
+	for i, c := range cells {
+		if c != "" && strings.ContainsRune("=+-@", rune(c[0])) {
+			cells[i] = "'" + c
+		}
+	}
+	return t.w.Write(cells)
+}
+
+func (t *csvTable) Close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxTable streams a single sheet workbook. Cells are inline strings, or
+// numbers when they hold a plain integer, so no shared strings table needs
+// to be kept until the end.
+type xlsxTable struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	buf   bytes.Buffer
+}
+
+func newXLSXTable(w io.Writer) (*xlsxTable, error) {
+	t := &xlsxTable{zw: zip.NewWriter(w)}
+	for _, p := range xlsxParts {
+		fw, err := t.zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(fw, p.content); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if t.sheet, err = t.zw.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(t.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return t, err
+}
+
+func (t *xlsxTable) Write(cells []string) error {
+	t.buf.Reset()
+	t.buf.WriteString("<row>")
+	for _, c := range cells {
+		if n, err := strconv.Atoi(c); err == nil && strconv.Itoa(n) == c {
+			t.buf.WriteString("<c><v>" + c + "</v></c>")
+			continue
+		}
+		t.buf.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(&t.buf, []byte(c))
+		t.buf.WriteString("</t></is></c>")
+	}
+	t.buf.WriteString("</row>")
+	_, err := t.sheet.Write(t.buf.Bytes())
+	return err
+}
+
+func (t *xlsxTable) Close() error {
+	if _, err := io.WriteString(t.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	return t.zw.Close()
+}
+
+// ndjsonTable writes one JSON object per row, keyed by the first row.
+type ndjsonTable struct {
+	w       *bufio.Writer
+	columns []string
+}
+
+func (t *ndjsonTable) Write(cells []string) error {
+	if t.columns == nil {
+		t.columns = append([]string{}, cells...)
+		return nil
+	}
+	t.w.WriteByte('{')
+	for i, c := range cells {
+		if i > 0 {
+			t.w.WriteByte(',')
+		}
+		k, _ := json.Marshal(t.columns[i])
+		v, _ := json.Marshal(c)
+		t.w.Write(k)
+		t.w.WriteByte(':')
+		t.w.Write(v)
+	}
+	t.w.WriteByte('}')
+	return t.w.WriteByte('\n')
+}
+
+func (t *ndjsonTable) Close() error {
+	return t.w.Flush()
+}
+
+// exportFormats maps the ?format= values to their content types.
+var exportFormats = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"xlsx":    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// exportFormat is the ?format= of the request, csv by default.
+func exportFormat(c echo.Context) (string, error) {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	if _, ok := exportFormats[format]; !ok {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "format must be csv, xlsx, ndjson or parquet")
+	}
+	return format, nil
+}
+
+func newTable(format string, w io.Writer) (tableWriter, error) {
+	switch format {
+	case "xlsx":
+		return newXLSXTable(w)
+	case "ndjson":
+		return &ndjsonTable{w: bufio.NewWriter(w)}, nil
+	case "parquet":
+		return newParquetTable(w)
+	}
+	return &csvTable{w: csv.NewWriter(w)}, nil
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// startExport answers 200 with the headers of a ?format= download named
+// after name, and returns the writer of its rows.
+func startExport(c echo.Context, name string) (tableWriter, error) {
+	format, err := exportFormat(c)
+	if err != nil {
+		return nil, err
+	}
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, exportFormats[format])
+	h.Set(echo.HeaderContentDisposition, `attachment; filename="`+unsafeFilename.ReplaceAllString(name, "_")+"."+format+`"`)
+	h.Set("Cache-Control", "no-store")
+	c.Response().WriteHeader(http.StatusOK)
+	return newTable(format, c.Response())
+}
+
+var betExportHeader = []string{
+	"id", "externalRef", "email", "championship", "championshipId", "round", "matchId", "match", "matchDate",
+	"homeTeamScore", "awayTeamScore", "createdAt", "settlement", "result", "points", "stake", "shootout",
+}
+
+// betExportFilter filters the exported bets like the bet listings, by
+// ?round=, ?matchId=, ?email=, ?from= and ?to=.
+func betExportFilter(c echo.Context) (BetFilter, error) {
+	f := BetFilter{
+		Tenant:         tenant(c),
+		ChampionshipID: c.Param("id"),
+		Round:          c.QueryParam("round"),
+		MatchID:        c.QueryParam("matchId"),
+		Email:          c.QueryParam("email"),
+	}
+	return f, parseDateRange(c, &f)
+}
+
+// ExportBets downloads the bets of a championship as a spreadsheet or data
+// file. Bets are streamed from the storage as they are written, and fields
+// are redacted for the caller's audience.
+func ExportBets(c echo.Context) error {
+	f, err := betExportFilter(c)
+	if err != nil {
+		return err
+	}
+	aud, _ := callerAudience(c, config.AdminRole)
+	t, err := startExport(c, f.ChampionshipID+"-bets")
+	if err != nil {
+		return err
+	}
+	err = writeBets(t, f, aud, c.Response().Flush)
+	if err == nil {
+		err = t.Close()
+	}
+	if err != nil {
+		// the status is sent already; the client sees a truncated file
+		log.Error().Err(err).Str("championship", f.ChampionshipID).Msg("failed to export bets")
+	}
+	return nil
+}
+
+// StoredExport is an export written to the blob store by a job, to be
+// downloaded once the job succeeded.
+type StoredExport struct {
+	Job      Job    `json:"job"`
+	Location string `json:"location"`
+}
+
+// exportKey keeps the exports of each tenant apart in the blob store.
+func exportKey(tenant, name string) string {
+	return "exports/" + tenant + "/" + name
+}
+
+// QueueBetExport writes the bets export to the blob store in the
+// background, for championships too large to download in one request. The
+// rows are piped to the store as they are read, nothing is buffered whole.
+func QueueBetExport(c echo.Context) error {
+	f, err := betExportFilter(c)
+	if err != nil {
+		return err
+	}
+	format, err := exportFormat(c)
+	if err != nil {
+		return err
+	}
+	aud, _ := callerAudience(c, config.AdminRole)
+	name := unsafeFilename.ReplaceAllString(f.ChampionshipID, "_") + "-bets-" + newID() + "." + format
+	j := jobs.Enqueue("bets-export", 3, func(ctx context.Context) error {
+		pr, pw := io.Pipe()
+		go func() {
+			t, err := newTable(format, pw)
+			if err == nil {
+				err = writeBets(t, f, aud, func() {})
+			}
+			if err == nil {
+				err = t.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		err := blobs.Put(exportKey(f.Tenant, name), pr)
+		pr.CloseWithError(err)
+		return err
+	})
+	prefix := c.Path()[:strings.Index(c.Path(), "/championships/")]
+	return c.JSON(http.StatusAccepted, &StoredExport{Job: j, Location: link(prefix + "/exports/" + name)})
+}
+
+// GetExport downloads an export written by QueueBetExport.
+func GetExport(c echo.Context) error {
+	name := c.Param("name")
+	contentType, ok := exportFormats[strings.TrimPrefix(path.Ext(name), ".")]
+	if !ok {
+		return echo.ErrNotFound
+	}
+	r, err := blobs.Get(exportKey(tenant(c), name))
+	if err == errBlobNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "export not found, or not written yet")
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+name+`"`)
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Stream(http.StatusOK, contentType, r)
+}
+
+// writeBets writes the header and the bets matching f, calling flush every
+// exportFlushRows rows.
+func writeBets(t tableWriter, f BetFilter, aud Audience, flush func()) error {
+	if err := t.Write(betExportHeader); err != nil {
+		return err
+	}
+	rows := 0
+	return bets.Each(f, func(b *Bet) error {
+		matchDate := ""
+		if b.MatchInfo != nil {
+			matchDate = b.MatchInfo.Date.Format(time.RFC3339)
+		}
+		s := b.Settlement
+		if s == nil {
+			s = &Settlement{Status: SettlementPending}
+		}
+		err := t.Write([]string{
+			b.ID,
+			b.ExternalRef,
+			redactField(aud, "email", b.Email),
+			b.Championship,
+			b.ChampionshipID,
+			b.Round,
+			b.MatchID,
+			b.Match,
+			matchDate,
+			b.HomeTeamScore,
+			b.AwayTeamScore,
+			b.CreatedAt.Format(time.RFC3339),
+			string(s.Status),
+			s.Result,
+			strconv.Itoa(s.Points),
+			strconv.FormatInt(b.Stake, 10),
+			b.Shootout,
+		})
+		if rows++; err == nil && rows%exportFlushRows == 0 {
+			flush()
+		}
+		return err
+	})
+}
+
+// ExportLeaderboard downloads the leaderboard of a championship, or of
+// a ?round=, as a spreadsheet.
+func ExportLeaderboard(c echo.Context) error {
+	lb, err := leaderboard(BetFilter{Tenant: tenant(c), ChampionshipID: c.Param("id"), Round: c.QueryParam("round")})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to compute the leaderboard")
+		return err
+	}
+	aud, _ := callerAudience(c, config.AdminRole)
+	name := lb.Championship + "-leaderboard"
+	if lb.Round != "" {
+		name += "-round-" + lb.Round
+	}
+	t, err := startExport(c, name)
+	if err != nil {
+		return err
+	}
+	err = t.Write([]string{"position", "email", "points", "bets", "exactScores"})
+	for _, e := range lb.Entries {
+		if err != nil {
+			break
+		}
+		err = t.Write([]string{
+			strconv.Itoa(e.Position),
+			redactField(aud, "email", e.Email),
+			strconv.Itoa(e.Points),
+			strconv.Itoa(e.Bets),
+			strconv.Itoa(e.ExactScores),
+		})
+	}
+	if err == nil {
+		err = t.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("championship", lb.Championship).Msg("failed to export the leaderboard")
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// The features rolled out behind flags, all enabled by default.
+const (
+	// flagSettlement scores the bets of the tenant when matches settle;
+	// bets skipped stay pending until a settlement with the flag on.
+	flagSettlement = "settlement"
+	// flagEvents publishes the tenant's bet.created events on the bus.
+	flagEvents = "events"
+)
+
+var knownFlags = []string{flagSettlement, flagEvents}
+
+// Flag turns a feature on for Rollout percent of the tenants, picked by a
+// stable hash so a tenant keeps its side as the percentage grows, and
+// always for the listed Tenants, even when disabled.
+type Flag struct {
+	Enabled bool     `json:"enabled"`
+	Rollout int      `json:"rollout"`
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+func (f Flag) enabled(name, tenant string) bool {
+	for _, t := range f.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	if !f.Enabled {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + tenant))
+	return int(h.Sum32()%100) < f.Rollout
+}
+
+// FlagsConfig sets the flags: Env holds the FEATURE_FLAGS entries, as
+// "name=true", "name=false" or "name=25%"; File, when set, is a JSON object
+// of flags by name, read again every Poll when it changed, e.g. as a
+// mounted ConfigMap.
+type FlagsConfig struct {
+	Env  []string
+	File string
+	Poll time.Duration
+}
+
+// FlagState is a flag as in effect, and where it was set: "default",
+// "env", "file" or "admin".
+type FlagState struct {
+	Name      string    `json:"name"`
+	Flag      Flag      `json:"flag"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// featureFlags layers the flags of each source, the admin overrides set
+// through the API over the file over the environment.
+type featureFlags struct {
+	cfg      FlagsConfig
+	mu       sync.RWMutex
+	sources  map[string]map[string]Flag
+	state    map[string]FlagState
+	modified time.Time
+}
+
+var flagSources = []string{"admin", "file", "env"}
+
+var features = newFeatureFlags(FlagsConfig{})
+
+func newFeatureFlags(cfg FlagsConfig) *featureFlags {
+	f := &featureFlags{cfg: cfg, sources: map[string]map[string]Flag{}, state: map[string]FlagState{}}
+	for _, name := range knownFlags {
+		f.state[name] = FlagState{Name: name, Flag: Flag{Enabled: true, Rollout: 100}, Source: "default"}
+	}
+	f.set("env", parseEnvFlags(cfg.Env))
+	f.reload()
+	return f
+}
+
+func parseEnvFlags(entries []string) map[string]Flag {
+	flags := map[string]Flag{}
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		name, v := strings.TrimSpace(kv[0]), "true"
+		if len(kv) == 2 {
+			v = strings.TrimSpace(kv[1])
+		}
+		if strings.HasSuffix(v, "%") {
+			n, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+			if err != nil || n < 0 || n > 100 {
+				log.Warn().Str("flag", name).Msg("ignoring invalid flag rollout " + v)
+				continue
+			}
+			flags[name] = Flag{Enabled: true, Rollout: n}
+			continue
+		}
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Warn().Str("flag", name).Msg("ignoring invalid flag value " + v)
+			continue
+		}
+		flags[name] = Flag{Enabled: on, Rollout: 100}
+	}
+	return flags
+}
+
+// decodeFlags reads flags by name; a flag without rollout is enabled for
+// every tenant.
+func decodeFlags(b []byte) (map[string]Flag, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	flags := map[string]Flag{}
+	for name, r := range raw {
+		f := Flag{Rollout: 100}
+		if err := json.Unmarshal(r, &f); err != nil {
+			return nil, err
+		}
+		flags[name] = f
+	}
+	return flags, nil
+}
+
+// enabled tells whether the feature is on for the tenant.
+func (f *featureFlags) enabled(name, tenant string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	s, ok := f.state[name]
+	return !ok || s.Flag.enabled(name, tenant)
+}
+
+// set replaces the flags of a source and logs every flag whose effective
+// state changed.
+func (f *featureFlags) set(source string, flags map[string]Flag) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setLocked(source, flags)
+}
+
+func (f *featureFlags) setLocked(source string, flags map[string]Flag) {
+	f.sources[source] = flags
+	for _, name := range knownFlags {
+		next := FlagState{Name: name, Flag: Flag{Enabled: true, Rollout: 100}, Source: "default"}
+		for _, src := range flagSources {
+			if flag, ok := f.sources[src][name]; ok {
+				next.Flag, next.Source = flag, src
+				break
+			}
+		}
+		prev := f.state[name]
+		if prev.Source == next.Source && flagEqual(prev.Flag, next.Flag) {
+			continue
+		}
+		next.UpdatedAt = time.Now()
+		f.state[name] = next
+		log.Info().Str("flag", name).Str("source", next.Source).Bool("enabled", next.Flag.Enabled).
+			Int("rollout", next.Flag.Rollout).Strs("tenants", next.Flag.Tenants).Msg("feature flag changed")
+	}
+	for name := range flags {
+		if _, ok := f.state[name]; !ok {
+			log.Warn().Str("flag", name).Str("source", source).Msg("ignoring unknown feature flag")
+		}
+	}
+}
+
+func flagEqual(a, b Flag) bool {
+	if a.Enabled != b.Enabled || a.Rollout != b.Rollout || len(a.Tenants) != len(b.Tenants) {
+		return false
+	}
+	for i := range a.Tenants {
+		if a.Tenants[i] != b.Tenants[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reload reads the flags file when it changed since it was last read. A
+// file that can't be read or parsed leaves the flags as they were.
+func (f *featureFlags) reload() {
+	if f.cfg.File == "" {
+		return
+	}
+	info, err := os.Stat(f.cfg.File)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the feature flags file")
+		return
+	}
+	if info.ModTime().Equal(f.modified) {
+		return
+	}
+	b, err := ioutil.ReadFile(f.cfg.File)
+	var flags map[string]Flag
+	if err == nil {
+		flags, err = decodeFlags(b)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the feature flags file")
+		return
+	}
+	f.modified = info.ModTime()
+	f.set("file", flags)
+}
+
+// Run watches the flags file.
+func (f *featureFlags) Run(ctx context.Context) {
+	t := time.NewTicker(f.cfg.Poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.reload()
+		}
+	}
+}
+
+func (f *featureFlags) list() []FlagState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	list := make([]FlagState, 0, len(f.state))
+	for _, s := range f.state {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// override sets, or with nil drops, the admin override of a flag.
+func (f *featureFlags) override(name string, flag *Flag) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	admin := map[string]Flag{}
+	for n, fl := range f.sources["admin"] {
+		admin[n] = fl
+	}
+	if flag == nil {
+		delete(admin, name)
+	} else {
+		admin[name] = *flag
+	}
+	f.setLocked("admin", admin)
+}
+
+var errFlagNotFound = echo.NewHTTPError(http.StatusNotFound, "unknown feature flag")
+
+func knownFlag(name string) bool {
+	for _, n := range knownFlags {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func ListFlags(c echo.Context) error {
+	return c.JSON(http.StatusOK, features.list())
+}
+
+// PutFlag overrides a flag on this replica until it restarts or the
+// override is deleted, whatever the environment and the file say.
+func PutFlag(c echo.Context) error {
+	name := c.Param("name")
+	if !knownFlag(name) {
+		return errFlagNotFound
+	}
+	flag := Flag{Rollout: 100}
+	if err := decodeJSON(c, &flag); err != nil {
+		return err
+	}
+	if flag.Rollout < 0 || flag.Rollout > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "rollout is a percentage")
+	}
+	features.override(name, &flag)
+	return ListFlags(c)
+}
+
+// DeleteFlag drops the override of a flag, back to its file or
+// environment setting.
+func DeleteFlag(c echo.Context) error {
+	name := c.Param("name")
+	if !knownFlag(name) {
+		return errFlagNotFound
+	}
+	features.override(name, nil)
+	return ListFlags(c)
+}
@@ -3,12 +3,21 @@ module championships
 go 1.13
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/99designs/gqlgen v0.14.0
+	github.com/andybalholm/brotli v1.0.6
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.3.0 // indirect
+	github.com/lib/pq v1.10.9
 	github.com/motemen/go-loghttp v0.0.0-20170804080138-974ac5ceac27
 	github.com/motemen/go-nuts v0.0.0-20190725124253-1d2432db96b0 // indirect
+	github.com/nats-io/nats.go v1.10.0
+	github.com/prometheus/client_golang v1.9.0
 	github.com/rs/zerolog v1.18.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.5.1 // indirect
 	github.com/valyala/fasttemplate v1.1.0 // indirect
+	github.com/vektah/gqlparser/v2 v2.2.0
+	go.mongodb.org/mongo-driver v1.12.2
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 )
@@ -0,0 +1,44 @@
+// Package graph is the GraphQL schema of the bets API, generated by gqlgen
+// from assets/api-docs/bets.graphql; the resolvers are in package main.
+package graph
+
+import "time"
+
+// Bet carries the keys of its player, match and championship, which are
+// resolved on demand.
+type Bet struct {
+	ID             string      `json:"id"`
+	ExternalRef    *string     `json:"externalRef"`
+	HomeTeamScore  string      `json:"homeTeamScore"`
+	AwayTeamScore  string      `json:"awayTeamScore"`
+	Stake          *int        `json:"stake"`
+	Shootout       *string     `json:"shootout"`
+	Round          *string     `json:"round"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	UpdatedAt      time.Time   `json:"updatedAt"`
+	Settlement     *Settlement `json:"settlement"`
+	Email          string      `json:"-"`
+	MatchID        string      `json:"-"`
+	ChampionshipID string      `json:"-"`
+}
+
+type Player struct {
+	Email string `json:"email"`
+}
+
+// Championship carries the currency of its stakes for its pot.
+type Championship struct {
+	ID       string   `json:"id"`
+	Title    string   `json:"title"`
+	Rounds   []string `json:"rounds"`
+	Currency string   `json:"-"`
+}
+
+type Entry struct {
+	Position    int    `json:"position"`
+	Points      int    `json:"points"`
+	Bets        int    `json:"bets"`
+	ExactScores int    `json:"exactScores"`
+	Bonus       int    `json:"bonus"`
+	Email       string `json:"-"`
+}
@@ -0,0 +1,56 @@
+// Code generated by github.com/99designs/gqlgen, DO NOT EDIT.
+
+package graph
+
+import (
+	"time"
+)
+
+type Leaderboard struct {
+	Championship string   `json:"championship"`
+	Round        *string  `json:"round"`
+	Entries      []*Entry `json:"entries"`
+}
+
+type Match struct {
+	ID       string    `json:"id"`
+	Date     time.Time `json:"date"`
+	Round    *string   `json:"round"`
+	Status   *string   `json:"status"`
+	HomeTeam *Team     `json:"homeTeam"`
+	AwayTeam *Team     `json:"awayTeam"`
+}
+
+type MatchPot struct {
+	Match string `json:"match"`
+	Total int    `json:"total"`
+	Bets  int    `json:"bets"`
+}
+
+type PlayerStats struct {
+	Bets          int `json:"bets"`
+	Settled       int `json:"settled"`
+	Points        int `json:"points"`
+	ExactScores   int `json:"exactScores"`
+	Championships int `json:"championships"`
+}
+
+// What the bets of a championship staked, in all and per match.
+type Pot struct {
+	Currency *string     `json:"currency"`
+	Total    int         `json:"total"`
+	Bets     int         `json:"bets"`
+	Matches  []*MatchPot `json:"matches"`
+}
+
+type Settlement struct {
+	Status    string     `json:"status"`
+	Result    *string    `json:"result"`
+	Points    int        `json:"points"`
+	SettledAt *time.Time `json:"settledAt"`
+}
+
+type Team struct {
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"championships/graph"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/labstack/echo"
+)
+
+// batchWait is how long a loader gathers keys after the first one, for
+// the resolvers running alongside to ask for theirs.
+const batchWait = 2 * time.Millisecond
+
+// graphFetches caps the concurrent downstream calls of a batch.
+const graphFetches = 8
+
+type loadResult struct {
+	value interface{}
+	err   error
+}
+
+type loaderBatch struct {
+	keys    []string
+	done    chan struct{}
+	results map[string]loadResult
+}
+
+// batchLoader loads the keys the resolvers of a request ask for in
+// batches, each key once.
+type batchLoader struct {
+	fetch   func(keys []string) map[string]loadResult
+	mu      sync.Mutex
+	batches map[string]*loaderBatch
+	pending *loaderBatch
+}
+
+func newBatchLoader(fetch func(keys []string) map[string]loadResult) *batchLoader {
+	return &batchLoader{fetch: fetch, batches: map[string]*loaderBatch{}}
+}
+
+func (l *batchLoader) load(key string) (interface{}, error) {
+	l.mu.Lock()
+	b, ok := l.batches[key]
+	if !ok {
+		if l.pending == nil {
+			l.pending = &loaderBatch{done: make(chan struct{})}
+			time.AfterFunc(batchWait, l.flush)
+		}
+		b = l.pending
+		b.keys = append(b.keys, key)
+		l.batches[key] = b
+	}
+	l.mu.Unlock()
+	<-b.done
+	r := b.results[key]
+	return r.value, r.err
+}
+
+func (l *batchLoader) flush() {
+	l.mu.Lock()
+	b := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	b.results = l.fetch(b.keys)
+	close(b.done)
+}
+
+// fetchEach loads the keys from a downstream service, which has no batch
+// call, concurrently.
+func fetchEach(keys []string, fetch func(key string) (interface{}, error)) map[string]loadResult {
+	results := make(map[string]loadResult, len(keys))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, graphFetches)
+	for _, key := range keys {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			v, err := fetch(key)
+			mu.Lock()
+			results[key] = loadResult{v, err}
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return results
+}
+
+// graphRequest is what the resolvers of a GraphQL request share: its echo
+// context, for the tenant and the forwarded headers, and its loaders.
+type graphRequest struct {
+	c             echo.Context
+	matches       *batchLoader
+	championships *batchLoader
+	playerBets    *batchLoader
+}
+
+type graphKey struct{}
+
+func newGraphRequest(c echo.Context) *graphRequest {
+	r := &graphRequest{c: c}
+	r.matches = newBatchLoader(func(ids []string) map[string]loadResult {
+		return fetchEach(ids, func(id string) (interface{}, error) {
+			m, status, err := fetchMatch(c, serviceURL(tenant(c), "MATCH_SVC", id))
+			if status == http.StatusNotFound {
+				return (*Match)(nil), nil
+			}
+			return m, err
+		})
+	})
+	r.championships = newBatchLoader(func(ids []string) map[string]loadResult {
+		return fetchEach(ids, func(id string) (interface{}, error) {
+			ch, status, err := championship(c, id)
+			if status == http.StatusNotFound {
+				return (*Championship)(nil), nil
+			}
+			return ch, err
+		})
+	})
+	r.playerBets = newBatchLoader(func(emails []string) map[string]loadResult {
+		results := make(map[string]loadResult, len(emails))
+		list, err := bets.List(BetFilter{Tenant: tenant(c), Emails: emails})
+		byEmail := map[string][]*Bet{}
+		for _, b := range list {
+			byEmail[b.Email] = append(byEmail[b.Email], b)
+		}
+		for _, e := range emails {
+			results[e] = loadResult{byEmail[e], err}
+		}
+		return results
+	})
+	return r
+}
+
+func requestOf(ctx context.Context) *graphRequest {
+	return ctx.Value(graphKey{}).(*graphRequest)
+}
+
+// GraphQL serves the schema of the graph package. Each request batches
+// the match, championship and player bet lookups of its resolvers, and
+// its data is redacted as respond would.
+func GraphQL() echo.HandlerFunc {
+	srv := handler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: &graphResolver{}}))
+	// nested players and bets would otherwise be unbounded
+	srv.Use(extension.FixedComplexityLimit(config.GraphQLComplexity))
+	srv.AroundResponses(func(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+		res := next(ctx)
+		if res != nil && res.Data != nil {
+			if err := redactGraph(requestOf(ctx).c, res); err != nil {
+				return graphql.ErrorResponse(ctx, "failed to render the response")
+			}
+		}
+		return res
+	})
+	return func(c echo.Context) error {
+		ctx := context.WithValue(c.Request().Context(), graphKey{}, newGraphRequest(c))
+		srv.ServeHTTP(c.Response(), c.Request().WithContext(ctx))
+		return nil
+	}
+}
+
+func redactGraph(c echo.Context, res *graphql.Response) error {
+	aud, email := callerAudience(c, config.AdminRole)
+	if len(config.Redaction[aud]) == 0 && len(config.Redaction[AudienceSelf]) == 0 {
+		return nil
+	}
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(res.Data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return err
+	}
+	redact(doc, aud, email, config.Redaction)
+	b, err := json.Marshal(doc)
+	res.Data = b
+	return err
+}
+
+type graphResolver struct{}
+
+func (r *graphResolver) Query() graph.QueryResolver               { return &queryResolver{} }
+func (r *graphResolver) Bet() graph.BetResolver                   { return &betResolver{} }
+func (r *graphResolver) Player() graph.PlayerResolver             { return &playerResolver{} }
+func (r *graphResolver) Championship() graph.ChampionshipResolver { return &championshipResolver{} }
+func (r *graphResolver) Entry() graph.EntryResolver               { return &entryResolver{} }
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func graphBet(b *Bet) *graph.Bet {
+	g := &graph.Bet{
+		ID: b.ID, ExternalRef: optional(b.ExternalRef), HomeTeamScore: b.HomeTeamScore, AwayTeamScore: b.AwayTeamScore,
+		Round: optional(b.Round), Shootout: optional(b.Shootout), CreatedAt: b.CreatedAt, UpdatedAt: b.UpdatedAt,
+		Email: b.Email, MatchID: b.MatchID, ChampionshipID: b.ChampionshipID,
+	}
+	if b.Stake > 0 {
+		stake := int(b.Stake)
+		g.Stake = &stake
+	}
+	if s := b.Settlement; s != nil {
+		g.Settlement = &graph.Settlement{Status: string(s.Status), Result: optional(s.Result), Points: s.Points, SettledAt: s.SettledAt}
+	}
+	return g
+}
+
+func graphBets(list []*Bet) []*graph.Bet {
+	r := make([]*graph.Bet, len(list))
+	for i, b := range list {
+		r[i] = graphBet(b)
+	}
+	return r
+}
+
+func graphMatch(m *Match, id string) *graph.Match {
+	if m == nil {
+		return nil
+	}
+	if m.ID != "" {
+		id = m.ID
+	}
+	return &graph.Match{
+		ID: id, Date: m.Date, Round: optional(m.Round), Status: optional(m.Status),
+		HomeTeam: &graph.Team{Name: m.Teams.Home.Name, Score: m.Teams.Home.Score},
+		AwayTeam: &graph.Team{Name: m.Teams.Away.Name, Score: m.Teams.Away.Score},
+	}
+}
+
+func graphChampionship(ch *Championship) *graph.Championship {
+	if ch == nil {
+		return nil
+	}
+	rounds := ch.Rounds
+	if rounds == nil {
+		rounds = []string{}
+	}
+	g := &graph.Championship{ID: ch.ID, Title: ch.Title, Rounds: rounds}
+	if ch.Stakes != nil {
+		g.Currency = ch.Stakes.Currency
+	}
+	return g
+}
+
+func graphLeaderboard(c echo.Context, championship string, round *string) (*graph.Leaderboard, error) {
+	lb, err := leaderboard(BetFilter{Tenant: tenant(c), ChampionshipID: championship, Round: deref(round)})
+	if err != nil {
+		return nil, err
+	}
+	g := &graph.Leaderboard{Championship: lb.Championship, Round: round, Entries: make([]*graph.Entry, len(lb.Entries))}
+	for i, e := range lb.Entries {
+		g.Entries[i] = &graph.Entry{Position: e.Position, Points: e.Points, Bets: e.Bets, ExactScores: e.ExactScores, Bonus: e.Bonus, Email: e.Email}
+	}
+	return g, nil
+}
+
+type queryResolver struct{}
+
+// Limits of the bets query.
+const (
+	graphBetsLimit    = 100
+	graphBetsMaxLimit = 1000
+)
+
+// errGraphBetsFilter is a bets query for the whole tenant by a caller other
+// than an admin, who has the exports for that.
+var errGraphBetsFilter = errors.New("bets needs a championship, match, round or email, unless asked by an admin")
+
+func (q *queryResolver) Bets(ctx context.Context, championship, match, round, email *string, limit *int) ([]*graph.Bet, error) {
+	c := requestOf(ctx).c
+	f := BetFilter{Tenant: tenant(c), ChampionshipID: deref(championship), MatchID: deref(match), Round: deref(round), Email: deref(email)}
+	if f.ChampionshipID == "" && f.MatchID == "" && f.Round == "" && f.Email == "" {
+		if id, ok := identity(c); !ok || !id.HasRole(config.AdminRole) {
+			return nil, errGraphBetsFilter
+		}
+	}
+	n := graphBetsLimit
+	if limit != nil {
+		n = *limit
+	}
+	if n < 1 || n > graphBetsMaxLimit {
+		return nil, errors.New("limit must be between 1 and " + strconv.Itoa(graphBetsMaxLimit))
+	}
+	list, err := bets.List(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > n {
+		list = list[:n]
+	}
+	return graphBets(list), nil
+}
+
+func (q *queryResolver) Bet(ctx context.Context, id string) (*graph.Bet, error) {
+	b, err := bets.Get(id)
+	if err == errBetNotFound || (err == nil && (b.Tenant != tenant(requestOf(ctx).c) || b.DeletedAt != nil)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return graphBet(b), nil
+}
+
+func (q *queryResolver) Player(ctx context.Context, email string) (*graph.Player, error) {
+	return &graph.Player{Email: email}, nil
+}
+
+func (q *queryResolver) Match(ctx context.Context, id string) (*graph.Match, error) {
+	m, err := requestOf(ctx).matches.load(id)
+	if err != nil {
+		return nil, err
+	}
+	return graphMatch(m.(*Match), id), nil
+}
+
+func (q *queryResolver) Championship(ctx context.Context, id string) (*graph.Championship, error) {
+	ch, err := requestOf(ctx).championships.load(id)
+	if err != nil {
+		return nil, err
+	}
+	return graphChampionship(ch.(*Championship)), nil
+}
+
+func (q *queryResolver) Leaderboard(ctx context.Context, championship string, round *string) (*graph.Leaderboard, error) {
+	return graphLeaderboard(requestOf(ctx).c, championship, round)
+}
+
+type betResolver struct{}
+
+func (r *betResolver) Player(ctx context.Context, b *graph.Bet) (*graph.Player, error) {
+	return &graph.Player{Email: b.Email}, nil
+}
+
+func (r *betResolver) Match(ctx context.Context, b *graph.Bet) (*graph.Match, error) {
+	if b.MatchID == "" {
+		return nil, nil
+	}
+	return (&queryResolver{}).Match(ctx, b.MatchID)
+}
+
+func (r *betResolver) Championship(ctx context.Context, b *graph.Bet) (*graph.Championship, error) {
+	if b.ChampionshipID == "" {
+		return nil, nil
+	}
+	return (&queryResolver{}).Championship(ctx, b.ChampionshipID)
+}
+
+type playerResolver struct{}
+
+func (r *playerResolver) Name(ctx context.Context, p *graph.Player) (*string, error) {
+	profile, err := players.Get(tenant(requestOf(ctx).c), playerKey(p.Email))
+	if err != nil || profile == nil {
+		return nil, err
+	}
+	return optional(profile.Name), nil
+}
+
+func (r *playerResolver) bets(ctx context.Context, p *graph.Player) ([]*Bet, error) {
+	list, err := requestOf(ctx).playerBets.load(p.Email)
+	if err != nil {
+		return nil, err
+	}
+	return list.([]*Bet), nil
+}
+
+func (r *playerResolver) Bets(ctx context.Context, p *graph.Player, championship *string) ([]*graph.Bet, error) {
+	list, err := r.bets(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []*graph.Bet{}
+	for _, b := range list {
+		if championship == nil || b.ChampionshipID == *championship {
+			filtered = append(filtered, graphBet(b))
+		}
+	}
+	return filtered, nil
+}
+
+func (r *playerResolver) Stats(ctx context.Context, p *graph.Player) (*graph.PlayerStats, error) {
+	list, err := r.bets(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	s := playerStats(list)
+	return &graph.PlayerStats{Bets: s.Bets, Settled: s.Settled, Points: s.Points, ExactScores: s.ExactScores, Championships: s.Championships}, nil
+}
+
+type championshipResolver struct{}
+
+func (r *championshipResolver) Leaderboard(ctx context.Context, ch *graph.Championship, round *string) (*graph.Leaderboard, error) {
+	return graphLeaderboard(requestOf(ctx).c, ch.ID, round)
+}
+
+func (r *championshipResolver) Pot(ctx context.Context, ch *graph.Championship) (*graph.Pot, error) {
+	a, err := bets.Aggregate(BetFilter{Tenant: tenant(requestOf(ctx).c), ChampionshipID: ch.ID})
+	if err != nil {
+		return nil, err
+	}
+	p := championshipPot(ch.ID, a)
+	g := &graph.Pot{Currency: optional(ch.Currency), Total: int(p.Total), Bets: p.Bets, Matches: make([]*graph.MatchPot, len(p.Matches))}
+	for i, m := range p.Matches {
+		g.Matches[i] = &graph.MatchPot{Match: m.MatchID, Total: int(m.Total), Bets: m.Bets}
+	}
+	return g, nil
+}
+
+type entryResolver struct{}
+
+func (r *entryResolver) Player(ctx context.Context, e *graph.Entry) (*graph.Player, error) {
+	return &graph.Player{Email: e.Email}, nil
+}
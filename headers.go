@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultForwardHeaders are the incoming headers passed on to the
+// services: the caller's credentials and API version, and the B3, W3C
+// and OpenTracing propagation headers.
+var defaultForwardHeaders = []string{
+	"Authorization",
+	"x-version",
+
+	"x-request-id",
+	"x-b3-traceid",
+	"x-b3-spanid",
+	"x-b3-parentspanid",
+	"x-b3-sampled",
+	"x-b3-flags",
+	"b3",
+	"traceparent",
+	"tracestate",
+	"x-ot-span-context",
+}
+
+// headerAllowlist matches header names case-insensitively, either exactly,
+// with "*" standing for any run of characters, as in "x-custom-*", or,
+// when surrounded by slashes, as in "/^x-(foo|bar)-id$/", against a
+// regular expression.
+type headerAllowlist struct {
+	names    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// forwarded is replaced by the configured allowlist on startup.
+var forwarded, _ = newHeaderAllowlist(defaultForwardHeaders)
+
+func newHeaderAllowlist(entries []string) (*headerAllowlist, error) {
+	l := &headerAllowlist{names: map[string]bool{}}
+	for _, e := range entries {
+		var expr string
+		switch {
+		case len(e) > 2 && strings.HasPrefix(e, "/") && strings.HasSuffix(e, "/"):
+			expr = e[1 : len(e)-1]
+		case strings.Contains(e, "*"):
+			parts := strings.Split(e, "*")
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(p)
+			}
+			expr = "^" + strings.Join(parts, ".*") + "$"
+		default:
+			l.names[http.CanonicalHeaderKey(e)] = true
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, errors.New("invalid forwarded header pattern " + e + ": " + err.Error())
+		}
+		l.patterns = append(l.patterns, re)
+	}
+	return l, nil
+}
+
+// allows expects a canonical header name, as the keys of http.Header are.
+func (l *headerAllowlist) allows(name string) bool {
+	if l.names[name] {
+		return true
+	}
+	for _, re := range l.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// copy sets the allowed headers of from on to, values and all.
+func (l *headerAllowlist) copy(from, to http.Header) {
+	for name, values := range from {
+		if len(values) > 0 && l.allows(name) {
+			to[name] = append([]string(nil), values...)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HedgeConfig sends a second, identical GET to the listed services when
+// the first hasn't answered after Delay; a zero delay disables hedging.
+type HedgeConfig struct {
+	Delay    time.Duration
+	Services []string
+}
+
+func hedged(service string) bool {
+	if config.Hedge.Delay <= 0 {
+		return false
+	}
+	for _, s := range config.Hedge.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+type hedgeResult struct {
+	attempt int
+	res     *http.Response
+	err     error
+}
+
+// hedgedDo sends req, and a hedge after the delay when the first attempt
+// is still pending. The first successful answer wins and the other attempt
+// is canceled; when both fail, the last error is returned. Only GETs are
+// hedged, since they are safe to send twice.
+func hedgedDo(service string, req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || !hedged(service) {
+		return client.Do(req)
+	}
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := client.Do(req.Clone(ctx))
+			results <- hedgeResult{attempt: attempt, res: res, err: err}
+		}()
+	}
+	send()
+	pending := 1
+	timer := time.NewTimer(config.Hedge.Delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			hedgesSent.WithLabelValues(service).Inc()
+			pending++
+			send()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				cancels[r.attempt]()
+				if pending > 0 {
+					continue
+				}
+				return nil, r.err
+			}
+			if r.attempt > 0 {
+				hedgesWon.WithLabelValues(service).Inc()
+			}
+			for i, cancel := range cancels {
+				if i != r.attempt {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go discard(results)
+			}
+			// the winner's context lives until its body is read
+			r.res.Body = &cancelOnClose{ReadCloser: r.res.Body, cancel: cancels[r.attempt]}
+			return r.res, nil
+		}
+	}
+}
+
+// discard closes the answer of the canceled attempt, should it have
+// arrived anyway.
+func discard(results chan hedgeResult) {
+	if r := <-results; r.res != nil {
+		r.res.Body.Close()
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type PlayerBets struct {
+	Email  string `json:"email"`
+	Points int    `json:"points"`
+	Bets   []*Bet `json:"bets"`
+}
+
+// PlayerBetHistory lists the bets of the player in the path.
+func PlayerBetHistory(c echo.Context) error {
+	return betHistory(c, c.Param("email"))
+}
+
+// MyBetHistory lists the bets of the authenticated caller.
+func MyBetHistory(c echo.Context) error {
+	id, ok := identity(c)
+	if !ok || id.Email == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "token carries no email")
+	}
+	return betHistory(c, id.Email)
+}
+
+func betHistory(c echo.Context, email string) error {
+	f := BetFilter{Tenant: tenant(c), Email: email, Championship: c.QueryParam("championship"), Round: c.QueryParam("round")}
+	if err := parseDateRange(c, &f); err != nil {
+		return err
+	}
+	list, err := bets.List(f)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list bets")
+		return err
+	}
+	r := &PlayerBets{Email: email, Bets: list}
+	for _, b := range list {
+		if b.Settlement != nil {
+			r.Points += b.Settlement.Points
+		}
+	}
+	return respond(c, http.StatusOK, r)
+}
+
+// GetBet returns a bet of the caller's tenant, rendered for the caller's
+// audience like the listings, which don't show deleted bets either.
+func GetBet(c echo.Context) error {
+	b, err := bets.Get(c.Param("id"))
+	if err == nil && (b.Tenant != tenant(c) || b.DeletedAt != nil) {
+		err = errBetNotFound
+	}
+	if err == errBetNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, b)
+}
+
+// FindBets looks up the caller tenant's bets by the integrator's
+// ?externalRef=.
+func FindBets(c echo.Context) error {
+	ref := c.QueryParam("externalRef")
+	if ref == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "externalRef is required")
+	}
+	list, err := bets.List(BetFilter{Tenant: tenant(c), ExternalRef: ref})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list bets")
+		return err
+	}
+	return respond(c, http.StatusOK, list)
+}
+
+// parseDateRange reads the ?from= and ?to= match dates into the filter.
+func parseDateRange(c echo.Context, f *BetFilter) error {
+	var err error
+	if f.From, err = parseDate(c.QueryParam("from")); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid from date")
+	}
+	if f.To, err = parseDate(c.QueryParam("to")); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid to date")
+	}
+	if len(c.QueryParam("to")) == len("2006-01-02") {
+		// a plain date includes the whole day
+		f.To = f.To.Add(24*time.Hour - time.Nanosecond)
+	}
+	return nil
+}
+
+// parseDate accepts RFC 3339 timestamps or plain dates; empty is the zero
+// time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
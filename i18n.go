@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Locale is a language the API answers in: its error messages, and how
+// the matches of the bets it returns are written.
+type Locale struct {
+	Tag string
+	// DateLayout and Score write the date and the score of a match, the
+	// latter given the home and away goals.
+	DateLayout string
+	Score      string
+}
+
+const englishTag = "en"
+
+var locales = map[string]*Locale{
+	englishTag: {Tag: englishTag, DateLayout: "2006-01-02", Score: "%dx%d"},
+	"pt-BR":    {Tag: "pt-BR", DateLayout: "02/01/2006", Score: "%d x %d"},
+	"es":       {Tag: "es", DateLayout: "02/01/2006", Score: "%d-%d"},
+}
+
+// messages translates the error messages from English. %s stands for the
+// variable parts, passed on in order; %[2]s and the like reorder them.
+// Messages missing a translation stay in English.
+var messages = map[string]map[string]string{
+	"scores must be non-negative integers": {
+		"pt-BR": "os placares devem ser inteiros não negativos",
+		"es":    "los marcadores deben ser enteros no negativos",
+	},
+	"scores must not be negative": {
+		"pt-BR": "os placares não podem ser negativos",
+		"es":    "los marcadores no pueden ser negativos",
+	},
+	"a correction needs a reason": {
+		"pt-BR": "uma correção precisa de um motivo",
+		"es":    "una corrección necesita un motivo",
+	},
+	"an accumulator predicts the scores of its legs only": {
+		"pt-BR": "uma múltipla só prevê os placares das suas seleções",
+		"es":    "una combinada solo predice los marcadores de sus selecciones",
+	},
+	"an accumulator has %s to %s legs": {
+		"pt-BR": "uma múltipla tem de %s a %s seleções",
+		"es":    "una combinada tiene de %s a %s selecciones",
+	},
+	"the legs of an accumulator are single bets": {
+		"pt-BR": "as seleções de uma múltipla são apostas simples",
+		"es":    "las selecciones de una combinada son apuestas simples",
+	},
+	"the legs of an accumulator are on different matches": {
+		"pt-BR": "as seleções de uma múltipla são de partidas diferentes",
+		"es":    "las selecciones de una combinada son de partidos distintos",
+	},
+	"the legs of an accumulator are in the same championship": {
+		"pt-BR": "as seleções de uma múltipla são do mesmo campeonato",
+		"es":    "las selecciones de una combinada son del mismo campeonato",
+	},
+	"the legs of an accumulator are not deleted one by one": {
+		"pt-BR": "as seleções de uma múltipla não são excluídas uma a uma",
+		"es":    "las selecciones de una combinada no se eliminan una a una",
+	},
+	"accumulator not found": {
+		"pt-BR": "múltipla não encontrada",
+		"es":    "combinada no encontrada",
+	},
+	"externalRef is limited to 128 characters": {
+		"pt-BR": "externalRef tem no máximo 128 caracteres",
+		"es":    "externalRef tiene como máximo 128 caracteres",
+	},
+	"externalRef is required": {
+		"pt-BR": "externalRef é obrigatório",
+		"es":    "externalRef es obligatorio",
+	},
+	"externalRef is already used by another bet": {
+		"pt-BR": "externalRef já é usado por outra aposta",
+		"es":    "externalRef ya lo usa otra apuesta",
+	},
+	"stake must be positive": {
+		"pt-BR": "o valor da aposta deve ser positivo",
+		"es":    "el importe de la apuesta debe ser positivo",
+	},
+	"stake must be at least %s": {
+		"pt-BR": "o valor da aposta deve ser de pelo menos %s",
+		"es":    "el importe de la apuesta debe ser de al menos %s",
+	},
+	"stake must be at most %s": {
+		"pt-BR": "o valor da aposta deve ser de no máximo %s",
+		"es":    "el importe de la apuesta debe ser como máximo %s",
+	},
+	"championship %s requires a stake": {
+		"pt-BR": "o campeonato %s exige um valor de aposta",
+		"es":    "el campeonato %s exige un importe de apuesta",
+	},
+	"championship %s takes no stakes": {
+		"pt-BR": "o campeonato %s não aceita valores de aposta",
+		"es":    "el campeonato %s no admite importes de apuesta",
+	},
+	"the match has started, bets on it are locked": {
+		"pt-BR": "a partida começou, as apostas nela estão bloqueadas",
+		"es":    "el partido ha comenzado, sus apuestas están bloqueadas",
+	},
+	"match does not belong to round %s": {
+		"pt-BR": "a partida não pertence à rodada %s",
+		"es":    "el partido no pertenece a la jornada %s",
+	},
+	"betting on championship %s opens at %s": {
+		"pt-BR": "as apostas no campeonato %s abrem em %s",
+		"es":    "las apuestas en el campeonato %s abren el %s",
+	},
+	"betting on championship %s is closed": {
+		"pt-BR": "as apostas no campeonato %s estão encerradas",
+		"es":    "las apuestas en el campeonato %s están cerradas",
+	},
+	"betting on championship %s is paused until %s": {
+		"pt-BR": "as apostas no campeonato %s estão suspensas até %s",
+		"es":    "las apuestas en el campeonato %s están suspendidas hasta %s",
+	},
+	"shootout must be home or away": {
+		"pt-BR": "a disputa de pênaltis deve ser home ou away",
+		"es":    "la tanda de penaltis debe ser home o away",
+	},
+	"scores are limited to %s goals per team": {
+		"pt-BR": "os placares são limitados a %s gols por time",
+		"es":    "los marcadores están limitados a %s goles por equipo",
+	},
+	"shootouts are only predicted on knockout matches": {
+		"pt-BR": "disputas de pênaltis só são apostadas em jogos eliminatórios",
+		"es":    "las tandas de penaltis solo se pronostican en partidos eliminatorios",
+	},
+	"a shootout is only predicted along with a draw": {
+		"pt-BR": "uma disputa de pênaltis só é apostada junto com um empate",
+		"es":    "una tanda de penaltis solo se pronostica junto con un empate",
+	},
+	"%s is a knockout stage, predict a winner": {
+		"pt-BR": "%s é uma fase eliminatória, aposte em um vencedor",
+		"es":    "%s es una fase eliminatoria, pronostica un ganador",
+	},
+	"%s is a knockout stage, predict the winner of the shootout along with a draw": {
+		"pt-BR": "%s é uma fase eliminatória, aposte no vencedor da disputa de pênaltis junto com um empate",
+		"es":    "%s es una fase eliminatoria, pronostica el ganador de la tanda de penaltis junto con un empate",
+	},
+	"championship not found": {
+		"pt-BR": "campeonato não encontrado",
+		"es":    "campeonato no encontrado",
+	},
+	"match not found": {
+		"pt-BR": "partida não encontrada",
+		"es":    "partido no encontrado",
+	},
+	"match %s can't be looked up: %s": {
+		"pt-BR": "não foi possível consultar a partida %s: %s",
+		"es":    "no se pudo consultar el partido %s: %s",
+	},
+	"bet not found": {
+		"pt-BR": "aposta não encontrada",
+		"es":    "apuesta no encontrada",
+	},
+	"bet request not found": {
+		"pt-BR": "pedido de aposta não encontrado",
+		"es":    "solicitud de apuesta no encontrada",
+	},
+	"the bet request was interrupted, check the bets before placing it again": {
+		"pt-BR": "o pedido de aposta foi interrompido, confira as apostas antes de fazê-la de novo",
+		"es":    "la solicitud de apuesta se interrumpió, revisa las apuestas antes de hacerla de nuevo",
+	},
+	"bet is already settled": {
+		"pt-BR": "a aposta já foi liquidada",
+		"es":    "la apuesta ya está liquidada",
+	},
+	"bet is deleted": {
+		"pt-BR": "a aposta foi excluída",
+		"es":    "la apuesta fue eliminada",
+	},
+	"only the owner or an admin may change the bet": {
+		"pt-BR": "só o dono ou um administrador pode alterar a aposta",
+		"es":    "solo el dueño o un administrador puede cambiar la apuesta",
+	},
+	"a batch holds between 1 and 50 bets": {
+		"pt-BR": "um lote tem entre 1 e 50 apostas",
+		"es":    "un lote tiene entre 1 y 50 apuestas",
+	},
+	"an import places between 1 and 50 bets": {
+		"pt-BR": "uma importação faz entre 1 e 50 apostas",
+		"es":    "una importación hace entre 1 y 50 apuestas",
+	},
+	"a bet needs an email and a matchId": {
+		"pt-BR": "uma aposta precisa de um email e de um matchId",
+		"es":    "una apuesta necesita un email y un matchId",
+	},
+	"unknown column %s": {
+		"pt-BR": "coluna desconhecida %s",
+		"es":    "columna desconocida %s",
+	},
+	"result %s conflicts with %s given before": {
+		"pt-BR": "o resultado %s conflita com %s informado antes",
+		"es":    "el resultado %s contradice %s indicado antes",
+	},
+	"createdAt must not be in the future": {
+		"pt-BR": "createdAt não pode estar no futuro",
+		"es":    "createdAt no puede estar en el futuro",
+	},
+	"player not found": {
+		"pt-BR": "jogador não encontrado",
+		"es":    "jugador no encontrado",
+	},
+	"only the player can refresh their profile": {
+		"pt-BR": "só o próprio jogador pode atualizar seu perfil",
+		"es":    "solo el propio jugador puede actualizar su perfil",
+	},
+	"unknown notification %s, expected one of %s": {
+		"pt-BR": "notificação %s desconhecida, esperada uma de %s",
+		"es":    "notificación %s desconocida, se esperaba una de %s",
+	},
+	"request body is empty": {
+		"pt-BR": "o corpo da requisição está vazio",
+		"es":    "el cuerpo de la solicitud está vacío",
+	},
+	"request body must hold a single JSON document": {
+		"pt-BR": "o corpo da requisição deve ter um único documento JSON",
+		"es":    "el cuerpo de la solicitud debe tener un único documento JSON",
+	},
+	"request body is limited to %s bytes": {
+		"pt-BR": "o corpo da requisição tem no máximo %s bytes",
+		"es":    "el cuerpo de la solicitud tiene como máximo %s bytes",
+	},
+	"Content-Type must be one of %s": {
+		"pt-BR": "o Content-Type deve ser um de %s",
+		"es":    "el Content-Type debe ser uno de %s",
+	},
+	"form field %s is given more than once": {
+		"pt-BR": "o campo %s do formulário aparece mais de uma vez",
+		"es":    "el campo %s del formulario aparece más de una vez",
+	},
+	"invalid %s: %s": {
+		"pt-BR": "%s inválido: %s",
+		"es":    "%s no válido: %s",
+	},
+	"invalid from date": {
+		"pt-BR": "data inicial inválida",
+		"es":    "fecha inicial no válida",
+	},
+	"invalid to date": {
+		"pt-BR": "data final inválida",
+		"es":    "fecha final no válida",
+	},
+	"timeout must be a duration up to 60s, e.g. 30s": {
+		"pt-BR": "timeout deve ser uma duração de até 60s, como 30s",
+		"es":    "timeout debe ser una duración de hasta 60s, como 30s",
+	},
+	"missing or malformed credentials": {
+		"pt-BR": "credenciais ausentes ou malformadas",
+		"es":    "credenciales ausentes o mal formadas",
+	},
+	"token carries no email": {
+		"pt-BR": "o token não tem email",
+		"es":    "el token no trae email",
+	},
+	"requires the %s role": {
+		"pt-BR": "exige o papel %s",
+		"es":    "requiere el rol %s",
+	},
+	"downstream services unavailable": {
+		"pt-BR": "serviços dependentes indisponíveis",
+		"es":    "servicios dependientes no disponibles",
+	},
+	"rate limit exceeded": {
+		"pt-BR": "limite de requisições excedido",
+		"es":    "límite de solicitudes superado",
+	},
+	"bet quota exceeded": {
+		"pt-BR": "cota de apostas excedida",
+		"es":    "cuota de apuestas superada",
+	},
+	"at most %s bets created or edited per minute": {
+		"pt-BR": "no máximo %s apostas criadas ou editadas por minuto",
+		"es":    "como máximo %s apuestas creadas o editadas por minuto",
+	},
+	"at most %s bets created or edited per day": {
+		"pt-BR": "no máximo %s apostas criadas ou editadas por dia",
+		"es":    "como máximo %s apuestas creadas o editadas por día",
+	},
+	"overloaded": {
+		"pt-BR": "sobrecarregado",
+		"es":    "sobrecargado",
+	},
+	"starting up": {
+		"pt-BR": "iniciando",
+		"es":    "iniciando",
+	},
+	"Not Found": {
+		"pt-BR": "Não encontrado",
+		"es":    "No encontrado",
+	},
+	"Unauthorized": {
+		"pt-BR": "Não autorizado",
+		"es":    "No autorizado",
+	},
+	"Forbidden": {
+		"pt-BR": "Proibido",
+		"es":    "Prohibido",
+	},
+	"Method Not Allowed": {
+		"pt-BR": "Método não permitido",
+		"es":    "Método no permitido",
+	},
+	"Internal Server Error": {
+		"pt-BR": "Erro interno do servidor",
+		"es":    "Error interno del servidor",
+	},
+}
+
+// messagePattern matches the messages with variable parts.
+type messagePattern struct {
+	re  *regexp.Regexp
+	key string
+}
+
+var messagePatterns []messagePattern
+
+func init() {
+	for key := range messages {
+		if !strings.Contains(key, "%s") {
+			continue
+		}
+		parts := strings.Split(key, "%s")
+		for i, p := range parts {
+			parts[i] = regexp.QuoteMeta(p)
+		}
+		re := regexp.MustCompile("^" + strings.Join(parts, "(.+?)") + "$")
+		messagePatterns = append(messagePatterns, messagePattern{re: re, key: key})
+	}
+	// the longest first, so the most specific pattern wins
+	sort.Slice(messagePatterns, func(i, j int) bool { return len(messagePatterns[i].key) > len(messagePatterns[j].key) })
+}
+
+// localeKey caches the locale of a request, negotiated once.
+const localeKey = "locale"
+
+// locale picks the first locale of Accept-Language, by quality, that the
+// API speaks; a language alone, as pt, matches its regional variant.
+// Without one, the responses are in config.Locale.
+func locale(c echo.Context) *Locale {
+	if l, ok := c.Get(localeKey).(*Locale); ok {
+		return l
+	}
+	l := negotiateLocale(c.Request().Header.Get("Accept-Language"))
+	c.Set(localeKey, l)
+	return l
+}
+
+func negotiateLocale(header string) *Locale {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if fields[0] == "" {
+			continue
+		}
+		w := weighted{tag: fields[0], q: 1}
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				if q, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					w.q = q
+				}
+			}
+		}
+		if w.q > 0 {
+			tags = append(tags, w)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		if l := findLocale(t.tag); l != nil {
+			return l
+		}
+	}
+	if l := findLocale(config.Locale); l != nil {
+		return l
+	}
+	return locales[englishTag]
+}
+
+func findLocale(tag string) *Locale {
+	for t, l := range locales {
+		if strings.EqualFold(t, tag) {
+			return l
+		}
+	}
+	lang := strings.SplitN(tag, "-", 2)[0]
+	for t, l := range locales {
+		if strings.EqualFold(strings.SplitN(t, "-", 2)[0], lang) {
+			return l
+		}
+	}
+	return nil
+}
+
+// localize translates an error message to the caller's locale.
+func localize(c echo.Context, msg string) string {
+	return translate(locale(c), msg)
+}
+
+func translate(l *Locale, msg string) string {
+	if l.Tag == englishTag || msg == "" {
+		return msg
+	}
+	if t, ok := messages[msg][l.Tag]; ok {
+		return t
+	}
+	for _, p := range messagePatterns {
+		m := p.re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		t, ok := messages[p.key][l.Tag]
+		if !ok {
+			return msg
+		}
+		args := make([]interface{}, len(m)-1)
+		for i, a := range m[1:] {
+			args[i] = a
+		}
+		return fmt.Sprintf(t, args...)
+	}
+	return msg
+}
+
+// localizeResponse marks a response as depending on Accept-Language and
+// tells its locale.
+func localizeResponse(c echo.Context) *Locale {
+	l := locale(c)
+	h := c.Response().Header()
+	h.Add(echo.HeaderVary, "Accept-Language")
+	h.Set("Content-Language", l.Tag)
+	return l
+}
+
+// localizeMatches writes again, in the locale, the match of the bets of a
+// response document, from their match info.
+func localizeMatches(v interface{}, l *Locale) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, e := range t {
+			localizeMatches(e, l)
+		}
+	case map[string]interface{}:
+		if info, ok := t["matchInfo"].(map[string]interface{}); ok {
+			if _, ok := t["match"].(string); ok {
+				if b, err := json.Marshal(info); err == nil {
+					m := &Match{}
+					if json.Unmarshal(b, m) == nil {
+						t["match"] = m.Format(l)
+					}
+				}
+			}
+		}
+		for _, e := range t {
+			localizeMatches(e, l)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// IdentityProvider tells who is calling and whom bets are placed for.
+// Deployments pick one with IDENTITY_PROVIDER:
+//
+//	service  bearer tokens, the player looked up on PLAYER_SVC (default)
+//	claims   bearer tokens, the player is their email claim
+//	local    HTTP Basic credentials of the users table
+type IdentityProvider interface {
+	// Identity returns the caller, false without credentials it accepts.
+	Identity(c echo.Context) (*Identity, bool)
+	// Player returns the email of the player placing a bet, and the
+	// status of the players service when there is one.
+	Player(c echo.Context) (string, int, error)
+}
+
+// IdentityConfig selects the identity provider. With the local one, an
+// AdminEmail without an account gets one with AdminPassword and the admin
+// role on startup, so the first admin can sign in.
+type IdentityConfig struct {
+	Provider      string
+	AdminEmail    string
+	AdminPassword string
+	// TokenKey verifies the bearer tokens; see parseTokenKey.
+	TokenKey string
+}
+
+func (cfg IdentityConfig) validate() error {
+	switch cfg.Provider {
+	case "service", "claims", "local":
+		return nil
+	}
+	return errors.New("unknown identity provider " + cfg.Provider)
+}
+
+// verified tells whether the callers are identified here rather than by a
+// gateway in front: by their local credentials, or by tokens whose
+// signature is checked.
+func (cfg IdentityConfig) verified() bool {
+	return cfg.Provider == "local" || cfg.TokenKey != ""
+}
+
+func newIdentityProvider(cfg IdentityConfig, users UserStore) (IdentityProvider, error) {
+	switch cfg.Provider {
+	case "claims":
+		return claimsIdentity{}, nil
+	case "local":
+		p := &localIdentity{users: users, verified: NewCache(30*time.Second, 10000)}
+		return p, p.bootstrap(cfg)
+	}
+	return serviceIdentity{}, nil
+}
+
+var errNoPlayer = echo.NewHTTPError(http.StatusUnauthorized, "the credentials carry no email")
+
+// serviceIdentity asks the players service for the player behind the
+// forwarded token, unless the profile fetched with the token's subject is
+// fresh.
+type serviceIdentity struct{}
+
+func (serviceIdentity) Identity(c echo.Context) (*Identity, bool) {
+	return tokenIdentity(c)
+}
+
+func (serviceIdentity) Player(c echo.Context) (string, int, error) {
+	if email, ok := cachedPlayer(c); ok {
+		return email, http.StatusOK, nil
+	}
+	p, status, err := fetchPlayer(c)
+	if err != nil {
+		return "", status, err
+	}
+	return p.Email, status, nil
+}
+
+// claimsIdentity trusts the email claim of the token, for deployments
+// whose gateway verifies tokens but that have no players service.
+type claimsIdentity struct{}
+
+func (claimsIdentity) Identity(c echo.Context) (*Identity, bool) {
+	return tokenIdentity(c)
+}
+
+func (claimsIdentity) Player(c echo.Context) (string, int, error) {
+	return identityEmail(c)
+}
+
+func identityEmail(c echo.Context) (string, int, error) {
+	id, ok := identity(c)
+	if !ok || id.Email == "" {
+		return "", 0, errNoPlayer
+	}
+	return id.Email, http.StatusOK, nil
+}
+
+// LocalUser is an account of the local identity provider. Emails are
+// unique across tenants, so the tenant follows from the credentials.
+type LocalUser struct {
+	Email        string    `json:"email"`
+	Tenant       string    `json:"tenant"`
+	PasswordHash string    `json:"-"`
+	Roles        []string  `json:"roles"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type UserStore interface {
+	// Get returns nil for an unknown email.
+	Get(email string) (*LocalUser, error)
+	Put(u *LocalUser) error
+	Delete(email string) error
+	List(tenant string) ([]*LocalUser, error)
+}
+
+// localIdentity authenticates HTTP Basic credentials against the users
+// table. Checked credentials are remembered for a few seconds with the
+// hash they matched, sparing a bcrypt comparison on every request of a
+// busy client: the user is still read on every request, so a password
+// changed, roles removed or a user deleted take effect at once, on every
+// replica.
+type localIdentity struct {
+	users    UserStore
+	verified *Cache
+}
+
+func (p *localIdentity) bootstrap(cfg IdentityConfig) error {
+	if cfg.AdminEmail == "" {
+		return nil
+	}
+	email := normalizeEmail(cfg.AdminEmail)
+	u, err := p.users.Get(email)
+	if err != nil || u != nil {
+		return err
+	}
+	if cfg.AdminPassword == "" {
+		return errors.New("LOCAL_ADMIN_PASSWORD is required with LOCAL_ADMIN_EMAIL")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(cfg.AdminPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("email", email).Msg("created the local admin account")
+	return p.users.Put(&LocalUser{Email: email, Tenant: config.Tenancy.Default, PasswordHash: string(hash), Roles: []string{config.AdminRole}, CreatedAt: clock.Now()})
+}
+
+func (p *localIdentity) Identity(c echo.Context) (*Identity, bool) {
+	email, password, ok := c.Request().BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	u, err := p.users.Get(normalizeEmail(email))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to look up the local user")
+		return nil, false
+	}
+	if u == nil {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(email + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	if hash, ok := p.verified.Get(key); !ok || hash.(string) != u.PasswordHash {
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return nil, false
+		}
+		p.verified.Set(key, u.PasswordHash)
+	}
+	return &Identity{Subject: u.Email, Email: u.Email, Roles: u.Roles, Tenant: u.Tenant}, true
+}
+
+func (p *localIdentity) Player(c echo.Context) (string, int, error) {
+	return identityEmail(c)
+}
+
+type userRequest struct {
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// PutUser creates or updates a local account of the caller's tenant.
+func PutUser(c echo.Context) error {
+	req := &userRequest{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	email := normalizeEmail(c.Param("email"))
+	if !strings.Contains(email, "@") {
+		return echo.NewHTTPError(http.StatusBadRequest, "the user is named by an email")
+	}
+	if len(req.Password) < 8 || len(req.Password) > 72 {
+		return echo.NewHTTPError(http.StatusBadRequest, "password must have between 8 and 72 characters")
+	}
+	u, err := users.Get(email)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if u == nil {
+		u, status = &LocalUser{Email: email, Tenant: tenant(c), CreatedAt: clock.Now()}, http.StatusCreated
+	} else if u.Tenant != tenant(c) {
+		return echo.NewHTTPError(http.StatusConflict, "the email belongs to another tenant")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash, u.Roles = string(hash), req.Roles
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+	if err := users.Put(u); err != nil {
+		return err
+	}
+	log.Info().Str("email", u.Email).Strs("roles", u.Roles).Str("actor", auditActor(c)).Msg("local user saved")
+	return c.JSON(status, u)
+}
+
+func ListUsers(c echo.Context) error {
+	list, err := users.List(tenant(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func DeleteUser(c echo.Context) error {
+	u, err := users.Get(c.Param("email"))
+	if err != nil {
+		return err
+	}
+	if u == nil || u.Tenant != tenant(c) {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	if err := users.Delete(u.Email); err != nil {
+		return err
+	}
+	log.Info().Str("email", u.Email).Str("actor", auditActor(c)).Msg("local user deleted")
+	return c.NoContent(http.StatusNoContent)
+}
+
+type memoryUsers struct {
+	mu    sync.Mutex
+	users map[string]*LocalUser
+}
+
+func newMemoryUsers() *memoryUsers {
+	return &memoryUsers{users: map[string]*LocalUser{}}
+}
+
+func (m *memoryUsers) Get(email string) (*LocalUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[email]
+	if !ok {
+		return nil, nil
+	}
+	c := *u
+	return &c, nil
+}
+
+func (m *memoryUsers) Put(u *LocalUser) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *u
+	m.users[u.Email] = &c
+	return nil
+}
+
+func (m *memoryUsers) Delete(email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, email)
+	return nil
+}
+
+func (m *memoryUsers) List(tenant string) ([]*LocalUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*LocalUser{}
+	for _, u := range m.users {
+		if u.Tenant == tenant {
+			c := *u
+			r = append(r, &c)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Email < r[j].Email })
+	return r, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+)
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+var uuidv7 struct {
+	sync.Mutex
+	ms  uint64
+	seq uint16
+}
+
+// newUUIDv7 returns a time ordered UUID (RFC 9562 version 7): the unix
+// milliseconds followed by random bits. The 12 bits after the timestamp
+// count up within a millisecond, so ids generated here sort in creation
+// order.
+func newUUIDv7() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	ms := uint64(clock.Now().UnixNano() / 1e6)
+	uuidv7.Lock()
+	if ms <= uuidv7.ms {
+		ms = uuidv7.ms
+		uuidv7.seq++
+		if uuidv7.seq > 0xfff {
+			ms++
+			uuidv7.seq = 0
+		}
+	} else {
+		uuidv7.seq = 0
+	}
+	uuidv7.ms = ms
+	seq := uuidv7.seq
+	uuidv7.Unlock()
+
+	binary.BigEndian.PutUint64(b[0:8], ms<<16)
+	binary.BigEndian.PutUint16(b[6:8], 0x7000|seq)
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
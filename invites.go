@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// inviteLink is the page players open to join the pool, built from the
+// INVITE_URL template.
+func inviteLink(pool string) string {
+	return strings.Replace(config.InviteURL, "{pool}", url.PathEscape(pool), -1)
+}
+
+// InviteQR renders the pool invite link as a PNG QR code, ?size= pixels
+// wide (128 to 1024, 512 by default), for posters. The image only depends
+// on the link and the size, so it is served with an ETag derived from them
+// and cached for a day.
+func InviteQR(c echo.Context) error {
+	size := 512
+	if s := c.QueryParam("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 128 || n > 1024 {
+			return echo.NewHTTPError(http.StatusBadRequest, "size must be between 128 and 1024")
+		}
+		size = n
+	}
+	link := inviteLink(c.Param("id"))
+	sum := sha256.Sum256([]byte(strconv.Itoa(size) + " " + link))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	h := c.Response().Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, max-age=86400")
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	png, err := qrcode.Encode(link, qrcode.Medium, size)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "image/png", png)
+}
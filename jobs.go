@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// JobFunc is the work done by a job. A returned error schedules another
+// attempt with exponential backoff until the job runs out of attempts.
+type JobFunc func(ctx context.Context) error
+
+type Job struct {
+	ID          string     `json:"id"`
+	Kind        string     `json:"kind"`
+	Status      JobStatus  `json:"status"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"maxAttempts"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	RunAt       time.Time  `json:"runAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+
+	fn    JobFunc
+	timer Timer
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCanceled
+}
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobState    = errors.New("job is not in a state allowing this operation")
+)
+
+// JobQueue runs background jobs (exports, settlements, backfills, digests)
+// on a fixed pool of workers and keeps a bounded history of finished ones.
+type JobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	order   []*Job
+	ready   chan *Job
+	workers int
+	history int
+	backoff time.Duration
+}
+
+func NewJobQueue(workers, history int) *JobQueue {
+	return &JobQueue{
+		jobs:    map[string]*Job{},
+		ready:   make(chan *Job),
+		workers: workers,
+		history: history,
+		backoff: time.Second,
+	}
+}
+
+// Start launches the workers; they stop when ctx is done.
+func (q *JobQueue) Start(ctx context.Context) {
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx)
+	}
+}
+
+func (q *JobQueue) Enqueue(kind string, maxAttempts int, fn JobFunc) Job {
+	return q.Schedule(kind, clock.Now(), maxAttempts, fn)
+}
+
+func (q *JobQueue) Schedule(kind string, at time.Time, maxAttempts int, fn JobFunc) Job {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	j := &Job{
+		ID:          newID(),
+		Kind:        kind,
+		Status:      JobPending,
+		MaxAttempts: maxAttempts,
+		CreatedAt:   clock.Now(),
+		RunAt:       at,
+		fn:          fn,
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs[j.ID] = j
+	q.order = append(q.order, j)
+	q.dispatch(j)
+	q.prune()
+	return *j
+}
+
+// dispatch hands the job to a worker once it is due; callers hold the lock.
+func (q *JobQueue) dispatch(j *Job) {
+	j.timer = clock.AfterFunc(j.RunAt.Sub(clock.Now()), func() { q.ready <- j })
+}
+
+// prune forgets the oldest finished jobs beyond the history size; callers
+// hold the lock.
+func (q *JobQueue) prune() {
+	excess := len(q.order) - q.history
+	if excess <= 0 {
+		return
+	}
+	kept := q.order[:0]
+	for _, j := range q.order {
+		if excess > 0 && j.finished() {
+			delete(q.jobs, j.ID)
+			excess--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	q.order = kept
+}
+
+func (q *JobQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-q.ready:
+			q.run(ctx, j)
+		}
+	}
+}
+
+func (q *JobQueue) run(ctx context.Context, j *Job) {
+	q.mu.Lock()
+	if j.Status != JobPending {
+		// canceled while waiting
+		q.mu.Unlock()
+		return
+	}
+	now := clock.Now()
+	j.Status = JobRunning
+	j.Attempts++
+	j.StartedAt = &now
+	j.FinishedAt = nil
+	fn := j.fn
+	q.mu.Unlock()
+
+	err := safeRun(ctx, fn)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now = clock.Now()
+	j.FinishedAt = &now
+	if err == nil {
+		j.Status = JobSucceeded
+		j.Error = ""
+		return
+	}
+	j.Error = err.Error()
+	log.Error().Err(err).Str("job", j.ID).Str("kind", j.Kind).Int("attempt", j.Attempts).Msg("job failed")
+	if j.Attempts >= j.MaxAttempts {
+		j.Status = JobFailed
+		return
+	}
+	j.Status = JobPending
+	j.RunAt = now.Add(q.backoff << uint(j.Attempts-1))
+	q.dispatch(j)
+}
+
+func safeRun(ctx context.Context, fn JobFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+func (q *JobQueue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return *j, nil
+}
+
+// List returns the known jobs newest first, optionally filtered by kind
+// and status.
+func (q *JobQueue) List(kind string, status JobStatus) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r := []Job{}
+	for i := len(q.order) - 1; i >= 0; i-- {
+		j := q.order[i]
+		if (kind == "" || j.Kind == kind) && (status == "" || j.Status == status) {
+			r = append(r, *j)
+		}
+	}
+	return r
+}
+
+// Retry gives a failed job one more attempt.
+func (q *JobQueue) Retry(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if j.Status != JobFailed {
+		return *j, errJobState
+	}
+	j.Status = JobPending
+	j.MaxAttempts = j.Attempts + 1
+	j.RunAt = clock.Now()
+	q.dispatch(j)
+	return *j, nil
+}
+
+// Cancel stops a pending job from running; running jobs are left alone.
+func (q *JobQueue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if j.Status != JobPending {
+		return *j, errJobState
+	}
+	j.timer.Stop()
+	now := clock.Now()
+	j.Status = JobCanceled
+	j.FinishedAt = &now
+	return *j, nil
+}
+
+func (q *JobQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := clock.Now()
+	st := QueueStats{}
+	for _, j := range q.order {
+		if j.Status != JobPending || j.RunAt.After(now) {
+			continue
+		}
+		st.Depth++
+		if age := now.Sub(j.RunAt); age > st.OldestAge {
+			st.OldestAge = age
+		}
+	}
+	return st
+}
+
+func ListJobs(c echo.Context) error {
+	return c.JSON(http.StatusOK, jobs.List(c.QueryParam("kind"), JobStatus(c.QueryParam("status"))))
+}
+
+func GetJob(c echo.Context) error {
+	j, err := jobs.Get(c.Param("id"))
+	if err != nil {
+		return jobError(err)
+	}
+	return c.JSON(http.StatusOK, j)
+}
+
+func RetryJob(c echo.Context) error {
+	j, err := jobs.Retry(c.Param("id"))
+	if err != nil {
+		return jobError(err)
+	}
+	return c.JSON(http.StatusAccepted, j)
+}
+
+func CancelJob(c echo.Context) error {
+	j, err := jobs.Cancel(c.Param("id"))
+	if err != nil {
+		return jobError(err)
+	}
+	return c.JSON(http.StatusOK, j)
+}
+
+func jobError(err error) error {
+	switch err {
+	case errJobNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errJobState:
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// lazyHandler serves the API from a process that may live for a single
+// request, e.g. a function. Only the config and the routes are set up
+// front; the storage and the caches are started by the first request, and
+// again by the next one if it failed. Nothing runs in the background:
+// events are left in the outbox, for the serve replicas to relay.
+type lazyHandler struct {
+	mu    sync.Mutex
+	e     *echo.Echo
+	ready int
+}
+
+// newLazyHandler sets up the config and the routes of the API served by
+// the lambda command.
+func newLazyHandler() (*lazyHandler, error) {
+	if err := startup.run("config", 0, configure); err != nil {
+		return nil, err
+	}
+	e, err := newServer(newSettlementConsumer())
+	if err != nil {
+		return nil, err
+	}
+	return &lazyHandler{e: e}, nil
+}
+
+func (h *lazyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !startup.done() {
+		if err := h.start(); err != nil {
+			log.Error().Err(err).Msg("failed to start")
+		}
+	}
+	// the startup gate turns the request away if the start failed
+	h.e.ServeHTTP(w, r)
+}
+
+// start runs the steps of the startup left, in order.
+func (h *lazyHandler) start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"storage", func() error { return initStorage(config) }},
+		{"cache", startCaches},
+		{"bus", func() error {
+			if config.Events.URL != "" {
+				events = NewOutbox(outboxStore, nil, config.Events.MaxAttempts)
+			}
+			return nil
+		}},
+		{"http", func() error { return nil }},
+	}
+	for ; h.ready < len(steps); h.ready++ {
+		if err := startup.run(steps[h.ready].name, 0, steps[h.ready].fn); err != nil {
+			return err
+		}
+	}
+	startup.finish()
+	return nil
+}
+
+// FunctionURLRequest is the payload, version 2.0, of the invocations made
+// through a Lambda function URL or an API Gateway HTTP API.
+type FunctionURLRequest struct {
+	RawPath         string            `json:"rawPath"`
+	RawQueryString  string            `json:"rawQueryString"`
+	Cookies         []string          `json:"cookies"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		DomainName string `json:"domainName"`
+		HTTP       struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+type FunctionURLResponse struct {
+	StatusCode      int               `json:"statusCode"`
+	Headers         map[string]string `json:"headers"`
+	Cookies         []string          `json:"cookies,omitempty"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+}
+
+func (in *FunctionURLRequest) request(ctx context.Context) (*http.Request, error) {
+	body := []byte(in.Body)
+	if in.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(in.Body); err != nil {
+			return nil, err
+		}
+	}
+	url := in.RawPath
+	if in.RawQueryString != "" {
+		url += "?" + in.RawQueryString
+	}
+	r, err := http.NewRequest(in.RequestContext.HTTP.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range in.Headers {
+		r.Header.Set(k, v)
+	}
+	if len(in.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(in.Cookies, "; "))
+	}
+	r.RequestURI = url
+	r.Host = in.RequestContext.DomainName
+	r.RemoteAddr = in.RequestContext.HTTP.SourceIP + ":0"
+	r.ContentLength = int64(len(body))
+	return r.WithContext(ctx), nil
+}
+
+// functionResponse buffers the response of an invocation.
+type functionResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *functionResponse) Header() http.Header { return w.header }
+
+func (w *functionResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+func (w *functionResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// response converts to the function URL format: binary bodies are base64
+// encoded and repeated headers joined with commas, but for the cookies.
+func (w *functionResponse) response() *FunctionURLResponse {
+	r := &FunctionURLResponse{StatusCode: w.status, Headers: map[string]string{}, Cookies: w.header["Set-Cookie"]}
+	if r.StatusCode == 0 {
+		r.StatusCode = http.StatusOK
+	}
+	for k, v := range w.header {
+		if k != "Set-Cookie" {
+			r.Headers[k] = strings.Join(v, ",")
+		}
+	}
+	if b := w.body.Bytes(); utf8.Valid(b) {
+		r.Body = string(b)
+	} else {
+		r.Body, r.IsBase64Encoded = base64.StdEncoding.EncodeToString(b), true
+	}
+	return r
+}
+
+// runLambda is a custom runtime, speaking the Lambda runtime API
+// (https://docs.aws.amazon.com/lambda/latest/dg/runtimes-api.html) to
+// fetch the function URL invocations one after the other and serve them.
+func runLambda(args []string) error {
+	if err := flag.NewFlagSet("lambda", flag.ContinueOnError).Parse(args); err != nil {
+		return err
+	}
+	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if api == "" {
+		return errors.New("AWS_LAMBDA_RUNTIME_API is not set, not running in Lambda")
+	}
+	base := "http://" + api + "/2018-06-01/runtime"
+	h, err := newLazyHandler()
+	if err == nil && !config.Identity.verified() {
+		// a function URL has no gateway verifying the tokens in front
+		err = errors.New("the lambda command needs TOKEN_VERIFY_KEY, or IDENTITY_PROVIDER=local, to verify the callers")
+	}
+	if err != nil {
+		postRuntime(base+"/init/error", lambdaError(err))
+		return err
+	}
+	for {
+		res, err := http.Get(base + "/invocation/next")
+		if err != nil {
+			return err
+		}
+		payload, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		id := res.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		deadline, _ := strconv.ParseInt(res.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64)
+		out, err := invoke(h, payload, deadline)
+		if err != nil {
+			log.Error().Err(err).Str("request", id).Msg("failed to serve the invocation")
+			err = postRuntime(base+"/invocation/"+id+"/error", lambdaError(err))
+		} else {
+			err = postRuntime(base+"/invocation/"+id+"/response", out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// invoke serves an invocation, cancelled at its deadline in unix
+// milliseconds, if any.
+func invoke(h http.Handler, payload []byte, deadlineMs int64) (*FunctionURLResponse, error) {
+	in := &FunctionURLRequest{}
+	if err := json.Unmarshal(payload, in); err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadlineMs > 0 {
+		ctx, cancel = context.WithDeadline(context.Background(), time.Unix(0, deadlineMs*int64(time.Millisecond)))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	r, err := in.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w := &functionResponse{header: http.Header{}}
+	h.ServeHTTP(w, r)
+	return w.response(), nil
+}
+
+func lambdaError(err error) map[string]string {
+	return map[string]string{"errorMessage": err.Error(), "errorType": "Runtime.HandlerError"}
+}
+
+func postRuntime(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(url, echo.MIMEApplicationJSON, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.New("the runtime API answered " + res.Status)
+	}
+	return nil
+}
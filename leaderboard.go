@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+type Leaderboard struct {
+	Championship string   `json:"championship"`
+	Round        string   `json:"round,omitempty"`
+	Entries      []*Entry `json:"entries"`
+}
+
+type Entry struct {
+	Position    int    `json:"position"`
+	Email       string `json:"email"`
+	Points      int    `json:"points"`
+	Bets        int    `json:"bets"`
+	ExactScores int    `json:"exactScores"`
+	// Bonus is the part of the points earned by accumulators won.
+	Bonus int `json:"bonus,omitempty"`
+}
+
+// leaderboard ranks players by points over the settled bets matching f;
+// ties are broken by exact scores, then email. Players sharing points and
+// exact scores share a position. The points of a whole championship
+// include the bonuses of the accumulators won.
+func leaderboard(f BetFilter) (*Leaderboard, error) {
+	list, err := bets.List(f)
+	if err != nil {
+		return nil, err
+	}
+	byEmail := tally(list)
+	if f.Round == "" {
+		accumulatorBonuses(byEmail, list)
+	}
+	return &Leaderboard{Championship: f.ChampionshipID, Round: f.Round, Entries: order(byEmail)}, nil
+}
+
+func rank(list []*Bet) []*Entry {
+	return order(tally(list))
+}
+
+// tally sums the bets of each player.
+func tally(list []*Bet) map[string]*Entry {
+	byEmail := map[string]*Entry{}
+	for _, b := range list {
+		// bets placed before emails were normalized may differ in case
+		email := normalizeEmail(b.Email)
+		e, ok := byEmail[email]
+		if !ok {
+			e = &Entry{Email: email}
+			byEmail[email] = e
+		}
+		e.Bets++
+		if b.Settlement != nil && b.Settlement.Status == SettlementSettled {
+			e.Points += b.Settlement.Points
+			if b.Settlement.Points == scoring(b.Tenant).ExactScore {
+				e.ExactScores++
+			}
+		}
+	}
+	return byEmail
+}
+
+// order sorts and positions the entries.
+func order(byEmail map[string]*Entry) []*Entry {
+	entries := make([]*Entry, 0, len(byEmail))
+	for _, e := range byEmail {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+		if a.ExactScores != b.ExactScores {
+			return a.ExactScores > b.ExactScores
+		}
+		return a.Email < b.Email
+	})
+	for i, e := range entries {
+		e.Position = i + 1
+		if i > 0 {
+			prev := entries[i-1]
+			if prev.Points == e.Points && prev.ExactScores == e.ExactScores {
+				e.Position = prev.Position
+			}
+		}
+	}
+	return entries
+}
+
+// GetLeaderboard ranks the players of a championship, optionally limited
+// to one round.
+func GetLeaderboard(c echo.Context) error {
+	lb, err := leaderboard(BetFilter{Tenant: tenant(c), ChampionshipID: c.Param("id"), Round: c.QueryParam("round")})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to compute the leaderboard")
+		return err
+	}
+	return respond(c, http.StatusOK, lb)
+}
+
+// publishLeaderboards announces the leaderboards a match of the tenant
+// counts for, of its championships and of their rounds: a
+// leaderboard.updated event, and a call to the webhooks subscribed.
+func publishLeaderboards(tenant, matchID string) {
+	list, err := bets.List(BetFilter{Tenant: tenant, MatchID: matchID})
+	if err != nil {
+		log.Error().Err(err).Str("match", matchID).Msg("failed to list the bets of the leaderboards")
+		return
+	}
+	seen := map[string]bool{}
+	for _, b := range list {
+		for _, f := range []BetFilter{
+			{Tenant: b.Tenant, ChampionshipID: b.ChampionshipID},
+			{Tenant: b.Tenant, ChampionshipID: b.ChampionshipID, Round: b.Round},
+		} {
+			key := f.Tenant + "/" + f.ChampionshipID + "/" + f.Round
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			lb, err := leaderboard(f)
+			if err != nil {
+				log.Error().Err(err).Str("championship", f.ChampionshipID).Msg("failed to compute the leaderboard")
+				continue
+			}
+			if f.Round != "" && summaryCache != nil {
+				summaryCache.Delete(key)
+			}
+			if data, err := json.Marshal(lb); err == nil && features.enabled(flagEvents, f.Tenant) {
+				events.Publish(config.Events.LeaderboardTopic, Event{ID: newID(), Type: "leaderboard.updated", OccurredAt: clock.Now(), Data: data})
+			}
+			notifier.Notify(f.Tenant, "leaderboard.updated", lb)
+		}
+	}
+}
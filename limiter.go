@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// rateHistory is how many past windows are kept per caller for
+// /me/usage.
+const rateHistory = 10
+
+// rateLimiter counts requests per caller in fixed windows.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rateWindow
+	swept   time.Time
+}
+
+type rateWindow struct {
+	start    time.Time
+	count    int
+	rejected int
+	// history holds the previous windows, the latest first.
+	history []UsageWindow
+}
+
+// UsageWindow counts the requests of a caller in a rate limiting window.
+type UsageWindow struct {
+	Start    time.Time `json:"start"`
+	Requests int       `json:"requests"`
+	Rejected int       `json:"rejected,omitempty"`
+}
+
+// Usage is the rate limiting state of a caller.
+type Usage struct {
+	Limit         int           `json:"limit"`
+	Remaining     int           `json:"remaining"`
+	Reset         time.Time     `json:"reset"`
+	WindowSeconds int64         `json:"windowSeconds"`
+	Recent        []UsageWindow `json:"recent"`
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{limit: cfg.Limit, window: cfg.Window, windows: map[string]*rateWindow{}}
+}
+
+// configure changes the limit and the window; the windows of the callers
+// run to their end, counted against the new limit.
+func (l *rateLimiter) configure(cfg RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.window = cfg.Limit, cfg.Window
+}
+
+// enabled tells whether a limit is set.
+func (l *rateLimiter) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit > 0
+}
+
+// current returns the window of key, rolling it over once expired. It
+// must be called with the lock held.
+func (l *rateLimiter) current(key string, now time.Time) *rateWindow {
+	if now.Sub(l.swept) > l.window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= rateHistory*l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.swept = now
+	}
+	w, ok := l.windows[key]
+	if !ok {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	} else if now.Sub(w.start) >= l.window {
+		w.history = append([]UsageWindow{{Start: w.start, Requests: w.count, Rejected: w.rejected}}, w.history...)
+		if len(w.history) > rateHistory-1 {
+			w.history = w.history[:rateHistory-1]
+		}
+		w.start, w.count, w.rejected = now, 0, 0
+	}
+	return w
+}
+
+// take counts a request of key. Over the limit it returns false; either
+// way it returns the caller's usage after the request.
+func (l *rateLimiter) take(key string) (Usage, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	w := l.current(key, now)
+	ok := w.count < l.limit
+	if ok {
+		w.count++
+	} else {
+		w.rejected++
+	}
+	return l.usage(w, now), ok
+}
+
+func (l *rateLimiter) peek(key string) Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	return l.usage(l.current(key, now), now)
+}
+
+func (l *rateLimiter) usage(w *rateWindow, now time.Time) Usage {
+	u := Usage{
+		Limit:         l.limit,
+		Remaining:     l.limit - w.count,
+		Reset:         w.start.Add(l.window),
+		WindowSeconds: int64(l.window / time.Second),
+		Recent:        append([]UsageWindow{{Start: w.start, Requests: w.count, Rejected: w.rejected}}, w.history...),
+	}
+	if u.Remaining < 0 {
+		u.Remaining = 0
+	}
+	return u
+}
+
+// key identifies the caller by their token subject or else their address,
+// within their tenant.
+func (l *rateLimiter) key(c echo.Context) string {
+	key := c.RealIP()
+	if id, ok := identity(c); ok && id.Subject != "" {
+		key = "sub:" + id.Subject
+	}
+	return tenant(c) + "/" + key
+}
+
+// Middleware answers 429 to callers over the limit. Every response tells
+// the caller where they stand with X-RateLimit-Limit, X-RateLimit-Remaining
+// and X-RateLimit-Reset, the seconds until the window resets. A zero limit
+// lets everything through.
+func (l *rateLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !l.enabled() {
+			return next(c)
+		}
+		u, ok := l.take(l.key(c))
+		reset := u.Reset.Sub(time.Now())
+		h := c.Response().Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(u.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(u.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(int64((reset+time.Second-1)/time.Second), 10))
+		if !ok {
+			return (&Problem{
+				Title:  "rate limit exceeded",
+				Status: http.StatusTooManyRequests,
+				Detail: "at most " + strconv.Itoa(u.Limit) + " requests per " + time.Duration(u.WindowSeconds*int64(time.Second)).String(),
+			}).retryAfter(reset)
+		}
+		return next(c)
+	}
+}
+
+// Usage reports the caller's rate limiting state and their requests in the
+// current and previous windows, this one included.
+func (l *rateLimiter) Usage(c echo.Context) error {
+	if !l.enabled() {
+		return echo.NewHTTPError(http.StatusNotFound, "rate limiting is disabled")
+	}
+	return c.JSON(http.StatusOK, l.peek(l.key(c)))
+}
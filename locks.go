@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errLockBusy = errors.New("lock is held by another instance")
+
+// errLockLost is a lease that could not be renewed while its holder ran,
+// and may have been taken over since.
+var errLockLost = errors.New("lock lease lost while held")
+
+// Locker hands out leases on named locks shared by every replica. A lease
+// not renewed before its TTL runs out can be taken over by another owner,
+// so a crashed replica never keeps a lock forever.
+type Locker interface {
+	// Acquire takes or renews the lease, reporting false when another
+	// owner holds an unexpired one.
+	Acquire(name, owner string, ttl time.Duration) (bool, error)
+	Release(name, owner string) error
+}
+
+// lockOwner identifies this process as the holder of leases; each call of
+// withLock holds them as an owner of its own, so the calls of one process
+// exclude each other as well.
+var lockOwner = func() string {
+	host, _ := os.Hostname()
+	return host + "-" + newID()[:8]
+}()
+
+var (
+	lockAcquisitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bets",
+		Subsystem: "lock",
+		Name:      "acquisitions_total",
+		Help:      "Attempts to take a distributed lock, per lock kind and result.",
+	}, []string{"lock", "result"})
+
+	lockHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bets",
+		Subsystem: "lock",
+		Name:      "held",
+		Help:      "Distributed locks currently held by this instance, per lock kind.",
+	}, []string{"lock"})
+)
+
+func init() {
+	registry.MustRegister(lockAcquisitions, lockHeld)
+}
+
+// withLock runs fn holding the lock kind:key, renewing the lease every third
+// of the TTL while fn runs. It returns errLockBusy without running fn when
+// another holder has the lock. A renewal failing cancels the context of fn,
+// which should stop as soon as it can, and withLock returns errLockLost.
+func withLock(kind, key string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	name := kind + ":" + key
+	owner := lockOwner + "-" + newID()[:8]
+	ok, err := locks.Acquire(name, owner, ttl)
+	if err != nil {
+		lockAcquisitions.WithLabelValues(kind, "error").Inc()
+		return err
+	}
+	if !ok {
+		lockAcquisitions.WithLabelValues(kind, "busy").Inc()
+		return errLockBusy
+	}
+	lockAcquisitions.WithLabelValues(kind, "acquired").Inc()
+	lockHeld.WithLabelValues(kind).Inc()
+	defer lockHeld.WithLabelValues(kind).Dec()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lost, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if ok, err := locks.Acquire(name, owner, ttl); err != nil || !ok {
+					lockAcquisitions.WithLabelValues(kind, "lost").Inc()
+					log.Error().Err(err).Str("lock", name).Msg("failed to renew the lock lease, stopping")
+					close(lost)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		// the renewals stop before the release, which one renewing after
+		// it would undo, holding the lock for another TTL
+		cancel()
+		<-done
+		if err := locks.Release(name, owner); err != nil {
+			log.Warn().Err(err).Str("lock", name).Msg("failed to release the lock, it expires with its lease")
+		}
+	}()
+	err = fn(ctx)
+	select {
+	case <-lost:
+		return errLockLost
+	default:
+	}
+	return err
+}
+
+// memoryLocks only coordinates the calls within this process, which is all
+// the memory driver has.
+type memoryLocks struct {
+	mu     sync.Mutex
+	leases map[string]lease
+}
+
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+func newMemoryLocks() *memoryLocks {
+	return &memoryLocks{leases: map[string]lease{}}
+}
+
+func (m *memoryLocks) Acquire(name, owner string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if l, ok := m.leases[name]; ok && l.owner != owner && now.Before(l.expires) {
+		return false, nil
+	}
+	m.leases[name] = lease{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *memoryLocks) Release(name, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leases[name].owner == owner {
+		delete(m.leases, name)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// LoggingConfig controls the debug logs of requests and calls. Headers are
+// logged with the Redact ones masked; bodies only when Bodies is set, up
+// to BodyLimit bytes, with the Redact JSON fields masked. Listing "email"
+// also masks email addresses wherever they appear.
+type LoggingConfig struct {
+	Bodies    bool
+	BodyLimit int
+	Redact    []string
+}
+
+const redactedValue = "[REDACTED]"
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+func redacts(name string) bool {
+	for _, r := range config.Logging.Redact {
+		if strings.EqualFold(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeaders copies h for logging.
+func redactHeaders(h http.Header) http.Header {
+	r := http.Header{}
+	for k, values := range h {
+		for _, v := range values {
+			if redacts(k) {
+				v = redactedValue
+			} else if redacts("email") {
+				v = emailPattern.ReplaceAllString(v, redactedValue)
+			}
+			r[k] = append(r[k], v)
+		}
+	}
+	return r
+}
+
+// redactBody masks the listed fields of a JSON body at any depth; other
+// bodies only get their email addresses masked.
+func redactBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		if b, err := json.Marshal(redactJSON(v)); err == nil {
+			body = b
+		}
+	}
+	if redacts("email") {
+		body = emailPattern.ReplaceAll(body, []byte(redactedValue))
+	}
+	return string(body)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if redacts(k) {
+				v[k] = redactedValue
+			} else {
+				v[k] = redactJSON(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactJSON(child)
+		}
+	}
+	return v
+}
+
+// truncated keeps the first limit bytes of a body.
+func truncated(b []byte, limit int) []byte {
+	if len(b) > limit {
+		return b[:limit]
+	}
+	return b
+}
+
+// bodyRecorder copies the first limit bytes written to the response.
+type bodyRecorder struct {
+	http.ResponseWriter
+	buf   bytes.Buffer
+	limit int
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if left := r.limit - r.buf.Len(); left > 0 {
+		r.buf.Write(truncated(b, left))
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *bodyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RequestLogger logs requests and responses at debug level. Bodies are
+// read only when enabled, and then only the logged prefix is buffered.
+func RequestLogger(cfg LoggingConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			req := c.Request()
+			res := c.Response()
+			start := time.Now()
+			in := log.Debug().Interface("headers", redactHeaders(req.Header))
+			var rec *bodyRecorder
+			if cfg.Bodies {
+				head, _ := ioutil.ReadAll(io.LimitReader(req.Body, int64(cfg.BodyLimit)))
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+				if len(head) > 0 {
+					in = in.Str("body", redactBody(head))
+				}
+				rec = &bodyRecorder{ResponseWriter: res.Writer, limit: cfg.BodyLimit}
+				res.Writer = rec
+			}
+			in.Msg(">>> " + req.Method + " " + req.RequestURI)
+			if err = next(c); err != nil {
+				c.Error(err)
+			}
+			out := log.Debug().
+				Str("latency", time.Now().Sub(start).String()).
+				Int("status", res.Status).
+				Interface("headers", redactHeaders(res.Header()))
+			if rec != nil && rec.buf.Len() > 0 {
+				out = out.Str("body", redactBody(rec.buf.Bytes()))
+			}
+			out.Msg("<<< " + req.Method + " " + req.RequestURI)
+			return
+		}
+	}
+}
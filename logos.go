@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	maxLogoBytes     = 2 << 20
+	maxLogoDimension = 4096
+)
+
+// thumbnailSizes are the widths served besides the original, kept to a
+// short list so thumbnails can be cached.
+var thumbnailSizes = map[int]bool{32: true, 64: true, 128: true, 256: true}
+
+var allowedLogoTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
+
+func logoKey(pool string, size int) string {
+	if size == 0 {
+		return "pools/" + pool + "/logo.png"
+	}
+	return "pools/" + pool + "/logo-" + strconv.Itoa(size) + ".png"
+}
+
+// UploadPoolLogo accepts a PNG, JPEG or GIF logo, either as the raw body
+// or as the "logo" field of a multipart form. The image is decoded and
+// re-encoded as PNG, which drops any EXIF or other embedded metadata.
+func UploadPoolLogo(c echo.Context) error {
+	var src io.Reader = c.Request().Body
+	if file, err := c.FormFile("logo"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(src, maxLogoBytes+1))
+	if err == errBodyTooLarge {
+		return err
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed reading the image")
+	}
+	if len(raw) > maxLogoBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "logos are limited to 2MB")
+	}
+	if !allowedLogoTypes[http.DetectContentType(raw)] {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "logos must be PNG, JPEG or GIF images")
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid image")
+	}
+	if cfg.Width > maxLogoDimension || cfg.Height > maxLogoDimension {
+		return echo.NewHTTPError(http.StatusBadRequest, "logos are limited to 4096x4096 pixels")
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid image")
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	pool := c.Param("id")
+	if err := blobs.Put(logoKey(pool, 0), buf); err != nil {
+		log.Error().Err(err).Str("pool", pool).Msg("failed to store the logo")
+		return err
+	}
+	for size := range thumbnailSizes {
+		if err := blobs.Delete(logoKey(pool, size)); err != nil {
+			log.Warn().Err(err).Str("pool", pool).Msg("failed to drop a stale thumbnail")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetPoolLogo serves the logo, or a thumbnail of it when ?size= names one
+// of the thumbnail widths. Thumbnails are rendered on first request and
+// kept in the blob store; responses carry an ETag and long lived caching.
+func GetPoolLogo(c echo.Context) error {
+	pool := c.Param("id")
+	size := 0
+	if s := c.QueryParam("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !thumbnailSizes[n] {
+			return echo.NewHTTPError(http.StatusBadRequest, "size must be one of 32, 64, 128 or 256")
+		}
+		size = n
+	}
+	data, err := readBlob(logoKey(pool, size))
+	if err == errBlobNotFound && size > 0 {
+		data, err = renderThumbnail(pool, size)
+	}
+	if err == errBlobNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "pool has no logo")
+	}
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	h := c.Response().Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, max-age=86400")
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, "image/png", data)
+}
+
+func readBlob(key string) ([]byte, error) {
+	r, err := blobs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func renderThumbnail(pool string, size int) ([]byte, error) {
+	data, err := readBlob(logoKey(pool, 0))
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, resize(img, size)); err != nil {
+		return nil, err
+	}
+	thumb := buf.Bytes()
+	if err := blobs.Put(logoKey(pool, size), bytes.NewReader(thumb)); err != nil {
+		log.Warn().Err(err).Str("pool", pool).Msg("failed to cache the thumbnail")
+	}
+	return thumb, nil
+}
+
+// resize scales img to the given width keeping its aspect ratio, averaging
+// the source pixels covered by each target pixel. Images narrower than the
+// width are returned as is.
+func resize(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBAModel.Convert(img.At(sx, sy)).(color.NRGBA)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			if n > 0 {
+				dst.SetNRGBA(x, y, color.NRGBA{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)})
+			}
+		}
+	}
+	return dst
+}
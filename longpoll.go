@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 60 * time.Second
+	// waitRecheck bounds how late a change saved by another replica is
+	// noticed, since only local saves wake waiters up.
+	waitRecheck = 2 * time.Second
+)
+
+var betChanges = newBetWatch()
+
+// betWatch wakes up the requests waiting on a bet when it is saved.
+type betWatch struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+func newBetWatch() *betWatch {
+	return &betWatch{waiters: map[string]map[chan struct{}]bool{}}
+}
+
+// Wait returns a channel closed on the next save of the bet, and a func
+// releasing it when the caller gives up.
+func (w *betWatch) Wait(id string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.waiters[id] == nil {
+		w.waiters[id] = map[chan struct{}]bool{}
+	}
+	w.waiters[id][ch] = true
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.waiters[id][ch] {
+			delete(w.waiters[id], ch)
+			if len(w.waiters[id]) == 0 {
+				delete(w.waiters, id)
+			}
+		}
+	}
+}
+
+func (w *betWatch) notify(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.waiters[id] {
+		close(ch)
+	}
+	delete(w.waiters, id)
+}
+
+// watchedBets notifies the bet watch of every save. Being the outermost
+// repository it also stamps the bets saved.
+type watchedBets struct {
+	BetRepository
+	watch *betWatch
+}
+
+func (r *watchedBets) Save(b *Bet) error {
+	b.UpdatedAt = clock.Now()
+	if err := r.BetRepository.Save(b); err != nil {
+		return err
+	}
+	r.watch.notify(b.ID)
+	return nil
+}
+
+// SaveWithEvents keeps the stamp of a bet whose events were built with
+// it.
+func (r *watchedBets) SaveWithEvents(b *Bet, entries []*OutboxEntry) error {
+	if len(entries) == 0 || b.UpdatedAt.IsZero() {
+		b.UpdatedAt = clock.Now()
+	}
+	if err := r.BetRepository.SaveWithEvents(b, entries); err != nil {
+		return err
+	}
+	r.watch.notify(b.ID)
+	return nil
+}
+
+// betVersion identifies the state of a bet; any change to it yields a
+// different version.
+func betVersion(b *Bet) string {
+	data, _ := json.Marshal(b)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WaitBet long polls a bet for clients that can't keep a WebSocket or SSE
+// connection open. It answers with the bet as soon as its version differs
+// from ?version= (or If-None-Match), and 304 when ?timeout= runs out first.
+// The current version is sent in the ETag header.
+func WaitBet(c echo.Context) error {
+	timeout := defaultWaitTimeout
+	if t := c.QueryParam("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 || d > maxWaitTimeout {
+			return echo.NewHTTPError(http.StatusBadRequest, "timeout must be a duration up to 60s, e.g. 30s")
+		}
+		timeout = d
+	}
+	version := c.QueryParam("version")
+	if version == "" {
+		version = strings.Trim(c.Request().Header.Get("If-None-Match"), `"`)
+	}
+	id := c.Param("id")
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheck)
+	defer recheck.Stop()
+	for {
+		changed, done := betChanges.Wait(id)
+		b, err := bets.Get(id)
+		if err == nil && b.Tenant != tenant(c) {
+			err = errBetNotFound
+		}
+		if err != nil {
+			done()
+			if err == errBetNotFound {
+				return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+			return err
+		}
+		current := betVersion(b)
+		c.Response().Header().Set("ETag", `"`+current+`"`)
+		if current != version {
+			done()
+			return respondOwned(c, http.StatusOK, b, b.Email)
+		}
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-deadline.C:
+			done()
+			return c.NoContent(http.StatusNotModified)
+		case <-c.Request().Context().Done():
+			done()
+			return nil
+		}
+		done()
+	}
+}
@@ -1,124 +1,745 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
-	"github.com/motemen/go-loghttp"
+	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog"
 
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var log *zerolog.Logger
+var config *Config
 var client *http.Client
+var matchCache, championshipCache *ShardedCache
+var jobs *JobQueue
+var bets BetRepository
+var audit *AuditLog
+var blobs BlobStore
+var locks Locker
+var outboxStore OutboxStore
+var events *Outbox
+var subscriptions SubscriptionStore
+var notifier *webhookNotifier
+var domains *domainTable
+var warehouse *warehouseExporter
+var rollup *rollups
+var matchStates MatchStateStore
+var playerEvents PlayerEventStore
+var users UserStore
+var identities IdentityProvider
+var awards AwardStore
+var players PlayerStore
 
 func init() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
 	logger := zerolog.New(output).With().Timestamp().Caller().Logger()
 	log = &logger
-	transport := &loghttp.Transport{
-		LogRequest: func(req *http.Request) {
-			log.Debug().
-				Interface("headers", req.Header).
-				Msg("calling " + req.Method + " " + req.URL.String())
-		},
-		LogResponse: func(res *http.Response) {
-			req := res.Request
-			log.Debug().
-				Str("status", res.Status).
-				Interface("headers", res.Header).
-				Msg("call " + req.Method + " " + req.URL.String() + " answered")
-		},
-	}
-	client = &http.Client{Transport: transport}
 }
 
 func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "serve":
+		err = runServe(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "settle":
+		err = runSettle(args)
+	case "audit":
+		err = runAudit(args)
+	case "lambda":
+		err = runLambda(args)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg(cmd + " failed")
+	}
+}
+
+const usage = `usage: application [command] [flags]
+
+commands:
+  serve                                  run the HTTP server (default)
+  lambda                                 serve AWS Lambda function URL invocations
+  migrate up|down [-steps N]|status      manage the database schema
+  settle -match-id ID -home N -away N    score the bets of a finished match
+  audit verify                           check the audit chain for tampering`
+
+// runServe is the HTTP server, the default command.
+func runServe(args []string) error {
+	if err := flag.NewFlagSet("serve", flag.ContinueOnError).Parse(args); err != nil {
+		return err
+	}
 	start := time.Now()
+	if err := startup.run("config", 0, configure); err != nil {
+		return err
+	}
+	settlements := newSettlementConsumer()
+	e, err := newServer(settlements)
+	if err != nil {
+		return err
+	}
+	if config.DiagnosticsAddr != "" {
+		go serveDiagnostics(config.DiagnosticsAddr)
+	}
+	// the listener is up while the other components start, so probes can
+	// tell a slow start from a dead one
+	served := make(chan error, 1)
+	go func() { served <- serve(e, config.ListenAddr, config.Server, config.ServerTLS) }()
+
+	if err := startup.run("storage", config.StartupTimeout, func() error {
+		return initStorage(config)
+	}); err != nil {
+		return err
+	}
+	if err := startup.run("cache", 0, startCaches); err != nil {
+		return err
+	}
+	startBackground()
+	if config.Events.URL != "" {
+		var nc *nats.Conn
+		if err := startup.run("bus", config.StartupTimeout, func() (err error) {
+			nc, err = connectBus(config.Events)
+			return err
+		}); err != nil {
+			return err
+		}
+		defer nc.Close()
+		events = NewOutbox(outboxStore, func(topic string, data []byte) error {
+			if err := nc.Publish(topic, data); err != nil {
+				return err
+			}
+			return nc.FlushTimeout(5 * time.Second)
+		}, config.Events.MaxAttempts)
+		go events.Run(context.Background())
+		stats.RegisterOutbox("events", events)
+		if _, err := subscribe(nc, config.Events.SettlementTopic, config.Events.Group, settlements.Handle); err != nil {
+			return err
+		}
+	} else {
+		startup.run("bus", 0, func() error { return nil })
+	}
+	startup.run("http", 0, func() error { return nil })
+	startup.finish()
+	log.Debug().Msg("Bets app initialized in " + time.Now().Sub(start).String())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		log.Info().Str("signal", sig.String()).Msg("shutting down")
+	}
+	return shutdown(e)
+}
+
+// shutdownTimeout is how long the requests in flight have to finish once
+// the replica is told to stop.
+const shutdownTimeout = 15 * time.Second
+
+// shutdown stops taking requests, lets those in flight finish, then saves
+// the memory snapshot, so a demo replica stopped loses nothing.
+func shutdown(e *echo.Echo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("requests were still in flight at shutdown")
+	}
+	if snapshots != nil {
+		if err := snapshots.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func configure() error {
+	config = loadConfig()
+	configureRegion(config.Region)
+	if err := config.Identity.validate(); err != nil {
+		return err
+	}
+	if err := config.ServerTLS.validate(); err != nil {
+		return err
+	}
+	var err error
+	if tokenKey, err = parseTokenKey(config.Identity.TokenKey); err != nil {
+		return err
+	}
+	if live, err = newLiveConfig(config.Reload); err != nil {
+		return err
+	}
+	if forwarded, err = newHeaderAllowlist(config.ForwardHeaders); err != nil {
+		return err
+	}
+	features = newFeatureFlags(config.Flags)
+	if chaos = (&chaosInjector{cfg: config.Chaos}); config.Chaos.Enabled {
+		log.Warn().Msg("chaos enabled: requests may be delayed or aborted on purpose")
+	}
+	if config.DemoMode {
+		clock = NewDemoClock()
+		log.Warn().Msg("demo mode: the clock can be fast-forwarded on POST /api/admin/clock/advance")
+	}
+	if config.TimeTravel {
+		log.Warn().Msg("time travel: requests may set their time with " + debugNowHeader)
+	}
+	return nil
+}
+
+// startCaches sets up the outbound client, the caches and the job queue,
+// all of which need the storage.
+func startCaches() error {
+	var err error
+	if client, err = newClient(config); err != nil {
+		return err
+	}
+	if outboundAuth, err = newOutboundAuth(config.OutboundAuth); err != nil {
+		return err
+	}
+	blobs = &fileBlobs{dir: config.BlobDir}
+	matchCache = NewShardedCache("matches", config.Cache.TTL, config.Cache.MaxEntries, config.Cache.Shards)
+	championshipCache = NewShardedCache("championships", config.Cache.TTL, config.Cache.MaxEntries, config.Cache.Shards)
+	lastKnown = NewCache(config.Degraded.LastKnownTTL, config.Cache.MaxEntries)
+	stats.RegisterCache("matches", matchCache)
+	stats.RegisterCache("championships", championshipCache)
+	summaryCache = NewCache(config.Cache.SummaryTTL, config.Cache.MaxEntries)
+	stats.RegisterCache("summaries", summaryCache)
+	jobs = NewJobQueue(config.Jobs.Workers, config.Jobs.History)
+	jobs.Start(context.Background())
+	recentBets = newDedupWindow(config.DedupWindow)
+	if quotas, err = newBetQuota(config.BetQuota); err != nil {
+		return err
+	}
+	settlements = newSettlementHistory(config.SettlementHistory)
+	stats.RegisterQueue("jobs", jobs)
+	notifier = &webhookNotifier{store: subscriptions, client: newWebhookClient(config.Transport.Timeout)}
+	if mailer, err = newPlayerMailer(config.Notifications, preferences); err != nil {
+		return err
+	}
+	return nil
+}
+
+// startBackground starts the scheduled work of long running replicas.
+func startBackground() {
+	if config.Prefetch.Interval > 0 {
+		go newPrefetcher(config.Prefetch).Run(context.Background())
+	}
+	if config.Warehouse.Interval > 0 {
+		go warehouse.Run(context.Background())
+	}
+	if config.Rollups.Interval > 0 {
+		go rollup.Run(context.Background())
+	}
+	if config.MatchStatus.Interval > 0 {
+		go (&matchStatusPoller{cfg: config.MatchStatus}).Run(context.Background())
+	}
+	if config.Reminders.Interval > 0 {
+		go (&reminderScheduler{cfg: config.Reminders}).Run(context.Background())
+	}
+	if config.Drift.Interval > 0 {
+		go drift.Run(context.Background(), config.Drift)
+	}
+	go live.Run(context.Background())
+	if config.Flags.File != "" && config.Flags.Poll > 0 {
+		go features.Run(context.Background())
+	}
+	if t := config.Cache.Tuning; t.Enabled && t.Interval > 0 && config.Cache.TTL > 0 {
+		go newTTLTuner(t).Run(context.Background())
+	}
+	if snapshots != nil && snapshots.interval > 0 {
+		go snapshots.Run(context.Background())
+	}
+	go watchBetRequests(context.Background())
+}
+
+// newServer sets up the middleware and routes. Only the config is needed;
+// the startup gate holds requests back until the other components started.
+func newServer(settlements *settlementConsumer) (*echo.Echo, error) {
 	e := echo.New()
 	e.Logger.SetOutput(ioutil.Discard)
-	// Middleware
-	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) (err error) {
-			req := c.Request()
-			res := c.Response()
-			start := time.Now()
-			log.Debug().
-				Interface("headers", req.Header).
-				Msg(">>> " + req.Method + " " + req.RequestURI)
-			if err = next(c); err != nil {
-				c.Error(err)
+	e.HTTPErrorHandler = errorHandler(e)
+	e.Pre(StripBasePath(config.BasePath))
+	e.Pre(startup.Gate)
+	e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		// domains is set by the storage startup
+		return func(c echo.Context) error {
+			if !startup.done() {
+				return next(c)
 			}
-			log.Debug().
-				Str("latency", time.Now().Sub(start).String()).
-				Int("status", res.Status).
-				Interface("headers", res.Header()).
-				Msg("<<< " + req.Method + " " + req.RequestURI)
-			return
+			return domains.Middleware(next)(c)
 		}
 	})
+	// Middleware
+	e.Use(RequestLogger(config.Logging))
+	e.Use(MetricsMiddleware)
+	e.Use(newLoadShedder(config.Shedding).Middleware)
+	e.Use(VersionHeaders)
+	e.Use(RegionHeaders)
 	e.Use(middleware.Recover())
+	e.Use(Compress(config.Compression))
+	e.Use(BodyLimit(config.MaxBodySize))
+	e.Use(chaos.Middleware)
+	e.Use(Tenancy(config.Tenancy))
+	e.Use(TimeTravel)
 	//CORS
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{echo.GET, echo.HEAD, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
-	}))
-
-	e.Static("/static", "assets/api-docs")
+	cors, err := CORS(config.CORS)
+	if err != nil {
+		return nil, err
+	}
+	e.Use(cors)
+
+	static := e.Group("/static", AssetHeaders)
+	static.GET("/bets-api.yaml", APISpec("assets/api-docs"))
+	static.Static("", "assets/api-docs")
+	if config.Static.SPADir != "" {
+		spa := SPA(config.Static)
+		e.Any(config.Static.SPAPath+"/*", spa)
+		if config.Static.SPAPath != "" {
+			e.Any(config.Static.SPAPath, spa)
+		}
+	}
 
 	// Server
-	e.POST("/api/bets", CreateBet)
 	e.GET("/health", Health)
-	elapsed := time.Now().Sub(start)
-	log.Debug().Msg("Bets app initialized in " + elapsed.String())
-	e.Logger.Fatal(e.Start(":9999"))
+	e.GET("/health/ready", HealthReady)
+	e.GET("/health/startup", HealthStartup)
+	e.GET("/info", Info)
+	e.GET("/region", GetRegion)
+	e.GET("/metrics", Metrics())
+	if config.DiagnosticsAddr == "" {
+		diagnosticsRoutes(e.Group("/debug", RequireRole(config.AdminRole)))
+	}
+	domainRoutes(e)
+
+	var webhooks *WebhookVerifier
+	if config.Webhooks.MatchResultsSecret != "" {
+		webhooks = NewWebhookVerifier("match-results", config.Webhooks.MatchResultsSecret, config.Webhooks.Tolerance)
+	}
+	limiter := newRateLimiter(live.settings().RateLimit)
+	live.limiter = limiter
+	apiRoutes(e.Group("/api/v1", APIVersion(1), limiter.Middleware, TrackLogins, NormalizeInputs), limiter, settlements, webhooks)
+	// the unversioned routes are deprecated aliases of v1
+	apiRoutes(e.Group("/api", LegacyAPI(link("/api/v1"), config.LegacySunset), limiter.Middleware, TrackLogins, NormalizeInputs), limiter, settlements, webhooks)
+	return e, nil
+}
+
+// apiRoutes registers the API on a version group. A nil verifier leaves
+// the match results webhook out.
+func apiRoutes(api *echo.Group, limiter *rateLimiter, settlements *settlementConsumer, webhooks *WebhookVerifier) {
+	api.POST("/bets", CreateBet)
+	api.GET("/bets", FindBets)
+	api.POST("/bets/batch", CreateBets)
+	api.GET("/bets/requests/:id", GetBetRequest)
+	api.GET("/bets/:id", GetBet, ConditionalGET)
+	api.GET("/bets/:id/wait", WaitBet)
+	api.PATCH("/bets/:id", UpdateBet)
+	api.DELETE("/bets/:id", DeleteBet)
+	api.GET("/bets/:id/history", BetChangeLog)
+	api.GET("/accumulators/:id", GetAccumulator)
+	api.GET("/championships/:id", GetChampionship)
+	api.GET("/championships/:id/rounds/:round/bets", ListRoundBets)
+	api.GET("/championships/:id/rounds/:round/summary", GetRoundSummary)
+	api.GET("/championships/:id/leaderboard", GetLeaderboard, ConditionalGET)
+	api.GET("/championships/:id/pot", GetPot)
+	api.GET("/championships/:id/leaderboard/export", ExportLeaderboard, RequireRole(config.AdminRole))
+	api.GET("/championships/:id/bets/export", ExportBets, RequireRole(config.AdminRole))
+	api.POST("/championships/:id/bets/export", QueueBetExport, RequireRole(config.AdminRole))
+	api.GET("/exports/:name", GetExport, RequireRole(config.AdminRole))
+	api.GET("/matches/:id", GetMatchDetails)
+	api.GET("/matches/:id/suggestion", GetMatchSuggestion)
+	api.GET("/players/:email", GetPlayer)
+	api.GET("/players/:email/bets", PlayerBetHistory)
+	graphQL := GraphQL()
+	api.GET("/graphql", graphQL)
+	api.POST("/graphql", graphQL)
+	api.GET("/me/bets", MyBetHistory)
+	api.GET("/me/usage", limiter.Usage)
+	api.GET("/me/notifications", GetNotificationSettings)
+	api.PUT("/me/notifications", PutNotificationSettings)
+	api.POST("/pools/:id/logo", UploadPoolLogo, RequireRole(config.AdminRole))
+	api.GET("/pools/:id/logo", GetPoolLogo)
+	api.GET("/pools/:id/invite/qr.png", InviteQR)
+
+	if webhooks != nil {
+		api.POST("/webhooks/match-results", MatchResultsWebhook(settlements), webhooks.Middleware)
+	}
+
+	admin := api.Group("/admin", RequireRole(config.AdminRole))
+	admin.POST("/matches/:id/settle", SettleMatch)
+	admin.POST("/matches/:id/resettle", ResettleMatch)
+	admin.GET("/settlements", ListSettlements)
+	admin.GET("/matches/:id/state", GetMatchState)
+	admin.PUT("/matches/:id/lock", LockMatch)
+	admin.GET("/championships/:id/windows", ListBetWindows)
+	admin.PUT("/championships/:id/window", PutBetWindow)
+	admin.DELETE("/championships/:id/window", DeleteBetWindow)
+	admin.PUT("/championships/:id/rounds/:round/window", PutBetWindow)
+	admin.DELETE("/championships/:id/rounds/:round/window", DeleteBetWindow)
+	admin.GET("/players/:email/timeline", GetPlayerTimeline)
+	admin.GET("/users", ListUsers)
+	admin.PUT("/users/:email", PutUser)
+	admin.DELETE("/users/:email", DeleteUser)
+	admin.POST("/pii/rotate", RotatePIIKeys)
+	admin.POST("/import", ImportBets)
+	admin.POST("/bets/parse-text", ParseTextBets)
+	admin.POST("/bets/parse-text/confirm", ConfirmTextBets)
+	admin.GET("/config", GetLiveConfig)
+	admin.POST("/config/reload", ReloadLiveConfig)
+	admin.GET("/flags", ListFlags)
+	admin.PUT("/flags/:name", PutFlag)
+	admin.DELETE("/flags/:name", DeleteFlag)
+	admin.GET("/clock", GetClock)
+	admin.POST("/clock/advance", AdvanceClock)
+	admin.GET("/audit", ListAudit)
+	admin.GET("/audit/verify", VerifyAudit)
+	admin.GET("/jobs", ListJobs)
+	admin.GET("/jobs/:id", GetJob)
+	admin.POST("/jobs/:id/retry", RetryJob)
+	admin.POST("/jobs/:id/cancel", CancelJob)
+	admin.GET("/outbox/dead", ListDeadLetters)
+	admin.POST("/outbox/dead/:id/redrive", RedriveDeadLetter)
+	admin.POST("/webhooks", CreateSubscription)
+	admin.GET("/webhooks", ListSubscriptions)
+	admin.DELETE("/webhooks/:id", DeleteSubscription)
+	admin.GET("/webhooks/:id/deliveries", ListDeliveries)
+	admin.PUT("/domains/:host", PutDomain)
+	admin.GET("/domains", ListDomains)
+	admin.DELETE("/domains/:host", DeleteDomain)
+	admin.GET("/stats", GetBetStats)
+	admin.GET("/drift", GetDrift)
+	admin.GET("/analytics", GetAnalytics)
+	admin.POST("/analytics/recompute", RecomputeAnalytics)
+	admin.GET("/warehouse", GetWarehouse)
+	admin.POST("/warehouse/backfill", BackfillWarehouse)
 }
 
 func Health(c echo.Context) error {
-	return c.JSON(200, &HealthData{Status: "UP"})
+	return c.JSON(200, &HealthData{Status: "UP", Build: buildInfo(c)})
 }
 
 type HealthData struct {
-	Status string `json:"status,omitempty"`
+	Status string     `json:"status,omitempty"`
+	Build  *BuildInfo `json:"build,omitempty"`
 }
 
 func CreateBet(c echo.Context) error {
 	defer c.Request().Body.Close()
 	bet := &Bet{}
-	if err := json.NewDecoder(c.Request().Body).Decode(bet); err != nil {
-		log.Error().Err(err).Msg("Failed reading the request body")
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error)
+	if err := decodeBody(c, bet, betMessage); err != nil {
+		return err
+	}
+	if c.QueryParam("dryRun") == "true" {
+		if len(bet.Legs) > 0 {
+			return dryRunAccumulator(c, bet)
+		}
+		b, warnings, err := placeBet(c, bet, betOptions{dryRun: true})
+		if err != nil {
+			return betError(err)
+		}
+		return respondOwned(c, http.StatusOK, &CreatedBet{Bet: b, Degraded: len(warnings) > 0, Warnings: warnings, DryRun: true}, b.Email)
 	}
+	// accumulators are always placed synchronously
+	async := respondAsync(c) && len(bet.Legs) == 0
+	replay, replayed, err := recentBets.do(c.Request().Context(), dedupKey(c, bet, async), func() (replayFunc, error) {
+		if len(bet.Legs) > 0 {
+			return createAccumulator(c, bet)
+		}
+		if async {
+			return acceptBet(c, bet)
+		}
+		b, warnings, err := placeBet(c, bet, betOptions{})
+		if err != nil {
+			return nil, betError(err)
+		}
+		created := &CreatedBet{Bet: b, Degraded: len(warnings) > 0, Warnings: warnings}
+		return func(c echo.Context) error { return respondOwned(c, http.StatusCreated, created, b.Email) }, nil
+	})
+	if err != nil {
+		return err
+	}
+	if replayed {
+		c.Response().Header().Set(replayedHeader, "true")
+	}
+	return replay(c)
+}
+
+// CreatedBet is a new bet with the enrichments that couldn't be applied.
+// Degraded bets were placed with fallback values for the failed services.
+// A dry run's bet is the one that would have been placed, without an id.
+type CreatedBet struct {
+	*Bet
+	Degraded bool      `json:"degraded,omitempty"`
+	Warnings []Warning `json:"warnings,omitempty"`
+	DryRun   bool      `json:"dryRun,omitempty"`
+}
+
+// Warning describes data missing from a response, or replaced by a
+// fallback, because a non-critical dependency failed.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// betOptions tune placeBet. When round is not empty the match must belong
+// to that round. A dry run validates the bet all the same but neither
+// stores nor announces it. A player places the bet for them instead of the
+// caller, for admins importing bets. An imported bet is a past one, placed
+// at placedAt unless zero, on a match that may have started: it is neither
+// held to the betting windows nor announced. A bet placed as the leg of an
+// accumulator carries its id and is announced once the whole accumulator
+// is stored, by announceBet; the last leg stores the bet.created events of
+// the legs before it with its own. A queued bet took its quota when
+// accepted.
+type betOptions struct {
+	round       string
+	dryRun      bool
+	player      string
+	imported    bool
+	placedAt    time.Time
+	accumulator string
+	lastLeg     bool
+	legEvents   []*OutboxEntry
+	queued      bool
+}
 
-	match, matchStatus, matchErr := match(c)
-	player, playerStatus, playerErr := player(c)
-	champ, champStatus, champErr := championship(c)
+// placeBet validates and enriches the requested bet, then stores it. The
+// services listed in CRITICAL_DEPENDENCIES are required; the others fall
+// back (see degraded.go) and the bet is stored with a warning per fallback.
+func placeBet(c echo.Context, bet *Bet, opts betOptions) (*Bet, []Warning, error) {
+	if err := validateBet(bet); err != nil {
+		return nil, nil, err
+	}
+	b, warnings, err := buildBet(c, bet, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.dryRun {
+		b.ID = ""
+		return b, warnings, checkExternalRef(b)
+	}
+	// the quota counts the bets stored only, once every check passed;
+	// admins placing bets for players are not held to it, an accumulator
+	// counts once and so does a bet retried in the background
+	if !opts.imported && opts.player == "" && opts.accumulator == "" && !opts.queued {
+		if err := quotas.take(c); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := storeBet(c, b, opts); err != nil {
+		return nil, nil, err
+	}
+	return b, warnings, nil
+}
 
-	if hasError(matchErr, playerErr, champErr) {
-		return c.JSON(http.StatusServiceUnavailable, &Error{Errors: map[string]int{
-			"players":       playerStatus,
-			"matches":       matchStatus,
-			"championships": champStatus,
-		}})
+// buildBet checks the requested bet, validated already, against its
+// match, player and championship, and builds the bet to store.
+func buildBet(c echo.Context, bet *Bet, opts betOptions) (*Bet, []Warning, error) {
+	start := time.Now()
+	match, matchStatus, matchErr := match(c, bet.Match)
+	matchCall := callSince(start, matchStatus, matchErr)
+	start = time.Now()
+	player, playerStatus, playerErr := opts.player, http.StatusOK, error(nil)
+	if player == "" {
+		player, playerStatus, playerErr = identities.Player(c)
+	}
+	if he, ok := playerErr.(*echo.HTTPError); ok {
+		return nil, nil, he
+	}
+	playerCall := callSince(start, playerStatus, playerErr)
+	start = time.Now()
+	champ, champStatus, champErr := championship(c, bet.Championship)
+	champCall := callSince(start, champStatus, champErr)
+
+	var warnings []Warning
+	if matchErr != nil && outage(matchStatus) {
+		if m, ok := matchFallback(c, bet.Match); ok {
+			match, matchErr, matchCall.optional = m, nil, true
+			warnings = append(warnings, degradedWarning("match_unavailable", "matches", matchStatus, "the match is the last one known"))
+		}
+	}
+	if playerErr != nil && outage(playerStatus) {
+		if email, ok := playerFallback(c); ok {
+			player, playerErr, playerCall.optional = email, nil, true
+			warnings = append(warnings, degradedWarning("player_unavailable", "players", playerStatus, "the player is the email of the token"))
+		}
+	}
+	criticalChampErr := champErr
+	if !critical("championships") {
+		criticalChampErr, champCall.optional = nil, true
+	}
+	if hasError(matchErr, playerErr, criticalChampErr) {
+		return nil, nil, &dependencyError{calls: map[string]dependencyCall{
+			"players":       playerCall,
+			"matches":       matchCall,
+			"championships": champCall,
+		}}
+	}
+	if !opts.imported {
+		if err := checkMatchStatus(tenant(c), bet.Match, match.Status); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.round != "" && match.Round != opts.round {
+		return nil, nil, echo.NewHTTPError(http.StatusUnprocessableEntity, "match does not belong to round "+opts.round)
+	}
+	if champErr != nil {
+		var fallback string
+		champ, fallback = championshipFallback(c, bet.Championship, match)
+		warnings = append(warnings, degradedWarning("championship_unavailable", "championships", champStatus, fallback))
 	}
 
+	championshipID := champ.ID
+	if championshipID == "" {
+		championshipID = bet.Championship
+	}
+	if !opts.imported {
+		if err := checkBetWindow(tenant(c), championshipID, match.Round, requestClock(c).Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := checkStake(bet.Stake, champ.Stakes, championshipID); err != nil {
+		return nil, nil, err
+	}
+	if err := checkScorePolicy(bet.HomeTeamScore, bet.AwayTeamScore, bet.Shootout, champ.Policy, match); err != nil {
+		return nil, nil, err
+	}
 	b := &Bet{
-		HomeTeamScore: strconv.Itoa(2),
-		AwayTeamScore: strconv.Itoa(3),
-		Championship:  champ,
-		Match:         match.String(),
-		Email:         player,
+		ID:             newUUIDv7(),
+		Tenant:         tenant(c),
+		ExternalRef:    bet.ExternalRef,
+		HomeTeamScore:  bet.HomeTeamScore,
+		AwayTeamScore:  bet.AwayTeamScore,
+		Stake:          bet.Stake,
+		Shootout:       bet.Shootout,
+		Championship:   champ.Title,
+		Match:          match.String(),
+		Email:          normalizeEmail(player),
+		MatchID:        bet.Match,
+		MatchInfo:      match,
+		ChampionshipID: championshipID,
+		Round:          match.Round,
+		CreatedAt:      requestClock(c).Now(),
+		Settlement:     &Settlement{Status: SettlementPending},
+		AccumulatorID:  opts.accumulator,
+	}
+	if !opts.placedAt.IsZero() {
+		b.CreatedAt = opts.placedAt.UTC()
+	}
+	return b, warnings, nil
+}
+
+// storeBet saves a bet built by buildBet and, unless it is the leg of an
+// accumulator, announces it. The bet.created event is stored with the
+// bet, so it can't be lost; an accumulator stores those of its legs with
+// its last leg.
+func storeBet(c echo.Context, b *Bet, opts betOptions) error {
+	entries := opts.legEvents
+	if !opts.imported && (opts.accumulator == "" || opts.lastLeg) {
+		entry, err := betCreated(b)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := bets.SaveWithEvents(b, entries); err == errExternalRefTaken {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	} else if err != nil {
+		log.Error().Err(err).Msg("failed to store the bet")
+		return err
 	}
-	return c.JSON(http.StatusCreated, b)
+	if opts.accumulator == "" {
+		announceBet(c, b, opts.imported)
+	}
+	return nil
+}
+
+// betCreated is the outbox entry of the bet.created event of a bet about
+// to be stored: nil without the event bus, or with the events flag off for
+// its tenant. A new bet is stamped first, the event carrying its
+// updatedAt.
+func betCreated(b *Bet) (*OutboxEntry, error) {
+	if events == nil || !features.enabled(flagEvents, b.Tenant) {
+		return nil, nil
+	}
+	if b.UpdatedAt.IsZero() {
+		b.UpdatedAt = clock.Now()
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return events.entry(config.Events.BetCreatedTopic, Event{ID: newID(), Type: "bet.created", OccurredAt: b.CreatedAt, Data: data})
+}
+
+// announceBet audits a bet just stored and, unless imported, tells the
+// webhooks and the player; its bet.created event was stored with it.
+func announceBet(c echo.Context, b *Bet, imported bool) {
+	data := map[string]string{
+		"matchId":       b.MatchID,
+		"homeTeamScore": b.HomeTeamScore,
+		"awayTeamScore": b.AwayTeamScore,
+	}
+	if b.Stake > 0 {
+		data["stake"] = strconv.FormatInt(b.Stake, 10)
+	}
+	if b.Shootout != "" {
+		data["shootout"] = b.Shootout
+	}
+	if b.AccumulatorID != "" {
+		data["accumulatorId"] = b.AccumulatorID
+	}
+	if imported {
+		audit.record(auditActor(c), "bet.imported", b.ID, data)
+		return
+	}
+	audit.record(auditActor(c), "bet.created", b.ID, data)
+	notifier.Notify(b.Tenant, "bet.created", b)
+	mailer.betPlaced(b)
+}
+
+// checkExternalRef tells, without saving the bet, whether saving it would
+// fail with errExternalRefTaken.
+func checkExternalRef(b *Bet) error {
+	if b.ExternalRef == "" {
+		return nil
+	}
+	taken, err := bets.List(BetFilter{Tenant: b.Tenant, ExternalRef: b.ExternalRef, IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+	if len(taken) > 0 {
+		return echo.NewHTTPError(http.StatusConflict, errExternalRefTaken.Error())
+	}
+	return nil
+}
+
+func validScore(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 0
 }
 
 func hasError(errs ...error) bool {
@@ -131,15 +752,30 @@ func hasError(errs ...error) bool {
 	return r
 }
 
-func match(ctx echo.Context) (*Match, int, error) {
-	req, _ := http.NewRequest("GET", os.Getenv("MATCH_SVC"), nil)
+func match(ctx echo.Context, id string) (*Match, int, error) {
+	return fetchMatch(ctx, serviceURL(tenant(ctx), "MATCH_SVC", id))
+}
+
+func fetchMatch(ctx echo.Context, url string) (*Match, int, error) {
+	if cached, ok := matchCache.Get(url); ok {
+		return cached.(*Match), http.StatusOK, nil
+	}
+	v, status, err := matchCache.Load(url, func() (interface{}, int, error) { return loadMatch(ctx, url) })
+	m, _ := v.(*Match)
+	return m, status, err
+}
+
+// loadMatch calls the matches service, bypassing and then filling the cache.
+func loadMatch(ctx echo.Context, url string) (*Match, int, error) {
+	req, _ := http.NewRequest("GET", url, nil)
 
 	forwardHeaders(ctx, req)
-	res, err := client.Do(req)
+	res, err := callService("matches", req)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to call matches")
 		return nil, 0, err
 	}
+	defer drain(res)
 	status := res.StatusCode
 	if !is2xx(status) {
 		return nil, status, errors.New(res.Status)
@@ -149,86 +785,55 @@ func match(ctx echo.Context) (*Match, int, error) {
 		log.Error().Err(jsonErr).Msg("failed to read matches response body")
 		return nil, 0, jsonErr
 	}
+	matchCache.Set(url, data)
+	lastKnown.Set(url, data)
 
 	return data, status, nil
 }
 
+// forwardHeaders copies the caller's auth and tracing headers; background
+// calls pass a nil context and forward nothing.
 func forwardHeaders(ctx echo.Context, r *http.Request) {
-	incomingHeaders := []string{
-		"Authorization",
-		"x-version",
-
-		// open tracing
-		"x-request-id",
-		"x-b3-traceid",
-		"x-b3-spanid",
-		"x-b3-parentspanid",
-		"x-b3-sampled",
-		"x-b3-flags",
-		"x-ot-span-context",
-	}
-	for _, th := range incomingHeaders {
-		h := ctx.Request().Header.Get(th)
-		if h != "" {
-			r.Header.Set(th, h)
-		}
+	if ctx == nil {
+		return
 	}
+	forwarded.copy(ctx.Request().Header, r.Header)
+	chaos.forward(ctx.Request().Header, r.Header)
 }
 
-func championship(ctx echo.Context) (string, int, error) {
-	req, _ := http.NewRequest("GET", os.Getenv("CHAMPIONSHIP_SVC"), nil)
-
-	forwardHeaders(ctx, req)
-	res, err := client.Do(req)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to call championships")
-		return "", 0, err
+func fetchChampionship(ctx echo.Context, url string) (*Championship, int, error) {
+	if cached, ok := championshipCache.Get(url); ok {
+		return cached.(*Championship), http.StatusOK, nil
 	}
-	status := res.StatusCode
-	if !is2xx(status) {
-		return "", status, errors.New(res.Status)
-	}
-	body, readErr := ioutil.ReadAll(res.Body)
-	if readErr != nil {
-		log.Error().Err(err).Msg("failed to read matches response body")
-		return "", status, readErr
-	}
-
-	var data map[string]string
-
-	if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
-		log.Error().Err(err).Msg("failed to read matches response body")
-		return "", status, jsonErr
-	}
-	return data["title"], status, nil
+	v, status, err := championshipCache.Load(url, func() (interface{}, int, error) { return loadChampionship(ctx, url) })
+	champ, _ := v.(*Championship)
+	return champ, status, err
 }
 
-func player(ctx echo.Context) (string, int, error) {
-	req, _ := http.NewRequest("GET", os.Getenv("PLAYER_SVC"), nil)
+// loadChampionship calls the championships service, bypassing and then
+// filling the cache.
+func loadChampionship(ctx echo.Context, url string) (*Championship, int, error) {
+	req, _ := http.NewRequest("GET", url, nil)
 
 	forwardHeaders(ctx, req)
-	res, err := client.Do(req)
+	res, err := callService("championships", req)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to call players")
-		return "", 0, err
+		log.Error().Err(err).Msg("failed to call championships")
+		return nil, 0, err
 	}
+	defer drain(res)
 	status := res.StatusCode
 	if !is2xx(status) {
-		return "", status, errors.New(res.Status)
-	}
-	body, readErr := ioutil.ReadAll(res.Body)
-	if readErr != nil {
-		log.Error().Err(err).Msg("failed to read players response body")
-		return "", status, readErr
+		return nil, status, errors.New(res.Status)
 	}
-
-	var data map[string]string
-
-	if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
-		log.Error().Err(err).Msg("failed to read players response body")
-		return "", status, jsonErr
+	data := &Championship{}
+	if jsonErr := json.NewDecoder(res.Body).Decode(data); jsonErr != nil {
+		log.Error().Err(jsonErr).Msg("failed to read championships response body")
+		return nil, status, jsonErr
 	}
-	return data["email"], status, nil
+	championshipCache.Set(url, data)
+	lastKnown.Set(url, data)
+	return data, status, nil
 }
 
 func is2xx(status int) bool {
@@ -236,19 +841,70 @@ func is2xx(status int) bool {
 }
 
 type Bet struct {
+	ID            string `json:"id,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+	ExternalRef   string `json:"externalRef,omitempty"`
 	HomeTeamScore string `json:"homeTeamScore,omitempty"`
 	AwayTeamScore string `json:"awayTeamScore,omitempty"`
-	Championship  string `json:"championship,omitempty"`
-	Match         string `json:"match,omitempty"`
-	Email         string `json:"email,omitempty"`
+	// Stake is what a bet of a paid pool is worth, in the minor unit of
+	// the championship's currency; see StakeLimits.
+	Stake int64 `json:"stake,omitempty"`
+	// Shootout is who wins the penalty shootout, home or away, of the
+	// draws predicted on knockout matches; see ScorePolicy.
+	Shootout       string      `json:"shootout,omitempty"`
+	Championship   string      `json:"championship,omitempty"`
+	Match          string      `json:"match,omitempty"`
+	Email          string      `json:"email,omitempty"`
+	EmailIndex     string      `json:"emailIndex,omitempty"`
+	MatchID        string      `json:"matchId,omitempty"`
+	MatchInfo      *Match      `json:"matchInfo,omitempty"`
+	ChampionshipID string      `json:"championshipId,omitempty"`
+	Round          string      `json:"round,omitempty"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	UpdatedAt      time.Time   `json:"updatedAt"`
+	Settlement     *Settlement `json:"settlement,omitempty"`
+	DeletedAt      *time.Time  `json:"deletedAt,omitempty"`
+	// AccumulatorID is the accumulator the bet is a leg of, if any; see
+	// Accumulator.
+	AccumulatorID string `json:"accumulatorId,omitempty"`
+	// Legs are the bets of an accumulator requested, placed as bets of
+	// their own; they are never stored.
+	Legs []*Bet `json:"legs,omitempty"`
+}
+
+func (b *Bet) clone() *Bet {
+	c := *b
+	if b.MatchInfo != nil {
+		m := *b.MatchInfo
+		c.MatchInfo = &m
+	}
+	if b.Settlement != nil {
+		s := *b.Settlement
+		c.Settlement = &s
+	}
+	if b.DeletedAt != nil {
+		t := *b.DeletedAt
+		c.DeletedAt = &t
+	}
+	return &c
 }
 
-type Error struct {
-	Errors map[string]int `json:"errors,omitempty"`
+type Championship struct {
+	ID     string   `json:"id"`
+	Title  string   `json:"title"`
+	Rounds []string `json:"rounds,omitempty"`
+	// Stakes is nil for the championships taking no stakes.
+	Stakes *StakeLimits `json:"stakes,omitempty"`
+	// Policy is nil for the championships taking any score.
+	Policy *ScorePolicy `json:"scorePolicy,omitempty"`
 }
 
 type Match struct {
+	ID           string    `json:"id,omitempty"`
 	Date         time.Time `json:"date"`
+	Round        string    `json:"round,omitempty"`
+	Status       string    `json:"status,omitempty"`
+	Odds         *Odds     `json:"odds,omitempty"`
 	Championship struct {
 		Name  string `json:"name"`
 		Stage string `json:"stage"`
@@ -265,8 +921,14 @@ type Match struct {
 	} `json:"teams"`
 }
 
+// String writes the match in English, as stored with the bets.
 func (m *Match) String() string {
+	return m.Format(locales[englishTag])
+}
+
+// Format writes the match with the date and score formats of the locale.
+func (m *Match) Format(l *Locale) string {
 	h := m.Teams.Home
 	a := m.Teams.Away
-	return fmt.Sprintf("%s - %s %dx%d %s (%s)", m.Date.Format("2006-01-02"), h.Name, h.Score, a.Score, a.Name, m.Championship.Stage)
+	return fmt.Sprintf("%s - %s %s %s (%s)", m.Date.Format(l.DateLayout), h.Name, fmt.Sprintf(l.Score, h.Score, a.Score), a.Name, m.Championship.Stage)
 }
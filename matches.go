@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// MatchDetails merges a match with its championship, so the bet form
+// renders from a single call.
+type MatchDetails struct {
+	ID           string              `json:"id"`
+	Date         time.Time           `json:"date"`
+	Round        string              `json:"round,omitempty"`
+	Teams        interface{}         `json:"teams"`
+	Championship ChampionshipDetails `json:"championship"`
+}
+
+type ChampionshipDetails struct {
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Stage string `json:"stage,omitempty"`
+}
+
+// serviceURL reads the service URL from the tenant overrides or else the
+// environment, replacing its {id} placeholder when present. URLs without
+// one are used as they are.
+func serviceURL(tenant, env, id string) string {
+	return strings.Replace(serviceBase(tenant, env), "{id}", url.PathEscape(id), -1)
+}
+
+// GetMatchDetails fetches the match and its championship (?championship=
+// fills the CHAMPIONSHIP_SVC placeholder) concurrently, both through the
+// caches, and merges them.
+func GetMatchDetails(c echo.Context) error {
+	type champResult struct {
+		champ *Championship
+		call  dependencyCall
+	}
+	champDone := make(chan champResult, 1)
+	go func() {
+		start := time.Now()
+		champ, status, err := championship(c, c.QueryParam("championship"))
+		champDone <- champResult{champ, callSince(start, status, err)}
+	}()
+	start := time.Now()
+	match, matchStatus, matchErr := fetchMatch(c, serviceURL(tenant(c), "MATCH_SVC", c.Param("id")))
+	matchCall := callSince(start, matchStatus, matchErr)
+	cr := <-champDone
+
+	if matchStatus == http.StatusNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "match not found")
+	}
+	if hasError(matchErr, cr.call.err) {
+		return betError(&dependencyError{calls: map[string]dependencyCall{
+			"matches":       matchCall,
+			"championships": cr.call,
+		}})
+	}
+	id := match.ID
+	if id == "" {
+		id = c.Param("id")
+	}
+	return c.JSON(http.StatusOK, &MatchDetails{
+		ID:    id,
+		Date:  match.Date,
+		Round: match.Round,
+		Teams: match.Teams,
+		Championship: ChampionshipDetails{
+			ID:    cr.champ.ID,
+			Title: cr.champ.Title,
+			Name:  match.Championship.Name,
+			Stage: match.Championship.Stage,
+		},
+	})
+}
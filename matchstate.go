@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// MatchState is the last status polled for a match, and whether bets on it
+// are locked: once locked, bets can't be placed, edited or deleted.
+// Locked is also set by admins, overriding the polled status until it
+// changes again.
+type MatchState struct {
+	Tenant    string    `json:"tenant"`
+	MatchID   string    `json:"matchId"`
+	Status    string    `json:"status"`
+	Locked    bool      `json:"locked"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type MatchStateStore interface {
+	// Get returns nil for a match never polled nor locked.
+	Get(tenant, matchID string) (*MatchState, error)
+	Put(s *MatchState) error
+}
+
+// MatchStatusConfig drives the polling of the status of the matches
+// drawing bets, from Ahead before kickoff until they reach a status
+// in LockStatuses. A zero interval disables polling.
+type MatchStatusConfig struct {
+	Interval     time.Duration
+	Ahead        time.Duration
+	Behind       time.Duration
+	LockStatuses []string
+}
+
+func (cfg MatchStatusConfig) locks(status string) bool {
+	for _, s := range cfg.LockStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+var errMatchLocked = echo.NewHTTPError(http.StatusConflict, "the match has started, bets on it are locked")
+
+// checkMatchOpen rejects changes to the bets of locked matches, from the
+// stored state alone.
+func checkMatchOpen(tenant, matchID string) error {
+	s, err := matchStates.Get(tenant, matchID)
+	if err != nil {
+		return err
+	}
+	if s != nil && s.Locked {
+		return errMatchLocked
+	}
+	return nil
+}
+
+// checkMatchStatus rejects new bets on a locked match, as checkMatchOpen,
+// and on a match whose status, just fetched, locks it before the poller
+// noticed: the state is stored then, so edits and later bets see it. A
+// stored state of the same status is left as is, an admin's unlock
+// included.
+func checkMatchStatus(tenant, matchID, status string) error {
+	s, err := matchStates.Get(tenant, matchID)
+	if err != nil {
+		return err
+	}
+	if s != nil && s.Locked {
+		return errMatchLocked
+	}
+	if (s != nil && s.Status == status) || !config.MatchStatus.locks(status) {
+		return nil
+	}
+	next := &MatchState{Tenant: tenant, MatchID: matchID, Status: status, Locked: true, UpdatedAt: clock.Now()}
+	if err := matchStates.Put(next); err != nil {
+		return err
+	}
+	log.Info().Str("tenant", tenant).Str("match", matchID).Str("status", status).Bool("locked", true).Msg("match status changed")
+	return errMatchLocked
+}
+
+type matchStatusPoller struct {
+	cfg MatchStatusConfig
+}
+
+func (p *matchStatusPoller) Run(ctx context.Context) {
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			err := withLock("match-status", "poll", p.cfg.Interval, func(context.Context) error { return p.poll() })
+			if err != nil && err != errLockBusy {
+				log.Error().Err(err).Msg("failed to poll the match statuses")
+			}
+		}
+	}
+}
+
+// poll refreshes the state of the matches kicking off within Ahead, or
+// that kicked off up to Behind ago, skipping those locked already.
+func (p *matchStatusPoller) poll() error {
+	now := clock.Now()
+	list, err := bets.List(BetFilter{From: now.Add(-p.cfg.Behind), To: now.Add(p.cfg.Ahead)})
+	if err != nil {
+		return err
+	}
+	seen := map[hotMatch]bool{}
+	for _, b := range list {
+		m := hotMatch{b.Tenant, b.MatchID}
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		if err := p.refresh(m); err != nil {
+			log.Warn().Err(err).Str("tenant", m.tenant).Str("match", m.match).Msg("failed to refresh the match status")
+		}
+	}
+	return nil
+}
+
+func (p *matchStatusPoller) refresh(m hotMatch) error {
+	s, err := matchStates.Get(m.tenant, m.match)
+	if err != nil || (s != nil && s.Locked) {
+		return err
+	}
+	match, _, err := loadMatch(nil, serviceURL(m.tenant, "MATCH_SVC", m.match))
+	if err != nil {
+		return err
+	}
+	if s != nil && s.Status == match.Status {
+		return nil
+	}
+	next := &MatchState{Tenant: m.tenant, MatchID: m.match, Status: match.Status, Locked: p.cfg.locks(match.Status), UpdatedAt: clock.Now()}
+	if err := matchStates.Put(next); err != nil {
+		return err
+	}
+	log.Info().Str("tenant", m.tenant).Str("match", m.match).Str("status", next.Status).Bool("locked", next.Locked).Msg("match status changed")
+	return nil
+}
+
+func GetMatchState(c echo.Context) error {
+	s, err := matchStates.Get(tenant(c), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "match state not known")
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+type matchLockRequest struct {
+	Locked bool `json:"locked"`
+}
+
+// LockMatch locks or unlocks the bets of a match by hand, e.g. when the
+// matches service is late to report a kickoff.
+func LockMatch(c echo.Context) error {
+	req := &matchLockRequest{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	s, err := matchStates.Get(tenant(c), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		s = &MatchState{Tenant: tenant(c), MatchID: c.Param("id")}
+	}
+	s.Locked, s.UpdatedAt = req.Locked, clock.Now()
+	if err := matchStates.Put(s); err != nil {
+		return err
+	}
+	log.Info().Str("match", s.MatchID).Bool("locked", s.Locked).Str("actor", auditActor(c)).Msg("match lock changed by hand")
+	return c.JSON(http.StatusOK, s)
+}
+
+type memoryMatchStates struct {
+	mu     sync.Mutex
+	states map[hotMatch]*MatchState
+}
+
+func newMemoryMatchStates() *memoryMatchStates {
+	return &memoryMatchStates{states: map[hotMatch]*MatchState{}}
+}
+
+func (m *memoryMatchStates) Get(tenant, matchID string) (*MatchState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.states[hotMatch{tenant, matchID}]
+	if !ok {
+		return nil, nil
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *memoryMatchStates) Put(s *MatchState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *s
+	m.states[hotMatch{s.Tenant, s.MatchID}] = &c
+	return nil
+}
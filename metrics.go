@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bets",
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of requests currently being served, per endpoint.",
+	}, []string{"method", "path"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bets",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of served requests, per endpoint and status code.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "path", "status"})
+
+	hedgesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bets",
+		Subsystem: "upstream",
+		Name:      "hedges_total",
+		Help:      "Hedge requests sent because the first attempt was slow, per service.",
+	}, []string{"service"})
+
+	hedgesWon = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bets",
+		Subsystem: "upstream",
+		Name:      "hedge_wins_total",
+		Help:      "Hedge requests answering before the first attempt, per service.",
+	}, []string{"service"})
+
+	schemaDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bets",
+		Subsystem: "upstream",
+		Name:      "schema_drift_fields",
+		Help:      "Fields of the last sampled answer new to, or missing from, the decoder, per service.",
+	}, []string{"service", "change"})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		requestsInFlight,
+		requestDuration,
+		hedgesSent,
+		hedgesWon,
+		schemaDrift,
+	)
+}
+
+// Metrics exposes the registry, negotiating the OpenMetrics format so
+// exemplars reach scrapers that ask for them.
+func Metrics() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
+}
+
+// MetricsMiddleware tracks in-flight requests and latency per route. Latency
+// observations carry the incoming trace id as an exemplar, so a slow bucket
+// can be followed to an example trace.
+func MetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		path := c.Path()
+		if path == "" {
+			path = "unmatched"
+		}
+		method := c.Request().Method
+		inFlight := requestsInFlight.WithLabelValues(method, path)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if err != nil && !c.Response().Committed {
+			status = errorStatus(err)
+		}
+		observer := requestDuration.WithLabelValues(method, path, strconv.Itoa(status))
+		observe(observer, time.Since(start).Seconds(), traceID(c.Request()))
+		return err
+	}
+}
+
+// observe records v with the trace as exemplar; a trace id that isn't one
+// is left out, as the client library panics on exemplars over 64 runes.
+func observe(o prometheus.Observer, v float64, trace string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && validTraceID(trace) {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": trace})
+		return
+	}
+	o.Observe(v)
+}
+
+// traceID extracts the trace id from B3 or W3C trace context headers;
+// the callers set them, so ids other than 16 or 32 lower case hex digits
+// are ignored.
+func traceID(r *http.Request) string {
+	if id := r.Header.Get("x-b3-traceid"); validTraceID(id) {
+		return id
+	}
+	// traceparent: version-traceid-parentid-flags
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && validTraceID(parts[1]) {
+		return parts[1]
+	}
+	return ""
+}
+
+func validTraceID(id string) bool {
+	if len(id) != 16 && len(id) != 32 {
+		return false
+	}
+	for _, r := range id {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
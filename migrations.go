@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Migration is one schema change. Versions are applied in ascending order
+// and must never be edited once released; add a new one instead.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_bets",
+		Up: `CREATE TABLE bets (
+	id              TEXT PRIMARY KEY,
+	email           TEXT NOT NULL,
+	email_index     TEXT NOT NULL DEFAULT '',
+	home_score      TEXT NOT NULL,
+	away_score      TEXT NOT NULL,
+	championship    TEXT NOT NULL DEFAULT '',
+	championship_id TEXT NOT NULL DEFAULT '',
+	round           TEXT NOT NULL DEFAULT '',
+	match_id        TEXT NOT NULL,
+	match           TEXT NOT NULL DEFAULT '',
+	match_info      JSONB,
+	match_date      TIMESTAMPTZ,
+	created_at      TIMESTAMPTZ NOT NULL,
+	settlement      TEXT NOT NULL DEFAULT 'pending',
+	result          TEXT NOT NULL DEFAULT '',
+	points          INTEGER NOT NULL DEFAULT 0,
+	settled_at      TIMESTAMPTZ
+);
+CREATE INDEX bets_email_idx ON bets (email);
+CREATE INDEX bets_email_index_idx ON bets (email_index);
+CREATE INDEX bets_match_idx ON bets (match_id);
+CREATE INDEX bets_championship_round_idx ON bets (championship_id, round);`,
+		Down: `DROP TABLE bets;`,
+	},
+	{
+		Version: 2,
+		Name:    "create_audit_log",
+		// data is TEXT rather than JSONB: the hash covers the exact bytes
+		Up: `CREATE TABLE audit_log (
+	seq       BIGINT PRIMARY KEY,
+	at        TIMESTAMPTZ NOT NULL,
+	actor     TEXT NOT NULL,
+	action    TEXT NOT NULL,
+	bet_id    TEXT NOT NULL,
+	data      TEXT NOT NULL DEFAULT '',
+	prev_hash TEXT NOT NULL,
+	hash      TEXT NOT NULL
+);
+CREATE INDEX audit_log_bet_idx ON audit_log (bet_id);`,
+		Down: `DROP TABLE audit_log;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_locks",
+		Up: `CREATE TABLE locks (
+	name       TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);`,
+		Down: `DROP TABLE locks;`,
+	},
+	{
+		Version: 4,
+		Name:    "create_outbox",
+		Up: `CREATE TABLE outbox (
+	id              TEXT PRIMARY KEY,
+	topic           TEXT NOT NULL,
+	payload         TEXT NOT NULL,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	last_error      TEXT NOT NULL DEFAULT '',
+	created_at      TIMESTAMPTZ NOT NULL,
+	next_attempt_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX outbox_next_attempt_idx ON outbox (next_attempt_at);
+CREATE TABLE dead_letters (
+	id         TEXT PRIMARY KEY,
+	topic      TEXT NOT NULL,
+	payload    TEXT NOT NULL,
+	attempts   INTEGER NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	dead_at    TIMESTAMPTZ NOT NULL
+);`,
+		Down: `DROP TABLE dead_letters;
+DROP TABLE outbox;`,
+	},
+	{
+		Version: 5,
+		Name:    "add_bets_tenant",
+		Up: `ALTER TABLE bets ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX bets_tenant_championship_round_idx ON bets (tenant, championship_id, round);`,
+		Down: `ALTER TABLE bets DROP COLUMN tenant;`,
+	},
+	{
+		Version: 6,
+		Name:    "add_bets_external_ref",
+		Up: `ALTER TABLE bets ADD COLUMN external_ref TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX bets_tenant_external_ref_idx ON bets (tenant, external_ref) WHERE external_ref <> '';`,
+		Down: `ALTER TABLE bets DROP COLUMN external_ref;`,
+	},
+	{
+		Version: 7,
+		Name:    "create_webhook_subscriptions",
+		Up: `CREATE TABLE webhook_subscriptions (
+	id         TEXT PRIMARY KEY,
+	tenant     TEXT NOT NULL,
+	url        TEXT NOT NULL,
+	secret     TEXT NOT NULL,
+	events     TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX webhook_subscriptions_tenant_idx ON webhook_subscriptions (tenant);
+CREATE TABLE webhook_deliveries (
+	id              TEXT PRIMARY KEY,
+	subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+	event           TEXT NOT NULL,
+	status          TEXT NOT NULL,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	response_status INTEGER NOT NULL DEFAULT 0,
+	last_error      TEXT NOT NULL DEFAULT '',
+	created_at      TIMESTAMPTZ NOT NULL,
+	delivered_at    TIMESTAMPTZ
+);
+CREATE INDEX webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, created_at);`,
+		Down: `DROP TABLE webhook_deliveries;
+DROP TABLE webhook_subscriptions;`,
+	},
+	{
+		Version: 8,
+		Name:    "create_pool_domains",
+		Up: `CREATE TABLE pool_domains (
+	host         TEXT PRIMARY KEY,
+	tenant       TEXT NOT NULL,
+	pool         TEXT NOT NULL,
+	championship TEXT NOT NULL,
+	title        TEXT NOT NULL DEFAULT '',
+	cert_file    TEXT NOT NULL DEFAULT '',
+	key_file     TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX pool_domains_tenant_idx ON pool_domains (tenant);`,
+		Down: `DROP TABLE pool_domains;`,
+	},
+	{
+		Version: 9,
+		Name:    "add_bets_deleted_at",
+		// the audit log was append-only by convention; enforce it
+		Up: `ALTER TABLE bets ADD COLUMN deleted_at TIMESTAMPTZ;
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();`,
+		Down: `DROP TRIGGER audit_log_append_only ON audit_log;
+DROP FUNCTION audit_log_append_only();
+ALTER TABLE bets DROP COLUMN deleted_at;`,
+	},
+	{
+		Version: 10,
+		Name:    "create_warehouse_watermarks",
+		Up: `ALTER TABLE bets ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX bets_updated_at_idx ON bets (updated_at);
+CREATE INDEX audit_log_at_idx ON audit_log (at);
+CREATE TABLE warehouse_watermarks (
+	name TEXT PRIMARY KEY,
+	at   TIMESTAMPTZ NOT NULL
+);`,
+		Down: `DROP TABLE warehouse_watermarks;
+DROP INDEX audit_log_at_idx;
+ALTER TABLE bets DROP COLUMN updated_at;`,
+	},
+	{
+		Version: 11,
+		Name:    "create_daily_stats",
+		Up: `CREATE INDEX bets_created_at_idx ON bets (created_at);
+CREATE TABLE daily_stats (
+	day             DATE NOT NULL,
+	tenant          TEXT NOT NULL,
+	championship_id TEXT NOT NULL,
+	bets            INTEGER NOT NULL,
+	players         INTEGER NOT NULL,
+	settled         INTEGER NOT NULL,
+	points          INTEGER NOT NULL,
+	computed_at     TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, day, championship_id)
+);`,
+		Down: `DROP TABLE daily_stats;
+DROP INDEX bets_created_at_idx;`,
+	},
+	{
+		Version: 12,
+		Name:    "create_match_states",
+		Up: `CREATE TABLE match_states (
+	tenant     TEXT NOT NULL,
+	match_id   TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	locked     BOOLEAN NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, match_id)
+);`,
+		Down: `DROP TABLE match_states;`,
+	},
+	{
+		Version: 13,
+		Name:    "create_player_events",
+		Up: `CREATE TABLE player_events (
+	id     TEXT PRIMARY KEY,
+	tenant TEXT NOT NULL,
+	player TEXT NOT NULL,
+	at     TIMESTAMPTZ NOT NULL,
+	kind   TEXT NOT NULL,
+	bet_id TEXT NOT NULL DEFAULT '',
+	data   TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX player_events_player_idx ON player_events (tenant, player, at);`,
+		Down: `DROP TABLE player_events;`,
+	},
+	{
+		Version: 14,
+		Name:    "create_users",
+		Up: `CREATE TABLE users (
+	email         TEXT PRIMARY KEY,
+	tenant        TEXT NOT NULL,
+	password_hash TEXT NOT NULL,
+	roles         TEXT[] NOT NULL DEFAULT '{}',
+	created_at    TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX users_tenant_idx ON users (tenant);`,
+		Down: `DROP TABLE users;`,
+	},
+	{
+		Version: 15,
+		Name:    "create_round_awards",
+		Up: `CREATE TABLE round_awards (
+	tenant          TEXT NOT NULL,
+	championship_id TEXT NOT NULL,
+	round           TEXT NOT NULL,
+	awards          TEXT NOT NULL,
+	computed_at     TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, championship_id, round)
+);`,
+		Down: `DROP TABLE round_awards;`,
+	},
+	{
+		Version: 16,
+		Name:    "create_players",
+		Up: `CREATE TABLE players (
+	tenant     TEXT NOT NULL,
+	player     TEXT NOT NULL,
+	subject    TEXT NOT NULL DEFAULT '',
+	email      TEXT NOT NULL,
+	name       TEXT NOT NULL DEFAULT '',
+	attributes TEXT NOT NULL DEFAULT '{}',
+	first_seen TIMESTAMPTZ NOT NULL,
+	fetched_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, player)
+);
+CREATE INDEX players_subject_idx ON players (tenant, subject, fetched_at);`,
+		Down: `DROP TABLE players;`,
+	},
+	{
+		Version: 17,
+		Name:    "add_bet_stakes",
+		Up:      `ALTER TABLE bets ADD COLUMN stake BIGINT NOT NULL DEFAULT 0;`,
+		Down:    `ALTER TABLE bets DROP COLUMN stake;`,
+	},
+	{
+		Version: 18,
+		Name:    "create_notification_preferences",
+		Up: `CREATE TABLE notification_preferences (
+	tenant     TEXT NOT NULL,
+	player     TEXT NOT NULL,
+	disabled   TEXT[] NOT NULL DEFAULT '{}',
+	updated_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, player)
+);`,
+		Down: `DROP TABLE notification_preferences;`,
+	},
+	{
+		Version: 19,
+		Name:    "create_reminders",
+		Up: `CREATE TABLE reminders (
+	tenant   TEXT NOT NULL,
+	match_id TEXT NOT NULL,
+	player   TEXT NOT NULL,
+	sent_at  TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, match_id, player)
+);`,
+		Down: `DROP TABLE reminders;`,
+	},
+	{
+		Version: 20,
+		Name:    "create_bet_requests",
+		Up: `CREATE TABLE bet_requests (
+	id         TEXT PRIMARY KEY,
+	tenant     TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	result     JSONB,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);`,
+		Down: `DROP TABLE bet_requests;`,
+	},
+	{
+		Version: 21,
+		Name:    "create_bet_windows",
+		Up: `CREATE TABLE bet_windows (
+	tenant          TEXT NOT NULL,
+	championship_id TEXT NOT NULL,
+	round           TEXT NOT NULL DEFAULT '',
+	opens_at        TIMESTAMPTZ,
+	closes_at       TIMESTAMPTZ,
+	blackouts       JSONB,
+	updated_at      TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, championship_id, round)
+);`,
+		Down: `DROP TABLE bet_windows;`,
+	},
+	{
+		Version: 22,
+		Name:    "add_bet_shootouts",
+		Up:      `ALTER TABLE bets ADD COLUMN shootout TEXT NOT NULL DEFAULT '';`,
+		Down:    `ALTER TABLE bets DROP COLUMN shootout;`,
+	},
+	{
+		Version: 23,
+		Name:    "add_bet_accumulators",
+		Up: `ALTER TABLE bets ADD COLUMN accumulator_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX bets_accumulator_id_idx ON bets (tenant, accumulator_id) WHERE accumulator_id <> '';`,
+		Down: `DROP INDEX bets_accumulator_id_idx;
+ALTER TABLE bets DROP COLUMN accumulator_id;`,
+	},
+	{
+		Version: 24,
+		Name:    "index_pending_bet_requests",
+		Up:      `CREATE INDEX bet_requests_pending_idx ON bet_requests (updated_at) WHERE status = 'pending';`,
+		Down:    `DROP INDEX bet_requests_pending_idx;`,
+	},
+	{
+		Version: 25,
+		Name:    "add_bet_request_owners",
+		Up:      `ALTER TABLE bet_requests ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+		Down:    `ALTER TABLE bet_requests DROP COLUMN owner;`,
+	},
+}
+
+// migrationLock is the advisory lock id serializing replicas migrating at
+// the same time on startup.
+const migrationLock = 7262388
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL
+)`)
+	return err
+}
+
+func appliedVersions(db *sql.DB) (map[int]bool, error) {
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]bool{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// withMigrationLock runs fn holding the advisory lock on a dedicated
+// connection, since session locks belong to the connection taking them.
+func withMigrationLock(db *sql.DB, fn func() error) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+	return fn()
+}
+
+// migrateUp applies every pending migration, each in its own transaction,
+// and returns how many were applied.
+func migrateUp(db *sql.DB) (int, error) {
+	n := 0
+	err := withMigrationLock(db, func() error {
+		if err := ensureMigrationsTable(db); err != nil {
+			return err
+		}
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range sortedMigrations() {
+			if applied[m.Version] {
+				continue
+			}
+			if err := apply(db, m, m.Up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, m.Name, time.Now()); err != nil {
+				return err
+			}
+			log.Info().Int("version", m.Version).Msg("applied migration " + m.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// migrateDown reverts the latest steps applied migrations.
+func migrateDown(db *sql.DB, steps int) (int, error) {
+	n := 0
+	err := withMigrationLock(db, func() error {
+		if err := ensureMigrationsTable(db); err != nil {
+			return err
+		}
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+		ms := sortedMigrations()
+		for i := len(ms) - 1; i >= 0 && n < steps; i-- {
+			m := ms[i]
+			if !applied[m.Version] {
+				continue
+			}
+			if err := apply(db, m, m.Down, `DELETE FROM schema_migrations WHERE version = $1`); err != nil {
+				return err
+			}
+			log.Info().Int("version", m.Version).Msg("reverted migration " + m.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func apply(db *sql.DB, m Migration, script, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(script); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d %s: %v", m.Version, m.Name, err)
+	}
+	if _, err := tx.Exec(record, append([]interface{}{m.Version}, args...)...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func sortedMigrations() []Migration {
+	ms := append([]Migration(nil), migrations...)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms
+}
+
+// runMigrate implements `bets-app migrate up|down|status`.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "number of migrations to revert with down")
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [-steps N]|status")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	cfg := loadConfig()
+	if cfg.Storage.Driver != "postgres" {
+		return errors.New("migrations need STORAGE_DRIVER=postgres")
+	}
+	db, err := openDatabase(cfg.Storage.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	switch args[0] {
+	case "up":
+		n, err := migrateUp(db)
+		fmt.Fprintf(os.Stdout, "%d migrations applied\n", n)
+		return err
+	case "down":
+		n, err := migrateDown(db, *steps)
+		fmt.Fprintf(os.Stdout, "%d migrations reverted\n", n)
+		return err
+	case "status":
+		if err := ensureMigrationsTable(db); err != nil {
+			return err
+		}
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range sortedMigrations() {
+			state := "pending"
+			if applied[m.Version] {
+				state = "applied"
+			}
+			fmt.Fprintf(os.Stdout, "%4d %-30s %s\n", m.Version, m.Name, state)
+		}
+		return nil
+	}
+	return errors.New("unknown migrate command " + args[0])
+}
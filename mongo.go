@@ -0,0 +1,928 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoTimeout bounds every call to MongoDB, as the repository interface
+// carries no context.
+const mongoTimeout = 10 * time.Second
+
+const mongoExternalRefIndex = "tenant_external_ref"
+
+// mongoBets stores bets as documents of the bets collection, one per bet
+// keyed by its ID.
+type mongoBets struct {
+	coll   *mongo.Collection
+	outbox *mongoOutbox
+}
+
+// mongoBet is the document of a bet.
+type mongoBet struct {
+	ID             string      `bson:"_id"`
+	Tenant         string      `bson:"tenant"`
+	ExternalRef    string      `bson:"externalRef,omitempty"`
+	HomeTeamScore  string      `bson:"homeTeamScore"`
+	AwayTeamScore  string      `bson:"awayTeamScore"`
+	Stake          int64       `bson:"stake,omitempty"`
+	Shootout       string      `bson:"shootout,omitempty"`
+	AccumulatorID  string      `bson:"accumulatorId,omitempty"`
+	Championship   string      `bson:"championship"`
+	Match          string      `bson:"match"`
+	Email          string      `bson:"email"`
+	EmailIndex     string      `bson:"emailIndex"`
+	MatchID        string      `bson:"matchId"`
+	MatchInfo      *Match      `bson:"matchInfo"`
+	ChampionshipID string      `bson:"championshipId"`
+	Round          string      `bson:"round"`
+	CreatedAt      time.Time   `bson:"createdAt"`
+	UpdatedAt      time.Time   `bson:"updatedAt"`
+	Settlement     *Settlement `bson:"settlement"`
+	DeletedAt      *time.Time  `bson:"deletedAt"`
+}
+
+// mongoIndexes are the indexes of the collections, created at startup:
+// the players' bets per match, the championship standings and the
+// externalRef uniqueness per tenant, and the keys the other stores upsert
+// on, unique so replicas racing on a key can't store it twice.
+var mongoIndexes = map[string][]mongo.IndexModel{
+	"bets": {
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "matchId", Value: 1}}},
+		{Keys: bson.D{{Key: "championshipId", Value: 1}, {Key: "settlement.points", Value: -1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "externalRef", Value: 1}},
+			Options: options.Index().SetName(mongoExternalRefIndex).SetUnique(true).
+				SetPartialFilterExpression(bson.M{"externalRef": bson.M{"$gt": ""}}),
+		},
+	},
+	"audit_log": {
+		{Keys: bson.D{{Key: "betId", Value: 1}}},
+		{Keys: bson.D{{Key: "at", Value: 1}}},
+	},
+	"outbox":                   {{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "nextattemptat", Value: 1}}}},
+	"dead_letters":             {{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)}},
+	"webhook_subscriptions":    {{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "tenant", Value: 1}}}},
+	"webhook_deliveries":       {{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "subscriptionid", Value: 1}, {Key: "createdat", Value: -1}}}},
+	"pool_domains":             {{Keys: bson.D{{Key: "host", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "tenant", Value: 1}}}},
+	"daily_stats":              {{Keys: bson.D{{Key: "day", Value: 1}}}, {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "day", Value: 1}}}},
+	"match_states":             {{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "matchid", Value: 1}}, Options: options.Index().SetUnique(true)}},
+	"player_events":            {{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "player", Value: 1}, {Key: "at", Value: 1}}}},
+	"users":                    {{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "tenant", Value: 1}}}},
+	"round_awards":             {{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "championshipid", Value: 1}, {Key: "round", Value: 1}}, Options: options.Index().SetUnique(true)}},
+	"players":                  {{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "player", Value: 1}}, Options: options.Index().SetUnique(true)}, {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "subject", Value: 1}, {Key: "fetchedat", Value: -1}}}},
+	"notification_preferences": {{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "player", Value: 1}}, Options: options.Index().SetUnique(true)}},
+	"reminders":                {{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "matchid", Value: 1}, {Key: "player", Value: 1}}, Options: options.Index().SetUnique(true)}},
+	"bet_requests":             {{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updatedAt", Value: 1}}}},
+	"bet_windows":              {{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "championshipid", Value: 1}, {Key: "round", Value: 1}}, Options: options.Index().SetUnique(true)}},
+}
+
+// openMongo connects to the database and creates the indexes of its
+// collections.
+func openMongo(url, database string) (*mongo.Database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	db := client.Database(database)
+	for coll, indexes := range mongoIndexes {
+		if _, err := db.Collection(coll).Indexes().CreateMany(ctx, indexes); err != nil {
+			client.Disconnect(ctx)
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (m *mongoBets) Save(b *Bet) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	s := b.Settlement
+	if s == nil {
+		s = &Settlement{Status: SettlementPending}
+	}
+	doc := &mongoBet{
+		ID: b.ID, Tenant: b.Tenant, ExternalRef: b.ExternalRef, HomeTeamScore: b.HomeTeamScore,
+		AwayTeamScore: b.AwayTeamScore, Championship: b.Championship, Match: b.Match, Email: b.Email,
+		EmailIndex: b.EmailIndex, MatchID: b.MatchID, MatchInfo: b.MatchInfo, ChampionshipID: b.ChampionshipID,
+		Round: b.Round, CreatedAt: b.CreatedAt, UpdatedAt: b.UpdatedAt, Settlement: s, DeletedAt: b.DeletedAt,
+		Stake: b.Stake, Shootout: b.Shootout, AccumulatorID: b.AccumulatorID,
+	}
+	_, err := m.coll.ReplaceOne(ctx, bson.M{"_id": b.ID}, doc, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), mongoExternalRefIndex) {
+		return errExternalRefTaken
+	}
+	return err
+}
+
+// SaveWithEvents adds the entries once the bet is saved: transactions
+// need a replica set, which a single MongoDB server isn't.
+func (m *mongoBets) SaveWithEvents(b *Bet, entries []*OutboxEntry) error {
+	if err := m.Save(b); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := m.outbox.Add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mongoBets) Get(id string) (*Bet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	doc := &mongoBet{}
+	err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, errBetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.bet(), nil
+}
+
+func (d *mongoBet) bet() *Bet {
+	return &Bet{
+		ID: d.ID, Tenant: d.Tenant, ExternalRef: d.ExternalRef, HomeTeamScore: d.HomeTeamScore,
+		AwayTeamScore: d.AwayTeamScore, Championship: d.Championship, Match: d.Match, Email: d.Email,
+		EmailIndex: d.EmailIndex, MatchID: d.MatchID, MatchInfo: d.MatchInfo, ChampionshipID: d.ChampionshipID,
+		Round: d.Round, CreatedAt: d.CreatedAt.UTC(), UpdatedAt: d.UpdatedAt.UTC(), Settlement: d.Settlement,
+		DeletedAt: d.DeletedAt, Stake: d.Stake, Shootout: d.Shootout, AccumulatorID: d.AccumulatorID,
+	}
+}
+
+func (m *mongoBets) List(f BetFilter) ([]*Bet, error) {
+	r := []*Bet{}
+	err := m.Each(f, func(b *Bet) error {
+		r = append(r, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Each bounds the query and every batch fetched after it, not the whole
+// iteration, which lasts as long as fn takes, as for exports.
+func (m *mongoBets) Each(f BetFilter, fn func(*Bet) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	cur, err := m.coll.Find(ctx, betQuery(f), options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+		defer cancel()
+		cur.Close(ctx)
+	}()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+		next := cur.Next(ctx)
+		cancel()
+		if !next {
+			break
+		}
+		doc := &mongoBet{}
+		if err := cur.Decode(doc); err != nil {
+			return err
+		}
+		if err := fn(doc.bet()); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Aggregate groups the bets in the database, as postgresBets does.
+func (m *mongoBets) Aggregate(f BetFilter) (*BetAggregate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	var scores []struct {
+		ID struct {
+			ChampionshipID string `bson:"championshipId"`
+			MatchID        string `bson:"matchId"`
+			Home           string `bson:"home"`
+			Away           string `bson:"away"`
+		} `bson:"_id"`
+		Bets   int   `bson:"bets"`
+		Staked int   `bson:"staked"`
+		Stakes int64 `bson:"stakes"`
+	}
+	if err := m.aggregate(ctx, &scores, betQuery(f), bson.M{"$group": bson.M{
+		"_id":    bson.M{"championshipId": "$championshipId", "matchId": "$matchId", "home": "$homeTeamScore", "away": "$awayTeamScore"},
+		"bets":   bson.M{"$sum": 1},
+		"staked": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$stake", 0}}, 1, 0}}},
+		"stakes": bson.M{"$sum": bson.M{"$ifNull": bson.A{"$stake", 0}}},
+	}}); err != nil {
+		return nil, err
+	}
+	a := &BetAggregate{Players: map[string]int{}}
+	for _, s := range scores {
+		a.Scores = append(a.Scores, ScoreGroup{s.ID.ChampionshipID, s.ID.MatchID, s.ID.Home, s.ID.Away, s.Bets, s.Staked, s.Stakes})
+	}
+	var players []struct {
+		ID      string `bson:"_id"`
+		Players int    `bson:"players"`
+	}
+	if err := m.aggregate(ctx, &players, betQuery(f), bson.M{"$group": bson.M{
+		"_id": "$championshipId",
+		"players": bson.M{"$addToSet": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$emailIndex", ""}}, "$emailIndex", "$email",
+		}}},
+	}}, bson.M{"$project": bson.M{"players": bson.M{"$size": "$players"}}}); err != nil {
+		return nil, err
+	}
+	for _, p := range players {
+		a.Players[p.ID] = p.Players
+	}
+	return a, nil
+}
+
+func (m *mongoBets) aggregate(ctx context.Context, results interface{}, match bson.M, stages ...bson.M) error {
+	pipeline := append([]bson.M{{"$match": match}}, stages...)
+	cur, err := m.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, results)
+}
+
+// betQuery renders the filter as a query document.
+func betQuery(f BetFilter) bson.M {
+	q := bson.M{}
+	eq := map[string]string{
+		"tenant": f.Tenant, "email": f.Email, "emailIndex": f.EmailIndex, "championship": f.Championship,
+		"championshipId": f.ChampionshipID, "round": f.Round, "matchId": f.MatchID, "externalRef": f.ExternalRef,
+		"accumulatorId": f.AccumulatorID,
+	}
+	for field, v := range eq {
+		if v != "" {
+			q[field] = v
+		}
+	}
+	if f.Emails != nil {
+		q["email"] = bson.M{"$in": f.Emails}
+	}
+	if f.EmailIndexes != nil {
+		q["emailIndex"] = bson.M{"$in": f.EmailIndexes}
+	}
+	between := func(field string, from, to time.Time, fromOp, toOp string) {
+		r := bson.M{}
+		if !from.IsZero() {
+			r[fromOp] = from
+		}
+		if !to.IsZero() {
+			r[toOp] = to
+		}
+		if len(r) > 0 {
+			q[field] = r
+		}
+	}
+	between("matchInfo.date", f.From, f.To, "$gte", "$lte")
+	between("updatedAt", f.ChangedAfter, f.ChangedUntil, "$gt", "$lte")
+	between("createdAt", f.PlacedFrom, f.PlacedBefore, "$gte", "$lt")
+	if !f.IncludeDeleted {
+		q["deletedAt"] = nil
+	}
+	return q
+}
+
+// The other stores keep their structs as documents, with the driver's
+// lowercased field names as keys, except where a field needs more than it
+// gives: the exact time of the audit entries, the JSON of the bet
+// requests' results.
+
+// mongoFind decodes into out the documents of the query, sorted.
+func mongoFind(coll *mongo.Collection, filter bson.M, sort bson.D, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, out)
+}
+
+// mongoFindOne decodes the document of the query into out, telling
+// whether there was one.
+func mongoFindOne(coll *mongo.Collection, filter bson.M, out interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	err := coll.FindOne(ctx, filter).Decode(out)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mongoUpsert replaces the document of the query with doc, inserting it
+// when there is none.
+func mongoUpsert(coll *mongo.Collection, filter bson.M, doc interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := coll.ReplaceOne(ctx, filter, doc, options.Replace().SetUpsert(true))
+	return err
+}
+
+func mongoDelete(coll *mongo.Collection, filter bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := coll.DeleteMany(ctx, filter)
+	return err
+}
+
+// mongoAudit stores the audit chain in the audit_log collection, keyed by
+// sequence: an append racing another on the same sequence fails on the
+// key and seals the entry again after the winner, so replicas can't fork
+// the chain.
+type mongoAudit struct {
+	coll *mongo.Collection
+}
+
+// mongoAuditEntry is the document of an entry; its time is kept in
+// nanoseconds, as the hash covers more than the milliseconds of a BSON
+// date.
+type mongoAuditEntry struct {
+	Seq      int64  `bson:"_id"`
+	At       int64  `bson:"at"`
+	Actor    string `bson:"actor"`
+	Action   string `bson:"action"`
+	BetID    string `bson:"betId"`
+	Data     string `bson:"data"`
+	PrevHash string `bson:"prevHash"`
+	Hash     string `bson:"hash"`
+}
+
+func (d *mongoAuditEntry) entry() *AuditEntry {
+	return &AuditEntry{
+		Seq: d.Seq, At: time.Unix(0, d.At).UTC(), Actor: d.Actor, Action: d.Action, BetID: d.BetID,
+		Data: json.RawMessage(d.Data), PrevHash: d.PrevHash, Hash: d.Hash,
+	}
+}
+
+func (m *mongoAudit) Append(e *AuditEntry, seal func(int64, string)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	for {
+		last := &mongoAuditEntry{}
+		err := m.coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(last)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		seal(last.Seq, last.Hash)
+		_, err = m.coll.InsertOne(ctx, &mongoAuditEntry{
+			Seq: e.Seq, At: e.At.UnixNano(), Actor: e.Actor, Action: e.Action, BetID: e.BetID,
+			Data: string(e.Data), PrevHash: e.PrevHash, Hash: e.Hash,
+		})
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+}
+
+func (m *mongoAudit) List(betID string) ([]*AuditEntry, error) {
+	q := bson.M{}
+	if betID != "" {
+		q["betId"] = betID
+	}
+	var docs []*mongoAuditEntry
+	if err := mongoFind(m.coll, q, bson.D{{Key: "_id", Value: 1}}, &docs); err != nil {
+		return nil, err
+	}
+	r := make([]*AuditEntry, len(docs))
+	for i, d := range docs {
+		r[i] = d.entry()
+	}
+	return r, nil
+}
+
+func (m *mongoAudit) Range(after, until time.Time, fn func(*AuditEntry) error) error {
+	var docs []*mongoAuditEntry
+	q := bson.M{"at": bson.M{"$gt": after.UnixNano(), "$lte": until.UnixNano()}}
+	if err := mongoFind(m.coll, q, bson.D{{Key: "_id", Value: 1}}, &docs); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		if err := fn(d.entry()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mongoLocks keeps leases in the locks collection, timed by the clock of
+// the database as postgresLocks are.
+type mongoLocks struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoLocks) Acquire(name, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	free := bson.M{"_id": name, "$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"$expr": bson.M{"$lt": bson.A{"$expiresAt", "$$NOW"}}},
+	}}
+	lease := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"owner":     owner,
+		"expiresAt": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+	}}}}
+	res, err := m.coll.UpdateOne(ctx, free, lease, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// held by another owner: the upsert collided with its lease
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount+res.UpsertedCount == 1, nil
+}
+
+func (m *mongoLocks) Release(name, owner string) error {
+	return mongoDelete(m.coll, bson.M{"_id": name, "owner": owner})
+}
+
+// mongoOutbox keeps pending events in the outbox collection and the ones
+// given up on in dead_letters. Entries are claimed one at a time, each on
+// the condition that it is still due, so replicas claiming together split
+// them.
+type mongoOutbox struct {
+	pending *mongo.Collection
+	dead    *mongo.Collection
+}
+
+func (m *mongoOutbox) Add(e *OutboxEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.pending.InsertOne(ctx, e)
+	return err
+}
+
+func (m *mongoOutbox) Claim(limit int, lease time.Duration) ([]*OutboxEntry, error) {
+	now := time.Now()
+	var due []*OutboxEntry
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cur, err := m.pending.Find(ctx, bson.M{"nextattemptat": bson.M{"$lte": now}},
+		options.Find().SetSort(bson.D{{Key: "nextattemptat", Value: 1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(ctx, &due); err != nil {
+		return nil, err
+	}
+	r := []*OutboxEntry{}
+	for _, e := range due {
+		claimed := &OutboxEntry{}
+		err := m.pending.FindOneAndUpdate(ctx,
+			bson.M{"id": e.ID, "nextattemptat": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"nextattemptat": now.Add(lease)}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(claimed)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, claimed)
+	}
+	return r, nil
+}
+
+func (m *mongoOutbox) Done(id string) error {
+	return mongoDelete(m.pending, bson.M{"id": id})
+}
+
+func (m *mongoOutbox) Retry(e *OutboxEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.pending.UpdateOne(ctx, bson.M{"id": e.ID}, bson.M{"$set": bson.M{
+		"attempts": e.Attempts, "lasterror": e.LastError, "nextattemptat": e.NextAttemptAt,
+	}})
+	return err
+}
+
+// Bury stores the dead letter before removing the pending entry, so a
+// failure in between leaves the event pending rather than lost.
+func (m *mongoOutbox) Bury(e *OutboxEntry) error {
+	c := *e
+	now := time.Now()
+	c.DeadAt = &now
+	if err := mongoUpsert(m.dead, bson.M{"id": e.ID}, &c); err != nil {
+		return err
+	}
+	return mongoDelete(m.pending, bson.M{"id": e.ID})
+}
+
+func (m *mongoOutbox) Dead() ([]*OutboxEntry, error) {
+	r := []*OutboxEntry{}
+	return r, mongoFind(m.dead, bson.M{}, bson.D{{Key: "deadat", Value: 1}}, &r)
+}
+
+// Redrive queues the event again before removing the dead letter, as Bury
+// does the other way round.
+func (m *mongoOutbox) Redrive(id string) (*OutboxEntry, error) {
+	e := &OutboxEntry{}
+	found, err := mongoFindOne(m.dead, bson.M{"id": id}, e)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errOutboxNotFound
+	}
+	e.Attempts, e.LastError, e.DeadAt, e.NextAttemptAt = 0, "", nil, time.Now()
+	if err := mongoUpsert(m.pending, bson.M{"id": id}, e); err != nil {
+		return nil, err
+	}
+	return e, mongoDelete(m.dead, bson.M{"id": id})
+}
+
+// Stats queries the backlog at scrape time; errors leave the metrics at zero.
+func (m *mongoOutbox) Stats() OutboxStats {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	st := OutboxStats{}
+	backlog, err := m.pending.CountDocuments(ctx, bson.M{})
+	if err == nil {
+		var dead int64
+		dead, err = m.dead.CountDocuments(ctx, bson.M{})
+		st.Backlog, st.Dead = int(backlog), int(dead)
+	}
+	if err == nil && backlog > 0 {
+		oldest := &OutboxEntry{}
+		err = m.pending.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "createdat", Value: 1}})).Decode(oldest)
+		st.OldestAge = time.Since(oldest.CreatedAt)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the outbox stats")
+		return OutboxStats{}
+	}
+	return st
+}
+
+// mongoSubscriptions keeps outbound webhooks in webhook_subscriptions and
+// their deliveries in webhook_deliveries. Deliveries go with their
+// subscription.
+type mongoSubscriptions struct {
+	subs       *mongo.Collection
+	deliveries *mongo.Collection
+}
+
+func (m *mongoSubscriptions) Add(s *WebhookSubscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.subs.InsertOne(ctx, s)
+	return err
+}
+
+func (m *mongoSubscriptions) Get(id string) (*WebhookSubscription, error) {
+	s := &WebhookSubscription{}
+	found, err := mongoFindOne(m.subs, bson.M{"id": id}, s)
+	if err == nil && !found {
+		return nil, errSubscriptionNotFound
+	}
+	return s, err
+}
+
+func (m *mongoSubscriptions) List(tenant string) ([]*WebhookSubscription, error) {
+	r := []*WebhookSubscription{}
+	return r, mongoFind(m.subs, bson.M{"tenant": tenant}, bson.D{{Key: "createdat", Value: 1}}, &r)
+}
+
+func (m *mongoSubscriptions) Delete(id string) error {
+	if err := mongoDelete(m.subs, bson.M{"id": id}); err != nil {
+		return err
+	}
+	return mongoDelete(m.deliveries, bson.M{"subscriptionid": id})
+}
+
+func (m *mongoSubscriptions) SaveDelivery(d *WebhookDelivery) error {
+	return mongoUpsert(m.deliveries, bson.M{"id": d.ID}, d)
+}
+
+func (m *mongoSubscriptions) Deliveries(subscription string, limit int) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cur, err := m.deliveries.Find(ctx, bson.M{"subscriptionid": subscription},
+		options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	r := []*WebhookDelivery{}
+	return r, cur.All(ctx, &r)
+}
+
+type mongoDomains struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoDomains) Put(d *PoolDomain) error {
+	return mongoUpsert(m.coll, bson.M{"host": d.Host}, d)
+}
+
+func (m *mongoDomains) Get(host string) (*PoolDomain, error) {
+	d := &PoolDomain{}
+	found, err := mongoFindOne(m.coll, bson.M{"host": host}, d)
+	if err == nil && !found {
+		return nil, errDomainNotFound
+	}
+	return d, err
+}
+
+func (m *mongoDomains) List(tenant string) ([]*PoolDomain, error) {
+	r := []*PoolDomain{}
+	return r, mongoFind(m.coll, bson.M{"tenant": tenant}, bson.D{{Key: "host", Value: 1}}, &r)
+}
+
+func (m *mongoDomains) Delete(host string) error {
+	return mongoDelete(m.coll, bson.M{"host": host})
+}
+
+// mongoWatermarks keeps the warehouse export progress, a document per
+// table.
+type mongoWatermarks struct {
+	coll *mongo.Collection
+}
+
+type mongoWatermark struct {
+	Table string    `bson:"_id"`
+	At    time.Time `bson:"at"`
+}
+
+func (m *mongoWatermarks) Get(table string) (time.Time, error) {
+	w := &mongoWatermark{}
+	_, err := mongoFindOne(m.coll, bson.M{"_id": table}, w)
+	return w.At, err
+}
+
+func (m *mongoWatermarks) Set(table string, at time.Time) error {
+	return mongoUpsert(m.coll, bson.M{"_id": table}, &mongoWatermark{Table: table, At: at})
+}
+
+// mongoRollups keeps the daily statistics in daily_stats.
+type mongoRollups struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoRollups) Put(day string, rows []*DailyStats) error {
+	if err := mongoDelete(m.coll, bson.M{"day": day}); err != nil || len(rows) == 0 {
+		return err
+	}
+	docs := make([]interface{}, len(rows))
+	for i, d := range rows {
+		c := *d
+		c.Day = day
+		docs[i] = &c
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.coll.InsertMany(ctx, docs)
+	return err
+}
+
+func (m *mongoRollups) List(tenant, championship, from, to string) ([]*DailyStats, error) {
+	q := bson.M{"tenant": tenant, "day": bson.M{"$gte": from, "$lte": to}}
+	if championship != "" {
+		q["championship"] = championship
+	}
+	r := []*DailyStats{}
+	return r, mongoFind(m.coll, q, bson.D{{Key: "day", Value: 1}, {Key: "championship", Value: 1}}, &r)
+}
+
+type mongoMatchStates struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoMatchStates) Get(tenant, matchID string) (*MatchState, error) {
+	s := &MatchState{}
+	found, err := mongoFindOne(m.coll, bson.M{"tenant": tenant, "matchid": matchID}, s)
+	if !found {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *mongoMatchStates) Put(s *MatchState) error {
+	return mongoUpsert(m.coll, bson.M{"tenant": s.Tenant, "matchid": s.MatchID}, s)
+}
+
+type mongoPlayerEvents struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoPlayerEvents) Add(e *PlayerEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.coll.InsertOne(ctx, e)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (m *mongoPlayerEvents) List(tenant, player string) ([]*PlayerEvent, error) {
+	r := []*PlayerEvent{}
+	return r, mongoFind(m.coll, bson.M{"tenant": tenant, "player": player}, bson.D{{Key: "at", Value: 1}, {Key: "id", Value: 1}}, &r)
+}
+
+type mongoAwards struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoAwards) Get(tenant, championshipID, round string) (*RoundAwards, error) {
+	a := &RoundAwards{}
+	found, err := mongoFindOne(m.coll, bson.M{"tenant": tenant, "championshipid": championshipID, "round": round}, a)
+	if !found {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (m *mongoAwards) Put(a *RoundAwards) error {
+	return mongoUpsert(m.coll, bson.M{"tenant": a.Tenant, "championshipid": a.ChampionshipID, "round": a.Round}, a)
+}
+
+type mongoPlayers struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoPlayers) Get(tenant, player string) (*PlayerProfile, error) {
+	p := &PlayerProfile{}
+	found, err := mongoFindOne(m.coll, bson.M{"tenant": tenant, "player": player}, p)
+	if !found {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (m *mongoPlayers) BySubject(tenant, subject string) (*PlayerProfile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	p := &PlayerProfile{}
+	err := m.coll.FindOne(ctx, bson.M{"tenant": tenant, "subject": subject},
+		options.FindOne().SetSort(bson.D{{Key: "fetchedat", Value: -1}})).Decode(p)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (m *mongoPlayers) Put(p *PlayerProfile) error {
+	return mongoUpsert(m.coll, bson.M{"tenant": p.Tenant, "player": p.Player}, p)
+}
+
+type mongoPreferences struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoPreferences) Get(tenant, player string) (*NotificationPreferences, error) {
+	p := &NotificationPreferences{}
+	found, err := mongoFindOne(m.coll, bson.M{"tenant": tenant, "player": player}, p)
+	if !found {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (m *mongoPreferences) Put(p *NotificationPreferences) error {
+	return mongoUpsert(m.coll, bson.M{"tenant": p.Tenant, "player": p.Player}, p)
+}
+
+type mongoReminders struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoReminders) Mark(tenant, matchID, player string, at time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := m.coll.InsertOne(ctx, bson.M{"tenant": tenant, "matchid": matchID, "player": player, "sentat": at})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type mongoBetRequests struct {
+	coll *mongo.Collection
+}
+
+// mongoBetRequest is the document of a bet request; its result is kept
+// as JSON, as the postgres table does.
+type mongoBetRequest struct {
+	ID        string           `bson:"_id"`
+	Tenant    string           `bson:"tenant"`
+	Status    BetRequestStatus `bson:"status"`
+	Attempts  int              `bson:"attempts"`
+	Result    string           `bson:"result,omitempty"`
+	CreatedAt time.Time        `bson:"createdAt"`
+	UpdatedAt time.Time        `bson:"updatedAt"`
+	Owner     string           `bson:"owner,omitempty"`
+}
+
+func (m *mongoBetRequests) Get(id string) (*BetRequest, error) {
+	d := &mongoBetRequest{}
+	found, err := mongoFindOne(m.coll, bson.M{"_id": id}, d)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errBetRequestNotFound
+	}
+	r := &BetRequest{ID: d.ID, Tenant: d.Tenant, Status: d.Status, Attempts: d.Attempts, CreatedAt: d.CreatedAt.UTC(), UpdatedAt: d.UpdatedAt.UTC(), Owner: d.Owner}
+	if d.Result != "" {
+		r.Result = &BatchResult{}
+		if err := json.Unmarshal([]byte(d.Result), r.Result); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (m *mongoBetRequests) Put(r *BetRequest) error {
+	d := &mongoBetRequest{ID: r.ID, Tenant: r.Tenant, Status: r.Status, Attempts: r.Attempts, CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt, Owner: r.Owner}
+	if r.Result != nil {
+		b, err := json.Marshal(r.Result)
+		if err != nil {
+			return err
+		}
+		d.Result = string(b)
+	}
+	return mongoUpsert(m.coll, bson.M{"_id": r.ID}, d)
+}
+
+func (m *mongoBetRequests) Pending(before time.Time) ([]*BetRequest, error) {
+	var docs []*mongoBetRequest
+	q := bson.M{"status": BetRequestPending, "updatedAt": bson.M{"$lt": before}}
+	if err := mongoFind(m.coll, q, bson.D{{Key: "updatedAt", Value: 1}}, &docs); err != nil {
+		return nil, err
+	}
+	r := make([]*BetRequest, len(docs))
+	for i, d := range docs {
+		r[i] = &BetRequest{ID: d.ID, Tenant: d.Tenant, Status: d.Status, Attempts: d.Attempts, CreatedAt: d.CreatedAt.UTC(), UpdatedAt: d.UpdatedAt.UTC(), Owner: d.Owner}
+	}
+	return r, nil
+}
+
+type mongoBetWindows struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoBetWindows) List(tenant, championshipID string) ([]*BetWindow, error) {
+	r := []*BetWindow{}
+	return r, mongoFind(m.coll, bson.M{"tenant": tenant, "championshipid": championshipID}, bson.D{{Key: "round", Value: 1}}, &r)
+}
+
+func (m *mongoBetWindows) Put(w *BetWindow) error {
+	return mongoUpsert(m.coll, bson.M{"tenant": w.Tenant, "championshipid": w.ChampionshipID, "round": w.Round}, w)
+}
+
+func (m *mongoBetWindows) Delete(tenant, championshipID, round string) error {
+	return mongoDelete(m.coll, bson.M{"tenant": tenant, "championshipid": championshipID, "round": round})
+}
+
+type mongoUsers struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoUsers) Get(email string) (*LocalUser, error) {
+	u := &LocalUser{}
+	found, err := mongoFindOne(m.coll, bson.M{"email": email}, u)
+	if !found {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (m *mongoUsers) Put(u *LocalUser) error {
+	return mongoUpsert(m.coll, bson.M{"email": u.Email}, u)
+}
+
+func (m *mongoUsers) Delete(email string) error {
+	return mongoDelete(m.coll, bson.M{"email": email})
+}
+
+func (m *mongoUsers) List(tenant string) ([]*LocalUser, error) {
+	r := []*LocalUser{}
+	return r, mongoFind(m.coll, bson.M{"tenant": tenant}, bson.D{{Key: "email", Value: 1}}, &r)
+}
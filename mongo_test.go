@@ -0,0 +1,211 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestMongo opens the stores of the mongo driver in a database of
+// their own, dropped after the test. The tests run against the database
+// at MONGODB_URL, as the container started by
+//
+//	docker run --rm -d -p 27017:27017 mongo:6
+//	MONGODB_URL=mongodb://localhost:27017 go test -tags integration .
+func openTestMongo(t *testing.T) *Storage {
+	url := os.Getenv("MONGODB_URL")
+	if url == "" {
+		t.Skip("MONGODB_URL is not set")
+	}
+	database := "bets_test_" + newID()[:8]
+	s, err := openStorage(StorageConfig{Driver: "mongo", MongoURL: url, MongoDatabase: database})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db, err := openMongo(url, database)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+		defer cancel()
+		db.Drop(ctx)
+		db.Client().Disconnect(ctx)
+	})
+	return s
+}
+
+func TestMongoBets(t *testing.T) {
+	s := openTestMongo(t)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	b := &Bet{ID: newID(), Tenant: "t1", ExternalRef: "r1", Email: "joe@doe.com", MatchID: "m1", ChampionshipID: "c1", HomeTeamScore: "2", AwayTeamScore: "1", CreatedAt: now, UpdatedAt: now}
+	if err := s.Bets.Save(b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Bets.Get(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HomeTeamScore != "2" || !got.CreatedAt.Equal(now) || got.Settlement.Status != SettlementPending {
+		t.Errorf("got %+v", got)
+	}
+	if _, err := s.Bets.Get(newID()); err != errBetNotFound {
+		t.Errorf("got %v for an unknown bet, want errBetNotFound", err)
+	}
+	other := &Bet{ID: newID(), Tenant: "t1", ExternalRef: "r1", MatchID: "m2", CreatedAt: now.Add(time.Second)}
+	if err := s.Bets.Save(other); err != errExternalRefTaken {
+		t.Errorf("got %v for a taken externalRef, want errExternalRefTaken", err)
+	}
+	other.Tenant = "t2"
+	if err := s.Bets.Save(other); err != nil {
+		t.Errorf("got %v for the externalRef of another tenant", err)
+	}
+	var ids []string
+	err = s.Bets.Each(BetFilter{ExternalRef: "r1"}, func(b *Bet) error {
+		ids = append(ids, b.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != b.ID || ids[1] != other.ID {
+		t.Errorf("got %v, want the bets oldest first", ids)
+	}
+}
+
+func TestMongoAudit(t *testing.T) {
+	s := openTestMongo(t)
+	a := &AuditLog{store: s.Audit, key: []byte("key")}
+	for i := 0; i < 3; i++ {
+		if err := a.Record("joe", "bet.created", "b1", map[string]int{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := a.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Valid || v.Entries != 3 {
+		t.Errorf("got %+v, want a valid chain of 3 entries", v)
+	}
+	entries, err := s.Audit.List("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = s.Audit.Range(entries[0].At, entries[2].At, func(*AuditEntry) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d entries after the first, want 2", n)
+	}
+}
+
+func TestMongoLocks(t *testing.T) {
+	s := openTestMongo(t)
+	ok, err := s.Locks.Acquire("settle", "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v acquiring a free lock", ok, err)
+	}
+	if ok, err := s.Locks.Acquire("settle", "b", time.Minute); err != nil || ok {
+		t.Errorf("got %v, %v acquiring a held lock", ok, err)
+	}
+	if ok, err := s.Locks.Acquire("settle", "a", time.Minute); err != nil || !ok {
+		t.Errorf("got %v, %v renewing a lock", ok, err)
+	}
+	if err := s.Locks.Release("settle", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Locks.Acquire("settle", "b", time.Millisecond); err != nil || !ok {
+		t.Errorf("got %v, %v acquiring a released lock", ok, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if ok, err := s.Locks.Acquire("settle", "a", time.Minute); err != nil || !ok {
+		t.Errorf("got %v, %v acquiring an expired lock", ok, err)
+	}
+}
+
+func TestMongoOutbox(t *testing.T) {
+	s := openTestMongo(t)
+	e := &OutboxEntry{ID: newID(), Topic: "bets", Payload: []byte(`{"id":"b1"}`), CreatedAt: time.Now(), NextAttemptAt: time.Now()}
+	if err := s.Outbox.Add(e); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := s.Outbox.Claim(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || string(claimed[0].Payload) != `{"id":"b1"}` {
+		t.Fatalf("got %+v, want the entry", claimed)
+	}
+	if again, err := s.Outbox.Claim(10, time.Minute); err != nil || len(again) != 0 {
+		t.Errorf("got %d, %v claiming a leased entry", len(again), err)
+	}
+	if err := s.Outbox.Bury(claimed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Outbox.Stats(); st.Backlog != 0 || st.Dead != 1 {
+		t.Errorf("got %+v, want a dead letter only", st)
+	}
+	if _, err := s.Outbox.Redrive(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Outbox.Redrive(e.ID); err != errOutboxNotFound {
+		t.Errorf("got %v redriving twice, want errOutboxNotFound", err)
+	}
+	if claimed, err := s.Outbox.Claim(10, time.Minute); err != nil || len(claimed) != 1 || claimed[0].Attempts != 0 {
+		t.Errorf("got %+v, %v claiming a redriven entry", claimed, err)
+	}
+}
+
+func TestMongoStores(t *testing.T) {
+	s := openTestMongo(t)
+	if err := s.Users.Put(&LocalUser{Email: "joe@doe.com", Tenant: "t1", PasswordHash: "h", Roles: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := s.Users.Get("joe@doe.com"); err != nil || u == nil || u.PasswordHash != "h" || len(u.Roles) != 1 {
+		t.Errorf("got %+v, %v", u, err)
+	}
+	if u, err := s.Users.Get("ann@doe.com"); err != nil || u != nil {
+		t.Errorf("got %+v, %v for an unknown user", u, err)
+	}
+	if fresh, err := s.Reminders.Mark("t1", "m1", "p1", time.Now()); err != nil || !fresh {
+		t.Errorf("got %v, %v marking a reminder", fresh, err)
+	}
+	if fresh, err := s.Reminders.Mark("t1", "m1", "p1", time.Now()); err != nil || fresh {
+		t.Errorf("got %v, %v marking a reminder again", fresh, err)
+	}
+	r := &BetRequest{ID: newID(), Tenant: "t1", Status: "done", Result: &BatchResult{Status: 201, Bet: &Bet{ID: "b1"}}}
+	if err := s.BetRequests.Put(r); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.BetRequests.Get(r.ID); err != nil || got.Result == nil || got.Result.Bet.ID != "b1" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	for _, round := range []string{"2", ""} {
+		if err := s.BetWindows.Put(&BetWindow{Tenant: "t1", ChampionshipID: "c1", Round: round}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w, err := s.BetWindows.List("t1", "c1"); err != nil || len(w) != 2 || w[0].Round != "" {
+		t.Errorf("got %+v, %v, want the championship's window first", w, err)
+	}
+	ev := &PlayerEvent{ID: "e1", Tenant: "t1", Player: "p1", At: time.Now(), Kind: "login"}
+	for i := 0; i < 2; i++ {
+		if err := s.PlayerEvents.Add(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if list, err := s.PlayerEvents.List("t1", "p1"); err != nil || len(list) != 1 {
+		t.Errorf("got %+v, %v, want the event once", list, err)
+	}
+}
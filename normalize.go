@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo"
+)
+
+// emailInputs are the path and query parameters holding emails.
+var emailInputs = map[string]bool{"email": true}
+
+var uuidInput = regexp.MustCompile(`^(?i)(urn:uuid:)?\{?([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})\}?$`)
+
+// normalizeEmail is the form emails are stored and compared in, so
+// "User@X.com " and "user@x.com" are the same player.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeInput trims a path or query value, case-folds emails and
+// canonicalizes UUIDs, lowercased without braces or URN prefix. Values
+// holding control characters are rejected.
+func normalizeInput(name, value string) (string, bool) {
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	value = strings.TrimSpace(value)
+	if emailInputs[name] {
+		return normalizeEmail(value), true
+	}
+	if m := uuidInput.FindStringSubmatch(value); m != nil {
+		return strings.ToLower(m[2]), true
+	}
+	return value, true
+}
+
+// NormalizeInputs normalizes the path and query parameters before the
+// handlers validate them. Path parameters are unescaped first: the router
+// matches the raw path when the request escaped characters it didn't need
+// to, so /players/joe%40x.com would otherwise not be /players/joe@x.com.
+func NormalizeInputs(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// values are written in place: SetParamValues would swap the
+		// pooled context's slice for a shorter one the router then
+		// overruns on a later request
+		values := c.ParamValues()
+		for i, name := range c.ParamNames() {
+			v, err := url.PathUnescape(values[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "malformed path parameter "+name)
+			}
+			var ok bool
+			if values[i], ok = normalizeInput(name, v); !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "path parameter "+name+" holds control characters")
+			}
+		}
+
+		req := c.Request()
+		if req.URL.RawQuery == "" {
+			return next(c)
+		}
+		query, err := url.ParseQuery(req.URL.RawQuery)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "malformed query string")
+		}
+		for name, vs := range query {
+			for i, v := range vs {
+				var ok bool
+				if vs[i], ok = normalizeInput(name, v); !ok {
+					return echo.NewHTTPError(http.StatusBadRequest, "query parameter "+name+" holds control characters")
+				}
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+		return next(c)
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NotificationsConfig emails players about their bets through Provider,
+// "smtp" or "log"; no provider sends nothing. Templates, when set, is a
+// directory whose <kind>.tmpl files replace the built-in templates.
+type NotificationsConfig struct {
+	Provider     string
+	From         string
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	Templates    string
+	Attempts     int
+}
+
+// The notifications players get, and may opt out of.
+const (
+	notifyBetConfirmed = "bet.confirmed"
+	notifyMatchSettled = "match.settled"
+	notifyBetReminder  = "bet.reminder"
+)
+
+var notificationKinds = []string{notifyBetConfirmed, notifyMatchSettled, notifyBetReminder}
+
+// Templates start with a "Subject:" line and a blank line, then the text
+// of the email.
+var defaultTemplates = map[string]string{
+	notifyBetConfirmed: `Subject: Your bet on {{.Title}} is in
+
+Hi{{with .Name}} {{.}}{{end}},
+
+Your bet {{.Prediction}} on {{.Title}}{{with .Championship}} ({{.}}){{end}}{{if not .Kickoff.IsZero}}, kicking off {{.Kickoff.Format "Mon, 02 Jan 2006 15:04 MST"}}{{end}}, is confirmed.
+
+Bet {{.BetID}}
+`,
+	notifyMatchSettled: `Subject: {{.Title}} ended {{.Result}}: {{.Points}} point{{if ne .Points 1}}s{{end}} for you
+
+Hi{{with .Name}} {{.}}{{end}},
+
+{{.Title}}{{with .Championship}} ({{.}}){{end}} ended {{.Result}}.
+{{range .Bets}}
+Your bet {{.Prediction}}: {{.Points}} point{{if ne .Points 1}}s{{end}}{{end}}
+`,
+	notifyBetReminder: `Subject: {{.Title}} kicks off soon, place your bet
+
+Hi{{with .Name}} {{.}}{{end}},
+
+{{.Title}}{{with .Championship}} ({{.}}){{end}} kicks off {{.Kickoff.Format "Mon, 02 Jan 2006 15:04 MST"}} and you haven't bet on it yet.
+`,
+}
+
+// Notification is an email to a player, rendered from a template.
+type Notification struct {
+	Kind    string
+	To      string
+	Subject string
+	Text    string
+}
+
+// NotificationProvider delivers notifications; an error has the delivery
+// retried.
+type NotificationProvider interface {
+	Send(ctx context.Context, n *Notification) error
+}
+
+// notificationProviders builds the provider named by NOTIFICATIONS_PROVIDER;
+// other providers register here.
+var notificationProviders = map[string]func(NotificationsConfig) (NotificationProvider, error){
+	"smtp": newSMTPProvider,
+	"log":  func(NotificationsConfig) (NotificationProvider, error) { return logProvider{}, nil },
+}
+
+var notificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "notifications",
+	Name:      "sent_total",
+	Help:      "Notification deliveries, per kind and outcome.",
+}, []string{"kind", "outcome"})
+
+func init() {
+	registry.MustRegister(notificationsSent)
+}
+
+// notificationMatch is the match a notification is about. Title falls
+// back to the match id when the match details are unknown.
+type notificationMatch struct {
+	MatchID      string
+	Home         string
+	Away         string
+	Championship string
+	Kickoff      time.Time
+}
+
+func (m notificationMatch) Title() string {
+	if m.Home == "" || m.Away == "" {
+		return "match " + m.MatchID
+	}
+	return m.Home + " x " + m.Away
+}
+
+func matchOf(b *Bet) notificationMatch {
+	m := notificationMatch{MatchID: b.MatchID, Championship: b.Championship}
+	if b.MatchInfo != nil {
+		m.Home, m.Away, m.Kickoff = b.MatchInfo.Teams.Home.Name, b.MatchInfo.Teams.Away.Name, b.MatchInfo.Date
+	}
+	return m
+}
+
+func predictedScore(b *Bet) string {
+	return b.HomeTeamScore + "x" + b.AwayTeamScore
+}
+
+// betConfirmation is the data of the bet.confirmed template.
+type betConfirmation struct {
+	notificationMatch
+	Name       string
+	BetID      string
+	Prediction string
+	Stake      int64
+}
+
+// matchResults is the data of the match.settled template: the bets of
+// one player on the match.
+type matchResults struct {
+	notificationMatch
+	Name   string
+	Result string
+	Points int
+	Bets   []betResult
+}
+
+// betReminder is the data of the bet.reminder template.
+type betReminder struct {
+	notificationMatch
+	Name string
+}
+
+type betResult struct {
+	BetID      string
+	Prediction string
+	Points     int
+}
+
+// playerMailer renders the notifications and sends them as jobs, so
+// failed deliveries are retried with backoff. A nil mailer sends nothing.
+type playerMailer struct {
+	provider  NotificationProvider
+	templates *template.Template
+	attempts  int
+	prefs     PreferenceStore
+}
+
+var mailer *playerMailer
+
+func newPlayerMailer(cfg NotificationsConfig, prefs PreferenceStore) (*playerMailer, error) {
+	if cfg.Provider == "" {
+		return nil, nil
+	}
+	build, ok := notificationProviders[cfg.Provider]
+	if !ok {
+		return nil, errors.New("unknown notifications provider " + cfg.Provider)
+	}
+	provider, err := build(cfg)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := loadTemplates(cfg.Templates)
+	if err != nil {
+		return nil, err
+	}
+	return &playerMailer{provider: provider, templates: templates, attempts: cfg.Attempts, prefs: prefs}, nil
+}
+
+// loadTemplates parses the built-in templates, replaced by the files of
+// dir named after them.
+func loadTemplates(dir string) (*template.Template, error) {
+	t := template.New("notifications")
+	for _, kind := range notificationKinds {
+		text := defaultTemplates[kind]
+		if dir != "" {
+			b, err := ioutil.ReadFile(filepath.Join(dir, kind+".tmpl"))
+			if err == nil {
+				text = string(b)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		if _, err := t.New(kind).Parse(text); err != nil {
+			return nil, fmt.Errorf("template %s: %v", kind, err)
+		}
+	}
+	return t, nil
+}
+
+// render executes the template of the kind, splitting off its subject.
+func (m *playerMailer) render(kind, to string, data interface{}) (*Notification, error) {
+	var buf bytes.Buffer
+	if err := m.templates.ExecuteTemplate(&buf, kind, data); err != nil {
+		return nil, err
+	}
+	text := strings.Replace(buf.String(), "\r\n", "\n", -1)
+	head := strings.SplitN(text, "\n", 2)
+	if !strings.HasPrefix(head[0], "Subject:") || len(head) < 2 {
+		return nil, errors.New("template " + kind + " does not start with a Subject: line")
+	}
+	return &Notification{
+		Kind:    kind,
+		To:      to,
+		Subject: strings.TrimSpace(strings.TrimPrefix(head[0], "Subject:")),
+		Text:    strings.TrimLeft(head[1], "\n"),
+	}, nil
+}
+
+// wants tells whether the player still takes notifications of the kind.
+func (m *playerMailer) wants(tenant, email, kind string) bool {
+	p, err := m.prefs.Get(tenant, playerKey(email))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the notification preferences")
+		return false
+	}
+	return p == nil || !containsString(p.Disabled, kind)
+}
+
+// send queues the notification of a player about a bet, unless they opted
+// out of the kind.
+func (m *playerMailer) send(tenant, email, kind, betID string, data interface{}) {
+	if m == nil || email == "" || !m.wants(tenant, email, kind) {
+		return
+	}
+	n, err := m.render(kind, email, data)
+	if err != nil {
+		log.Error().Err(err).Str("kind", kind).Msg("failed to render the notification")
+		return
+	}
+	j := jobs.Enqueue("notification", m.attempts, func(ctx context.Context) error {
+		err := m.provider.Send(ctx, n)
+		if err != nil {
+			notificationsSent.WithLabelValues(kind, "error").Inc()
+			return err
+		}
+		notificationsSent.WithLabelValues(kind, "sent").Inc()
+		return nil
+	})
+	recordPlayerEvent(tenant, email, "notification-"+j.ID, "notification", betID, j.CreatedAt, map[string]string{"event": kind, "channel": "email"})
+}
+
+func (m *playerMailer) playerName(tenant, email string) string {
+	p, err := players.Get(tenant, playerKey(email))
+	if err != nil || p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// betPlaced confirms a new bet to its player.
+func (m *playerMailer) betPlaced(b *Bet) {
+	if m == nil {
+		return
+	}
+	m.send(b.Tenant, b.Email, notifyBetConfirmed, b.ID, &betConfirmation{
+		notificationMatch: matchOf(b),
+		Name:              m.playerName(b.Tenant, b.Email),
+		BetID:             b.ID,
+		Prediction:        predictedScore(b),
+		Stake:             b.Stake,
+	})
+}
+
+// matchSettled sends every player with a bet just settled the points of
+// their bets on the match.
+func (m *playerMailer) matchSettled(settled []*Bet, r MatchResult) {
+	if m == nil {
+		return
+	}
+	type player struct{ tenant, email string }
+	byPlayer := map[player][]*Bet{}
+	var order []player
+	for _, b := range settled {
+		p := player{b.Tenant, b.Email}
+		if byPlayer[p] == nil {
+			order = append(order, p)
+		}
+		byPlayer[p] = append(byPlayer[p], b)
+	}
+	for _, p := range order {
+		list := byPlayer[p]
+		data := &matchResults{notificationMatch: matchOf(list[0]), Name: m.playerName(p.tenant, p.email), Result: r.String()}
+		for _, b := range list {
+			data.Bets = append(data.Bets, betResult{BetID: b.ID, Prediction: predictedScore(b), Points: b.Settlement.Points})
+			data.Points += b.Settlement.Points
+		}
+		m.send(p.tenant, p.email, notifyMatchSettled, list[0].ID, data)
+	}
+}
+
+// matchReminder reminds a player that the match kicks off soon; the bet is
+// any of the match, for its details.
+func (m *playerMailer) matchReminder(match *Bet, email string) {
+	if m == nil {
+		return
+	}
+	m.send(match.Tenant, email, notifyBetReminder, "", &betReminder{notificationMatch: matchOf(match), Name: m.playerName(match.Tenant, email)})
+}
+
+// smtpTimeout bounds a delivery whose context has no deadline of its
+// own, so a relay that stops answering can't hold a job forever.
+const smtpTimeout = 30 * time.Second
+
+// smtpProvider sends plain text emails through a relay, authenticating
+// when a user is set and upgrading to TLS when the relay offers it.
+type smtpProvider struct {
+	addr string
+	host string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPProvider(cfg NotificationsConfig) (NotificationProvider, error) {
+	if cfg.SMTPAddr == "" {
+		return nil, errors.New("the smtp notifications provider needs SMTP_ADDR")
+	}
+	p := &smtpProvider{addr: cfg.SMTPAddr, host: cfg.SMTPAddr, from: cfg.From}
+	if i := strings.LastIndex(p.host, ":"); i >= 0 {
+		p.host = p.host[:i]
+	}
+	if cfg.SMTPUser != "" {
+		p.auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, p.host)
+	}
+	return p, nil
+}
+
+func (p *smtpProvider) Send(ctx context.Context, n *Notification) error {
+	from := p.from
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		from = strings.TrimSuffix(from[i+1:], ">")
+	}
+	msg, err := p.message(n)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+		defer cancel()
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// a cancelled delivery stops at once, without waiting for the deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err = p.deliver(conn, from, n.To, msg)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// deliver sends the message over the connection, as smtp.SendMail does.
+func (p *smtpProvider) deliver(conn net.Conn, from, to string, msg []byte) error {
+	c, err := smtp.NewClient(conn, p.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: p.host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if p.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("the smtp relay does not support authentication")
+		}
+		if err := c.Auth(p.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message renders the email, the subject encoded as RFC 2047 asks and the
+// text as quoted-printable UTF-8.
+func (p *smtpProvider) message(n *Notification) ([]byte, error) {
+	if strings.ContainsAny(n.To, "\r\n") {
+		return nil, errors.New("invalid recipient")
+	}
+	var buf bytes.Buffer
+	header := func(k, v string) { buf.WriteString(k + ": " + v + "\r\n") }
+	header("From", p.from)
+	header("To", n.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject)))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+newID()+"@bets>")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	header("Auto-Submitted", "auto-generated")
+	buf.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(strings.Replace(n.Text, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// logProvider only logs the notifications, for development.
+type logProvider struct{}
+
+func (logProvider) Send(ctx context.Context, n *Notification) error {
+	log.Info().Str("kind", n.Kind).Str("player", playerKey(n.To)).Str("subject", n.Subject).Msg("notification\n" + n.Text)
+	return nil
+}
+
+// NotificationPreferences are the notifications a player turned off.
+type NotificationPreferences struct {
+	Tenant    string    `json:"-"`
+	Player    string    `json:"-"`
+	Disabled  []string  `json:"disabled"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+type PreferenceStore interface {
+	// Get returns nil for a player who never changed them.
+	Get(tenant, player string) (*NotificationPreferences, error)
+	Put(p *NotificationPreferences) error
+}
+
+var preferences PreferenceStore
+
+// NotificationSettings is what GET /api/me/notifications answers: the
+// kinds turned off, among those available.
+type NotificationSettings struct {
+	Disabled  []string `json:"disabled"`
+	Available []string `json:"available"`
+}
+
+// callerEmail identifies the caller as their bets do, through the
+// identity provider.
+func callerEmail(c echo.Context) (string, error) {
+	start := time.Now()
+	player, status, err := identities.Player(c)
+	if he, ok := err.(*echo.HTTPError); ok {
+		return "", he
+	}
+	if err != nil {
+		return "", betError(&dependencyError{calls: map[string]dependencyCall{"players": callSince(start, status, err)}})
+	}
+	return normalizeEmail(player), nil
+}
+
+// GetNotificationSettings reports the notifications the caller turned off.
+func GetNotificationSettings(c echo.Context) error {
+	email, err := callerEmail(c)
+	if err != nil {
+		return err
+	}
+	p, err := preferences.Get(tenant(c), playerKey(email))
+	if err != nil {
+		return err
+	}
+	s := &NotificationSettings{Disabled: []string{}, Available: notificationKinds}
+	if p != nil {
+		s.Disabled = p.Disabled
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+// PutNotificationSettings replaces the notifications the caller turned
+// off; an empty list turns them all back on.
+func PutNotificationSettings(c echo.Context) error {
+	email, err := callerEmail(c)
+	if err != nil {
+		return err
+	}
+	req := &NotificationSettings{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	disabled := []string{}
+	for _, kind := range req.Disabled {
+		if !containsString(notificationKinds, kind) {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown notification "+kind+", expected one of "+strings.Join(notificationKinds, ", "))
+		}
+		if !containsString(disabled, kind) {
+			disabled = append(disabled, kind)
+		}
+	}
+	sort.Strings(disabled)
+	p := &NotificationPreferences{Tenant: tenant(c), Player: playerKey(email), Disabled: disabled, UpdatedAt: clock.Now()}
+	if err := preferences.Put(p); err != nil {
+		log.Error().Err(err).Msg("failed to store the notification preferences")
+		return err
+	}
+	return c.JSON(http.StatusOK, &NotificationSettings{Disabled: disabled, Available: notificationKinds})
+}
+
+type memoryPreferences struct {
+	mu    sync.Mutex
+	prefs map[string]*NotificationPreferences
+}
+
+func newMemoryPreferences() *memoryPreferences {
+	return &memoryPreferences{prefs: map[string]*NotificationPreferences{}}
+}
+
+func (m *memoryPreferences) Get(tenant, player string) (*NotificationPreferences, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.prefs[tenant+"/"+player]
+	if !ok {
+		return nil, nil
+	}
+	c := *p
+	c.Disabled = append([]string{}, p.Disabled...)
+	return &c, nil
+}
+
+func (m *memoryPreferences) Put(p *NotificationPreferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *p
+	c.Disabled = append([]string{}, p.Disabled...)
+	m.prefs[p.Tenant+"/"+p.Player] = &c
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServiceAuthConfig is how the calls to one downstream service prove who
+// is calling: Type "hmac" signs each request with the shared Secret,
+// "oauth2" sends a client-credentials token obtained from TokenURL in
+// Header. No Type leaves the calls as they are.
+type ServiceAuthConfig struct {
+	Type         string
+	KeyID        string
+	Secret       string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Audience     string
+	Header       string
+}
+
+// OutboundAuthConfig holds the auth of each downstream service, keyed by
+// the service name, as "matches".
+type OutboundAuthConfig map[string]ServiceAuthConfig
+
+// outboundServices are the downstream services and the variable prefix
+// of their settings.
+var outboundServices = map[string]string{
+	"matches":       "MATCH_SVC",
+	"championships": "CHAMPIONSHIP_SVC",
+	"players":       "PLAYER_SVC",
+}
+
+func loadOutboundAuth() OutboundAuthConfig {
+	cfg := OutboundAuthConfig{}
+	for service, env := range outboundServices {
+		kind := strings.ToLower(os.Getenv(env + "_AUTH"))
+		if kind == "" || kind == "none" {
+			continue
+		}
+		cfg[service] = ServiceAuthConfig{
+			Type:         kind,
+			KeyID:        os.Getenv(env + "_HMAC_KEY_ID"),
+			Secret:       secret(env + "_HMAC_SECRET"),
+			TokenURL:     os.Getenv(env + "_TOKEN_URL"),
+			ClientID:     os.Getenv(env + "_CLIENT_ID"),
+			ClientSecret: secret(env + "_CLIENT_SECRET"),
+			Scopes:       envList(env + "_SCOPES"),
+			Audience:     os.Getenv(env + "_AUDIENCE"),
+			Header:       envOr(env+"_AUTH_HEADER", "Authorization"),
+		}
+	}
+	return cfg
+}
+
+// Signed request headers. The signature is "sha256=" followed by the hex
+// HMAC-SHA256 of the method, the path and query, the host, the timestamp,
+// the nonce and the hex SHA-256 of the body, one per line.
+const (
+	signatureKeyHeader       = "X-Signature-Key-Id"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+	signatureDigestHeader    = "X-Content-SHA256"
+	signatureHeader          = "X-Signature"
+)
+
+var outboundAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "outbound_auth",
+	Name:      "failures_total",
+	Help:      "Downstream calls left unsent for want of credentials, per service.",
+}, []string{"service"})
+
+var tokenFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "outbound_auth",
+	Name:      "token_fetches_total",
+	Help:      "Client-credentials tokens requested, per service and outcome.",
+}, []string{"service", "outcome"})
+
+func init() {
+	registry.MustRegister(outboundAuthFailures, tokenFetches)
+}
+
+// requestAuthenticator adds the credentials of a service to its requests.
+type requestAuthenticator interface {
+	authenticate(req *http.Request) error
+}
+
+var outboundAuth = map[string]requestAuthenticator{}
+
+// newOutboundAuth checks the settings of every service and sets up their
+// authenticators.
+func newOutboundAuth(cfg OutboundAuthConfig) (map[string]requestAuthenticator, error) {
+	auth := map[string]requestAuthenticator{}
+	for service, c := range cfg {
+		switch c.Type {
+		case "hmac":
+			if c.Secret == "" {
+				return nil, fmt.Errorf("%s: hmac signing needs %s_HMAC_SECRET", service, outboundServices[service])
+			}
+			auth[service] = &hmacSigner{keyID: c.KeyID, secret: []byte(c.Secret)}
+		case "oauth2":
+			if c.TokenURL == "" || c.ClientID == "" {
+				return nil, fmt.Errorf("%s: oauth2 needs %s_TOKEN_URL and %s_CLIENT_ID", service, outboundServices[service], outboundServices[service])
+			}
+			auth[service] = &tokenSource{service: service, cfg: c}
+		default:
+			return nil, fmt.Errorf("%s: unknown auth %q, expected hmac or oauth2", service, c.Type)
+		}
+		log.Info().Str("service", service).Str("auth", c.Type).Msg("authenticating downstream calls")
+	}
+	return auth, nil
+}
+
+// authenticateCall adds the credentials of the service to a request about
+// to be sent, hedged copies included.
+func authenticateCall(service string, req *http.Request) error {
+	a, ok := outboundAuth[service]
+	if !ok {
+		return nil
+	}
+	if err := a.authenticate(req); err != nil {
+		outboundAuthFailures.WithLabelValues(service).Inc()
+		return fmt.Errorf("authenticating the call to %s: %v", service, err)
+	}
+	return nil
+}
+
+// rejectedCall drops the token of a service that answered 401, as it may
+// have been revoked before it expired; the next call fetches a new one.
+func rejectedCall(service string, res *http.Response) {
+	if s, ok := outboundAuth[service].(*tokenSource); ok && res.StatusCode == http.StatusUnauthorized {
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+	}
+}
+
+// hmacSigner signs requests with a secret shared with the service, which
+// recomputes the signature and rejects stale timestamps and seen nonces.
+type hmacSigner struct {
+	keyID  string
+	secret []byte
+}
+
+func (s *hmacSigner) authenticate(req *http.Request) error {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	digest := sha256.Sum256(body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	h := req.Header
+	if s.keyID != "" {
+		h.Set(signatureKeyHeader, s.keyID)
+	}
+	h.Set(signatureTimestampHeader, timestamp)
+	h.Set(signatureNonceHeader, hex.EncodeToString(nonce))
+	h.Set(signatureDigestHeader, hex.EncodeToString(digest[:]))
+	h.Set(signatureHeader, signRequest(s.secret, req.Method, req.URL.RequestURI(), req.URL.Host, timestamp, h.Get(signatureNonceHeader), h.Get(signatureDigestHeader)))
+	return nil
+}
+
+func signRequest(secret []byte, fields ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenEarly is how long before it expires a token is replaced, so
+// requests in flight never carry one the service just stopped accepting.
+const tokenEarly = 30 * time.Second
+
+// tokenSource keeps the client-credentials token of a service, fetching a
+// new one when it is about to expire; callers wait on the one fetch.
+type tokenSource struct {
+	service string
+	cfg     ServiceAuthConfig
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (s *tokenSource) authenticate(req *http.Request) error {
+	token, err := s.get(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set(s.cfg.Header, "Bearer "+token)
+	return nil
+}
+
+func (s *tokenSource) get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+	t, err := s.fetch(ctx)
+	if err != nil {
+		tokenFetches.WithLabelValues(s.service, "error").Inc()
+		return "", err
+	}
+	tokenFetches.WithLabelValues(s.service, "ok").Inc()
+	s.token = t.AccessToken
+	// a token without a lifetime is asked for again on every call
+	s.expires = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - tokenEarly)
+	return s.token, nil
+}
+
+func (s *tokenSource) fetch(ctx context.Context) (*tokenResponse, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+	}
+	if s.cfg.Audience != "" {
+		form.Set("audience", s.cfg.Audience)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(s.cfg.ClientSecret))
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint answered %s", res.Status)
+	}
+	t := &tokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(t); err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, errors.New("token endpoint answered no access_token")
+	}
+	if t.TokenType != "" && !strings.EqualFold(t.TokenType, "bearer") {
+		return nil, fmt.Errorf("token endpoint answered a %s token, expected a bearer one", t.TokenType)
+	}
+	return t, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var errOutboxNotFound = errors.New("dead-lettered event not found")
+
+// OutboxEntry is an event waiting to be published, or given up on.
+type OutboxEntry struct {
+	ID            string          `json:"id"`
+	Topic         string          `json:"topic"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	DeadAt        *time.Time      `json:"deadAt,omitempty"`
+}
+
+// OutboxStore keeps pending events and the dead letters.
+type OutboxStore interface {
+	Add(e *OutboxEntry) error
+	// Claim returns up to limit entries due now, hiding them from other
+	// claims for the lease so replicas don't publish the same event.
+	Claim(limit int, lease time.Duration) ([]*OutboxEntry, error)
+	// Done removes a published entry.
+	Done(id string) error
+	// Retry records a failed attempt and when to try again.
+	Retry(e *OutboxEntry) error
+	// Bury moves the entry to the dead letters.
+	Bury(e *OutboxEntry) error
+	Dead() ([]*OutboxEntry, error)
+	// Redrive moves a dead letter back to the pending events, with its
+	// attempts reset.
+	Redrive(id string) (*OutboxEntry, error)
+	Stats() OutboxStats
+}
+
+// Outbox publishes events through the store, so an event whose publish
+// fails is retried with exponential backoff instead of being lost, and ends
+// up dead-lettered after MaxAttempts.
+type Outbox struct {
+	store       OutboxStore
+	publish     func(topic string, data []byte) error
+	maxAttempts int
+	backoff     time.Duration
+	interval    time.Duration
+}
+
+const (
+	outboxBatch    = 100
+	outboxLease    = 30 * time.Second
+	outboxMaxDelay = time.Hour
+)
+
+func NewOutbox(store OutboxStore, publish func(string, []byte) error, maxAttempts int) *Outbox {
+	return &Outbox{store: store, publish: publish, maxAttempts: maxAttempts, backoff: time.Second, interval: time.Second}
+}
+
+// Publish queues the event for topic, failing when it can't be queued. It
+// is a no-op when o is nil, i.e. the event bus is not configured.
+func (o *Outbox) Publish(topic string, e Event) error {
+	if o == nil {
+		return nil
+	}
+	entry, err := o.entry(topic, e)
+	if err == nil {
+		err = o.store.Add(entry)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("event", e.ID).Msg("failed to queue event")
+	}
+	return err
+}
+
+// entry is the outbox entry of the event for topic, to be stored along
+// with what it announces; nil when o is.
+func (o *Outbox) entry(topic string, e Event) (*OutboxEntry, error) {
+	if o == nil {
+		return nil, nil
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &OutboxEntry{ID: e.ID, Topic: topic, Payload: payload, CreatedAt: now, NextAttemptAt: now}, nil
+}
+
+// Run relays the due events until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	t := time.NewTicker(o.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			o.relay()
+		}
+	}
+}
+
+func (o *Outbox) relay() {
+	due, err := o.store.Claim(outboxBatch, outboxLease)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the outbox")
+		return
+	}
+	for _, e := range due {
+		err := o.publish(e.Topic, e.Payload)
+		if err == nil {
+			err = o.store.Done(e.ID)
+			if err != nil {
+				log.Error().Err(err).Str("event", e.ID).Msg("failed to clear published event")
+			}
+			continue
+		}
+		e.Attempts++
+		e.LastError = err.Error()
+		if e.Attempts >= o.maxAttempts {
+			log.Error().Err(err).Str("event", e.ID).Str("topic", e.Topic).Msg("dead-lettering event")
+			err = o.store.Bury(e)
+		} else {
+			delay := o.backoff << uint(e.Attempts-1)
+			if delay > outboxMaxDelay {
+				delay = outboxMaxDelay
+			}
+			e.NextAttemptAt = time.Now().Add(delay)
+			err = o.store.Retry(e)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("event", e.ID).Msg("failed to update the outbox")
+		}
+	}
+}
+
+func (o *Outbox) Stats() OutboxStats {
+	return o.store.Stats()
+}
+
+// memoryOutbox is the outbox of the memory driver; it survives publish
+// failures but not restarts.
+type memoryOutbox struct {
+	mu      sync.Mutex
+	pending map[string]*OutboxEntry
+	dead    []*OutboxEntry
+}
+
+func newMemoryOutbox() *memoryOutbox {
+	return &memoryOutbox{pending: map[string]*OutboxEntry{}}
+}
+
+func (m *memoryOutbox) Add(e *OutboxEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *e
+	m.pending[e.ID] = &c
+	return nil
+}
+
+func (m *memoryOutbox) Claim(limit int, lease time.Duration) ([]*OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	r := []*OutboxEntry{}
+	for _, e := range m.pending {
+		if len(r) == limit {
+			break
+		}
+		if e.NextAttemptAt.After(now) {
+			continue
+		}
+		e.NextAttemptAt = now.Add(lease)
+		c := *e
+		r = append(r, &c)
+	}
+	return r, nil
+}
+
+func (m *memoryOutbox) Done(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, id)
+	return nil
+}
+
+func (m *memoryOutbox) Retry(e *OutboxEntry) error {
+	return m.Add(e)
+}
+
+func (m *memoryOutbox) Bury(e *OutboxEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, e.ID)
+	c := *e
+	now := time.Now()
+	c.DeadAt = &now
+	m.dead = append(m.dead, &c)
+	return nil
+}
+
+func (m *memoryOutbox) Dead() ([]*OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := make([]*OutboxEntry, len(m.dead))
+	for i, e := range m.dead {
+		c := *e
+		r[i] = &c
+	}
+	return r, nil
+}
+
+func (m *memoryOutbox) Redrive(id string) (*OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, e := range m.dead {
+		if e.ID != id {
+			continue
+		}
+		m.dead = append(m.dead[:i], m.dead[i+1:]...)
+		e.Attempts = 0
+		e.DeadAt = nil
+		e.NextAttemptAt = time.Now()
+		m.pending[id] = e
+		c := *e
+		return &c, nil
+	}
+	return nil, errOutboxNotFound
+}
+
+func (m *memoryOutbox) Stats() OutboxStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := OutboxStats{Backlog: len(m.pending), Dead: len(m.dead)}
+	now := time.Now()
+	for _, e := range m.pending {
+		if age := now.Sub(e.CreatedAt); age > st.OldestAge {
+			st.OldestAge = age
+		}
+	}
+	return st
+}
+
+func ListDeadLetters(c echo.Context) error {
+	dead, err := outboxStore.Dead()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dead)
+}
+
+// RedriveDeadLetter queues a dead-lettered event for publishing again.
+func RedriveDeadLetter(c echo.Context) error {
+	e, err := outboxStore.Redrive(c.Param("id"))
+	if err == errOutboxNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Str("event", e.ID).Str("topic", e.Topic).Msg("redriving dead-lettered event")
+	return c.JSON(http.StatusAccepted, e)
+}
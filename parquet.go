@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// parquetRowGroup is how many rows are buffered per row group; memory
+// stays bounded by it however many rows are exported.
+const parquetRowGroup = 10000
+
+const (
+	parquetMagic     = "PAR1"
+	parquetCreatedBy = "bets-app"
+	parquetByteArray = 6
+	parquetRequired  = 0
+	parquetUTF8      = 0
+	parquetPlain     = 0
+	parquetRLE       = 3
+	parquetGzip      = 2
+	parquetDataPage  = 0
+)
+
+// Thrift compact protocol field types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetTable streams a Parquet file: the first row written names the
+// columns, which are all required UTF8 strings as in the CSV export. Each
+// row group holds one gzipped, plain encoded page per column.
+type parquetTable struct {
+	w       *countingWriter
+	columns []string
+	values  [][][]byte
+	rows    int
+	total   int64
+	groups  []parquetGroup
+}
+
+type parquetGroup struct {
+	rows   int
+	size   int64
+	chunks []parquetChunk
+}
+
+type parquetChunk struct {
+	offset           int64
+	compressedSize   int64
+	uncompressedSize int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newParquetTable(w io.Writer) (*parquetTable, error) {
+	t := &parquetTable{w: &countingWriter{w: w}}
+	_, err := io.WriteString(t.w, parquetMagic)
+	return t, err
+}
+
+func (t *parquetTable) Write(cells []string) error {
+	if t.columns == nil {
+		t.columns = append([]string{}, cells...)
+		t.values = make([][][]byte, len(cells))
+		return nil
+	}
+	if len(cells) != len(t.columns) {
+		return errors.New("parquet row has the wrong number of cells")
+	}
+	for i, c := range cells {
+		t.values[i] = append(t.values[i], []byte(c))
+	}
+	if t.rows++; t.rows == parquetRowGroup {
+		return t.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group.
+func (t *parquetTable) flush() error {
+	if t.rows == 0 {
+		return nil
+	}
+	g := parquetGroup{rows: t.rows}
+	page := &bytes.Buffer{}
+	compressed := &bytes.Buffer{}
+	for i := range t.columns {
+		page.Reset()
+		for _, v := range t.values[i] {
+			binary.Write(page, binary.LittleEndian, uint32(len(v)))
+			page.Write(v)
+		}
+		compressed.Reset()
+		zw := gzip.NewWriter(compressed)
+		zw.Write(page.Bytes())
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		header := &thriftWriter{}
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(compressed.Len()))
+		header.structBegin(5)
+		header.i32(1, int32(t.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.structEnd()
+		header.stop()
+		chunk := parquetChunk{
+			offset:           t.w.n,
+			compressedSize:   int64(header.Len() + compressed.Len()),
+			uncompressedSize: int64(header.Len() + page.Len()),
+		}
+		if _, err := t.w.Write(header.Bytes()); err != nil {
+			return err
+		}
+		if _, err := t.w.Write(compressed.Bytes()); err != nil {
+			return err
+		}
+		g.size += chunk.uncompressedSize
+		g.chunks = append(g.chunks, chunk)
+		t.values[i] = t.values[i][:0]
+	}
+	t.groups = append(t.groups, g)
+	t.total += int64(t.rows)
+	t.rows = 0
+	return nil
+}
+
+// Close writes the remaining rows and the footer, the file metadata.
+func (t *parquetTable) Close() error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	m := &thriftWriter{}
+	m.i32(1, 1)
+	m.listBegin(2, thriftStruct, len(t.columns)+1)
+	m.string(4, "schema")
+	m.i32(5, int32(len(t.columns)))
+	m.stop()
+	for _, c := range t.columns {
+		m.i32(1, parquetByteArray)
+		m.i32(3, parquetRequired)
+		m.string(4, c)
+		m.i32(6, parquetUTF8)
+		m.stop()
+	}
+	m.listEnd()
+	m.i64(3, t.total)
+	m.listBegin(4, thriftStruct, len(t.groups))
+	for _, g := range t.groups {
+		m.listBegin(1, thriftStruct, len(g.chunks))
+		for i, ch := range g.chunks {
+			m.i64(2, ch.offset)
+			m.structBegin(3)
+			m.i32(1, parquetByteArray)
+			m.listBegin(2, thriftI32, 2)
+			m.varint(parquetPlain)
+			m.varint(parquetRLE)
+			m.listEnd()
+			m.listBegin(3, thriftBinary, 1)
+			m.bytes(t.columns[i])
+			m.listEnd()
+			m.i32(4, parquetGzip)
+			m.i64(5, int64(g.rows))
+			m.i64(6, ch.uncompressedSize)
+			m.i64(7, ch.compressedSize)
+			m.i64(9, ch.offset)
+			m.structEnd()
+			m.stop()
+		}
+		m.listEnd()
+		m.i64(2, g.size)
+		m.i64(3, int64(g.rows))
+		m.stop()
+	}
+	m.listEnd()
+	m.string(6, parquetCreatedBy)
+	m.stop()
+	bw := bufio.NewWriter(t.w)
+	bw.Write(m.Bytes())
+	binary.Write(bw, binary.LittleEndian, uint32(m.Len()))
+	bw.WriteString(parquetMagic)
+	return bw.Flush()
+}
+
+// thriftWriter encodes structs with the Thrift compact protocol, which is
+// how Parquet serializes its metadata. Fields are written in increasing id
+// order; struct and list nesting is tracked to compute field id deltas.
+type thriftWriter struct {
+	bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	if d := id - w.last; d > 0 && d <= 15 {
+		w.WriteByte(byte(d)<<4 | typ)
+	} else {
+		w.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	w.last = id
+}
+
+// varint writes a zigzag encoded integer.
+func (w *thriftWriter) varint(v int64) {
+	u := uint64(v<<1) ^ uint64(v>>63)
+	w.uvarint(u)
+}
+
+func (w *thriftWriter) uvarint(u uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutUvarint(buf, u)])
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) string(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.bytes(s)
+}
+
+func (w *thriftWriter) bytes(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *thriftWriter) structBegin(id int16) {
+	w.field(id, thriftStruct)
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+// structEnd closes a struct opened by structBegin.
+func (w *thriftWriter) structEnd() {
+	w.stop()
+	w.pop()
+}
+
+// stop ends the current struct; for list elements and the top level
+// struct it also resets the field ids for the next one.
+func (w *thriftWriter) stop() {
+	w.WriteByte(0)
+	w.last = 0
+}
+
+// listBegin opens a list of size elements; struct elements are each ended
+// with stop.
+func (w *thriftWriter) listBegin(id int16, elem byte, size int) {
+	w.field(id, thriftList)
+	if size < 15 {
+		w.WriteByte(byte(size)<<4 | elem)
+	} else {
+		w.WriteByte(0xf0 | elem)
+		w.uvarint(uint64(size))
+	}
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+func (w *thriftWriter) listEnd() {
+	w.pop()
+}
+
+func (w *thriftWriter) pop() {
+	w.last = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
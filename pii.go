@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const ciphertextPrefix = "enc:"
+
+// piiCipher encrypts personal data with AES-GCM. The first key is used for
+// new ciphertexts; the others remain available to decrypt values written
+// before a rotation. Each ciphertext names the key that sealed it:
+// "enc:<key id>:<base64 nonce+sealed>".
+type piiCipher struct {
+	active   string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// newPIICipher parses "id:base64key" entries of 32 byte AES keys, active key
+// first, and the key of the blind index.
+func newPIICipher(entries []string, indexKey string) (*piiCipher, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	if indexKey == "" {
+		return nil, errors.New("no blind index key")
+	}
+	p := &piiCipher{keys: map[string]cipher.AEAD{}, indexKey: []byte(indexKey)}
+	for i, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("key %d is not in the id:base64 format", i)
+		}
+		raw, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", parts[0], err)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes long", parts[0])
+		}
+		block, _ := aes.NewCipher(raw)
+		aead, _ := cipher.NewGCM(block)
+		p.keys[parts[0]] = aead
+		if i == 0 {
+			p.active = parts[0]
+		}
+	}
+	return p, nil
+}
+
+func (p *piiCipher) Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	aead := p.keys[p.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(p.active))
+	return ciphertextPrefix + p.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a ciphertext; values not carrying the prefix were stored
+// before encryption was enabled and are returned unchanged.
+func (p *piiCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, ciphertextPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, ciphertextPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed ciphertext")
+	}
+	aead, ok := p.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %s", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed ciphertext")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// BlindIndex is a keyed hash of the normalized value, letting exact match
+// lookups work on encrypted data without revealing it.
+func (p *piiCipher) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, p.indexKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptedBets stores player emails encrypted, with a blind index to
+// look bets up by email.
+type encryptedBets struct {
+	BetRepository
+	pii *piiCipher
+}
+
+func (r *encryptedBets) Save(b *Bet) error {
+	enc, err := r.encrypt(b)
+	if err != nil {
+		return err
+	}
+	return r.BetRepository.Save(enc)
+}
+
+func (r *encryptedBets) SaveWithEvents(b *Bet, entries []*OutboxEntry) error {
+	enc, err := r.encrypt(b)
+	if err != nil {
+		return err
+	}
+	return r.BetRepository.SaveWithEvents(enc, entries)
+}
+
+func (r *encryptedBets) encrypt(b *Bet) (*Bet, error) {
+	enc := b.clone()
+	enc.EmailIndex = r.pii.BlindIndex(b.Email)
+	var err error
+	enc.Email, err = r.pii.Encrypt(b.Email)
+	return enc, err
+}
+
+func (r *encryptedBets) Get(id string) (*Bet, error) {
+	b, err := r.BetRepository.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return b, r.decrypt(b)
+}
+
+func (r *encryptedBets) List(f BetFilter) ([]*Bet, error) {
+	list, err := r.BetRepository.List(r.filter(f))
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range list {
+		if err := r.decrypt(b); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (r *encryptedBets) Each(f BetFilter, fn func(*Bet) error) error {
+	return r.BetRepository.Each(r.filter(f), func(b *Bet) error {
+		if err := r.decrypt(b); err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// Aggregate needs no decryption: players are told apart by blind index.
+func (r *encryptedBets) Aggregate(f BetFilter) (*BetAggregate, error) {
+	return r.BetRepository.Aggregate(r.filter(f))
+}
+
+// filter looks the players up by blind index, their emails being
+// encrypted.
+func (r *encryptedBets) filter(f BetFilter) BetFilter {
+	if f.Email != "" {
+		f.EmailIndex = r.pii.BlindIndex(f.Email)
+		f.Email = ""
+	}
+	if f.Emails != nil {
+		f.EmailIndexes = make([]string, len(f.Emails))
+		for i, e := range f.Emails {
+			f.EmailIndexes[i] = r.pii.BlindIndex(e)
+		}
+		f.Emails = nil
+	}
+	return f
+}
+
+func (r *encryptedBets) decrypt(b *Bet) error {
+	var err error
+	b.Email, err = r.pii.Decrypt(b.Email)
+	b.EmailIndex = ""
+	return err
+}
+
+// RotatePIIKeys re-encrypts every stored bet with the active key, in the
+// background, so retired keys can be dropped once the job succeeded.
+func RotatePIIKeys(c echo.Context) error {
+	if len(config.PII.Keys) == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "PII encryption is not enabled")
+	}
+	j := jobs.Enqueue("pii-rotation", 3, func(ctx context.Context) error {
+		list, err := bets.List(BetFilter{})
+		if err != nil {
+			return err
+		}
+		for _, b := range list {
+			if err := bets.Save(b); err != nil {
+				return err
+			}
+		}
+		log.Info().Int("bets", len(list)).Msg("re-encrypted bets with the active key")
+		return nil
+	})
+	return c.JSON(http.StatusAccepted, j)
+}
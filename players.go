@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// PlayerProfile is what the players service answered about a player, kept
+// so placing bets needn't ask it every time. Players are keyed, like in
+// the timeline, by pseudonymous key; Subject is the token subject the
+// profile was fetched with.
+type PlayerProfile struct {
+	Tenant     string            `json:"-"`
+	Player     string            `json:"-"`
+	Subject    string            `json:"-"`
+	Email      string            `json:"email"`
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	FirstSeen  time.Time         `json:"firstSeen"`
+	FetchedAt  time.Time         `json:"fetchedAt"`
+}
+
+type PlayerStore interface {
+	// Get returns nil for a player never seen.
+	Get(tenant, player string) (*PlayerProfile, error)
+	// BySubject returns the profile last fetched with the token subject,
+	// nil if none.
+	BySubject(tenant, subject string) (*PlayerProfile, error)
+	Put(p *PlayerProfile) error
+}
+
+var errPlayerRefresh = echo.NewHTTPError(http.StatusForbidden, "only the player can refresh their profile")
+
+// refreshPlayer is the bypass flag: ?refresh=true, or a no-cache request,
+// fetches the profile from the players service even when fresh.
+func refreshPlayer(c echo.Context) bool {
+	return c.QueryParam("refresh") == "true" || strings.Contains(c.Request().Header.Get("Cache-Control"), "no-cache")
+}
+
+// cachedPlayer returns the email of the caller's profile while it is
+// fresh, i.e. fetched less than PLAYER_CACHE_TTL ago.
+func cachedPlayer(c echo.Context) (string, bool) {
+	id, ok := identity(c)
+	if !ok || id.Subject == "" || config.Cache.PlayerTTL <= 0 || refreshPlayer(c) {
+		return "", false
+	}
+	p, err := players.BySubject(tenant(c), id.Subject)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to look up the cached player")
+		return "", false
+	}
+	if p == nil || clock.Now().Sub(p.FetchedAt) >= config.Cache.PlayerTTL {
+		return "", false
+	}
+	return p.Email, true
+}
+
+// fetchPlayer asks the players service for the profile of the caller,
+// as identified by the forwarded token, and stores it.
+func fetchPlayer(c echo.Context) (*PlayerProfile, int, error) {
+	req, _ := http.NewRequest("GET", serviceURL(tenant(c), "PLAYER_SVC", ""), nil)
+
+	forwardHeaders(c, req)
+	res, err := callService("players", req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to call players")
+		return nil, 0, err
+	}
+	defer drain(res)
+	status := res.StatusCode
+	if !is2xx(status) {
+		return nil, status, errors.New(res.Status)
+	}
+	body, readErr := ioutil.ReadAll(res.Body)
+	if readErr != nil {
+		log.Error().Err(readErr).Msg("failed to read players response body")
+		return nil, status, readErr
+	}
+
+	var data map[string]interface{}
+
+	if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
+		log.Error().Err(jsonErr).Msg("failed to read players response body")
+		return nil, status, jsonErr
+	}
+	p := &PlayerProfile{Tenant: tenant(c), Attributes: map[string]string{}, FetchedAt: clock.Now()}
+	for k, v := range data {
+		s, ok := v.(string)
+		switch {
+		case !ok:
+		case k == "email":
+			p.Email = normalizeEmail(s)
+		case k == "name":
+			p.Name = s
+		default:
+			p.Attributes[k] = s
+		}
+	}
+	if p.Email == "" {
+		return p, status, nil
+	}
+	if id, ok := identity(c); ok {
+		p.Subject = id.Subject
+	}
+	p.Player = playerKey(p.Email)
+	p.FirstSeen = p.FetchedAt
+	if seen, err := players.Get(p.Tenant, p.Player); err != nil {
+		log.Error().Err(err).Msg("failed to look up the cached player")
+	} else if seen != nil {
+		p.FirstSeen = seen.FirstSeen
+	}
+	if err := players.Put(p); err != nil {
+		log.Error().Err(err).Msg("failed to cache the player")
+	}
+	return p, status, nil
+}
+
+// PlayerStats sums up the bets of a player.
+type PlayerStats struct {
+	Bets          int `json:"bets"`
+	Settled       int `json:"settled"`
+	Points        int `json:"points"`
+	ExactScores   int `json:"exactScores"`
+	Championships int `json:"championships"`
+}
+
+// PlayerView is the cached profile of a player with their statistics;
+// the profile is missing for players the players service was never
+// asked about.
+type PlayerView struct {
+	Email   string         `json:"email"`
+	Profile *PlayerProfile `json:"profile,omitempty"`
+	Stats   PlayerStats    `json:"stats"`
+}
+
+// GetPlayer serves the cached profile of a player and their statistics.
+// With the bypass flag, players refresh their own profile first.
+func GetPlayer(c echo.Context) error {
+	email := c.Param("email")
+	var p *PlayerProfile
+	var err error
+	if refreshPlayer(c) {
+		// the players service only tells callers about themselves
+		if _, ok := identity(c); !ok {
+			return errPlayerRefresh
+		}
+		var status int
+		start := time.Now()
+		if p, status, err = fetchPlayer(c); err != nil {
+			return betError(&dependencyError{calls: map[string]dependencyCall{"players": callSince(start, status, err)}})
+		}
+		if p.Email != email {
+			return errPlayerRefresh
+		}
+	} else if p, err = players.Get(tenant(c), playerKey(email)); err != nil {
+		return err
+	}
+	list, err := bets.List(BetFilter{Tenant: tenant(c), Email: email})
+	if err != nil {
+		return err
+	}
+	if p == nil && len(list) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "player not found")
+	}
+	return respond(c, http.StatusOK, &PlayerView{Email: email, Profile: p, Stats: playerStats(list)})
+}
+
+func playerStats(list []*Bet) PlayerStats {
+	st := PlayerStats{}
+	championships := map[string]bool{}
+	for _, b := range list {
+		st.Bets++
+		championships[b.ChampionshipID] = true
+		if s := b.Settlement; s != nil && s.Status == SettlementSettled {
+			st.Settled++
+			st.Points += s.Points
+			if s.Points == scoring(b.Tenant).ExactScore {
+				st.ExactScores++
+			}
+		}
+	}
+	st.Championships = len(championships)
+	return st
+}
+
+// encryptedPlayers stores the emails and names of the players encrypted;
+// players are looked up by key, which needs no decryption.
+type encryptedPlayers struct {
+	PlayerStore
+	pii *piiCipher
+}
+
+func (r *encryptedPlayers) Put(p *PlayerProfile) error {
+	enc := *p
+	var err error
+	if enc.Email, err = r.pii.Encrypt(p.Email); err != nil {
+		return err
+	}
+	if enc.Name, err = r.pii.Encrypt(p.Name); err != nil {
+		return err
+	}
+	return r.PlayerStore.Put(&enc)
+}
+
+func (r *encryptedPlayers) Get(tenant, player string) (*PlayerProfile, error) {
+	return r.decrypt(r.PlayerStore.Get(tenant, player))
+}
+
+func (r *encryptedPlayers) BySubject(tenant, subject string) (*PlayerProfile, error) {
+	return r.decrypt(r.PlayerStore.BySubject(tenant, subject))
+}
+
+func (r *encryptedPlayers) decrypt(p *PlayerProfile, err error) (*PlayerProfile, error) {
+	if err != nil || p == nil {
+		return p, err
+	}
+	if p.Email, err = r.pii.Decrypt(p.Email); err != nil {
+		return nil, err
+	}
+	p.Name, err = r.pii.Decrypt(p.Name)
+	return p, err
+}
+
+type memoryPlayers struct {
+	mu      sync.Mutex
+	players map[string]*PlayerProfile
+}
+
+func newMemoryPlayers() *memoryPlayers {
+	return &memoryPlayers{players: map[string]*PlayerProfile{}}
+}
+
+func (m *memoryPlayers) Get(tenant, player string) (*PlayerProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.copy(m.players[tenant+"/"+player]), nil
+}
+
+func (m *memoryPlayers) BySubject(tenant, subject string) (*PlayerProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var last *PlayerProfile
+	for _, p := range m.players {
+		if p.Tenant == tenant && p.Subject == subject && (last == nil || p.FetchedAt.After(last.FetchedAt)) {
+			last = p
+		}
+	}
+	return m.copy(last), nil
+}
+
+func (m *memoryPlayers) Put(p *PlayerProfile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.players[p.Tenant+"/"+p.Player] = m.copy(p)
+	return nil
+}
+
+func (m *memoryPlayers) copy(p *PlayerProfile) *PlayerProfile {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Attributes = map[string]string{}
+	for k, v := range p.Attributes {
+		c.Attributes[k] = v
+	}
+	return &c
+}
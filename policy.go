@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// ScorePolicy constrains the scores predicted on the matches of a
+// championship: at most MaxGoals per team, unless zero. Stages refine it
+// for the matches of the stages or rounds they name.
+type ScorePolicy struct {
+	MaxGoals int           `json:"maxGoals,omitempty"`
+	Stages   []StagePolicy `json:"stages,omitempty"`
+}
+
+// StagePolicy applies to the matches whose stage or round is listed, as
+// "Final". Knockout matches need a winner: a draw is only predicted along
+// with the winner of the penalty shootout, when Shootout allows it.
+type StagePolicy struct {
+	Stages   []string `json:"stages"`
+	MaxGoals int      `json:"maxGoals,omitempty"`
+	Knockout bool     `json:"knockout,omitempty"`
+	Shootout bool     `json:"shootout,omitempty"`
+}
+
+// The winners of a penalty shootout.
+const (
+	shootoutHome = "home"
+	shootoutAway = "away"
+)
+
+// stage finds the rules of the match's stage, and the stage they matched.
+func (p *ScorePolicy) stage(m *Match) (*StagePolicy, string) {
+	for i, s := range p.Stages {
+		for _, name := range s.Stages {
+			if strings.EqualFold(name, m.Championship.Stage) || strings.EqualFold(name, m.Round) {
+				return &p.Stages[i], name
+			}
+		}
+	}
+	return nil, ""
+}
+
+// checkScorePolicy validates the predicted score, and shootout, against
+// the policy of the championship, rejecting them with 422s telling which
+// rule they break. No policy takes any score.
+func checkScorePolicy(homeScore, awayScore, shootout string, p *ScorePolicy, m *Match) error {
+	home, _ := strconv.Atoi(homeScore)
+	away, _ := strconv.Atoi(awayScore)
+	var s *StagePolicy
+	var stage string
+	max := 0
+	if p != nil && m != nil {
+		s, stage = p.stage(m)
+		max = p.MaxGoals
+	}
+	if s != nil && s.MaxGoals > 0 {
+		max = s.MaxGoals
+	}
+	if max > 0 && (home > max || away > max) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "scores are limited to "+strconv.Itoa(max)+" goals per team")
+	}
+	knockout := s != nil && s.Knockout
+	switch {
+	case shootout != "" && !(knockout && s.Shootout):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "shootouts are only predicted on knockout matches")
+	case shootout != "" && home != away:
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "a shootout is only predicted along with a draw")
+	case knockout && home == away && !s.Shootout:
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, stage+" is a knockout stage, predict a winner")
+	case knockout && home == away && shootout == "":
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, stage+" is a knockout stage, predict the winner of the shootout along with a draw")
+	}
+	return nil
+}
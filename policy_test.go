@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func policyMatch(stage, round string) *Match {
+	m := &Match{ID: "m1", Round: round}
+	m.Championship.Stage = stage
+	return m
+}
+
+func TestCheckScorePolicy(t *testing.T) {
+	policy := &ScorePolicy{
+		MaxGoals: 5,
+		Stages: []StagePolicy{
+			{Stages: []string{"Group Stage"}, MaxGoals: 3},
+			{Stages: []string{"Round of 16"}, Knockout: true},
+			{Stages: []string{"Final"}, MaxGoals: 9, Knockout: true, Shootout: true},
+		},
+	}
+	for _, tc := range []struct {
+		name        string
+		home, away  string
+		shootout    string
+		policy      *ScorePolicy
+		match       *Match
+		wantMessage string
+	}{
+		{"no policy", "12", "12", "", nil, policyMatch("Final", ""), ""},
+		{"within max goals", "5", "0", "", policy, policyMatch("League", ""), ""},
+		{"above max goals", "6", "0", "", policy, policyMatch("League", ""), "limited to 5 goals"},
+		{"away above max goals", "0", "6", "", policy, policyMatch("League", ""), "limited to 5 goals"},
+		{"stage lowering the limit", "4", "0", "", policy, policyMatch("group stage", ""), "limited to 3 goals"},
+		{"stage raising the limit", "9", "0", "", policy, policyMatch("Final", ""), ""},
+		{"stage matched by round", "4", "0", "", policy, policyMatch("", "Group Stage"), "limited to 3 goals"},
+		{"knockout winner", "2", "1", "", policy, policyMatch("Round of 16", ""), ""},
+		{"knockout draw without shootout", "1", "1", "", policy, policyMatch("Round of 16", ""), "Round of 16 is a knockout stage, predict a winner"},
+		{"knockout draw missing its shootout", "1", "1", "", policy, policyMatch("Final", ""), "predict the winner of the shootout"},
+		{"knockout draw with its shootout", "1", "1", shootoutAway, policy, policyMatch("Final", ""), ""},
+		{"shootout without a draw", "2", "1", shootoutHome, policy, policyMatch("Final", ""), "only predicted along with a draw"},
+		{"shootout on a knockout without shootouts", "1", "1", shootoutHome, policy, policyMatch("Round of 16", ""), "only predicted on knockout matches"},
+		{"shootout outside knockout", "1", "1", shootoutHome, policy, policyMatch("Group Stage", ""), "only predicted on knockout matches"},
+		{"shootout without a policy", "1", "1", shootoutHome, nil, policyMatch("Final", ""), "only predicted on knockout matches"},
+	} {
+		err := checkScorePolicy(tc.home, tc.away, tc.shootout, tc.policy, tc.match)
+		if tc.wantMessage == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want nil", tc.name, err)
+			}
+			continue
+		}
+		he, ok := err.(*echo.HTTPError)
+		if !ok {
+			t.Errorf("%s: got %v, want a 422", tc.name, err)
+			continue
+		}
+		if he.Code != http.StatusUnprocessableEntity || !strings.Contains(he.Message.(string), tc.wantMessage) {
+			t.Errorf("%s: got %d %q, want 422 with %q", tc.name, he.Code, he.Message, tc.wantMessage)
+		}
+	}
+}
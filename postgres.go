@@ -0,0 +1,1009 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func openDatabase(url string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+const uniqueViolation = "23505"
+
+// postgresBets stores bets in the table created by the migrations.
+type postgresBets struct {
+	db *sql.DB
+}
+
+const betColumns = `id, email, email_index, home_score, away_score, championship, championship_id,
+	round, match_id, match, match_info, created_at, settlement, result, points, settled_at, tenant, external_ref, deleted_at, updated_at, stake, shootout, accumulator_id`
+
+// execer is the database or a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (p *postgresBets) Save(b *Bet) error {
+	return saveBet(p.db, b)
+}
+
+// SaveWithEvents stores the bet and its outbox entries in one transaction.
+func (p *postgresBets) SaveWithEvents(b *Bet, entries []*OutboxEntry) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveBet(tx, b); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := addOutboxEntry(tx, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func saveBet(db execer, b *Bet) error {
+	var info []byte
+	var matchDate *time.Time
+	if b.MatchInfo != nil {
+		var err error
+		if info, err = json.Marshal(b.MatchInfo); err != nil {
+			return err
+		}
+		matchDate = &b.MatchInfo.Date
+	}
+	s := b.Settlement
+	if s == nil {
+		s = &Settlement{Status: SettlementPending}
+	}
+	_, err := db.Exec(`INSERT INTO bets (`+betColumns+`, match_date)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)
+ON CONFLICT (id) DO UPDATE SET
+	email = EXCLUDED.email, email_index = EXCLUDED.email_index,
+	home_score = EXCLUDED.home_score, away_score = EXCLUDED.away_score,
+	championship = EXCLUDED.championship, championship_id = EXCLUDED.championship_id,
+	round = EXCLUDED.round, match_id = EXCLUDED.match_id, match = EXCLUDED.match,
+	match_info = EXCLUDED.match_info, match_date = EXCLUDED.match_date,
+	settlement = EXCLUDED.settlement, result = EXCLUDED.result,
+	points = EXCLUDED.points, settled_at = EXCLUDED.settled_at, tenant = EXCLUDED.tenant, external_ref = EXCLUDED.external_ref,
+	deleted_at = EXCLUDED.deleted_at, updated_at = EXCLUDED.updated_at, stake = EXCLUDED.stake, shootout = EXCLUDED.shootout,
+	accumulator_id = EXCLUDED.accumulator_id`,
+		b.ID, b.Email, b.EmailIndex, b.HomeTeamScore, b.AwayTeamScore, b.Championship, b.ChampionshipID,
+		b.Round, b.MatchID, b.Match, nullJSON(info), b.CreatedAt, s.Status, s.Result, s.Points, s.SettledAt,
+		b.Tenant, b.ExternalRef, b.DeletedAt, b.UpdatedAt, b.Stake, b.Shootout, b.AccumulatorID, matchDate)
+	if pe, ok := err.(*pq.Error); ok && pe.Code == uniqueViolation && pe.Constraint == "bets_tenant_external_ref_idx" {
+		return errExternalRefTaken
+	}
+	return err
+}
+
+func (p *postgresBets) Get(id string) (*Bet, error) {
+	b, err := scanBet(p.db.QueryRow(`SELECT `+betColumns+` FROM bets WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, errBetNotFound
+	}
+	return b, err
+}
+
+func (p *postgresBets) List(f BetFilter) ([]*Bet, error) {
+	r := []*Bet{}
+	err := p.Each(f, func(b *Bet) error {
+		r = append(r, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (p *postgresBets) Each(f BetFilter, fn func(*Bet) error) error {
+	where, args := betWhere(f)
+	rows, err := p.db.Query(`SELECT `+betColumns+` FROM bets`+where+` ORDER BY created_at`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b, err := scanBet(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *postgresBets) Aggregate(f BetFilter) (*BetAggregate, error) {
+	where, args := betWhere(f)
+	rows, err := p.db.Query(`SELECT championship_id, match_id, home_score, away_score, count(*),
+	count(*) FILTER (WHERE stake > 0), coalesce(sum(stake), 0) FROM bets`+where+`
+GROUP BY championship_id, match_id, home_score, away_score`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	a := &BetAggregate{Players: map[string]int{}}
+	for rows.Next() {
+		g := ScoreGroup{}
+		if err := rows.Scan(&g.ChampionshipID, &g.MatchID, &g.HomeTeamScore, &g.AwayTeamScore, &g.Bets, &g.Staked, &g.Stakes); err != nil {
+			return nil, err
+		}
+		a.Scores = append(a.Scores, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	players, err := p.db.Query(`SELECT championship_id, count(DISTINCT CASE WHEN email_index <> '' THEN email_index ELSE email END)
+FROM bets`+where+` GROUP BY championship_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer players.Close()
+	for players.Next() {
+		var championship string
+		var n int
+		if err := players.Scan(&championship, &n); err != nil {
+			return nil, err
+		}
+		a.Players[championship] = n
+	}
+	return a, players.Err()
+}
+
+// betWhere renders the filter as a WHERE clause with positional arguments.
+func betWhere(f BetFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		conds = append(conds, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+	if f.Tenant != "" {
+		add("tenant = ?", f.Tenant)
+	}
+	if f.Email != "" {
+		add("email = ?", f.Email)
+	}
+	if f.EmailIndex != "" {
+		add("email_index = ?", f.EmailIndex)
+	}
+	if f.Emails != nil {
+		add("email = ANY(?)", pq.Array(f.Emails))
+	}
+	if f.EmailIndexes != nil {
+		add("email_index = ANY(?)", pq.Array(f.EmailIndexes))
+	}
+	if f.Championship != "" {
+		add("championship = ?", f.Championship)
+	}
+	if f.ChampionshipID != "" {
+		add("championship_id = ?", f.ChampionshipID)
+	}
+	if f.Round != "" {
+		add("round = ?", f.Round)
+	}
+	if f.MatchID != "" {
+		add("match_id = ?", f.MatchID)
+	}
+	if f.ExternalRef != "" {
+		add("external_ref = ?", f.ExternalRef)
+	}
+	if f.AccumulatorID != "" {
+		add("accumulator_id = ?", f.AccumulatorID)
+	}
+	if !f.From.IsZero() {
+		add("match_date >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		add("match_date <= ?", f.To)
+	}
+	if !f.ChangedAfter.IsZero() {
+		add("updated_at > ?", f.ChangedAfter)
+	}
+	if !f.ChangedUntil.IsZero() {
+		add("updated_at <= ?", f.ChangedUntil)
+	}
+	if !f.PlacedFrom.IsZero() {
+		add("created_at >= ?", f.PlacedFrom)
+	}
+	if !f.PlacedBefore.IsZero() {
+		add("created_at < ?", f.PlacedBefore)
+	}
+	if !f.IncludeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBet(row scanner) (*Bet, error) {
+	b := &Bet{}
+	s := &Settlement{}
+	var info []byte
+	var settledAt *time.Time
+	if err := row.Scan(&b.ID, &b.Email, &b.EmailIndex, &b.HomeTeamScore, &b.AwayTeamScore, &b.Championship,
+		&b.ChampionshipID, &b.Round, &b.MatchID, &b.Match, &info, &b.CreatedAt, &s.Status, &s.Result,
+		&s.Points, &settledAt, &b.Tenant, &b.ExternalRef, &b.DeletedAt, &b.UpdatedAt, &b.Stake, &b.Shootout, &b.AccumulatorID); err != nil {
+		return nil, err
+	}
+	if info != nil {
+		b.MatchInfo = &Match{}
+		if err := json.Unmarshal(info, b.MatchInfo); err != nil {
+			return nil, err
+		}
+	}
+	s.SettledAt = settledAt
+	b.Settlement = s
+	return b, nil
+}
+
+func nullJSON(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+// auditLock is the transaction level advisory lock serializing appends to
+// the audit chain across replicas.
+const auditLock = 7262389
+
+// postgresAudit stores the audit chain in the audit_log table.
+type postgresAudit struct {
+	db *sql.DB
+}
+
+func (p *postgresAudit) Append(e *AuditEntry, seal func(int64, string)) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, auditLock); err != nil {
+		return err
+	}
+	var prevSeq int64
+	var prevHash string
+	err = tx.QueryRow(`SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1`).Scan(&prevSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	seal(prevSeq, prevHash)
+	if _, err := tx.Exec(`INSERT INTO audit_log (seq, at, actor, action, bet_id, data, prev_hash, hash)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.Seq, e.At, e.Actor, e.Action, e.BetID, string(e.Data), e.PrevHash, e.Hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *postgresAudit) List(betID string) ([]*AuditEntry, error) {
+	q := `SELECT seq, at, actor, action, bet_id, data, prev_hash, hash FROM audit_log`
+	var args []interface{}
+	if betID != "" {
+		q += ` WHERE bet_id = $1`
+		args = append(args, betID)
+	}
+	rows, err := p.db.Query(q+` ORDER BY seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*AuditEntry{}
+	for rows.Next() {
+		e := &AuditEntry{}
+		var data string
+		if err := rows.Scan(&e.Seq, &e.At, &e.Actor, &e.Action, &e.BetID, &data, &e.PrevHash, &e.Hash); err != nil {
+			return nil, err
+		}
+		e.At = e.At.UTC()
+		e.Data = json.RawMessage(data)
+		r = append(r, e)
+	}
+	return r, rows.Err()
+}
+
+func (p *postgresAudit) Range(after, until time.Time, fn func(*AuditEntry) error) error {
+	rows, err := p.db.Query(`SELECT seq, at, actor, action, bet_id, data, prev_hash, hash FROM audit_log
+WHERE at > $1 AND at <= $2 ORDER BY seq`, after, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &AuditEntry{}
+		var data string
+		if err := rows.Scan(&e.Seq, &e.At, &e.Actor, &e.Action, &e.BetID, &data, &e.PrevHash, &e.Hash); err != nil {
+			return err
+		}
+		e.At = e.At.UTC()
+		e.Data = json.RawMessage(data)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// postgresWatermarks keeps the warehouse export progress.
+type postgresWatermarks struct {
+	db *sql.DB
+}
+
+func (p *postgresWatermarks) Get(table string) (time.Time, error) {
+	var at time.Time
+	err := p.db.QueryRow(`SELECT at FROM warehouse_watermarks WHERE name = $1`, table).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+func (p *postgresWatermarks) Set(table string, at time.Time) error {
+	_, err := p.db.Exec(`INSERT INTO warehouse_watermarks (name, at) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET at = EXCLUDED.at`, table, at)
+	return err
+}
+
+// postgresRollups keeps the daily statistics in daily_stats.
+type postgresRollups struct {
+	db *sql.DB
+}
+
+func (p *postgresRollups) Put(day string, rows []*DailyStats) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM daily_stats WHERE day = $1`, day); err != nil {
+		return err
+	}
+	for _, d := range rows {
+		if _, err := tx.Exec(`INSERT INTO daily_stats (day, tenant, championship_id, bets, players, settled, points, computed_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, day, d.Tenant, d.Championship, d.Bets, d.Players, d.Settled, d.Points, d.ComputedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *postgresRollups) List(tenant, championship, from, to string) ([]*DailyStats, error) {
+	rows, err := p.db.Query(`SELECT to_char(day, 'YYYY-MM-DD'), tenant, championship_id, bets, players, settled, points, computed_at
+FROM daily_stats WHERE tenant = $1 AND ($2 = '' OR championship_id = $2) AND day BETWEEN $3 AND $4
+ORDER BY day, championship_id`, tenant, championship, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*DailyStats{}
+	for rows.Next() {
+		d := &DailyStats{}
+		if err := rows.Scan(&d.Day, &d.Tenant, &d.Championship, &d.Bets, &d.Players, &d.Settled, &d.Points, &d.ComputedAt); err != nil {
+			return nil, err
+		}
+		r = append(r, d)
+	}
+	return r, rows.Err()
+}
+
+type postgresMatchStates struct {
+	db *sql.DB
+}
+
+func (p *postgresMatchStates) Get(tenant, matchID string) (*MatchState, error) {
+	s := &MatchState{}
+	err := p.db.QueryRow(`SELECT tenant, match_id, status, locked, updated_at FROM match_states
+WHERE tenant = $1 AND match_id = $2`, tenant, matchID).Scan(&s.Tenant, &s.MatchID, &s.Status, &s.Locked, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+func (p *postgresMatchStates) Put(s *MatchState) error {
+	_, err := p.db.Exec(`INSERT INTO match_states (tenant, match_id, status, locked, updated_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (tenant, match_id) DO UPDATE SET status = EXCLUDED.status, locked = EXCLUDED.locked, updated_at = EXCLUDED.updated_at`,
+		s.Tenant, s.MatchID, s.Status, s.Locked, s.UpdatedAt)
+	return err
+}
+
+type postgresPlayerEvents struct {
+	db *sql.DB
+}
+
+func (p *postgresPlayerEvents) Add(e *PlayerEvent) error {
+	_, err := p.db.Exec(`INSERT INTO player_events (id, tenant, player, at, kind, bet_id, data) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO NOTHING`, e.ID, e.Tenant, e.Player, e.At, e.Kind, e.BetID, string(e.Data))
+	return err
+}
+
+func (p *postgresPlayerEvents) List(tenant, player string) ([]*PlayerEvent, error) {
+	rows, err := p.db.Query(`SELECT id, tenant, player, at, kind, bet_id, data FROM player_events
+WHERE tenant = $1 AND player = $2 ORDER BY at, id`, tenant, player)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*PlayerEvent{}
+	for rows.Next() {
+		e := &PlayerEvent{}
+		var data string
+		if err := rows.Scan(&e.ID, &e.Tenant, &e.Player, &e.At, &e.Kind, &e.BetID, &data); err != nil {
+			return nil, err
+		}
+		e.At = e.At.UTC()
+		if data != "" {
+			e.Data = json.RawMessage(data)
+		}
+		r = append(r, e)
+	}
+	return r, rows.Err()
+}
+
+type postgresAwards struct {
+	db *sql.DB
+}
+
+func (p *postgresAwards) Get(tenant, championshipID, round string) (*RoundAwards, error) {
+	a := &RoundAwards{}
+	var data string
+	err := p.db.QueryRow(`SELECT tenant, championship_id, round, awards, computed_at FROM round_awards
+WHERE tenant = $1 AND championship_id = $2 AND round = $3`, tenant, championshipID, round).
+		Scan(&a.Tenant, &a.ChampionshipID, &a.Round, &data, &a.ComputedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.ComputedAt = a.ComputedAt.UTC()
+	return a, json.Unmarshal([]byte(data), &a.Awards)
+}
+
+func (p *postgresAwards) Put(a *RoundAwards) error {
+	data, err := json.Marshal(a.Awards)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`INSERT INTO round_awards (tenant, championship_id, round, awards, computed_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (tenant, championship_id, round) DO UPDATE SET awards = EXCLUDED.awards, computed_at = EXCLUDED.computed_at`,
+		a.Tenant, a.ChampionshipID, a.Round, string(data), a.ComputedAt)
+	return err
+}
+
+type postgresPlayers struct {
+	db *sql.DB
+}
+
+const playerColumns = `tenant, player, subject, email, name, attributes, first_seen, fetched_at`
+
+func (p *postgresPlayers) Get(tenant, player string) (*PlayerProfile, error) {
+	return scanPlayer(p.db.QueryRow(`SELECT `+playerColumns+` FROM players WHERE tenant = $1 AND player = $2`, tenant, player))
+}
+
+func (p *postgresPlayers) BySubject(tenant, subject string) (*PlayerProfile, error) {
+	return scanPlayer(p.db.QueryRow(`SELECT `+playerColumns+` FROM players
+WHERE tenant = $1 AND subject = $2 ORDER BY fetched_at DESC LIMIT 1`, tenant, subject))
+}
+
+func scanPlayer(row *sql.Row) (*PlayerProfile, error) {
+	pp := &PlayerProfile{}
+	var attributes string
+	err := row.Scan(&pp.Tenant, &pp.Player, &pp.Subject, &pp.Email, &pp.Name, &attributes, &pp.FirstSeen, &pp.FetchedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pp.FirstSeen, pp.FetchedAt = pp.FirstSeen.UTC(), pp.FetchedAt.UTC()
+	return pp, json.Unmarshal([]byte(attributes), &pp.Attributes)
+}
+
+func (p *postgresPlayers) Put(pp *PlayerProfile) error {
+	attributes, err := json.Marshal(pp.Attributes)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`INSERT INTO players (`+playerColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (tenant, player) DO UPDATE SET subject = EXCLUDED.subject, email = EXCLUDED.email, name = EXCLUDED.name,
+	attributes = EXCLUDED.attributes, fetched_at = EXCLUDED.fetched_at`,
+		pp.Tenant, pp.Player, pp.Subject, pp.Email, pp.Name, string(attributes), pp.FirstSeen, pp.FetchedAt)
+	return err
+}
+
+type postgresPreferences struct {
+	db *sql.DB
+}
+
+func (p *postgresPreferences) Get(tenant, player string) (*NotificationPreferences, error) {
+	np := &NotificationPreferences{}
+	err := p.db.QueryRow(`SELECT tenant, player, disabled, updated_at FROM notification_preferences
+WHERE tenant = $1 AND player = $2`, tenant, player).Scan(&np.Tenant, &np.Player, pq.Array(&np.Disabled), &np.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	np.UpdatedAt = np.UpdatedAt.UTC()
+	return np, err
+}
+
+func (p *postgresPreferences) Put(np *NotificationPreferences) error {
+	_, err := p.db.Exec(`INSERT INTO notification_preferences (tenant, player, disabled, updated_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (tenant, player) DO UPDATE SET disabled = EXCLUDED.disabled, updated_at = EXCLUDED.updated_at`,
+		np.Tenant, np.Player, pq.Array(np.Disabled), np.UpdatedAt)
+	return err
+}
+
+type postgresReminders struct {
+	db *sql.DB
+}
+
+func (p *postgresReminders) Mark(tenant, matchID, player string, at time.Time) (bool, error) {
+	res, err := p.db.Exec(`INSERT INTO reminders (tenant, match_id, player, sent_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT DO NOTHING`, tenant, matchID, player, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+type postgresBetRequests struct {
+	db *sql.DB
+}
+
+func (p *postgresBetRequests) Get(id string) (*BetRequest, error) {
+	r := &BetRequest{}
+	var result []byte
+	err := p.db.QueryRow(`SELECT id, tenant, status, attempts, result, created_at, updated_at, owner FROM bet_requests WHERE id = $1`, id).
+		Scan(&r.ID, &r.Tenant, &r.Status, &r.Attempts, &result, &r.CreatedAt, &r.UpdatedAt, &r.Owner)
+	if err == sql.ErrNoRows {
+		return nil, errBetRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		r.Result = &BatchResult{}
+		if err := json.Unmarshal(result, r.Result); err != nil {
+			return nil, err
+		}
+	}
+	r.CreatedAt, r.UpdatedAt = r.CreatedAt.UTC(), r.UpdatedAt.UTC()
+	return r, nil
+}
+
+func (p *postgresBetRequests) Put(r *BetRequest) error {
+	var result interface{}
+	if r.Result != nil {
+		b, err := json.Marshal(r.Result)
+		if err != nil {
+			return err
+		}
+		result = string(b)
+	}
+	_, err := p.db.Exec(`INSERT INTO bet_requests (id, tenant, status, attempts, result, created_at, updated_at, owner) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (id) DO UPDATE SET status = EXCLUDED.status, attempts = EXCLUDED.attempts, result = EXCLUDED.result, updated_at = EXCLUDED.updated_at`,
+		r.ID, r.Tenant, r.Status, r.Attempts, result, r.CreatedAt, r.UpdatedAt, r.Owner)
+	return err
+}
+
+func (p *postgresBetRequests) Pending(before time.Time) ([]*BetRequest, error) {
+	rows, err := p.db.Query(`SELECT id, tenant, status, attempts, created_at, updated_at, owner FROM bet_requests
+WHERE status = $1 AND updated_at < $2`, string(BetRequestPending), before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*BetRequest{}
+	for rows.Next() {
+		req := &BetRequest{}
+		if err := rows.Scan(&req.ID, &req.Tenant, &req.Status, &req.Attempts, &req.CreatedAt, &req.UpdatedAt, &req.Owner); err != nil {
+			return nil, err
+		}
+		req.CreatedAt, req.UpdatedAt = req.CreatedAt.UTC(), req.UpdatedAt.UTC()
+		r = append(r, req)
+	}
+	return r, rows.Err()
+}
+
+type postgresBetWindows struct {
+	db *sql.DB
+}
+
+func (p *postgresBetWindows) List(tenant, championshipID string) ([]*BetWindow, error) {
+	rows, err := p.db.Query(`SELECT tenant, championship_id, round, opens_at, closes_at, blackouts, updated_at FROM bet_windows
+WHERE tenant = $1 AND championship_id = $2 ORDER BY round`, tenant, championshipID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*BetWindow{}
+	for rows.Next() {
+		w := &BetWindow{}
+		var opens, closes pq.NullTime
+		var blackouts []byte
+		if err := rows.Scan(&w.Tenant, &w.ChampionshipID, &w.Round, &opens, &closes, &blackouts, &w.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if opens.Valid {
+			t := opens.Time.UTC()
+			w.OpensAt = &t
+		}
+		if closes.Valid {
+			t := closes.Time.UTC()
+			w.ClosesAt = &t
+		}
+		if blackouts != nil {
+			if err := json.Unmarshal(blackouts, &w.Blackouts); err != nil {
+				return nil, err
+			}
+		}
+		w.UpdatedAt = w.UpdatedAt.UTC()
+		r = append(r, w)
+	}
+	return r, rows.Err()
+}
+
+func (p *postgresBetWindows) Put(w *BetWindow) error {
+	blackouts, err := json.Marshal(w.Blackouts)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`INSERT INTO bet_windows (tenant, championship_id, round, opens_at, closes_at, blackouts, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (tenant, championship_id, round) DO UPDATE SET opens_at = EXCLUDED.opens_at, closes_at = EXCLUDED.closes_at,
+	blackouts = EXCLUDED.blackouts, updated_at = EXCLUDED.updated_at`,
+		w.Tenant, w.ChampionshipID, w.Round, w.OpensAt, w.ClosesAt, string(blackouts), w.UpdatedAt)
+	return err
+}
+
+func (p *postgresBetWindows) Delete(tenant, championshipID, round string) error {
+	_, err := p.db.Exec(`DELETE FROM bet_windows WHERE tenant = $1 AND championship_id = $2 AND round = $3`, tenant, championshipID, round)
+	return err
+}
+
+type postgresUsers struct {
+	db *sql.DB
+}
+
+func (p *postgresUsers) Get(email string) (*LocalUser, error) {
+	u := &LocalUser{}
+	err := p.db.QueryRow(`SELECT email, tenant, password_hash, roles, created_at FROM users WHERE email = $1`, email).
+		Scan(&u.Email, &u.Tenant, &u.PasswordHash, pq.Array(&u.Roles), &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (p *postgresUsers) Put(u *LocalUser) error {
+	_, err := p.db.Exec(`INSERT INTO users (email, tenant, password_hash, roles, created_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (email) DO UPDATE SET password_hash = EXCLUDED.password_hash, roles = EXCLUDED.roles`,
+		u.Email, u.Tenant, u.PasswordHash, pq.Array(u.Roles), u.CreatedAt)
+	return err
+}
+
+func (p *postgresUsers) Delete(email string) error {
+	_, err := p.db.Exec(`DELETE FROM users WHERE email = $1`, email)
+	return err
+}
+
+func (p *postgresUsers) List(tenant string) ([]*LocalUser, error) {
+	rows, err := p.db.Query(`SELECT email, tenant, password_hash, roles, created_at FROM users WHERE tenant = $1 ORDER BY email`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*LocalUser{}
+	for rows.Next() {
+		u := &LocalUser{}
+		if err := rows.Scan(&u.Email, &u.Tenant, &u.PasswordHash, pq.Array(&u.Roles), &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		r = append(r, u)
+	}
+	return r, rows.Err()
+}
+
+// postgresLocks keeps leases in the locks table. Unlike advisory locks they
+// survive connection churn and expire on their own.
+type postgresLocks struct {
+	db *sql.DB
+}
+
+func (p *postgresLocks) Acquire(name, owner string, ttl time.Duration) (bool, error) {
+	res, err := p.db.Exec(`INSERT INTO locks (name, owner, expires_at)
+VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+ON CONFLICT (name) DO UPDATE SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at
+WHERE locks.owner = EXCLUDED.owner OR locks.expires_at < now()`, name, owner, ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (p *postgresLocks) Release(name, owner string) error {
+	_, err := p.db.Exec(`DELETE FROM locks WHERE name = $1 AND owner = $2`, name, owner)
+	return err
+}
+
+// postgresOutbox keeps pending events in the outbox table and the ones
+// given up on in dead_letters.
+type postgresOutbox struct {
+	db *sql.DB
+}
+
+func (p *postgresOutbox) Add(e *OutboxEntry) error {
+	return addOutboxEntry(p.db, e)
+}
+
+func addOutboxEntry(db execer, e *OutboxEntry) error {
+	_, err := db.Exec(`INSERT INTO outbox (id, topic, payload, attempts, last_error, created_at, next_attempt_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		e.ID, e.Topic, string(e.Payload), e.Attempts, e.LastError, e.CreatedAt, e.NextAttemptAt)
+	return err
+}
+
+func (p *postgresOutbox) Claim(limit int, lease time.Duration) ([]*OutboxEntry, error) {
+	rows, err := p.db.Query(`UPDATE outbox SET next_attempt_at = now() + $2 * interval '1 millisecond'
+WHERE id IN (
+	SELECT id FROM outbox WHERE next_attempt_at <= now()
+	ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED
+)
+RETURNING id, topic, payload, attempts, last_error, created_at, next_attempt_at`, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*OutboxEntry{}
+	for rows.Next() {
+		e := &OutboxEntry{}
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Topic, &payload, &e.Attempts, &e.LastError, &e.CreatedAt, &e.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		r = append(r, e)
+	}
+	return r, rows.Err()
+}
+
+func (p *postgresOutbox) Done(id string) error {
+	_, err := p.db.Exec(`DELETE FROM outbox WHERE id = $1`, id)
+	return err
+}
+
+func (p *postgresOutbox) Retry(e *OutboxEntry) error {
+	_, err := p.db.Exec(`UPDATE outbox SET attempts = $2, last_error = $3, next_attempt_at = $4 WHERE id = $1`,
+		e.ID, e.Attempts, e.LastError, e.NextAttemptAt)
+	return err
+}
+
+func (p *postgresOutbox) Bury(e *OutboxEntry) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE id = $1`, e.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO dead_letters (id, topic, payload, attempts, last_error, created_at, dead_at)
+VALUES ($1, $2, $3, $4, $5, $6, now())`,
+		e.ID, e.Topic, string(e.Payload), e.Attempts, e.LastError, e.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *postgresOutbox) Dead() ([]*OutboxEntry, error) {
+	rows, err := p.db.Query(`SELECT id, topic, payload, attempts, last_error, created_at, dead_at
+FROM dead_letters ORDER BY dead_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*OutboxEntry{}
+	for rows.Next() {
+		e := &OutboxEntry{}
+		var payload string
+		var dead time.Time
+		if err := rows.Scan(&e.ID, &e.Topic, &payload, &e.Attempts, &e.LastError, &e.CreatedAt, &dead); err != nil {
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		e.DeadAt = &dead
+		r = append(r, e)
+	}
+	return r, rows.Err()
+}
+
+func (p *postgresOutbox) Redrive(id string) (*OutboxEntry, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	e := &OutboxEntry{}
+	var payload string
+	err = tx.QueryRow(`DELETE FROM dead_letters WHERE id = $1
+RETURNING id, topic, payload, created_at`, id).Scan(&e.ID, &e.Topic, &payload, &e.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errOutboxNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.Payload = json.RawMessage(payload)
+	e.NextAttemptAt = time.Now()
+	if _, err := tx.Exec(`INSERT INTO outbox (id, topic, payload, attempts, last_error, created_at, next_attempt_at)
+VALUES ($1, $2, $3, 0, '', $4, $5)`, e.ID, e.Topic, payload, e.CreatedAt, e.NextAttemptAt); err != nil {
+		return nil, err
+	}
+	return e, tx.Commit()
+}
+
+// Stats queries the backlog at scrape time; errors leave the metrics at zero.
+func (p *postgresOutbox) Stats() OutboxStats {
+	st := OutboxStats{}
+	var oldest sql.NullFloat64
+	err := p.db.QueryRow(`SELECT count(*), extract(epoch FROM now() - min(created_at)),
+	(SELECT count(*) FROM dead_letters) FROM outbox`).Scan(&st.Backlog, &oldest, &st.Dead)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the outbox stats")
+		return OutboxStats{}
+	}
+	st.OldestAge = time.Duration(oldest.Float64 * float64(time.Second))
+	return st
+}
+
+// postgresSubscriptions keeps outbound webhooks in webhook_subscriptions and
+// their deliveries in webhook_deliveries. Deliveries go with their
+// subscription.
+type postgresSubscriptions struct {
+	db *sql.DB
+}
+
+func (p *postgresSubscriptions) Add(s *WebhookSubscription) error {
+	_, err := p.db.Exec(`INSERT INTO webhook_subscriptions (id, tenant, url, secret, events, created_at)
+VALUES ($1, $2, $3, $4, $5, $6)`, s.ID, s.Tenant, s.URL, s.Secret, pq.Array(s.Events), s.CreatedAt)
+	return err
+}
+
+func (p *postgresSubscriptions) Get(id string) (*WebhookSubscription, error) {
+	s := &WebhookSubscription{}
+	err := p.db.QueryRow(`SELECT id, tenant, url, secret, events, created_at FROM webhook_subscriptions WHERE id = $1`, id).
+		Scan(&s.ID, &s.Tenant, &s.URL, &s.Secret, pq.Array(&s.Events), &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errSubscriptionNotFound
+	}
+	return s, err
+}
+
+func (p *postgresSubscriptions) List(tenant string) ([]*WebhookSubscription, error) {
+	rows, err := p.db.Query(`SELECT id, tenant, url, secret, events, created_at FROM webhook_subscriptions
+WHERE tenant = $1 ORDER BY created_at`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*WebhookSubscription{}
+	for rows.Next() {
+		s := &WebhookSubscription{}
+		if err := rows.Scan(&s.ID, &s.Tenant, &s.URL, &s.Secret, pq.Array(&s.Events), &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		r = append(r, s)
+	}
+	return r, rows.Err()
+}
+
+func (p *postgresSubscriptions) Delete(id string) error {
+	_, err := p.db.Exec(`DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	return err
+}
+
+func (p *postgresSubscriptions) SaveDelivery(d *WebhookDelivery) error {
+	_, err := p.db.Exec(`INSERT INTO webhook_deliveries
+	(id, subscription_id, event, status, attempts, response_status, last_error, created_at, delivered_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (id) DO UPDATE SET status = EXCLUDED.status, attempts = EXCLUDED.attempts,
+	response_status = EXCLUDED.response_status, last_error = EXCLUDED.last_error, delivered_at = EXCLUDED.delivered_at`,
+		d.ID, d.SubscriptionID, d.Event, string(d.Status), d.Attempts, d.ResponseStatus, d.Error, d.CreatedAt, d.DeliveredAt)
+	return err
+}
+
+func (p *postgresSubscriptions) Deliveries(subscription string, limit int) ([]*WebhookDelivery, error) {
+	rows, err := p.db.Query(`SELECT id, subscription_id, event, status, attempts, response_status, last_error, created_at, delivered_at
+FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY created_at DESC LIMIT $2`, subscription, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*WebhookDelivery{}
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		var status string
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.Event, &status, &d.Attempts, &d.ResponseStatus, &d.Error, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		d.Status = DeliveryStatus(status)
+		r = append(r, d)
+	}
+	return r, rows.Err()
+}
+
+type postgresDomains struct {
+	db *sql.DB
+}
+
+func (p *postgresDomains) Put(d *PoolDomain) error {
+	_, err := p.db.Exec(`INSERT INTO pool_domains (host, tenant, pool, championship, title, cert_file, key_file, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (host) DO UPDATE SET tenant = EXCLUDED.tenant, pool = EXCLUDED.pool, championship = EXCLUDED.championship,
+	title = EXCLUDED.title, cert_file = EXCLUDED.cert_file, key_file = EXCLUDED.key_file`,
+		d.Host, d.Tenant, d.Pool, d.Championship, d.Title, d.CertFile, d.KeyFile, d.CreatedAt)
+	return err
+}
+
+func (p *postgresDomains) Get(host string) (*PoolDomain, error) {
+	d := &PoolDomain{}
+	err := p.db.QueryRow(`SELECT host, tenant, pool, championship, title, cert_file, key_file, created_at
+FROM pool_domains WHERE host = $1`, host).
+		Scan(&d.Host, &d.Tenant, &d.Pool, &d.Championship, &d.Title, &d.CertFile, &d.KeyFile, &d.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errDomainNotFound
+	}
+	return d, err
+}
+
+func (p *postgresDomains) List(tenant string) ([]*PoolDomain, error) {
+	rows, err := p.db.Query(`SELECT host, tenant, pool, championship, title, cert_file, key_file, created_at
+FROM pool_domains WHERE tenant = $1 ORDER BY host`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []*PoolDomain{}
+	for rows.Next() {
+		d := &PoolDomain{}
+		if err := rows.Scan(&d.Host, &d.Tenant, &d.Pool, &d.Championship, &d.Title, &d.CertFile, &d.KeyFile, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		r = append(r, d)
+	}
+	return r, rows.Err()
+}
+
+func (p *postgresDomains) Delete(host string) error {
+	_, err := p.db.Exec(`DELETE FROM pool_domains WHERE host = $1`, host)
+	return err
+}
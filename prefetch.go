@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var prefetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "prefetch",
+	Name:      "requests_total",
+	Help:      "Upstream lookups made ahead of kickoffs, per service and result.",
+}, []string{"service", "result"})
+
+func init() {
+	registry.MustRegister(prefetches)
+}
+
+// prefetcher keeps the match and championship lookups of hot matches warm
+// until kickoff, so the rush of last minute bets is served from the cache.
+// A match is hot when it kicks off within the window and already drew at
+// least MinBets bets. Lookups run Connections at a time, which also keeps
+// that many connections to the services open.
+type prefetcher struct {
+	cfg PrefetchConfig
+}
+
+func newPrefetcher(cfg PrefetchConfig) *prefetcher {
+	if cfg.Connections < 1 {
+		cfg.Connections = 1
+	}
+	return &prefetcher{cfg: cfg}
+}
+
+func (p *prefetcher) Run(ctx context.Context) {
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := p.prefetch(); err != nil {
+				log.Error().Err(err).Msg("failed to prefetch hot matches")
+			}
+		}
+	}
+}
+
+type hotMatch struct {
+	tenant, match string
+}
+
+// hot returns the hot matches, mapped to the id of their championship.
+func (p *prefetcher) hot() (map[hotMatch]string, error) {
+	now := clock.Now()
+	list, err := bets.List(BetFilter{From: now, To: now.Add(p.cfg.Window)})
+	if err != nil {
+		return nil, err
+	}
+	count := map[hotMatch]int{}
+	championships := map[hotMatch]string{}
+	for _, b := range list {
+		m := hotMatch{b.Tenant, b.MatchID}
+		count[m]++
+		championships[m] = b.ChampionshipID
+	}
+	hot := map[hotMatch]string{}
+	for id, n := range count {
+		if n >= p.cfg.MinBets {
+			hot[id] = championships[id]
+		}
+	}
+	return hot, nil
+}
+
+func (p *prefetcher) prefetch() error {
+	hot, err := p.hot()
+	if err != nil || len(hot) == 0 {
+		return err
+	}
+	urls := map[string]func(){}
+	for match, champ := range hot {
+		matchURL := serviceURL(match.tenant, "MATCH_SVC", match.match)
+		champURL := serviceURL(match.tenant, "CHAMPIONSHIP_SVC", champ)
+		urls[matchURL] = func() {
+			_, _, err := loadMatch(nil, matchURL)
+			countPrefetch("matches", err)
+		}
+		if champURL == "" {
+			continue
+		}
+		urls[champURL] = func() {
+			_, _, err := loadChampionship(nil, champURL)
+			countPrefetch("championships", err)
+		}
+	}
+	sem := make(chan struct{}, p.cfg.Connections)
+	wg := sync.WaitGroup{}
+	for _, load := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(load func()) {
+			defer wg.Done()
+			load()
+			<-sem
+		}(load)
+	}
+	wg.Wait()
+	log.Debug().Int("matches", len(hot)).Int("lookups", len(urls)).Msg("prefetched hot matches")
+	return nil
+}
+
+func countPrefetch(service string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	prefetches.WithLabelValues(service, result).Inc()
+}
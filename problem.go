@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Problem is an RFC 7807 error. Throttled and unavailable responses carry
+// the wait before retrying both in Retry-After and, to the millisecond, in
+// retryAfterMs.
+type Problem struct {
+	Type         string         `json:"type,omitempty"`
+	Title        string         `json:"title"`
+	Status       int            `json:"status"`
+	Detail       string         `json:"detail,omitempty"`
+	RetryAfterMs int64          `json:"retryAfterMs,omitempty"`
+	Errors       map[string]int `json:"errors,omitempty"`
+	// Dependencies details the downstream calls behind a 503.
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return p.Title
+}
+
+// retryAfter sets the wait before retrying; zero means no guidance.
+func (p *Problem) retryAfter(d time.Duration) *Problem {
+	if d > 0 {
+		p.RetryAfterMs = int64((d + time.Millisecond - 1) / time.Millisecond)
+	}
+	return p
+}
+
+// errorHandler renders problems as application/problem+json and leaves the
+// other errors to echo, their messages translated to the caller's locale.
+func errorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		l := localizeResponse(c)
+		p, ok := err.(*Problem)
+		if !ok {
+			// the errors may be shared, as echo.ErrNotFound
+			if he, ok := err.(*echo.HTTPError); ok {
+				if msg, ok := he.Message.(string); ok {
+					err = &echo.HTTPError{Code: he.Code, Message: translate(l, msg), Internal: he.Internal}
+				}
+			}
+			e.DefaultHTTPErrorHandler(err, c)
+			return
+		}
+		localized := *p
+		localized.Title, localized.Detail = translate(l, p.Title), translate(l, p.Detail)
+		p = &localized
+		if c.Response().Committed {
+			return
+		}
+		if p.RetryAfterMs > 0 {
+			// whole seconds, rounded up so clients never retry early
+			c.Response().Header().Set("Retry-After", strconv.FormatInt((p.RetryAfterMs+999)/1000, 10))
+		}
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(p.Status)
+		} else {
+			c.Response().Header().Set(echo.HeaderContentType, MIMEApplicationProblemJSON)
+			err = c.JSON(p.Status, p)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to write the problem response")
+		}
+	}
+}
+
+// errorStatus is the status an error returned by a handler is rendered with.
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case *echo.HTTPError:
+		return e.Code
+	case *Problem:
+		return e.Status
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const MIMEApplicationProtobuf = "application/protobuf"
+
+// The protobuf messages of the API, described in
+// assets/api-docs/bets.proto, are mapped field by field to their JSON
+// documents, so the handlers and the redaction rules only ever see JSON.
+type protoKind int
+
+const (
+	protoString protoKind = iota
+	protoInt
+	protoBool
+	protoMessageKind
+	// protoMap is a map<string, int64>, i.e. repeated key/value entries.
+	protoMap
+)
+
+type protoField struct {
+	num      uint64
+	name     string
+	kind     protoKind
+	repeated bool
+	msg      *protoMessage
+}
+
+type protoMessage struct {
+	fields []protoField
+	// root names the field holding the document, for JSON arrays.
+	root string
+}
+
+func (m *protoMessage) field(num uint64) *protoField {
+	for i := range m.fields {
+		if m.fields[i].num == num {
+			return &m.fields[i]
+		}
+	}
+	return nil
+}
+
+var (
+	settlementMessage = &protoMessage{fields: []protoField{
+		{num: 1, name: "status"},
+		{num: 2, name: "result"},
+		{num: 3, name: "points", kind: protoInt},
+		{num: 4, name: "settledAt"},
+	}}
+	betFields = []protoField{
+		{num: 1, name: "id"},
+		{num: 2, name: "tenant"},
+		{num: 3, name: "externalRef"},
+		{num: 4, name: "homeTeamScore"},
+		{num: 5, name: "awayTeamScore"},
+		{num: 6, name: "championship"},
+		{num: 7, name: "match"},
+		{num: 8, name: "email"},
+		{num: 9, name: "matchId"},
+		{num: 10, name: "championshipId"},
+		{num: 11, name: "round"},
+		{num: 12, name: "createdAt"},
+		{num: 13, name: "updatedAt"},
+		{num: 14, name: "settlement", kind: protoMessageKind, msg: settlementMessage},
+		{num: 15, name: "deletedAt"},
+		{num: 19, name: "stake", kind: protoInt},
+		{num: 20, name: "shootout"},
+		{num: 21, name: "accumulatorId"},
+	}
+	betMessage     = &protoMessage{fields: betFields}
+	warningMessage = &protoMessage{fields: []protoField{
+		{num: 1, name: "code"},
+		{num: 2, name: "message"},
+	}}
+	createdBetMessage = &protoMessage{fields: append(append([]protoField{}, betFields...),
+		protoField{num: 16, name: "degraded", kind: protoBool},
+		protoField{num: 17, name: "warnings", kind: protoMessageKind, repeated: true, msg: warningMessage},
+		protoField{num: 18, name: "dryRun", kind: protoBool},
+	)}
+	betBatchMessage = &protoMessage{fields: []protoField{
+		{num: 1, name: "round"},
+		{num: 2, name: "bets", kind: protoMessageKind, repeated: true, msg: betMessage},
+	}}
+	batchResultMessage = &protoMessage{fields: []protoField{
+		{num: 1, name: "status", kind: protoInt},
+		{num: 2, name: "bet", kind: protoMessageKind, msg: betMessage},
+		{num: 3, name: "degraded", kind: protoBool},
+		{num: 4, name: "warnings", kind: protoMessageKind, repeated: true, msg: warningMessage},
+		{num: 5, name: "error"},
+		{num: 6, name: "errors", kind: protoMap},
+		{num: 7, name: "retryAfterMs", kind: protoInt},
+	}}
+	batchResultsMessage = &protoMessage{root: "results", fields: []protoField{
+		{num: 1, name: "results", kind: protoMessageKind, repeated: true, msg: batchResultMessage},
+	}}
+	betUpdateMessage = &protoMessage{fields: []protoField{
+		{num: 1, name: "homeTeamScore"},
+		{num: 2, name: "awayTeamScore"},
+		{num: 3, name: "shootout"},
+	}}
+)
+
+// responseMessage is the message v is encoded as, nil when the response
+// is only offered as JSON.
+func responseMessage(v interface{}) *protoMessage {
+	switch v.(type) {
+	case *CreatedBet:
+		return createdBetMessage
+	case []BatchResult:
+		return batchResultsMessage
+	}
+	return nil
+}
+
+var errProtoTruncated = errors.New("truncated message")
+
+// decodeProto converts a message to its JSON document. Unknown fields are
+// skipped, as protobuf parsers do.
+func decodeProto(m *protoMessage, b []byte) (interface{}, error) {
+	doc := map[string]interface{}{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		num, wire := tag>>3, tag&7
+		var v uint64
+		var data []byte
+		switch wire {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return nil, errProtoTruncated
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errProtoTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, errProtoTruncated
+			}
+			b = b[4:]
+		default:
+			return nil, errors.New("unsupported wire type " + strconv.FormatUint(wire, 10))
+		}
+		f := m.field(num)
+		if f == nil {
+			continue
+		}
+		var value interface{}
+		switch {
+		case f.kind == protoString && wire == 2:
+			value = string(data)
+		case f.kind == protoInt && wire == 0:
+			value = int64(v)
+		case f.kind == protoBool && wire == 0:
+			value = v != 0
+		case f.kind == protoMessageKind && wire == 2:
+			sub, err := decodeProto(f.msg, data)
+			if err != nil {
+				return nil, err
+			}
+			value = sub
+		case f.kind == protoMap && wire == 2:
+			entry, err := decodeProto(mapEntryMessage, data)
+			if err != nil {
+				return nil, err
+			}
+			e := entry.(map[string]interface{})
+			key, _ := e["key"].(string)
+			entries, _ := doc[f.name].(map[string]interface{})
+			if entries == nil {
+				entries = map[string]interface{}{}
+				doc[f.name] = entries
+			}
+			entries[key] = e["value"]
+			continue
+		default:
+			return nil, errors.New("wrong wire type for field " + f.name)
+		}
+		if f.repeated {
+			list, _ := doc[f.name].([]interface{})
+			doc[f.name] = append(list, value)
+		} else {
+			doc[f.name] = value
+		}
+	}
+	if m.root != "" {
+		list, _ := doc[m.root].([]interface{})
+		if list == nil {
+			list = []interface{}{}
+		}
+		return list, nil
+	}
+	return doc, nil
+}
+
+var mapEntryMessage = &protoMessage{fields: []protoField{
+	{num: 1, name: "key"},
+	{num: 2, name: "value", kind: protoInt},
+}}
+
+// encodeProto converts a JSON document, decoded with UseNumber, to a
+// message. Fields the message doesn't have are left out.
+func encodeProto(m *protoMessage, doc interface{}) []byte {
+	if m.root != "" {
+		doc = map[string]interface{}{m.root: doc}
+	}
+	obj, _ := doc.(map[string]interface{})
+	var b []byte
+	for _, f := range m.fields {
+		v, ok := obj[f.name]
+		if !ok || v == nil {
+			continue
+		}
+		values := []interface{}{v}
+		if f.repeated {
+			values, _ = v.([]interface{})
+		}
+		if f.kind == protoMap {
+			entries, _ := v.(map[string]interface{})
+			values = nil
+			keys := make([]string, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				values = append(values, map[string]interface{}{"key": k, "value": entries[k]})
+			}
+		}
+		for _, v := range values {
+			b = appendProtoValue(b, f, v)
+		}
+	}
+	return b
+}
+
+func appendProtoValue(b []byte, f protoField, v interface{}) []byte {
+	switch f.kind {
+	case protoString:
+		s, ok := v.(string)
+		if !ok {
+			return b
+		}
+		b = appendUvarint(b, f.num<<3|2)
+		b = appendUvarint(b, uint64(len(s)))
+		return append(b, s...)
+	case protoInt:
+		n, err := v.(json.Number).Int64()
+		if err != nil {
+			f, _ := v.(json.Number).Float64()
+			n = int64(math.Round(f))
+		}
+		b = appendUvarint(b, f.num<<3)
+		return appendUvarint(b, uint64(n))
+	case protoBool:
+		if t, _ := v.(bool); t {
+			b = appendUvarint(b, f.num<<3)
+			return append(b, 1)
+		}
+		return b
+	}
+	msg := f.msg
+	if f.kind == protoMap {
+		msg = mapEntryMessage
+	}
+	sub := encodeProto(msg, v)
+	b = appendUvarint(b, f.num<<3|2)
+	b = appendUvarint(b, uint64(len(sub)))
+	return append(b, sub...)
+}
+
+func appendUvarint(b []byte, u uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, u)]...)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var quotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "quota",
+	Name:      "rejections_total",
+	Help:      "Bets created or edited over a player's quota, per window: minute or day.",
+}, []string{"window"})
+
+var quotaErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "quota",
+	Name:      "errors_total",
+	Help:      "Quota checks let through because the counters could not be reached.",
+})
+
+func init() {
+	registry.MustRegister(quotaRejections, quotaErrors)
+}
+
+// quotaWindow allows Limit bets per Period, counted in fixed windows aligned
+// on the epoch, so days start at midnight UTC.
+type quotaWindow struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+func (w quotaWindow) start(now time.Time) time.Time {
+	return now.Truncate(w.Period)
+}
+
+// QuotaStore keeps the counters of the quotas. Take counts a bet of key in
+// every window, unless one of them is at its limit, in which case nothing
+// is counted; it returns the counts after the bet, or as they stand when
+// it was refused.
+type QuotaStore interface {
+	Take(key string, windows []quotaWindow, now time.Time) (counts []int, ok bool, err error)
+}
+
+// betQuota caps the bets each player creates or edits, on top of the rate
+// limiting of the API requests: it stops scripts placing and editing bets
+// from accounts, whatever address they call from.
+type betQuota struct {
+	windows []quotaWindow
+	store   QuotaStore
+}
+
+var quotas *betQuota
+
+// newBetQuota returns nil, enforcing nothing, when no limit is set.
+func newBetQuota(cfg BetQuotaConfig) (*betQuota, error) {
+	q := &betQuota{}
+	if cfg.PerMinute > 0 {
+		q.windows = append(q.windows, quotaWindow{Name: "minute", Limit: cfg.PerMinute, Period: time.Minute})
+	}
+	if cfg.PerDay > 0 {
+		q.windows = append(q.windows, quotaWindow{Name: "day", Limit: cfg.PerDay, Period: 24 * time.Hour})
+	}
+	if len(q.windows) == 0 {
+		return nil, nil
+	}
+	if cfg.RedisURL == "" {
+		q.store = &memoryQuotas{counters: map[string]*quotaCounter{}}
+		return q, nil
+	}
+	r, err := newRedisClient(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	q.store = &redisQuotas{client: r}
+	return q, nil
+}
+
+// key identifies the player by their token subject, or else email or
+// address, within their tenant.
+func (q *betQuota) key(c echo.Context) string {
+	key := "ip:" + c.RealIP()
+	if id, ok := identity(c); ok && id.Subject != "" {
+		key = "sub:" + id.Subject
+	} else if ok && id.Email != "" {
+		key = "email:" + normalizeEmail(id.Email)
+	}
+	return tenant(c) + "/" + key
+}
+
+// take counts a bet created or edited by the caller, answering 429 over
+// the quota. Every response tells where the caller stands in each window
+// with X-Quota-Minute-Limit, X-Quota-Minute-Remaining and
+// X-Quota-Minute-Reset, the seconds until the window resets, and their
+// X-Quota-Day-* counterparts. The quota fails open: bets go through while
+// the counters can't be reached.
+func (q *betQuota) take(c echo.Context) error {
+	if q == nil {
+		return nil
+	}
+	now := time.Now()
+	counts, ok, err := q.store.Take(q.key(c), q.windows, now)
+	if err != nil {
+		quotaErrors.Inc()
+		log.Warn().Err(err).Msg("failed to count the bet quota, letting the bet through")
+		return nil
+	}
+	h := c.Response().Header()
+	var exceeded *quotaWindow
+	var reset time.Duration
+	for i, w := range q.windows {
+		remaining := w.Limit - counts[i]
+		if remaining < 0 {
+			remaining = 0
+		}
+		until := w.start(now).Add(w.Period).Sub(now)
+		prefix := "X-Quota-" + strings.Title(w.Name) + "-"
+		h.Set(prefix+"Limit", strconv.Itoa(w.Limit))
+		h.Set(prefix+"Remaining", strconv.Itoa(remaining))
+		h.Set(prefix+"Reset", strconv.FormatInt(int64((until+time.Second-1)/time.Second), 10))
+		// the longest wait is the one that lets the bet through
+		if !ok && counts[i] >= w.Limit && until > reset {
+			exceeded, reset = &q.windows[i], until
+		}
+	}
+	if ok {
+		return nil
+	}
+	quotaRejections.WithLabelValues(exceeded.Name).Inc()
+	return (&Problem{
+		Title:  "bet quota exceeded",
+		Status: http.StatusTooManyRequests,
+		Detail: "at most " + strconv.Itoa(exceeded.Limit) + " bets created or edited per " + exceeded.Name,
+	}).retryAfter(reset)
+}
+
+// memoryQuotas keeps the counters of this replica only.
+type memoryQuotas struct {
+	mu       sync.Mutex
+	counters map[string]*quotaCounter
+	swept    time.Time
+}
+
+type quotaCounter struct {
+	count   int
+	expires time.Time
+}
+
+func (m *memoryQuotas) Take(key string, windows []quotaWindow, now time.Time) ([]int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.swept) > time.Minute {
+		for k, c := range m.counters {
+			if !now.Before(c.expires) {
+				delete(m.counters, k)
+			}
+		}
+		m.swept = now
+	}
+	counters := make([]*quotaCounter, len(windows))
+	counts := make([]int, len(windows))
+	ok := true
+	for i, w := range windows {
+		k := quotaKey(key, w, now)
+		c, found := m.counters[k]
+		if !found || !now.Before(c.expires) {
+			c = &quotaCounter{expires: w.start(now).Add(w.Period)}
+			m.counters[k] = c
+		}
+		counters[i], counts[i] = c, c.count
+		ok = ok && c.count < w.Limit
+	}
+	if ok {
+		for i, c := range counters {
+			c.count++
+			counts[i] = c.count
+		}
+	}
+	return counts, ok, nil
+}
+
+func quotaKey(key string, w quotaWindow, now time.Time) string {
+	return "bets:quota:" + key + ":" + w.Name + ":" + strconv.FormatInt(w.start(now).Unix(), 10)
+}
+
+// redisQuotas shares the counters between the replicas. The script checks
+// and counts every window at once, so concurrent bets never get past the
+// limit; the counters expire with their window.
+type redisQuotas struct {
+	client *redisClient
+}
+
+const quotaScript = `
+local counts = {}
+local ok = 1
+for i = 1, #KEYS do
+  counts[i] = tonumber(redis.call('GET', KEYS[i]) or '0')
+  if counts[i] >= tonumber(ARGV[i * 2 - 1]) then ok = 0 end
+end
+if ok == 1 then
+  for i = 1, #KEYS do
+    counts[i] = redis.call('INCR', KEYS[i])
+    if counts[i] == 1 then redis.call('PEXPIRE', KEYS[i], ARGV[i * 2]) end
+  end
+end
+table.insert(counts, 1, ok)
+return counts
+`
+
+func (r *redisQuotas) Take(key string, windows []quotaWindow, now time.Time) ([]int, bool, error) {
+	args := []string{"EVAL", quotaScript, strconv.Itoa(len(windows))}
+	for _, w := range windows {
+		args = append(args, quotaKey(key, w, now))
+	}
+	for _, w := range windows {
+		ttl := w.start(now).Add(w.Period).Sub(now)
+		args = append(args, strconv.Itoa(w.Limit), strconv.FormatInt(int64(ttl/time.Millisecond)+1, 10))
+	}
+	reply, err := r.client.Do(args...)
+	if err != nil {
+		return nil, false, err
+	}
+	items, _ := reply.([]interface{})
+	if len(items) != len(windows)+1 {
+		return nil, false, redisError("unexpected reply to the quota script")
+	}
+	counts := make([]int, len(windows))
+	for i := range counts {
+		n, _ := items[i+1].(int64)
+		counts[i] = int(n)
+	}
+	ok, _ := items[0].(int64)
+	return counts, ok == 1, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var testQuotaWindows = []quotaWindow{
+	{Name: "minute", Limit: 2, Period: time.Minute},
+	{Name: "day", Limit: 3, Period: 24 * time.Hour},
+}
+
+func TestMemoryQuotasTake(t *testing.T) {
+	m := &memoryQuotas{counters: map[string]*quotaCounter{}}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name   string
+		key    string
+		at     time.Duration
+		counts []int
+		ok     bool
+	}{
+		{"first bet", "joe", 10 * time.Second, []int{1, 1}, true},
+		{"second bet", "joe", 20 * time.Second, []int{2, 2}, true},
+		{"over the minute", "joe", 59 * time.Second, []int{2, 2}, false},
+		{"another player", "ann", 59 * time.Second, []int{1, 1}, true},
+		{"next minute", "joe", time.Minute, []int{1, 3}, true},
+		{"over the day", "joe", 2 * time.Minute, []int{0, 3}, false},
+		{"refusals uncounted", "joe", 3 * time.Minute, []int{0, 3}, false},
+		{"next day", "joe", 24 * time.Hour, []int{1, 1}, true},
+	} {
+		counts, ok, err := m.Take(tc.key, testQuotaWindows, day.Add(tc.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.ok || len(counts) != 2 || counts[0] != tc.counts[0] || counts[1] != tc.counts[1] {
+			t.Errorf("%s: got %v, %v, want %v, %v", tc.name, counts, ok, tc.counts, tc.ok)
+		}
+	}
+}
+
+func TestBetQuotaTake(t *testing.T) {
+	q := &betQuota{windows: testQuotaWindows, store: &memoryQuotas{counters: map[string]*quotaCounter{}}}
+	e := echo.New()
+	for i, remaining := range []string{"1", "0", "0"} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/bets", nil), rec)
+		c.Set(tenantKey, "t1")
+		err := q.take(c)
+		h := rec.Header()
+		if got := h.Get("X-Quota-Minute-Limit"); got != "2" {
+			t.Errorf("bet %d: got X-Quota-Minute-Limit %q, want 2", i, got)
+		}
+		if got := h.Get("X-Quota-Minute-Remaining"); got != remaining {
+			t.Errorf("bet %d: got X-Quota-Minute-Remaining %q, want %s", i, got, remaining)
+		}
+		if reset, _ := strconv.Atoi(h.Get("X-Quota-Minute-Reset")); reset < 1 || reset > 60 {
+			t.Errorf("bet %d: got X-Quota-Minute-Reset %q, want 1 to 60 seconds", i, h.Get("X-Quota-Minute-Reset"))
+		}
+		if got := h.Get("X-Quota-Day-Limit"); got != "3" {
+			t.Errorf("bet %d: got X-Quota-Day-Limit %q, want 3", i, got)
+		}
+		if i < 2 {
+			if err != nil {
+				t.Errorf("bet %d: got %v within the quota", i, err)
+			}
+			continue
+		}
+		p, ok := err.(*Problem)
+		if !ok || p.Status != http.StatusTooManyRequests {
+			t.Fatalf("bet %d: got %v over the quota, want a 429 problem", i, err)
+		}
+		if p.RetryAfterMs <= 0 || p.RetryAfterMs > time.Minute.Milliseconds() {
+			t.Errorf("got a retry after %dms, want the end of the minute", p.RetryAfterMs)
+		}
+		if got := h.Get("X-Quota-Day-Remaining"); got != "1" {
+			t.Errorf("got X-Quota-Day-Remaining %q, want 1", got)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Audience is who a response is rendered for. Pools are not modelled yet,
+// so every authenticated caller counts as a pool member.
+type Audience string
+
+const (
+	AudienceSelf       Audience = "self"
+	AudiencePoolMember Audience = "pool-member"
+	AudienceAdmin      Audience = "admin"
+	AudiencePublic     Audience = "public"
+)
+
+// RedactionPolicy lists, per audience, the JSON fields left out of
+// responses. Fields whose rule is true are masked instead of removed.
+type RedactionPolicy map[Audience]map[string]bool
+
+// parseRedaction reads a comma separated field list; a leading "~" masks
+// the field instead of removing it, e.g. "~email,matchInfo".
+func parseRedaction(fields []string) map[string]bool {
+	rules := map[string]bool{}
+	for _, f := range fields {
+		rules[strings.TrimPrefix(f, "~")] = strings.HasPrefix(f, "~")
+	}
+	return rules
+}
+
+func callerAudience(c echo.Context, adminRole string) (Audience, string) {
+	id, ok := identity(c)
+	switch {
+	case !ok:
+		return AudiencePublic, ""
+	case id.HasRole(adminRole):
+		return AudienceAdmin, id.Email
+	}
+	return AudiencePoolMember, id.Email
+}
+
+// respond is the single place records leave the API: it renders v as JSON,
+// or protobuf when negotiated and v has a message, with the fields the
+// caller's audience may not see taken out. An object carrying the
+// caller's own email is rendered for the self audience.
+func respond(c echo.Context, status int, v interface{}) error {
+	aud, email := callerAudience(c, config.AdminRole)
+	return render(c, status, v, aud, email)
+}
+
+// respondOwned is respond for records created on behalf of the caller,
+// whose email the players service resolved even without a bearer token.
+func respondOwned(c echo.Context, status int, v interface{}, owner string) error {
+	aud, _ := callerAudience(c, config.AdminRole)
+	if aud == AudiencePublic {
+		aud = AudiencePoolMember
+	}
+	return render(c, status, v, aud, owner)
+}
+
+func render(c echo.Context, status int, v interface{}, aud Audience, email string) error {
+	m := responseMessage(v)
+	if m != nil {
+		c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	}
+	proto := negotiate(c, m) == MIMEApplicationProtobuf
+	l := localizeResponse(c)
+	localized := l.Tag != englishTag
+	if !proto && !localized && len(config.Redaction[aud]) == 0 && len(config.Redaction[AudienceSelf]) == 0 {
+		return c.JSON(status, v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return err
+	}
+	if localized {
+		localizeMatches(doc, l)
+	}
+	redact(doc, aud, email, config.Redaction)
+	if proto {
+		return c.Blob(status, MIMEApplicationProtobuf, encodeProto(m, doc))
+	}
+	return c.JSON(status, doc)
+}
+
+func redact(v interface{}, aud Audience, email string, policy RedactionPolicy) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, e := range t {
+			redact(e, aud, email, policy)
+		}
+	case map[string]interface{}:
+		if aud != AudienceAdmin && email != "" && t["email"] == email {
+			aud = AudienceSelf
+		}
+		for field, mask := range policy[aud] {
+			if _, ok := t[field]; !ok {
+				continue
+			}
+			if s, isString := t[field].(string); mask && isString {
+				t[field] = maskValue(s)
+			} else {
+				delete(t, field)
+			}
+		}
+		for _, e := range t {
+			redact(e, aud, email, policy)
+		}
+	}
+}
+
+// redactField renders one field value as the audience may see it; removed
+// fields come out empty.
+func redactField(aud Audience, field, value string) string {
+	mask, redacted := config.Redaction[aud][field]
+	switch {
+	case !redacted:
+		return value
+	case mask:
+		return maskValue(value)
+	}
+	return ""
+}
+
+// maskValue keeps just enough of a value to tell entries apart:
+// "joe@doe.com" becomes "jo***@doe.com".
+func maskValue(s string) string {
+	local, domain := s, ""
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		local, domain = s[:i], s[i:]
+	}
+	if len(local) > 2 {
+		local = local[:2]
+	}
+	return local + "***" + domain
+}
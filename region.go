@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegionConfig names the region, and zone, the replica runs in, for
+// multi-region deployments; empty when there is a single one.
+type RegionConfig struct {
+	Name string
+	Zone string
+}
+
+// upstreamEnvs are the variables naming the downstream services.
+var upstreamEnvs = []string{"MATCH_SVC", "CHAMPIONSHIP_SVC", "PLAYER_SVC"}
+
+var regionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "bets",
+	Name:      "region_info",
+	Help:      "Always 1, labeled with the region and zone of the replica.",
+}, []string{"region", "zone"})
+
+func init() {
+	registry.MustRegister(regionInfo)
+}
+
+// configureRegion stamps the logs and metrics with the region.
+func configureRegion(cfg RegionConfig) {
+	if cfg.Name == "" {
+		return
+	}
+	logger := log.With().Str("region", cfg.Name).Logger()
+	log = &logger
+	regionInfo.WithLabelValues(cfg.Name, cfg.Zone).Set(1)
+}
+
+// regionalEnv is the variable holding the region-local URL of a service,
+// as MATCH_SVC_EU_WEST_1 for MATCH_SVC in eu-west-1.
+func regionalEnv(env string) string {
+	if config.Region.Name == "" {
+		return ""
+	}
+	suffix := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(config.Region.Name))
+	return env + "_" + suffix
+}
+
+// serviceBase is the URL template of a service for the tenant: the
+// tenant's own, then the global one, each preferably region-local.
+func serviceBase(tenant, env string) string {
+	regional := regionalEnv(env)
+	services := config.Tenancy.Tenants[tenant].Services
+	if u, ok := services[regional]; ok && regional != "" {
+		return u
+	}
+	if u, ok := services[env]; ok {
+		return u
+	}
+	if u := live.env(regional); regional != "" && u != "" {
+		return u
+	}
+	return live.env(env)
+}
+
+// RegionHeaders stamps every response with the region that served it.
+func RegionHeaders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if config.Region.Name != "" {
+			c.Response().Header().Set("X-Region", config.Region.Name)
+		}
+		return next(c)
+	}
+}
+
+// RegionInfo tells where the replica runs and which services it calls in
+// its region.
+type RegionInfo struct {
+	Region         string   `json:"region,omitempty"`
+	Zone           string   `json:"zone,omitempty"`
+	LocalUpstreams []string `json:"localUpstreams"`
+}
+
+// GetRegion serves the locality checks of the global load balancer: with
+// ?expect=, a replica of another region answers 421, so traffic meant for
+// a region never lands elsewhere.
+func GetRegion(c echo.Context) error {
+	info := &RegionInfo{Region: config.Region.Name, Zone: config.Region.Zone, LocalUpstreams: []string{}}
+	for _, env := range upstreamEnvs {
+		if r := regionalEnv(env); r != "" && live.env(r) != "" {
+			info.LocalUpstreams = append(info.LocalUpstreams, env)
+		}
+	}
+	status := http.StatusOK
+	if expect := c.QueryParam("expect"); expect != "" && expect != info.Region {
+		status = http.StatusMisdirectedRequest
+	}
+	return c.JSON(status, info)
+}
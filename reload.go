@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+var configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "config",
+	Name:      "reloads_total",
+	Help:      "Reloads of the config file, per trigger and result: applied, unchanged or invalid.",
+}, []string{"trigger", "result"})
+
+var configVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "bets",
+	Subsystem: "config",
+	Name:      "version",
+	Help:      "Version of the settings in effect, bumped by every reload changing them.",
+})
+
+func init() {
+	registry.MustRegister(configReloads, configVersion)
+}
+
+// ReloadConfig names the file of the settings changed without a restart,
+// read again on SIGHUP, on POST /api/admin/config/reload and, every Poll
+// unless zero, when it changed, e.g. as a mounted ConfigMap.
+type ReloadConfig struct {
+	File string
+	Poll time.Duration
+}
+
+// LiveSettings are the settings that can change while serving: the URLs
+// of the downstream services, the rate limit and the log level. They are
+// replaced as a whole, so a request sees either the old ones or the new.
+type LiveSettings struct {
+	Version   int               `json:"version"`
+	LoadedAt  time.Time         `json:"loadedAt"`
+	Services  map[string]string `json:"services"`
+	RateLimit RateLimitConfig   `json:"rateLimit"`
+	LogLevel  string            `json:"logLevel"`
+}
+
+// MarshalJSON writes the rate limit as the variables setting it do.
+func (s *LiveSettings) MarshalJSON() ([]byte, error) {
+	type settings LiveSettings
+	return json.Marshal(&struct {
+		*settings
+		RateLimit       int    `json:"rateLimit"`
+		RateLimitWindow string `json:"rateLimitWindow"`
+	}{(*settings)(s), s.RateLimit.Limit, s.RateLimit.Window.String()})
+}
+
+// liveConfig holds the settings in effect. The file holds KEY=VALUE lines
+// named as the environment variables they override; blank lines and #
+// comments are ignored. Settings the file no longer mentions go back to
+// the environment's.
+type liveConfig struct {
+	cfg      ReloadConfig
+	mu       sync.Mutex
+	current  atomic.Value
+	limiter  *rateLimiter
+	modified time.Time
+}
+
+var live *liveConfig
+
+// errConfigUnchanged is a reload finding the settings as they were.
+var errConfigUnchanged = errors.New("config unchanged")
+
+// ConfigError lists what is wrong with a config file; none of it applies.
+type ConfigError struct {
+	Errors []string `json:"errors"`
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e.Errors, "; ")
+}
+
+// newLiveConfig reads the settings from the environment and the file, if
+// any; an invalid file fails the start.
+func newLiveConfig(cfg ReloadConfig) (*liveConfig, error) {
+	l := &liveConfig{cfg: cfg}
+	s, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	s.Version, s.LoadedAt = 1, time.Now()
+	l.apply(s)
+	return l, nil
+}
+
+// settings are those in effect.
+func (l *liveConfig) settings() *LiveSettings {
+	s, _ := l.current.Load().(*LiveSettings)
+	return s
+}
+
+// env is the value of a downstream service variable, as reloaded.
+func (l *liveConfig) env(name string) string {
+	if l == nil {
+		return os.Getenv(name)
+	}
+	return l.settings().Services[name]
+}
+
+// reloadable tells the variables a config file may set.
+func reloadable(name string) bool {
+	switch name {
+	case "RATE_LIMIT", "RATE_LIMIT_WINDOW", "LOG_LEVEL":
+		return true
+	}
+	return serviceEnv(name)
+}
+
+// serviceEnv tells the variables of the downstream service URLs, the
+// region-local one included.
+func serviceEnv(name string) bool {
+	for _, env := range upstreamEnvs {
+		if r := regionalEnv(env); name == env || (r != "" && name == r) {
+			return true
+		}
+	}
+	return false
+}
+
+// read builds the settings of the environment overridden by the file,
+// validating all of them.
+func (l *liveConfig) read() (*LiveSettings, error) {
+	vars := map[string]string{}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && reloadable(parts[0]) {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	var errs []string
+	if l.cfg.File != "" {
+		info, err := os.Stat(l.cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(l.cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		l.modified = info.ModTime()
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for n := 1; sc.Scan(); n++ {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			kv := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+			name := strings.TrimSpace(kv[0])
+			switch {
+			case len(kv) != 2:
+				errs = append(errs, "line "+strconv.Itoa(n)+" is not KEY=VALUE")
+			case !reloadable(name):
+				errs = append(errs, name+" can't be reloaded, it needs a restart")
+			default:
+				vars[name] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+			}
+		}
+	}
+	s := &LiveSettings{
+		Services:  map[string]string{},
+		RateLimit: RateLimitConfig{Limit: 0, Window: time.Minute},
+		LogLevel:  zerolog.DebugLevel.String(),
+	}
+	for name, v := range vars {
+		switch name {
+		case "RATE_LIMIT":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				errs = append(errs, "RATE_LIMIT must be a non-negative integer")
+			}
+			s.RateLimit.Limit = n
+		case "RATE_LIMIT_WINDOW":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				errs = append(errs, "RATE_LIMIT_WINDOW must be a positive duration")
+			}
+			s.RateLimit.Window = d
+		case "LOG_LEVEL":
+			if _, err := zerolog.ParseLevel(strings.ToLower(v)); err != nil || v == "" {
+				errs = append(errs, "LOG_LEVEL must be one of trace, debug, info, warn, error")
+			}
+			s.LogLevel = strings.ToLower(v)
+		default:
+			if u, err := url.Parse(v); v != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+				errs = append(errs, name+" must be an http or https URL")
+			}
+			s.Services[name] = v
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, &ConfigError{Errors: errs}
+	}
+	return s, nil
+}
+
+// apply puts the settings in effect: the snapshot first, then the rate
+// limiter and the log level it configures.
+func (l *liveConfig) apply(s *LiveSettings) {
+	l.current.Store(s)
+	if l.limiter != nil {
+		l.limiter.configure(s.RateLimit)
+	}
+	level, _ := zerolog.ParseLevel(s.LogLevel)
+	zerolog.SetGlobalLevel(level)
+	configVersion.Set(float64(s.Version))
+}
+
+// reload reads the settings again and returns those in effect and the
+// variables that changed. A file that can't be read or is invalid leaves
+// the settings as they were, none of it applies.
+func (l *liveConfig) reload(trigger string) (*LiveSettings, []string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := l.settings()
+	next, err := l.read()
+	if err != nil {
+		configReloads.WithLabelValues(trigger, "invalid").Inc()
+		log.Error().Err(err).Str("trigger", trigger).Msg("config reload rejected, the settings in effect are kept")
+		return prev, nil, err
+	}
+	changed := settingsDiff(prev, next)
+	if len(changed) == 0 {
+		configReloads.WithLabelValues(trigger, "unchanged").Inc()
+		return prev, nil, errConfigUnchanged
+	}
+	next.Version, next.LoadedAt = prev.Version+1, time.Now()
+	l.apply(next)
+	configReloads.WithLabelValues(trigger, "applied").Inc()
+	log.Info().Str("trigger", trigger).Int("version", next.Version).Strs("changed", changed).Msg("config reloaded")
+	return next, changed, nil
+}
+
+// settingsDiff names the variables whose setting changed.
+func settingsDiff(a, b *LiveSettings) []string {
+	var changed []string
+	for name, v := range b.Services {
+		if a.Services[name] != v {
+			changed = append(changed, name)
+		}
+	}
+	for name := range a.Services {
+		if _, ok := b.Services[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if a.RateLimit.Limit != b.RateLimit.Limit {
+		changed = append(changed, "RATE_LIMIT")
+	}
+	if a.RateLimit.Window != b.RateLimit.Window {
+		changed = append(changed, "RATE_LIMIT_WINDOW")
+	}
+	if a.LogLevel != b.LogLevel {
+		changed = append(changed, "LOG_LEVEL")
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Run reloads the settings on SIGHUP and, when polling, once the file
+// changed.
+func (l *liveConfig) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if l.cfg.File != "" && l.cfg.Poll > 0 {
+		t := time.NewTicker(l.cfg.Poll)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			l.reload("signal")
+		case <-tick:
+			if info, err := os.Stat(l.cfg.File); err == nil && !info.ModTime().Equal(l.modifiedAt()) {
+				l.reload("file")
+			}
+		}
+	}
+}
+
+func (l *liveConfig) modifiedAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.modified
+}
+
+// ConfigReload is the outcome of a reload: the settings in effect and the
+// variables it changed.
+type ConfigReload struct {
+	Settings *LiveSettings `json:"settings"`
+	Changed  []string      `json:"changed"`
+}
+
+// GetLiveConfig reports the settings in effect on the replica answering.
+func GetLiveConfig(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, live.settings())
+}
+
+// ReloadLiveConfig reloads the settings of the replica answering,
+// answering 422 with the errors of an invalid file.
+func ReloadLiveConfig(c echo.Context) error {
+	s, changed, err := live.reload("api")
+	switch e := err.(type) {
+	case nil:
+		audit.record(auditActor(c), "config.reloaded", "", map[string]interface{}{"version": s.Version, "changed": changed})
+	case *ConfigError:
+		return c.JSON(http.StatusUnprocessableEntity, e)
+	default:
+		if err != errConfigUnchanged {
+			return err
+		}
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	return c.JSON(http.StatusOK, &ConfigReload{Settings: s, Changed: changed})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// ReminderConfig reminds, every Interval, the players of a championship
+// who haven't bet on one of its matches kicking off within Ahead. Only the
+// matches drawing bets already are known. A zero interval disables it.
+type ReminderConfig struct {
+	Interval time.Duration
+	Ahead    time.Duration
+	Topic    string
+}
+
+type ReminderStore interface {
+	// Mark records the reminder of the player about the match, telling
+	// whether it is new; false means it was sent already.
+	Mark(tenant, matchID, player string, at time.Time) (bool, error)
+}
+
+var reminders ReminderStore
+
+// Reminder is the payload of the reminder events.
+type Reminder struct {
+	Tenant         string    `json:"tenant"`
+	MatchID        string    `json:"matchId"`
+	ChampionshipID string    `json:"championshipId"`
+	Email          string    `json:"email"`
+	Kickoff        time.Time `json:"kickoff"`
+}
+
+type reminderScheduler struct {
+	cfg ReminderConfig
+}
+
+func (s *reminderScheduler) Run(ctx context.Context) {
+	t := time.NewTicker(s.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			err := withLock("reminders", "run", s.cfg.Interval, func(context.Context) error {
+				n, err := s.remind(clock.Now())
+				if n > 0 {
+					log.Info().Int("players", n).Msg("reminded players of the upcoming matches")
+				}
+				return err
+			})
+			if err != nil && err != errLockBusy {
+				log.Error().Err(err).Msg("failed to send the reminders")
+			}
+		}
+	}
+}
+
+// remind finds the matches kicking off within Ahead, still open, and the
+// players of their championship who bet on other matches but not on them.
+// It returns how many reminders it sent.
+func (s *reminderScheduler) remind(now time.Time) (int, error) {
+	upcoming, err := bets.List(BetFilter{From: now, To: now.Add(s.cfg.Ahead)})
+	if err != nil {
+		return 0, err
+	}
+	type match struct{ tenant, id string }
+	matches := map[match]*Bet{}
+	for _, b := range upcoming {
+		m := match{b.Tenant, b.MatchID}
+		if matches[m] == nil {
+			matches[m] = b
+		}
+	}
+	// the players of a championship, fetched once for all its matches
+	type championship struct{ tenant, id string }
+	pools := map[championship][]*Bet{}
+	sent := 0
+	for m, first := range matches {
+		if checkMatchOpen(m.tenant, m.id) != nil {
+			continue
+		}
+		ch := championship{m.tenant, first.ChampionshipID}
+		pool, ok := pools[ch]
+		if !ok {
+			if pool, err = bets.List(BetFilter{Tenant: ch.tenant, ChampionshipID: ch.id}); err != nil {
+				return sent, err
+			}
+			pools[ch] = pool
+		}
+		betting := map[string]bool{}
+		for _, b := range pool {
+			if b.MatchID == m.id {
+				betting[b.Email] = true
+			}
+		}
+		reminded := map[string]bool{}
+		for _, b := range pool {
+			if betting[b.Email] || reminded[b.Email] {
+				continue
+			}
+			reminded[b.Email] = true
+			fresh, err := reminders.Mark(m.tenant, m.id, playerKey(b.Email), now)
+			if err != nil {
+				return sent, err
+			}
+			if fresh {
+				s.send(first, b.Email)
+				sent++
+			}
+		}
+	}
+	return sent, nil
+}
+
+// send announces the reminder on the bus and emails the player.
+func (s *reminderScheduler) send(match *Bet, email string) {
+	r := &Reminder{Tenant: match.Tenant, MatchID: match.MatchID, ChampionshipID: match.ChampionshipID, Email: email}
+	if match.MatchInfo != nil {
+		r.Kickoff = match.MatchInfo.Date
+	}
+	if data, err := json.Marshal(r); err == nil && features.enabled(flagEvents, r.Tenant) {
+		events.Publish(s.cfg.Topic, Event{ID: newID(), Type: "bet.reminder", OccurredAt: clock.Now(), Data: data})
+	}
+	mailer.matchReminder(match, email)
+}
+
+type memoryReminders struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func newMemoryReminders() *memoryReminders {
+	return &memoryReminders{sent: map[string]time.Time{}}
+}
+
+func (m *memoryReminders) Mark(tenant, matchID, player string, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := tenant + "/" + matchID + "/" + player
+	if _, ok := m.sent[key]; ok {
+		return false, nil
+	}
+	m.sent[key] = at
+	return true, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const dayLayout = "2006-01-02"
+
+// DailyStats aggregates the bets placed on a day (UTC) in a championship.
+// Points are summed over the settled bets, so days add up into ranges.
+type DailyStats struct {
+	Day          string    `json:"day"`
+	Tenant       string    `json:"-"`
+	Championship string    `json:"championship"`
+	Bets         int       `json:"bets"`
+	Players      int       `json:"players"`
+	Settled      int       `json:"settled"`
+	Points       int       `json:"points"`
+	AvgPoints    float64   `json:"avgPoints"`
+	ComputedAt   time.Time `json:"computedAt"`
+}
+
+// RollupStore keeps the daily aggregates. Put replaces every row of the
+// day, so recomputing a day is idempotent.
+type RollupStore interface {
+	Put(day string, rows []*DailyStats) error
+	// List returns the rows of the tenant between the days, inclusive,
+	// ordered by day.
+	List(tenant, championship, from, to string) ([]*DailyStats, error)
+}
+
+// rollups recomputes the daily aggregates: nightly for the last Lookback
+// days, and for the days of the bets a settlement just scored, since
+// settlements arrive long after the bets were placed.
+type rollups struct {
+	cfg   RollupConfig
+	store RollupStore
+}
+
+// Run queues the recomputation of the last days every interval.
+func (r *rollups) Run(ctx context.Context) {
+	t := time.NewTicker(r.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			today := clock.Now().UTC().Truncate(24 * time.Hour)
+			r.enqueue(daysBetween(today.AddDate(0, 0, -r.cfg.Lookback), today))
+		}
+	}
+}
+
+// enqueue queues the recomputation of days.
+func (r *rollups) enqueue(days []time.Time) Job {
+	return jobs.Enqueue("daily-rollup", 3, func(ctx context.Context) error {
+		return r.recompute(days)
+	})
+}
+
+// recompute computes the days under a lock, so replicas don't compute the
+// same day at once.
+func (r *rollups) recompute(days []time.Time) error {
+	for _, day := range days {
+		err := withLock("rollup", day.Format(dayLayout), time.Hour, func(context.Context) error {
+			return r.compute(day)
+		})
+		if err != nil && err != errLockBusy {
+			return err
+		}
+	}
+	return nil
+}
+
+// compute aggregates the bets placed on day and replaces its rows.
+func (r *rollups) compute(day time.Time) error {
+	type key struct{ tenant, championship string }
+	groups := map[key]*DailyStats{}
+	players := map[key]map[string]bool{}
+	now := clock.Now()
+	err := bets.Each(BetFilter{PlacedFrom: day, PlacedBefore: day.Add(24 * time.Hour)}, func(b *Bet) error {
+		k := key{b.Tenant, b.ChampionshipID}
+		g, ok := groups[k]
+		if !ok {
+			g = &DailyStats{Day: day.Format(dayLayout), Tenant: b.Tenant, Championship: b.ChampionshipID, ComputedAt: now}
+			groups[k] = g
+			players[k] = map[string]bool{}
+		}
+		g.Bets++
+		players[k][playerOf(b)] = true
+		if s := b.Settlement; s != nil && s.Status == SettlementSettled {
+			g.Settled++
+			g.Points += s.Points
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rows := make([]*DailyStats, 0, len(groups))
+	for k, g := range groups {
+		g.Players = len(players[k])
+		rows = append(rows, g)
+	}
+	return r.store.Put(day.Format(dayLayout), rows)
+}
+
+// settled queues the recomputation of the days the bets were placed on.
+func (r *rollups) settled(list []*Bet) {
+	seen := map[time.Time]bool{}
+	var days []time.Time
+	for _, b := range list {
+		day := b.CreatedAt.UTC().Truncate(24 * time.Hour)
+		if !seen[day] {
+			seen[day] = true
+			days = append(days, day)
+		}
+	}
+	switch {
+	case len(days) == 0:
+	case jobs == nil:
+		// the settle command runs without a job queue
+		if err := r.recompute(days); err != nil {
+			log.Error().Err(err).Msg("failed to recompute the daily statistics")
+		}
+	default:
+		r.enqueue(days)
+	}
+}
+
+// daysBetween lists the days from first to last, both included.
+func daysBetween(first, last time.Time) []time.Time {
+	var days []time.Time
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
+
+// Analytics is the daily series of a range and its totals.
+type Analytics struct {
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	Bets      int           `json:"bets"`
+	Settled   int           `json:"settled"`
+	AvgPoints float64       `json:"avgPoints"`
+	Days      []*DailyStats `json:"days"`
+}
+
+// maxAnalyticsDays bounds the range of an analytics request.
+const maxAnalyticsDays = 366
+
+// GetAnalytics reads the rollups of the tenant for ?from= to ?to= (the
+// last 30 days by default), optionally of a ?championship=. It never
+// touches the bets.
+func GetAnalytics(c echo.Context) error {
+	to := clock.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -29)
+	var err error
+	if s := c.QueryParam("from"); s != "" {
+		if from, err = time.Parse(dayLayout, s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from must be YYYY-MM-DD")
+		}
+	}
+	if s := c.QueryParam("to"); s != "" {
+		if to, err = time.Parse(dayLayout, s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "to must be YYYY-MM-DD")
+		}
+	}
+	if to.Before(from) || to.Sub(from) > maxAnalyticsDays*24*time.Hour {
+		return echo.NewHTTPError(http.StatusBadRequest, "the range must cover 1 to 366 days")
+	}
+	rows, err := rollup.store.List(tenant(c), c.QueryParam("championship"), from.Format(dayLayout), to.Format(dayLayout))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the rollups")
+		return err
+	}
+	a := &Analytics{From: from.Format(dayLayout), To: to.Format(dayLayout), Days: rows}
+	points := 0
+	for _, d := range rows {
+		a.Bets += d.Bets
+		a.Settled += d.Settled
+		points += d.Points
+		d.AvgPoints = average(d.Points, d.Settled)
+	}
+	a.AvgPoints = average(points, a.Settled)
+	return c.JSON(http.StatusOK, a)
+}
+
+func average(sum, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(sum) / float64(n)
+}
+
+type recomputeRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RecomputeAnalytics queues the recomputation of a range of days, e.g.
+// after bets were imported or edited.
+func RecomputeAnalytics(c echo.Context) error {
+	req := &recomputeRequest{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	from, ferr := time.Parse(dayLayout, req.From)
+	to, terr := time.Parse(dayLayout, req.To)
+	if ferr != nil || terr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to must be YYYY-MM-DD")
+	}
+	if to.Before(from) || to.Sub(from) > maxAnalyticsDays*24*time.Hour {
+		return echo.NewHTTPError(http.StatusBadRequest, "the range must cover 1 to 366 days")
+	}
+	return c.JSON(http.StatusAccepted, rollup.enqueue(daysBetween(from, to)))
+}
+
+type memoryRollups struct {
+	mu   sync.Mutex
+	days map[string][]*DailyStats
+}
+
+func newMemoryRollups() *memoryRollups {
+	return &memoryRollups{days: map[string][]*DailyStats{}}
+}
+
+func (m *memoryRollups) Put(day string, rows []*DailyStats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.days[day] = rows
+	return nil
+}
+
+func (m *memoryRollups) List(tenant, championship, from, to string) ([]*DailyStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*DailyStats{}
+	for day, rows := range m.days {
+		if day < from || day > to {
+			continue
+		}
+		for _, d := range rows {
+			if d.Tenant == tenant && (championship == "" || d.Championship == championship) {
+				c := *d
+				r = append(r, &c)
+			}
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Day != r[j].Day {
+			return r[i].Day < r[j].Day
+		}
+		return r[i].Championship < r[j].Championship
+	})
+	return r, nil
+}
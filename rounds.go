@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// RoundBets groups the bets of one championship round by match.
+type RoundBets struct {
+	Championship string      `json:"championship"`
+	Round        string      `json:"round"`
+	Matches      []MatchBets `json:"matches"`
+}
+
+type MatchBets struct {
+	MatchID string `json:"matchId"`
+	Match   string `json:"match,omitempty"`
+	Bets    []*Bet `json:"bets"`
+}
+
+func groupByMatch(list []*Bet) []MatchBets {
+	r := []MatchBets{}
+	index := map[string]int{}
+	for _, b := range list {
+		i, ok := index[b.MatchID]
+		if !ok {
+			i = len(r)
+			index[b.MatchID] = i
+			r = append(r, MatchBets{MatchID: b.MatchID, Match: b.Match})
+		}
+		r[i].Bets = append(r[i].Bets, b)
+	}
+	return r
+}
+
+func ListRoundBets(c echo.Context) error {
+	f := BetFilter{Tenant: tenant(c), ChampionshipID: c.Param("id"), Round: c.Param("round")}
+	list, err := bets.List(f)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list bets")
+		return err
+	}
+	return respond(c, http.StatusOK, &RoundBets{
+		Championship: f.ChampionshipID,
+		Round:        f.Round,
+		Matches:      groupByMatch(list),
+	})
+}
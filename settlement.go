@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type SettlementStatus string
+
+const (
+	SettlementPending SettlementStatus = "pending"
+	SettlementSettled SettlementStatus = "settled"
+)
+
+type Settlement struct {
+	Status    SettlementStatus `json:"status"`
+	Result    string           `json:"result,omitempty"`
+	Points    int              `json:"points"`
+	SettledAt *time.Time       `json:"settledAt,omitempty"`
+}
+
+// Points awarded per bet: the exact score, or only the right winner/draw;
+// and per leg of an accumulator won.
+const (
+	exactScorePoints       = 3
+	outcomePoints          = 1
+	accumulatorBonusPoints = 1
+)
+
+type MatchResult struct {
+	HomeScore int `json:"homeScore"`
+	AwayScore int `json:"awayScore"`
+}
+
+func (r MatchResult) String() string {
+	return fmt.Sprintf("%dx%d", r.HomeScore, r.AwayScore)
+}
+
+// score applies the scoring rules of the bet's tenant.
+func score(b *Bet, r MatchResult) int {
+	rules := scoring(b.Tenant)
+	home, herr := strconv.Atoi(b.HomeTeamScore)
+	away, aerr := strconv.Atoi(b.AwayTeamScore)
+	if herr != nil || aerr != nil {
+		return 0
+	}
+	if home == r.HomeScore && away == r.AwayScore {
+		return rules.ExactScore
+	}
+	if sign(home-away) == sign(r.HomeScore-r.AwayScore) {
+		return rules.Outcome
+	}
+	return 0
+}
+
+func sign(n int) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
+	}
+	return 0
+}
+
+// settlementLockTTL is the lease on a match being settled; it is renewed
+// while settling and only matters when the holder dies.
+const settlementLockTTL = time.Minute
+
+// settle scores every bet placed on the match in the tenant; matches are
+// the tenant's own, given by its matches service, so another tenant's
+// match of the same id isn't touched. Bets already settled with the same
+// result are left untouched, so settling twice is harmless. Only one
+// replica settles a match at a time; the others get errLockBusy. It
+// returns how many bets were scored. Each call is a SettlementRun, in the
+// trace, if any, of what triggered it; the bets are settled at the time of
+// clk, that of the request settling them under X-Debug-Now.
+func settle(tenant, matchID string, r MatchResult, trigger, trace string, clk Clock) (scored int, err error) {
+	run := startSettlement(tenant, matchID, r, trigger, trace)
+	defer func() { run.end(err) }()
+	err = withLock("settlement", tenant+"/"+matchID, settlementLockTTL, func(ctx context.Context) error {
+		return settleLocked(ctx, run, r, clk.Now())
+	})
+	return run.Scored, err
+}
+
+// settleLocked scores the bets of the match while ctx, the lease on the
+// match, holds; a lease lost stops it between two bets.
+func settleLocked(ctx context.Context, run *SettlementRun, r MatchResult, now time.Time) error {
+	list, err := bets.List(BetFilter{Tenant: run.Tenant, MatchID: run.MatchID})
+	if err != nil {
+		return err
+	}
+	var settled []*Bet
+	for _, b := range list {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s := b.Settlement; s != nil && s.Status == SettlementSettled && s.Result == r.String() {
+			run.Unchanged++
+			continue
+		}
+		if !features.enabled(flagSettlement, b.Tenant) {
+			run.Skipped++
+			continue
+		}
+		prev := b.Settlement
+		b.Settlement = &Settlement{
+			Status:    SettlementSettled,
+			Result:    r.String(),
+			Points:    score(b, r),
+			SettledAt: &now,
+		}
+		if err := bets.Save(b); err != nil {
+			run.Errored++
+			return err
+		}
+		run.Scored++
+		if prev != nil && prev.Status == SettlementSettled {
+			// the points of the previous result are replaced, not added to
+			run.Corrected++
+			audit.record("settlement", "bet.resettled", b.ID, map[string]*Settlement{"before": prev, "after": b.Settlement})
+		} else {
+			audit.record("settlement", "bet.settled", b.ID, b.Settlement)
+		}
+		notifier.Notify(b.Tenant, "bet.settled", b)
+		settled = append(settled, b)
+	}
+	if run.Skipped > 0 {
+		log.Info().Str("tenant", run.Tenant).Str("match", run.MatchID).Int("bets", run.Skipped).Msg("settlement flag off, bets left pending")
+	}
+	if run.Scored > 0 {
+		rollup.settled(list)
+		awardRounds(list)
+		settleAccumulators(settled)
+		mailer.matchSettled(settled, r)
+	}
+	return nil
+}
+
+// SettleMatch records the final result of a match of the caller's tenant
+// and scores its bets in the background.
+func SettleMatch(c echo.Context) error {
+	r := MatchResult{}
+	if err := decodeJSON(c, &r); err != nil {
+		return err
+	}
+	if r.HomeScore < 0 || r.AwayScore < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "scores must not be negative")
+	}
+	t, matchID := tenant(c), c.Param("id")
+	trace, clk := traceID(c.Request()), requestClock(c)
+	j := jobs.Enqueue("settlement", 3, func(ctx context.Context) error {
+		n, err := settle(t, matchID, r, settlementTriggerAPI, trace, clk)
+		if err == nil {
+			log.Info().Str("tenant", t).Str("match", matchID).Int("bets", n).Msg("match settled " + r.String())
+		}
+		return err
+	})
+	return c.JSON(http.StatusAccepted, j)
+}
+
+// Resettlement corrects the result a match was settled with, as when it
+// is awarded to a team after the fact.
+type Resettlement struct {
+	MatchResult
+	Reason string `json:"reason"`
+}
+
+// ResettleMatch settles a match of the caller's tenant again with its
+// corrected result in the background: the points of the bets settled before are replaced by those
+// of the new result, the correction is audited with its reason, and the
+// leaderboards the match counts for are published again.
+func ResettleMatch(c echo.Context) error {
+	r := Resettlement{}
+	if err := decodeJSON(c, &r); err != nil {
+		return err
+	}
+	if r.HomeScore < 0 || r.AwayScore < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "scores must not be negative")
+	}
+	if r.Reason == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "a correction needs a reason")
+	}
+	t, matchID := tenant(c), c.Param("id")
+	trace, clk := traceID(c.Request()), requestClock(c)
+	actor := auditActor(c)
+	j := jobs.Enqueue("resettlement", 3, func(ctx context.Context) error {
+		n, err := settle(t, matchID, r.MatchResult, settlementTriggerResettle, trace, clk)
+		if err != nil {
+			return err
+		}
+		audit.record(actor, "match.resettled", matchID, map[string]interface{}{
+			"result": r.MatchResult.String(), "reason": r.Reason, "bets": n,
+		})
+		log.Info().Str("tenant", t).Str("match", matchID).Int("bets", n).Str("reason", r.Reason).Msg("match resettled " + r.MatchResult.String())
+		publishLeaderboards(t, matchID)
+		return nil
+	})
+	return c.JSON(http.StatusAccepted, j)
+}
+
+// runSettle implements `bets-app settle`, scoring the bets of a match in
+// the foreground.
+func runSettle(args []string) error {
+	fs := flag.NewFlagSet("settle", flag.ContinueOnError)
+	matchID := fs.String("match-id", "", "match to settle")
+	tenantID := fs.String("tenant", "", "tenant of the match (default TENANT_DEFAULT)")
+	home := fs.Int("home", -1, "final home team score")
+	away := fs.Int("away", -1, "final away team score")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *matchID == "" || *home < 0 || *away < 0 {
+		return errors.New("usage: settle -match-id ID -home N -away N")
+	}
+	config = loadConfig()
+	cfg := config
+	if cfg.Storage.Driver == "memory" {
+		return errors.New("settling from the command line needs a persistent storage driver")
+	}
+	if err := initStorage(cfg); err != nil {
+		return err
+	}
+	if *tenantID == "" {
+		*tenantID = cfg.Tenancy.Default
+	}
+	r := MatchResult{HomeScore: *home, AwayScore: *away}
+	n, err := settle(*tenantID, *matchID, r, settlementTriggerCommand, "", clock)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%d bets settled with %s\n", n, r)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// What starts a settlement.
+const (
+	settlementTriggerAPI     = "api"
+	settlementTriggerEvent   = "event"
+	settlementTriggerCommand = "command"
+	settlementTriggerImport  = "import"
+	// settlementTriggerResettle corrects the result of a settled match.
+	settlementTriggerResettle = "resettle"
+)
+
+type SettlementRunStatus string
+
+const (
+	SettlementRunning   SettlementRunStatus = "running"
+	SettlementSucceeded SettlementRunStatus = "succeeded"
+	SettlementFailed    SettlementRunStatus = "failed"
+	// SettlementBusy runs found another replica settling the match.
+	SettlementBusy SettlementRunStatus = "busy"
+)
+
+// SettlementRun is the record of one settlement of a match: how its bets
+// came out and how long it took. TraceID is the trace of the request or
+// event that started it, a new one otherwise, so the run is found among the
+// logs and exemplars of that trace; no span is exported to a tracer. Unchanged bets were settled already
+// with the same result; skipped ones wait for the settlement flag.
+// Corrected bets, counted among the scored, had been settled with another
+// result.
+type SettlementRun struct {
+	ID         string              `json:"id"`
+	TraceID    string              `json:"traceId"`
+	Tenant     string              `json:"tenant"`
+	MatchID    string              `json:"matchId"`
+	Result     string              `json:"result"`
+	Trigger    string              `json:"trigger"`
+	Status     SettlementRunStatus `json:"status"`
+	Scored     int                 `json:"scored"`
+	Corrected  int                 `json:"corrected"`
+	Unchanged  int                 `json:"unchanged"`
+	Skipped    int                 `json:"skipped"`
+	Errored    int                 `json:"errored"`
+	Error      string              `json:"error,omitempty"`
+	StartedAt  time.Time           `json:"startedAt"`
+	FinishedAt *time.Time          `json:"finishedAt,omitempty"`
+	ElapsedMs  int64               `json:"elapsedMs"`
+}
+
+var (
+	settlementBets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bets",
+		Subsystem: "settlement",
+		Name:      "bets_total",
+		Help:      "Bets gone through settlement, per outcome: scored, unchanged, skipped or errored.",
+	}, []string{"outcome"})
+
+	settlementDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bets",
+		Subsystem: "settlement",
+		Name:      "duration_seconds",
+		Help:      "Duration of the settlements of a match, per trigger and status.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"trigger", "status"})
+)
+
+func init() {
+	registry.MustRegister(settlementBets, settlementDuration)
+}
+
+// startSettlement starts the record of a settlement; trace is empty when
+// nothing traced started it.
+func startSettlement(tenant, matchID string, r MatchResult, trigger, trace string) *SettlementRun {
+	if trace == "" {
+		trace = newID()
+	}
+	run := &SettlementRun{
+		ID: newID()[:16], TraceID: trace, Tenant: tenant, MatchID: matchID, Result: r.String(), Trigger: trigger,
+		Status: SettlementRunning, StartedAt: time.Now(),
+	}
+	settlements.put(run)
+	return run
+}
+
+// end closes the run with the outcome of the settlement: it is counted,
+// timed, logged and kept in the history.
+func (run *SettlementRun) end(err error) {
+	now := time.Now()
+	elapsed := now.Sub(run.StartedAt)
+	run.FinishedAt, run.ElapsedMs = &now, int64(elapsed/time.Millisecond)
+	switch {
+	case err == errLockBusy:
+		run.Status = SettlementBusy
+	case err != nil:
+		run.Status, run.Error = SettlementFailed, err.Error()
+	default:
+		run.Status = SettlementSucceeded
+	}
+	settlementBets.WithLabelValues("scored").Add(float64(run.Scored))
+	settlementBets.WithLabelValues("unchanged").Add(float64(run.Unchanged))
+	settlementBets.WithLabelValues("skipped").Add(float64(run.Skipped))
+	settlementBets.WithLabelValues("errored").Add(float64(run.Errored))
+	observe(settlementDuration.WithLabelValues(run.Trigger, string(run.Status)), elapsed.Seconds(), run.TraceID)
+	ev := log.Info()
+	if run.Status == SettlementFailed {
+		ev = log.Error().Str("error", run.Error)
+	}
+	ev.Str("trace_id", run.TraceID).Str("run_id", run.ID).Str("tenant", run.Tenant).Str("match", run.MatchID).Str("result", run.Result).
+		Str("trigger", run.Trigger).Str("status", string(run.Status)).Int("scored", run.Scored).
+		Int("corrected", run.Corrected).Int("unchanged", run.Unchanged).Int("skipped", run.Skipped).Int("errored", run.Errored).
+		Int64("elapsed_ms", run.ElapsedMs).Msg("settlement")
+	settlements.put(run)
+}
+
+// settlementHistory keeps the latest runs of this replica, and the latest
+// failures apart so a burst of successes does not push them out.
+type settlementHistory struct {
+	mu       sync.Mutex
+	size     int
+	runs     []SettlementRun
+	failures []SettlementRun
+}
+
+var settlements *settlementHistory
+
+// newSettlementHistory returns nil, keeping nothing, for a zero size.
+func newSettlementHistory(size int) *settlementHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &settlementHistory{size: size}
+}
+
+// put records a run, replacing its previous state while running.
+func (h *settlementHistory) put(run *SettlementRun) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runs = upsertRun(h.runs, *run, h.size)
+	if run.Status == SettlementFailed {
+		h.failures = upsertRun(h.failures, *run, h.size)
+	}
+}
+
+// upsertRun replaces the run in list, or prepends it dropping the oldest
+// beyond size; the list is newest first.
+func upsertRun(list []SettlementRun, run SettlementRun, size int) []SettlementRun {
+	for i := range list {
+		if list[i].ID == run.ID {
+			list[i] = run
+			return list
+		}
+	}
+	list = append([]SettlementRun{run}, list...)
+	if len(list) > size {
+		list = list[:size]
+	}
+	return list
+}
+
+// list returns the runs, or the failures, of the tenant, of a match or of
+// all, newest first.
+func (h *settlementHistory) list(tenant, matchID string, failures bool) []SettlementRun {
+	r := []SettlementRun{}
+	if h == nil {
+		return r
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	src := h.runs
+	if failures {
+		src = h.failures
+	}
+	for _, run := range src {
+		if run.Tenant == tenant && (matchID == "" || run.MatchID == matchID) {
+			r = append(r, run)
+		}
+	}
+	return r
+}
+
+// SettlementReport lists the recent settlements of the replica answering
+// and, apart, the recent failed ones.
+type SettlementReport struct {
+	Runs     []SettlementRun `json:"runs"`
+	Failures []SettlementRun `json:"failures"`
+}
+
+// ListSettlements reports the recent settlements of the caller's tenant,
+// of a ?matchId= or of all; ?status= narrows the runs down.
+func ListSettlements(c echo.Context) error {
+	t, matchID := tenant(c), c.QueryParam("matchId")
+	report := &SettlementReport{Runs: []SettlementRun{}, Failures: settlements.list(t, matchID, true)}
+	status := SettlementRunStatus(c.QueryParam("status"))
+	for _, run := range settlements.list(t, matchID, false) {
+		if status == "" || run.Status == status {
+			report.Runs = append(report.Runs, run)
+		}
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, report)
+}
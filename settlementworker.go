@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// MatchFinished is the payload of the match.finished events published by
+// the matches service. Tenant is the tenant whose matches service the
+// match comes from, the default tenant when empty.
+type MatchFinished struct {
+	Tenant    string `json:"tenant,omitempty"`
+	MatchID   string `json:"matchId"`
+	HomeScore int    `json:"homeScore"`
+	AwayScore int    `json:"awayScore"`
+}
+
+// settlementConsumer turns match.finished events into settlement jobs. The
+// ids of handled events are remembered for a day so a redelivered event is
+// acknowledged without settling twice; settle itself skips bets already
+// scored with the same result, covering redeliveries racing a running job.
+type settlementConsumer struct {
+	seen *Cache
+}
+
+func newSettlementConsumer() *settlementConsumer {
+	return &settlementConsumer{seen: NewCache(24*time.Hour, 100000)}
+}
+
+func (s *settlementConsumer) Handle(e Event) error {
+	if _, dup := s.seen.Get(e.ID); dup {
+		log.Debug().Str("event", e.ID).Msg("skipping already handled match.finished event")
+		return nil
+	}
+	mf := MatchFinished{}
+	if err := json.Unmarshal(e.Data, &mf); err != nil {
+		return err
+	}
+	if mf.MatchID == "" {
+		return errors.New("match.finished event without matchId")
+	}
+	if mf.Tenant == "" {
+		mf.Tenant = config.Tenancy.Default
+	}
+	if !validTenant.MatchString(mf.Tenant) {
+		return errors.New("match.finished event of invalid tenant " + mf.Tenant)
+	}
+	r := MatchResult{HomeScore: mf.HomeScore, AwayScore: mf.AwayScore}
+	jobs.Enqueue("settlement", 3, func(ctx context.Context) error {
+		n, err := settle(mf.Tenant, mf.MatchID, r, settlementTriggerEvent, "", clock)
+		if err != nil {
+			return err
+		}
+		s.seen.Set(e.ID, true)
+		log.Info().Str("tenant", mf.Tenant).Str("match", mf.MatchID).Str("event", e.ID).Int("bets", n).Msg("match settled " + r.String())
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bets",
+	Subsystem: "cache",
+	Name:      "coalesced_total",
+	Help:      "Cache misses answered by the load of a concurrent lookup of the same key.",
+}, []string{"cache"})
+
+func init() {
+	registry.MustRegister(cacheCoalesced)
+}
+
+// ringReplicas is how many points each shard takes on the hash ring, so
+// the keys spread evenly.
+const ringReplicas = 64
+
+// ShardedCache spreads its keys over shards, each a Cache with its own
+// lock, so lookups of different keys rarely contend. Keys are placed on a
+// consistent hash ring: changing the number of shards moves few of them.
+// Misses of the same key are coalesced by Load into one call downstream.
+type ShardedCache struct {
+	name   string
+	shards []*cacheShard
+	ring   []ringPoint
+}
+
+type cacheShard struct {
+	*Cache
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+// flight is a load in progress; its outcome is set before done is closed,
+// ok only when the load succeeded.
+type flight struct {
+	done   chan struct{}
+	value  interface{}
+	status int
+	ok     bool
+}
+
+// NewShardedCache returns a cache of at most max entries, split evenly
+// between the shards, with the TTL semantics of Cache.
+func NewShardedCache(name string, ttl time.Duration, max, shards int) *ShardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	perShard := max
+	if max > 0 {
+		perShard = (max + shards - 1) / shards
+	}
+	c := &ShardedCache{name: name}
+	for i := 0; i < shards; i++ {
+		c.shards = append(c.shards, &cacheShard{Cache: NewCache(ttl, perShard), flights: map[string]*flight{}})
+		for r := 0; r < ringReplicas; r++ {
+			c.ring = append(c.ring, ringPoint{crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + strconv.Itoa(r))), i})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i].hash < c.ring[j].hash })
+	return c
+}
+
+// shard is the shard owning the key: the first ring point at or after the
+// key's hash, wrapping around.
+func (c *ShardedCache) shard(key string) *cacheShard {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.shards[c.ring[i].shard]
+}
+
+func (c *ShardedCache) Get(key string) (interface{}, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedCache) Set(key string, value interface{}) {
+	c.shard(key).Set(key, value)
+}
+
+func (c *ShardedCache) Delete(key string) {
+	c.shard(key).Delete(key)
+}
+
+// Load calls load, which is expected to Set the key, after a Get of the key
+// missed. Concurrent misses of the key wait for the first one's call and
+// share its value when it succeeded; when it failed with an error or a
+// non-2xx status, or panicked, they load on their own. A miss racing the
+// end of a call gets the value it set, with status 200.
+func (c *ShardedCache) Load(key string, load func() (interface{}, int, error)) (interface{}, int, error) {
+	s := c.shard(key)
+	for {
+		s.mu.Lock()
+		if f, ok := s.flights[key]; ok {
+			s.mu.Unlock()
+			<-f.done
+			if f.ok {
+				cacheCoalesced.WithLabelValues(c.name).Inc()
+				return f.value, f.status, nil
+			}
+			continue
+		}
+		if v, ok := s.peek(key); ok {
+			s.mu.Unlock()
+			cacheCoalesced.WithLabelValues(c.name).Inc()
+			return v, http.StatusOK, nil
+		}
+		f := &flight{done: make(chan struct{})}
+		s.flights[key] = f
+		s.mu.Unlock()
+		return s.lead(key, f, load)
+	}
+}
+
+// lead makes the call of a flight. The flight ends even when load panics,
+// failed, so its waiters don't hang nor take a nil value for a hit.
+func (s *cacheShard) lead(key string, f *flight, load func() (interface{}, int, error)) (interface{}, int, error) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.flights, key)
+		s.mu.Unlock()
+		close(f.done)
+	}()
+	value, status, err := load()
+	f.value, f.status, f.ok = value, status, err == nil && is2xx(status)
+	return value, status, err
+}
+
+// Stats sums the counters of the shards.
+func (c *ShardedCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, s := range c.shards {
+		st := s.Stats()
+		stats.Hits += st.Hits
+		stats.Misses += st.Misses
+		stats.Evictions += st.Evictions
+		stats.Size += st.Size
+		stats.TTL = st.TTL
+	}
+	return stats
+}
+
+// SetTTL changes the TTL of every shard.
+func (c *ShardedCache) SetTTL(ttl time.Duration) {
+	for _, s := range c.shards {
+		s.SetTTL(ttl)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SheddingConfig caps the requests served at once; the excess is shed.
+// The cap is Limit, or with Adaptive set it starts there and moves between
+// MinLimit and MaxLimit: up by one every cap's worth of requests served
+// within TargetLatency, down by a tenth on each slower one. A zero limit
+// disables shedding.
+type SheddingConfig struct {
+	Limit         int
+	Adaptive      bool
+	MinLimit      int
+	MaxLimit      int
+	TargetLatency time.Duration
+	RetryAfter    time.Duration
+}
+
+var (
+	shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bets",
+		Subsystem: "http",
+		Name:      "shed_requests_total",
+		Help:      "Requests answered 503 because too many were being served.",
+	})
+
+	concurrencyLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "bets",
+		Subsystem: "http",
+		Name:      "concurrency_limit",
+		Help:      "Requests served at once before shedding the excess.",
+	})
+)
+
+func init() {
+	registry.MustRegister(shedRequests, concurrencyLimit)
+}
+
+// loadShedder admits requests while fewer than the limit are in flight.
+// Queueing them instead would only slow everyone down together.
+type loadShedder struct {
+	cfg      SheddingConfig
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+}
+
+func newLoadShedder(cfg SheddingConfig) *loadShedder {
+	if cfg.MinLimit < 1 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit < cfg.Limit {
+		cfg.MaxLimit = cfg.Limit
+	}
+	s := &loadShedder{cfg: cfg, limit: float64(cfg.Limit)}
+	concurrencyLimit.Set(s.limit)
+	return s
+}
+
+func (s *loadShedder) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if float64(s.inflight) >= s.limit {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+// release adapts the limit to the latency of the request just served.
+func (s *loadShedder) release(took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	if !s.cfg.Adaptive {
+		return
+	}
+	if took <= s.cfg.TargetLatency {
+		s.limit += 1 / s.limit
+	} else {
+		s.limit *= 0.9
+	}
+	if min := float64(s.cfg.MinLimit); s.limit < min {
+		s.limit = min
+	}
+	if max := float64(s.cfg.MaxLimit); s.limit > max {
+		s.limit = max
+	}
+	concurrencyLimit.Set(s.limit)
+}
+
+// Middleware answers 503 with Retry-After to requests over the limit,
+// before they reach the handlers. Probes are never shed, so an overloaded
+// replica isn't mistaken for a dead one.
+func (s *loadShedder) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.cfg.Limit <= 0 || isProbe(c.Request().URL.Path) {
+			return next(c)
+		}
+		if !s.acquire() {
+			shedRequests.Inc()
+			return (&Problem{
+				Title:  "overloaded",
+				Status: http.StatusServiceUnavailable,
+				Detail: "the server is serving too many requests, retry later",
+			}).retryAfter(s.cfg.RetryAfter)
+		}
+		start := time.Now()
+		defer func() { s.release(time.Since(start)) }()
+		return next(c)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memorySnapshot is what the memory driver writes to disk: the bets, as
+// stored, the audit chain, and the stores admins and players fill by hand:
+// the local users, the bet windows, the webhook subscriptions, the player
+// profiles and the match states.
+type memorySnapshot struct {
+	TakenAt       time.Time               `json:"takenAt"`
+	Bets          []*Bet                  `json:"bets"`
+	Audit         []*AuditEntry           `json:"audit"`
+	Users         []*snapshotUser         `json:"users,omitempty"`
+	BetWindows    []*BetWindow            `json:"betWindows,omitempty"`
+	Subscriptions []*snapshotSubscription `json:"subscriptions,omitempty"`
+	Players       []*snapshotPlayer       `json:"players,omitempty"`
+	MatchStates   []*MatchState           `json:"matchStates,omitempty"`
+}
+
+// snapshotUser and the like carry the fields the API never answers.
+type snapshotUser struct {
+	*LocalUser
+	PasswordHash string `json:"passwordHash"`
+}
+
+type snapshotSubscription struct {
+	*WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+type snapshotPlayer struct {
+	*PlayerProfile
+	Tenant  string `json:"tenant"`
+	Player  string `json:"player"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// snapshotter saves the memory driver's stores to a JSON file every
+// interval and when the replica stops, so a demo replica restarted with
+// the same file picks up where it left off.
+type snapshotter struct {
+	file        string
+	interval    time.Duration
+	bets        *memoryBets
+	audit       *memoryAudit
+	users       *memoryUsers
+	windows     *memoryBetWindows
+	subs        *memorySubscriptions
+	players     *memoryPlayers
+	matchStates *memoryMatchStates
+
+	mu   sync.Mutex
+	last []byte
+}
+
+var snapshots *snapshotter
+
+// newSnapshotter snapshots the stores of the memory driver.
+func newSnapshotter(cfg StorageConfig, storage *Storage) *snapshotter {
+	return &snapshotter{
+		file:        cfg.SnapshotFile,
+		interval:    cfg.SnapshotInterval,
+		bets:        storage.Bets.(*memoryBets),
+		audit:       storage.Audit.(*memoryAudit),
+		users:       storage.Users.(*memoryUsers),
+		windows:     storage.BetWindows.(*memoryBetWindows),
+		subs:        storage.Subscriptions.(*memorySubscriptions),
+		players:     storage.Players.(*memoryPlayers),
+		matchStates: storage.MatchStates.(*memoryMatchStates),
+	}
+}
+
+// restore loads the snapshot file, if there is one yet.
+func (s *snapshotter) restore() error {
+	b, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snap := &memorySnapshot{}
+	if err := json.Unmarshal(b, snap); err != nil {
+		return err
+	}
+	for _, bet := range snap.Bets {
+		s.bets.bets[bet.ID] = bet
+	}
+	s.audit.entries = snap.Audit
+	for _, u := range snap.Users {
+		u.LocalUser.PasswordHash = u.PasswordHash
+		s.users.users[u.Email] = u.LocalUser
+	}
+	for _, w := range snap.BetWindows {
+		s.windows.windows[w.Tenant+"/"+w.ChampionshipID+"/"+w.Round] = w
+	}
+	for _, sub := range snap.Subscriptions {
+		sub.WebhookSubscription.Secret = sub.Secret
+		s.subs.subs[sub.ID] = sub.WebhookSubscription
+	}
+	for _, p := range snap.Players {
+		p.PlayerProfile.Tenant, p.PlayerProfile.Player, p.PlayerProfile.Subject = p.Tenant, p.Player, p.Subject
+		s.players.players[p.Tenant+"/"+p.Player] = p.PlayerProfile
+	}
+	for _, st := range snap.MatchStates {
+		s.matchStates.states[hotMatch{st.Tenant, st.MatchID}] = st
+	}
+	log.Info().Str("file", s.file).Int("bets", len(snap.Bets)).Time("takenAt", snap.TakenAt).Msg("restored the storage snapshot")
+	snap.TakenAt = time.Time{}
+	s.last, err = json.Marshal(snap)
+	return err
+}
+
+// take copies the stores, each in a stable order so unchanged stores
+// marshal the same.
+func (s *snapshotter) take() (*memorySnapshot, error) {
+	snap := &memorySnapshot{}
+	var err error
+	if snap.Bets, err = s.bets.List(BetFilter{IncludeDeleted: true}); err != nil {
+		return nil, err
+	}
+	if snap.Audit, err = s.audit.List(""); err != nil {
+		return nil, err
+	}
+	s.users.mu.Lock()
+	for _, u := range s.users.users {
+		c := *u
+		snap.Users = append(snap.Users, &snapshotUser{LocalUser: &c, PasswordHash: u.PasswordHash})
+	}
+	s.users.mu.Unlock()
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].Email < snap.Users[j].Email })
+	s.windows.mu.Lock()
+	for _, w := range s.windows.windows {
+		c := *w
+		snap.BetWindows = append(snap.BetWindows, &c)
+	}
+	s.windows.mu.Unlock()
+	sort.Slice(snap.BetWindows, func(i, j int) bool {
+		a, b := snap.BetWindows[i], snap.BetWindows[j]
+		return a.Tenant+"/"+a.ChampionshipID+"/"+a.Round < b.Tenant+"/"+b.ChampionshipID+"/"+b.Round
+	})
+	s.subs.mu.Lock()
+	for _, sub := range s.subs.subs {
+		c := *sub
+		snap.Subscriptions = append(snap.Subscriptions, &snapshotSubscription{WebhookSubscription: &c, Secret: sub.Secret})
+	}
+	s.subs.mu.Unlock()
+	sort.Slice(snap.Subscriptions, func(i, j int) bool { return snap.Subscriptions[i].ID < snap.Subscriptions[j].ID })
+	s.players.mu.Lock()
+	for _, p := range s.players.players {
+		snap.Players = append(snap.Players, &snapshotPlayer{PlayerProfile: s.players.copy(p), Tenant: p.Tenant, Player: p.Player, Subject: p.Subject})
+	}
+	s.players.mu.Unlock()
+	sort.Slice(snap.Players, func(i, j int) bool {
+		return snap.Players[i].Tenant+"/"+snap.Players[i].Player < snap.Players[j].Tenant+"/"+snap.Players[j].Player
+	})
+	s.matchStates.mu.Lock()
+	for _, st := range s.matchStates.states {
+		c := *st
+		snap.MatchStates = append(snap.MatchStates, &c)
+	}
+	s.matchStates.mu.Unlock()
+	sort.Slice(snap.MatchStates, func(i, j int) bool {
+		a, b := snap.MatchStates[i], snap.MatchStates[j]
+		return a.Tenant+"/"+a.MatchID < b.Tenant+"/"+b.MatchID
+	})
+	return snap, nil
+}
+
+// save writes the snapshot when the stores changed since the last one
+// saved, replacing the file at once so a crash never leaves half of it.
+func (s *snapshotter) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap, err := s.take()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, s.last) {
+		return nil
+	}
+	snap.TakenAt = time.Now().UTC()
+	taken, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	blobs := &fileBlobs{dir: filepath.Dir(s.file)}
+	if err := blobs.Put(filepath.Base(s.file), bytes.NewReader(taken)); err != nil {
+		return err
+	}
+	s.last = b
+	return nil
+}
+
+func (s *snapshotter) Run(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.save(); err != nil {
+				log.Error().Err(err).Str("file", s.file).Msg("failed to save the storage snapshot")
+			}
+		}
+	}
+}
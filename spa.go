@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// StaticConfig serves a single-page app: the build in SPADir, mounted at
+// SPAPath, falls back to its index.html for the client-side routes. CSP is
+// the Content-Security-Policy of its responses.
+type StaticConfig struct {
+	SPADir  string
+	SPAPath string
+	CSP     string
+}
+
+// fingerprint matches the content hash bundlers put in asset names, as
+// main.3f2a1b9c.js or index-B2xk9aQf.css.
+var fingerprint = regexp.MustCompile(`[.-]([0-9A-Za-z_]{8,})\.[0-9A-Za-z]+$`)
+
+func fingerprinted(name string) bool {
+	m := fingerprint.FindStringSubmatch(path.Base(name))
+	return m != nil && strings.ContainsAny(m[1], "0123456789")
+}
+
+// AssetHeaders lets clients keep fingerprinted assets forever, as their
+// name changes with their content, and revalidate the others.
+func AssetHeaders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if fingerprinted(c.Request().URL.Path) {
+			c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			c.Response().Header().Set("Cache-Control", "no-cache")
+		}
+		return next(c)
+	}
+}
+
+// spaReserved are the prefixes of the server's own routes, which an app
+// mounted at the root never answers for.
+var spaReserved = []string{"/api/", "/static/", "/debug/", "/domain/", "/health", "/metrics", "/info", "/region"}
+
+// SPA serves the files of the app, and its index.html for any other path
+// without an extension, so deep links reach the client-side router.
+func SPA(cfg StaticConfig) echo.HandlerFunc {
+	index := filepath.Join(cfg.SPADir, "index.html")
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return echo.ErrNotFound
+		}
+		for _, p := range spaReserved {
+			if strings.HasPrefix(req.URL.Path, p) {
+				return echo.ErrNotFound
+			}
+		}
+		p, err := url.PathUnescape(c.Param("*"))
+		if err != nil {
+			return echo.ErrNotFound
+		}
+		name := filepath.Join(cfg.SPADir, path.Clean("/"+p))
+		h := c.Response().Header()
+		if cfg.CSP != "" {
+			h.Set("Content-Security-Policy", cfg.CSP)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			return AssetHeaders(func(c echo.Context) error { return c.File(name) })(c)
+		}
+		if path.Ext(p) != "" {
+			return echo.ErrNotFound
+		}
+		h.Set("Cache-Control", "no-cache")
+		return c.File(index)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// StakeLimits make a championship a paid pool: bets may carry a stake, in
+// the minor unit of Currency (cents for EUR), between Min and Max. Required
+// rejects bets without one.
+type StakeLimits struct {
+	Currency string `json:"currency"`
+	Min      int64  `json:"min"`
+	Max      int64  `json:"max,omitempty"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// checkStake validates the stake of a bet against the limits of its
+// championship; championships without limits take no stakes.
+func checkStake(stake int64, l *StakeLimits, championshipID string) error {
+	if stake < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "stake must be positive")
+	}
+	if l == nil {
+		if stake > 0 {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "championship "+championshipID+" takes no stakes")
+		}
+		return nil
+	}
+	if stake == 0 {
+		if l.Required {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "championship "+championshipID+" requires a stake")
+		}
+		return nil
+	}
+	if stake < l.Min {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "stake must be at least "+strconv.FormatInt(l.Min, 10)+" "+l.Currency)
+	}
+	if l.Max > 0 && stake > l.Max {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "stake must be at most "+strconv.FormatInt(l.Max, 10)+" "+l.Currency)
+	}
+	return nil
+}
+
+// Pot is what the bets of a championship staked, in all and per match.
+// Deleted bets are refunded, so they no longer count.
+type Pot struct {
+	ChampionshipID string     `json:"championshipId"`
+	Currency       string     `json:"currency,omitempty"`
+	Total          int64      `json:"total"`
+	Bets           int        `json:"bets"`
+	Matches        []MatchPot `json:"matches"`
+}
+
+type MatchPot struct {
+	MatchID string `json:"matchId"`
+	Total   int64  `json:"total"`
+	Bets    int    `json:"bets"`
+}
+
+// championshipPot sums the staked score groups of one championship per
+// match.
+func championshipPot(id string, a *BetAggregate) *Pot {
+	p := &Pot{ChampionshipID: id, Matches: []MatchPot{}}
+	matches := map[string]*MatchPot{}
+	for _, g := range a.Scores {
+		if g.ChampionshipID != id || g.Staked == 0 {
+			continue
+		}
+		m := matches[g.MatchID]
+		if m == nil {
+			m = &MatchPot{MatchID: g.MatchID}
+			matches[g.MatchID] = m
+		}
+		m.Total += g.Stakes
+		m.Bets += g.Staked
+		p.Total += g.Stakes
+		p.Bets += g.Staked
+	}
+	for _, m := range matches {
+		p.Matches = append(p.Matches, *m)
+	}
+	sort.Slice(p.Matches, func(i, j int) bool { return p.Matches[i].MatchID < p.Matches[j].MatchID })
+	return p
+}
+
+// GetPot reports the pot of a championship of the caller's tenant. The
+// currency is left out when the championship cannot be fetched.
+func GetPot(c echo.Context) error {
+	id := c.Param("id")
+	a, err := bets.Aggregate(BetFilter{Tenant: tenant(c), ChampionshipID: id})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to aggregate bets")
+		return err
+	}
+	p := championshipPot(id, a)
+	if champ, _, err := championship(c, id); err == nil && champ.Stakes != nil {
+		p.Currency = champ.Stakes.Currency
+	}
+	return c.JSON(http.StatusOK, p)
+}
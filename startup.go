@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type ComponentState string
+
+const (
+	ComponentPending      ComponentState = "pending"
+	ComponentInitializing ComponentState = "initializing"
+	ComponentReady        ComponentState = "ready"
+	ComponentFailed       ComponentState = "failed"
+)
+
+// startupOrder is the order components start in, each depending on the
+// previous ones.
+var startupOrder = []string{"config", "storage", "cache", "bus", "http"}
+
+// ComponentStatus is the startup progress of a component.
+type ComponentStatus struct {
+	Name      string         `json:"name"`
+	State     ComponentState `json:"state"`
+	Attempts  int            `json:"attempts,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	StartedAt *time.Time     `json:"startedAt,omitempty"`
+	ReadyAt   *time.Time     `json:"readyAt,omitempty"`
+}
+
+// startupTracker records the startup of the components. The listener is
+// up from the start, so probes see the progress, but requests other than
+// the probes are turned away until every component is ready.
+type startupTracker struct {
+	mu         sync.Mutex
+	components []*ComponentStatus
+	ready      int32
+}
+
+var startup = newStartupTracker()
+
+func newStartupTracker() *startupTracker {
+	t := &startupTracker{}
+	for _, name := range startupOrder {
+		t.components = append(t.components, &ComponentStatus{Name: name, State: ComponentPending})
+	}
+	return t
+}
+
+func (t *startupTracker) component(name string) *ComponentStatus {
+	for _, c := range t.components {
+		if c.Name == name {
+			return c
+		}
+	}
+	panic("unknown startup component " + name)
+}
+
+// run starts a component with fn, retrying every backoff, doubled up to a
+// limit, for as long as timeout allows; a zero timeout allows one attempt.
+func (t *startupTracker) run(name string, timeout time.Duration, fn func() error) error {
+	now := time.Now()
+	deadline := now.Add(timeout)
+	t.mu.Lock()
+	c := t.component(name)
+	c.State = ComponentInitializing
+	c.StartedAt = &now
+	t.mu.Unlock()
+	backoff := 500 * time.Millisecond
+	for {
+		err := fn()
+		t.mu.Lock()
+		c.Attempts++
+		if err == nil {
+			readyAt := time.Now()
+			c.State = ComponentReady
+			c.Error = ""
+			c.ReadyAt = &readyAt
+			t.mu.Unlock()
+			log.Info().Str("component", name).Dur("took", readyAt.Sub(now)).Msg("component started")
+			return nil
+		}
+		c.Error = err.Error()
+		if time.Now().Add(backoff).After(deadline) {
+			c.State = ComponentFailed
+			t.mu.Unlock()
+			return err
+		}
+		t.mu.Unlock()
+		log.Warn().Err(err).Str("component", name).Dur("retryIn", backoff).Msg("component not started yet")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// done reports whether every component started; it is safe to read the
+// globals they set once it returns true.
+func (t *startupTracker) done() bool {
+	return atomic.LoadInt32(&t.ready) == 1
+}
+
+func (t *startupTracker) finish() {
+	atomic.StoreInt32(&t.ready, 1)
+}
+
+func (t *startupTracker) snapshot() []ComponentStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := make([]ComponentStatus, len(t.components))
+	for i, c := range t.components {
+		r[i] = *c
+	}
+	return r
+}
+
+// probePaths are served while starting.
+var probePaths = []string{"/health", "/info", "/metrics", "/region"}
+
+func isProbe(path string) bool {
+	for _, p := range probePaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Gate answers 503 to everything but the probes until startup is done. It
+// runs before routing, i.e. via Echo#Pre, so no middleware relying on the
+// components runs early either.
+func (t *startupTracker) Gate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if t.done() || isProbe(c.Request().URL.Path) {
+			return next(c)
+		}
+		return (&Problem{
+			Title:  "starting up",
+			Status: http.StatusServiceUnavailable,
+			Detail: "the application is still starting, see " + link("/health/startup"),
+		}).retryAfter(time.Second)
+	}
+}
+
+// StartupStatus describes each component, for startup probes: 200 once
+// every component is ready, 503 before.
+type StartupStatus struct {
+	Ready      bool              `json:"ready"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// HealthReady is the readiness probe: 503 until startup is done.
+func HealthReady(c echo.Context) error {
+	if !startup.done() {
+		return c.JSON(http.StatusServiceUnavailable, &HealthData{Status: "STARTING"})
+	}
+	return c.JSON(http.StatusOK, &HealthData{Status: "UP"})
+}
+
+func HealthStartup(c echo.Context) error {
+	st := StartupStatus{Ready: startup.done(), Components: startup.snapshot()}
+	status := http.StatusOK
+	if !st.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, st)
+}
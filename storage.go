@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errBetNotFound      = errors.New("bet not found")
+	errExternalRefTaken = errors.New("externalRef is already used by another bet")
+)
+
+const maxExternalRef = 128
+
+// BetFilter narrows a bet listing; zero fields match everything. The date
+// range applies to the match date. Soft deleted bets are left out unless
+// asked for.
+type BetFilter struct {
+	Tenant         string
+	Email          string
+	EmailIndex     string
+	Championship   string
+	ChampionshipID string
+	Round          string
+	MatchID        string
+	ExternalRef    string
+	AccumulatorID  string
+	// Emails and EmailIndexes, when set, keep the bets of any of the
+	// players, for loading the bets of several at once.
+	Emails         []string
+	EmailIndexes   []string
+	From           time.Time
+	To             time.Time
+	IncludeDeleted bool
+	// ChangedAfter and ChangedUntil bound the last save, the latter
+	// inclusively.
+	ChangedAfter time.Time
+	ChangedUntil time.Time
+	// PlacedFrom and PlacedBefore bound the creation, the latter
+	// exclusively.
+	PlacedFrom   time.Time
+	PlacedBefore time.Time
+}
+
+func (f BetFilter) matches(b *Bet) bool {
+	if !f.IncludeDeleted && b.DeletedAt != nil {
+		return false
+	}
+	if f.Tenant != "" && b.Tenant != f.Tenant {
+		return false
+	}
+	if f.Email != "" && b.Email != f.Email {
+		return false
+	}
+	if f.EmailIndex != "" && b.EmailIndex != f.EmailIndex {
+		return false
+	}
+	if f.Emails != nil && !containsString(f.Emails, b.Email) {
+		return false
+	}
+	if f.EmailIndexes != nil && !containsString(f.EmailIndexes, b.EmailIndex) {
+		return false
+	}
+	if f.Championship != "" && b.Championship != f.Championship {
+		return false
+	}
+	if f.ChampionshipID != "" && b.ChampionshipID != f.ChampionshipID {
+		return false
+	}
+	if f.Round != "" && b.Round != f.Round {
+		return false
+	}
+	if f.MatchID != "" && b.MatchID != f.MatchID {
+		return false
+	}
+	if f.ExternalRef != "" && b.ExternalRef != f.ExternalRef {
+		return false
+	}
+	if f.AccumulatorID != "" && b.AccumulatorID != f.AccumulatorID {
+		return false
+	}
+	if !f.ChangedAfter.IsZero() && !b.UpdatedAt.After(f.ChangedAfter) {
+		return false
+	}
+	if !f.ChangedUntil.IsZero() && b.UpdatedAt.After(f.ChangedUntil) {
+		return false
+	}
+	if !f.PlacedFrom.IsZero() && b.CreatedAt.Before(f.PlacedFrom) {
+		return false
+	}
+	if !f.PlacedBefore.IsZero() && !b.CreatedAt.Before(f.PlacedBefore) {
+		return false
+	}
+	if b.MatchInfo != nil {
+		if !f.From.IsZero() && b.MatchInfo.Date.Before(f.From) {
+			return false
+		}
+		if !f.To.IsZero() && b.MatchInfo.Date.After(f.To) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage groups the repositories of one storage driver.
+type Storage struct {
+	Bets   BetRepository
+	Audit  AuditStore
+	Locks  Locker
+	Outbox OutboxStore
+	// Subscriptions holds the outbound webhooks and their deliveries.
+	Subscriptions SubscriptionStore
+	// Domains maps custom hostnames to pools.
+	Domains DomainStore
+	// Watermarks tracks the warehouse exports.
+	Watermarks WatermarkStore
+	// Rollups holds the daily statistics.
+	Rollups RollupStore
+	// MatchStates holds the polled match statuses and bet locks.
+	MatchStates MatchStateStore
+	// PlayerEvents holds the logins and notifications of the players.
+	PlayerEvents PlayerEventStore
+	// Users holds the accounts of the local identity provider.
+	Users UserStore
+	// Awards holds the awards of the settled rounds.
+	Awards AwardStore
+	// Players caches the profiles of the players service.
+	Players PlayerStore
+	// Preferences holds the notifications the players turned off.
+	Preferences PreferenceStore
+	// Reminders tracks the reminders sent about upcoming matches.
+	Reminders ReminderStore
+	// BetRequests holds the bets placed in the background.
+	BetRequests BetRequestStore
+	// BetWindows holds when betting opens and closes per championship.
+	BetWindows BetWindowStore
+	// DB is nil for the memory and mongo drivers.
+	DB *sql.DB
+}
+
+// openStorage returns the repositories selected by the config, applying
+// the pending migrations first when asked to.
+func openStorage(cfg StorageConfig) (*Storage, error) {
+	switch cfg.Driver {
+	case "memory":
+		outbox := newMemoryOutbox()
+		return &Storage{Bets: newMemoryBets(outbox), Audit: &memoryAudit{}, Locks: newMemoryLocks(), Outbox: outbox, Subscriptions: newMemorySubscriptions(), Domains: newMemoryDomains(), Watermarks: newMemoryWatermarks(), Rollups: newMemoryRollups(), MatchStates: newMemoryMatchStates(), PlayerEvents: newMemoryPlayerEvents(), Users: newMemoryUsers(), Awards: newMemoryAwards(), Players: newMemoryPlayers(), Preferences: newMemoryPreferences(), Reminders: newMemoryReminders(), BetRequests: newMemoryBetRequests(), BetWindows: newMemoryBetWindows()}, nil
+	case "postgres":
+		db, err := openDatabase(cfg.DatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.MigrateOnStart {
+			if _, err := migrateUp(db); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		return &Storage{Bets: &postgresBets{db: db}, Audit: &postgresAudit{db: db}, Locks: &postgresLocks{db: db}, Outbox: &postgresOutbox{db: db}, Subscriptions: &postgresSubscriptions{db: db}, Domains: &postgresDomains{db: db}, Watermarks: &postgresWatermarks{db: db}, Rollups: &postgresRollups{db: db}, MatchStates: &postgresMatchStates{db: db}, PlayerEvents: &postgresPlayerEvents{db: db}, Users: &postgresUsers{db: db}, Awards: &postgresAwards{db: db}, Players: &postgresPlayers{db: db}, Preferences: &postgresPreferences{db: db}, Reminders: &postgresReminders{db: db}, BetRequests: &postgresBetRequests{db: db}, BetWindows: &postgresBetWindows{db: db}, DB: db}, nil
+	case "mongo":
+		db, err := openMongo(cfg.MongoURL, cfg.MongoDatabase)
+		if err != nil {
+			return nil, err
+		}
+		outbox := &mongoOutbox{pending: db.Collection("outbox"), dead: db.Collection("dead_letters")}
+		return &Storage{Bets: &mongoBets{coll: db.Collection("bets"), outbox: outbox}, Audit: &mongoAudit{coll: db.Collection("audit_log")}, Locks: &mongoLocks{coll: db.Collection("locks")}, Outbox: outbox, Subscriptions: &mongoSubscriptions{subs: db.Collection("webhook_subscriptions"), deliveries: db.Collection("webhook_deliveries")}, Domains: &mongoDomains{coll: db.Collection("pool_domains")}, Watermarks: &mongoWatermarks{coll: db.Collection("warehouse_watermarks")}, Rollups: &mongoRollups{coll: db.Collection("daily_stats")}, MatchStates: &mongoMatchStates{coll: db.Collection("match_states")}, PlayerEvents: &mongoPlayerEvents{coll: db.Collection("player_events")}, Users: &mongoUsers{coll: db.Collection("users")}, Awards: &mongoAwards{coll: db.Collection("round_awards")}, Players: &mongoPlayers{coll: db.Collection("players")}, Preferences: &mongoPreferences{coll: db.Collection("notification_preferences")}, Reminders: &mongoReminders{coll: db.Collection("reminders")}, BetRequests: &mongoBetRequests{coll: db.Collection("bet_requests")}, BetWindows: &mongoBetWindows{coll: db.Collection("bet_windows")}}, nil
+	}
+	return nil, errors.New("unknown storage driver " + cfg.Driver)
+}
+
+// initStorage opens the configured storage and sets up the bets repository,
+// encrypting PII when keys are configured, the locks, the outbox, the
+// webhook subscriptions, the custom domains, the warehouse exporter, the
+// daily rollups, the match states, the player events, preferences and
+// reminders, the identity provider and the audit log, restoring the memory snapshot if any.
+func initStorage(cfg *Config) error {
+	storage, err := openStorage(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	if _, ok := storage.Bets.(*memoryBets); ok && cfg.Storage.SnapshotFile != "" {
+		snapshots = newSnapshotter(cfg.Storage, storage)
+		if err := snapshots.restore(); err != nil {
+			return err
+		}
+	}
+	bets = storage.Bets
+	players = storage.Players
+	if len(cfg.PII.Keys) > 0 {
+		pii, err := newPIICipher(cfg.PII.Keys, cfg.PII.IndexKey)
+		if err != nil {
+			return err
+		}
+		bets = &encryptedBets{BetRepository: bets, pii: pii}
+		players = &encryptedPlayers{PlayerStore: players, pii: pii}
+	}
+	bets = &watchedBets{BetRepository: bets, watch: betChanges}
+	locks = storage.Locks
+	outboxStore = storage.Outbox
+	subscriptions = storage.Subscriptions
+	domains = newDomainTable(storage.Domains, cfg.Cache)
+	warehouse = &warehouseExporter{
+		cfg:        cfg.Warehouse,
+		writer:     &blobWarehouse{store: &fileBlobs{dir: cfg.Warehouse.Dir}, prefix: cfg.Warehouse.Prefix},
+		watermarks: storage.Watermarks,
+	}
+	rollup = &rollups{cfg: cfg.Rollups, store: storage.Rollups}
+	matchStates = storage.MatchStates
+	playerEvents = storage.PlayerEvents
+	users = storage.Users
+	awards = storage.Awards
+	preferences = storage.Preferences
+	reminders = storage.Reminders
+	betRequests = storage.BetRequests
+	betWindows = storage.BetWindows
+	if identities, err = newIdentityProvider(cfg.Identity, users); err != nil {
+		return err
+	}
+	audit = &AuditLog{store: storage.Audit, key: []byte(cfg.AuditKey)}
+	return nil
+}
+
+type BetRepository interface {
+	Save(b *Bet) error
+	// SaveWithEvents saves the bet and adds the entries announcing it to
+	// the outbox of the storage, in the same transaction with postgres;
+	// the others add the entries once the bet is saved, failing when they
+	// can't.
+	SaveWithEvents(b *Bet, entries []*OutboxEntry) error
+	Get(id string) (*Bet, error)
+	// List returns the bets matching the filter, oldest first.
+	List(f BetFilter) ([]*Bet, error)
+	// Each calls fn with the bets List would return, one at a time, so
+	// large listings need not be held in memory. An error from fn stops
+	// the iteration and is returned.
+	Each(f BetFilter, fn func(*Bet) error) error
+	// Aggregate counts the bets matching the filter per predicted score,
+	// and their distinct players per championship.
+	Aggregate(f BetFilter) (*BetAggregate, error)
+}
+
+// memoryBets keeps bets in process memory. Values are copied in and out so
+// callers never share state with the store.
+type memoryBets struct {
+	mu     sync.RWMutex
+	bets   map[string]*Bet
+	outbox OutboxStore
+}
+
+func newMemoryBets(outbox OutboxStore) *memoryBets {
+	return &memoryBets{bets: map[string]*Bet{}, outbox: outbox}
+}
+
+// Save enforces externalRef uniqueness per tenant, as the postgres index
+// does.
+func (m *memoryBets) Save(b *Bet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b.ExternalRef != "" {
+		for _, other := range m.bets {
+			if other.ID != b.ID && other.Tenant == b.Tenant && other.ExternalRef == b.ExternalRef {
+				return errExternalRefTaken
+			}
+		}
+	}
+	m.bets[b.ID] = b.clone()
+	return nil
+}
+
+func (m *memoryBets) SaveWithEvents(b *Bet, entries []*OutboxEntry) error {
+	if err := m.Save(b); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := m.outbox.Add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBets) Get(id string) (*Bet, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.bets[id]
+	if !ok {
+		return nil, errBetNotFound
+	}
+	return b.clone(), nil
+}
+
+func (m *memoryBets) List(f BetFilter) ([]*Bet, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := []*Bet{}
+	for _, b := range m.bets {
+		if f.matches(b) {
+			r = append(r, b.clone())
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].CreatedAt.Before(r[j].CreatedAt) })
+	return r, nil
+}
+
+func (m *memoryBets) Aggregate(f BetFilter) (*BetAggregate, error) {
+	list, err := m.List(f)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateBets(list), nil
+}
+
+func (m *memoryBets) Each(f BetFilter, fn func(*Bet) error) error {
+	list, err := m.List(f)
+	if err != nil {
+		return err
+	}
+	for _, b := range list {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
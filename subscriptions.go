@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var errSubscriptionNotFound = errors.New("webhook subscription not found")
+
+// webhookEvents are the bet lifecycle events partners can subscribe to,
+// and the announcements of the awards of a round and of the leaderboards
+// a resettled match changed.
+var webhookEvents = map[string]bool{"bet.created": true, "bet.settled": true, "round.awarded": true, "leaderboard.updated": true, "accumulator.settled": true}
+
+const (
+	webhookDeliveryAttempts = 8
+	deliveryHistory         = 100
+)
+
+// WebhookSubscription is a partner endpoint called on bet lifecycle
+// events of its tenant; no events means all of them.
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s *WebhookSubscription) wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// WebhookDelivery tracks the delivery of one event to one subscription.
+type WebhookDelivery struct {
+	ID             string         `json:"id"`
+	SubscriptionID string         `json:"subscriptionId"`
+	Event          string         `json:"event"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	ResponseStatus int            `json:"responseStatus,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	DeliveredAt    *time.Time     `json:"deliveredAt,omitempty"`
+}
+
+type SubscriptionStore interface {
+	Add(s *WebhookSubscription) error
+	Get(id string) (*WebhookSubscription, error)
+	List(tenant string) ([]*WebhookSubscription, error)
+	Delete(id string) error
+	SaveDelivery(d *WebhookDelivery) error
+	// Deliveries returns the latest deliveries of the subscription, newest
+	// first.
+	Deliveries(subscription string, limit int) ([]*WebhookDelivery, error)
+}
+
+var errWebhookTarget = errors.New("webhooks are only sent to public https endpoints")
+
+// internalIP tells the addresses webhooks must not reach: a tenant admin
+// could otherwise have the server post into its own network.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// newWebhookClient calls the partner endpoints over https only, refusing
+// to connect to internal addresses. The check is made on the address
+// dialed, once resolved, so neither a DNS name pointing inward, nor a
+// redirect, gets past it.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return errWebhookTarget
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errWebhookTarget
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// checkWebhookURL rejects, when registered, the endpoints the client
+// would refuse anyway: those not over https, and hosts naming an internal
+// address outright.
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must be an absolute https URL")
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && internalIP(ip)) {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must not point to an internal address")
+	}
+	return nil
+}
+
+// webhookNotifier calls the subscribed partner endpoints, with payloads
+// signed like the inbound webhooks. Each delivery is a job, so failures
+// are retried with exponential backoff.
+type webhookNotifier struct {
+	store  SubscriptionStore
+	client *http.Client
+}
+
+// Notify delivers the event to the tenant's subscriptions. It is a no-op
+// on a nil notifier, i.e. outside the server.
+func (n *webhookNotifier) Notify(tenant, event string, data interface{}) {
+	if n == nil {
+		return
+	}
+	subs, err := n.store.List(tenant)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("failed to list webhook subscriptions")
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("failed to encode webhook payload")
+		return
+	}
+	for _, s := range subs {
+		if !s.wants(event) {
+			continue
+		}
+		e := Event{ID: newID(), Type: event, OccurredAt: clock.Now(), Data: payload}
+		body, _ := json.Marshal(e)
+		d := &WebhookDelivery{
+			ID:             e.ID,
+			SubscriptionID: s.ID,
+			Event:          event,
+			Status:         DeliveryPending,
+			CreatedAt:      e.OccurredAt,
+		}
+		if err := n.store.SaveDelivery(d); err != nil {
+			log.Error().Err(err).Str("subscription", s.ID).Msg("failed to record webhook delivery")
+		}
+		if b, ok := data.(*Bet); ok {
+			recordPlayerEvent(tenant, b.Email, "notification-"+d.ID, "notification", b.ID, d.CreatedAt, map[string]string{"event": event, "subscriptionId": s.ID})
+		}
+		s := s
+		jobs.Enqueue("webhook-delivery", webhookDeliveryAttempts, func(ctx context.Context) error {
+			return n.deliver(ctx, s, d, body)
+		})
+	}
+}
+
+func (n *webhookNotifier) deliver(ctx context.Context, s *WebhookSubscription, d *WebhookDelivery, body []byte) error {
+	d.Attempts++
+	status, err := n.post(ctx, s, d.ID, body)
+	d.ResponseStatus = status
+	if err == nil {
+		now := clock.Now()
+		d.Status, d.Error, d.DeliveredAt = DeliveryDelivered, "", &now
+	} else {
+		d.Error = err.Error()
+		if d.Attempts >= webhookDeliveryAttempts {
+			d.Status = DeliveryFailed
+		}
+	}
+	if serr := n.store.SaveDelivery(d); serr != nil {
+		log.Error().Err(serr).Str("delivery", d.ID).Msg("failed to record webhook delivery")
+	}
+	return err
+}
+
+func (n *webhookNotifier) post(ctx context.Context, s *WebhookSubscription, nonce string, body []byte) (int, error) {
+	// subscriptions registered before https was required are not served
+	if u, err := url.Parse(s.URL); err != nil || u.Scheme != "https" {
+		return 0, errWebhookTarget
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookNonceHeader, nonce)
+	req.Header.Set(webhookSignatureHeader, signWebhook([]byte(s.Secret), timestamp, nonce, body))
+	res, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer drain(res)
+	if !is2xx(res.StatusCode) {
+		return res.StatusCode, errors.New("endpoint answered " + res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+type subscriptionRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// CreatedSubscription is the only response carrying the secret.
+type CreatedSubscription struct {
+	*WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+// CreateSubscription registers a partner endpoint for the caller's tenant.
+// Without a secret one is generated and returned once.
+func CreateSubscription(c echo.Context) error {
+	req := &subscriptionRequest{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	if err := checkWebhookURL(req.URL); err != nil {
+		return err
+	}
+	for _, e := range req.Events {
+		if !webhookEvents[e] {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown event "+e+", expected bet.created or bet.settled")
+		}
+	}
+	if req.Secret == "" {
+		req.Secret = newID()
+	} else if len(req.Secret) < 16 {
+		return echo.NewHTTPError(http.StatusBadRequest, "secret must be at least 16 characters")
+	}
+	s := &WebhookSubscription{
+		ID:        newID(),
+		Tenant:    tenant(c),
+		URL:       req.URL,
+		Secret:    req.Secret,
+		Events:    req.Events,
+		CreatedAt: clock.Now(),
+	}
+	if err := subscriptions.Add(s); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, &CreatedSubscription{WebhookSubscription: s, Secret: s.Secret})
+}
+
+func ListSubscriptions(c echo.Context) error {
+	subs, err := subscriptions.List(tenant(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, subs)
+}
+
+// tenantSubscription loads the subscription in the path, hiding those of
+// other tenants.
+func tenantSubscription(c echo.Context) (*WebhookSubscription, error) {
+	s, err := subscriptions.Get(c.Param("id"))
+	if err == nil && s.Tenant != tenant(c) {
+		err = errSubscriptionNotFound
+	}
+	if err == errSubscriptionNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return s, err
+}
+
+func DeleteSubscription(c echo.Context) error {
+	s, err := tenantSubscription(c)
+	if err != nil {
+		return err
+	}
+	if err := subscriptions.Delete(s.ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListDeliveries reports the latest deliveries of a subscription.
+func ListDeliveries(c echo.Context) error {
+	s, err := tenantSubscription(c)
+	if err != nil {
+		return err
+	}
+	list, err := subscriptions.Deliveries(s.ID, deliveryHistory)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+type memorySubscriptions struct {
+	mu         sync.Mutex
+	subs       map[string]*WebhookSubscription
+	deliveries map[string][]*WebhookDelivery
+}
+
+func newMemorySubscriptions() *memorySubscriptions {
+	return &memorySubscriptions{subs: map[string]*WebhookSubscription{}, deliveries: map[string][]*WebhookDelivery{}}
+}
+
+func (m *memorySubscriptions) Add(s *WebhookSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *s
+	m.subs[s.ID] = &c
+	return nil
+}
+
+func (m *memorySubscriptions) Get(id string) (*WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.subs[id]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *memorySubscriptions) List(tenant string) ([]*WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*WebhookSubscription{}
+	for _, s := range m.subs {
+		if s.Tenant == tenant {
+			c := *s
+			r = append(r, &c)
+		}
+	}
+	return r, nil
+}
+
+func (m *memorySubscriptions) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subs, id)
+	delete(m.deliveries, id)
+	return nil
+}
+
+// SaveDelivery keeps the latest deliveryHistory deliveries per subscription.
+func (m *memorySubscriptions) SaveDelivery(d *WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *d
+	list := m.deliveries[d.SubscriptionID]
+	for i, e := range list {
+		if e.ID == d.ID {
+			list[i] = &c
+			return nil
+		}
+	}
+	list = append(list, &c)
+	if len(list) > deliveryHistory {
+		list = list[len(list)-deliveryHistory:]
+	}
+	m.deliveries[d.SubscriptionID] = list
+	return nil
+}
+
+func (m *memorySubscriptions) Deliveries(subscription string, limit int) ([]*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.deliveries[subscription]
+	r := []*WebhookDelivery{}
+	for i := len(list) - 1; i >= 0 && len(r) < limit; i-- {
+		c := *list[i]
+		r = append(r, &c)
+	}
+	return r, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// headToHeadYears bounds how far back past meetings of the teams are
+// looked up.
+const headToHeadYears = 10
+
+// Suggestion is the popular pick for a match: the score most predicted by
+// the other players, or without predictions yet the most frequent result
+// of the past meetings of the teams.
+type Suggestion struct {
+	MatchID     string        `json:"matchId"`
+	Score       string        `json:"score,omitempty"`
+	Source      string        `json:"source,omitempty"`
+	Bets        int           `json:"bets"`
+	Predictions []ScoreShare  `json:"predictions"`
+	HeadToHead  []PastMeeting `json:"headToHead"`
+}
+
+type ScoreShare struct {
+	Score string  `json:"score"`
+	Bets  int     `json:"bets"`
+	Share float64 `json:"share"`
+}
+
+// PastMeeting is a settled match between the same teams, its result
+// oriented as the suggested match, home team first.
+type PastMeeting struct {
+	MatchID string    `json:"matchId"`
+	Date    time.Time `json:"date"`
+	Result  string    `json:"result"`
+}
+
+// GetMatchSuggestion suggests a score for a match from the bets stored
+// locally: the distribution of the predictions made for it, and the
+// results of the previous meetings of its teams settled here.
+func GetMatchSuggestion(c echo.Context) error {
+	start := time.Now()
+	match, status, err := fetchMatch(c, serviceURL(tenant(c), "MATCH_SVC", c.Param("id")))
+	if status == http.StatusNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "match not found")
+	}
+	if err != nil {
+		return betError(&dependencyError{calls: map[string]dependencyCall{"matches": callSince(start, status, err)}})
+	}
+	a, err := bets.Aggregate(BetFilter{Tenant: tenant(c), MatchID: c.Param("id")})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to aggregate the bets")
+		return err
+	}
+	s := &Suggestion{MatchID: c.Param("id"), Predictions: []ScoreShare{}}
+	for _, g := range a.Scores {
+		s.Bets += g.Bets
+		s.Predictions = append(s.Predictions, ScoreShare{Score: g.HomeTeamScore + "x" + g.AwayTeamScore, Bets: g.Bets})
+	}
+	for i := range s.Predictions {
+		s.Predictions[i].Share = float64(s.Predictions[i].Bets) / float64(s.Bets)
+	}
+	sort.Slice(s.Predictions, func(i, j int) bool {
+		if s.Predictions[i].Bets != s.Predictions[j].Bets {
+			return s.Predictions[i].Bets > s.Predictions[j].Bets
+		}
+		return s.Predictions[i].Score < s.Predictions[j].Score
+	})
+	if s.HeadToHead, err = headToHead(tenant(c), match); err != nil {
+		log.Error().Err(err).Msg("failed to look up the past meetings")
+		return err
+	}
+	if len(s.Predictions) > 0 {
+		s.Score, s.Source = s.Predictions[0].Score, "predictions"
+	} else if score := mostFrequent(s.HeadToHead); score != "" {
+		s.Score, s.Source = score, "headToHead"
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+// headToHead finds the settled bets on earlier matches between the teams
+// of match, either side at home, and returns each match once, the latest
+// first.
+func headToHead(tenant string, match *Match) ([]PastMeeting, error) {
+	home, away := match.Teams.Home.Name, match.Teams.Away.Name
+	seen := map[string]bool{}
+	r := []PastMeeting{}
+	err := bets.Each(BetFilter{Tenant: tenant, From: match.Date.AddDate(-headToHeadYears, 0, 0), To: match.Date}, func(b *Bet) error {
+		m, s := b.MatchInfo, b.Settlement
+		if m == nil || s == nil || s.Status != SettlementSettled || seen[b.MatchID] || !m.Date.Before(match.Date) {
+			return nil
+		}
+		result := s.Result
+		switch {
+		case m.Teams.Home.Name == home && m.Teams.Away.Name == away:
+		case m.Teams.Home.Name == away && m.Teams.Away.Name == home:
+			parts := strings.SplitN(result, "x", 2)
+			if len(parts) != 2 {
+				return nil
+			}
+			result = parts[1] + "x" + parts[0]
+		default:
+			return nil
+		}
+		seen[b.MatchID] = true
+		r = append(r, PastMeeting{MatchID: b.MatchID, Date: m.Date, Result: result})
+		return nil
+	})
+	sort.Slice(r, func(i, j int) bool { return r[i].Date.After(r[j].Date) })
+	return r, err
+}
+
+// mostFrequent returns the most frequent result, the latest on ties.
+func mostFrequent(meetings []PastMeeting) string {
+	counts := map[string]int{}
+	best := ""
+	for _, m := range meetings {
+		counts[m.Result]++
+		if best == "" || counts[m.Result] > counts[best] {
+			best = m.Result
+		}
+	}
+	return best
+}
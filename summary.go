@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// summaryCache keeps assembled round summaries; dashboards refresh them
+// constantly and they only change when a match of the round is settled.
+var summaryCache *Cache
+
+const summaryHighlights = 3
+
+// RoundSummary is everything the office TV dashboard shows about a round,
+// in one payload.
+type RoundSummary struct {
+	Championship string        `json:"championship"`
+	Round        string        `json:"round"`
+	Results      []RoundResult `json:"results"`
+	Winners      []*Entry      `json:"winners"`
+	Climbers     []Mover       `json:"climbers"`
+	Fallers      []Mover       `json:"fallers"`
+	Best         []Prediction  `json:"best"`
+	Worst        []Prediction  `json:"worst"`
+	// Awards are empty until every bet of the round is settled.
+	Awards []Award `json:"awards"`
+}
+
+type RoundResult struct {
+	MatchID string `json:"matchId"`
+	Home    string `json:"home,omitempty"`
+	Away    string `json:"away,omitempty"`
+	Result  string `json:"result,omitempty"`
+	Bets    int    `json:"bets"`
+}
+
+// Mover is a player whose overall position changed with the round.
+type Mover struct {
+	Email    string `json:"email"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Movement int    `json:"movement"`
+}
+
+// Prediction is a settled bet with how far it was from the result, in goals.
+type Prediction struct {
+	Email   string `json:"email"`
+	MatchID string `json:"matchId"`
+	Bet     string `json:"bet"`
+	Result  string `json:"result"`
+	Points  int    `json:"points"`
+	Miss    int    `json:"miss"`
+}
+
+// roundSummary compares the standings before and after the round, the
+// rounds ordered by roundOrder.
+func roundSummary(tenant, championship, round string) (*RoundSummary, error) {
+	list, err := bets.List(BetFilter{Tenant: tenant, ChampionshipID: championship})
+	if err != nil {
+		return nil, err
+	}
+	var before, in []*Bet
+	earlier := roundOrder(tenant, championship)
+	for _, b := range list {
+		switch {
+		case b.Round == round:
+			in = append(in, b)
+		case earlier(b.Round, round):
+			before = append(before, b)
+		}
+	}
+	s := &RoundSummary{
+		Championship: championship,
+		Round:        round,
+		Results:      roundResults(in),
+		Winners:      []*Entry{},
+		Best:         []Prediction{},
+		Worst:        []Prediction{},
+		Awards:       []Award{},
+	}
+	a, err := awards.Get(tenant, championship, round)
+	if err != nil {
+		return nil, err
+	}
+	if a != nil {
+		s.Awards = a.Awards
+	}
+	for _, e := range rank(in) {
+		if e.Position == 1 && e.Points > 0 {
+			s.Winners = append(s.Winners, e)
+		}
+	}
+	s.Climbers, s.Fallers = movers(rank(before), rank(append(before, in...)))
+
+	var predictions []Prediction
+	for _, b := range in {
+		if p, ok := prediction(b); ok {
+			predictions = append(predictions, p)
+		}
+	}
+	sort.SliceStable(predictions, func(i, j int) bool {
+		a, b := predictions[i], predictions[j]
+		if a.Miss != b.Miss {
+			return a.Miss < b.Miss
+		}
+		return a.Email < b.Email
+	})
+	for i := 0; i < len(predictions) && i < summaryHighlights; i++ {
+		s.Best = append(s.Best, predictions[i])
+		s.Worst = append(s.Worst, predictions[len(predictions)-1-i])
+	}
+	return s, nil
+}
+
+func roundBefore(a, b string) bool {
+	x, xerr := strconv.Atoi(a)
+	y, yerr := strconv.Atoi(b)
+	if xerr == nil && yerr == nil {
+		return x < y
+	}
+	return a < b
+}
+
+func roundResults(in []*Bet) []RoundResult {
+	r := []RoundResult{}
+	for _, m := range groupByMatch(in) {
+		res := RoundResult{MatchID: m.MatchID, Bets: len(m.Bets)}
+		for _, b := range m.Bets {
+			if b.MatchInfo != nil {
+				res.Home, res.Away = b.MatchInfo.Teams.Home.Name, b.MatchInfo.Teams.Away.Name
+			}
+			if b.Settlement != nil && b.Settlement.Status == SettlementSettled {
+				res.Result = b.Settlement.Result
+			}
+		}
+		r = append(r, res)
+	}
+	return r
+}
+
+// movers returns the players who gained and lost the most positions,
+// ignoring those who had no position before the round.
+func movers(before, after []*Entry) (climbers, fallers []Mover) {
+	previous := map[string]int{}
+	for _, e := range before {
+		previous[e.Email] = e.Position
+	}
+	var all []Mover
+	for _, e := range after {
+		if from, ok := previous[e.Email]; ok && from != e.Position {
+			all = append(all, Mover{Email: e.Email, From: from, To: e.Position, Movement: from - e.Position})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Movement > all[j].Movement })
+	climbers, fallers = []Mover{}, []Mover{}
+	for i := 0; i < len(all) && len(climbers) < summaryHighlights && all[i].Movement > 0; i++ {
+		climbers = append(climbers, all[i])
+	}
+	for i := len(all) - 1; i >= 0 && len(fallers) < summaryHighlights && all[i].Movement < 0; i-- {
+		fallers = append(fallers, all[i])
+	}
+	return climbers, fallers
+}
+
+func prediction(b *Bet) (Prediction, bool) {
+	if b.Settlement == nil || b.Settlement.Status != SettlementSettled {
+		return Prediction{}, false
+	}
+	var r MatchResult
+	if _, err := fmt.Sscanf(b.Settlement.Result, "%dx%d", &r.HomeScore, &r.AwayScore); err != nil {
+		return Prediction{}, false
+	}
+	home, herr := strconv.Atoi(b.HomeTeamScore)
+	away, aerr := strconv.Atoi(b.AwayTeamScore)
+	if herr != nil || aerr != nil {
+		return Prediction{}, false
+	}
+	return Prediction{
+		Email:   b.Email,
+		MatchID: b.MatchID,
+		Bet:     MatchResult{home, away}.String(),
+		Result:  b.Settlement.Result,
+		Points:  b.Settlement.Points,
+		Miss:    abs(home-r.HomeScore) + abs(away-r.AwayScore),
+	}, true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// GetRoundSummary serves the cached summary of a round; browsers and
+// proxies may keep it for as long as the server does.
+func GetRoundSummary(c echo.Context) error {
+	key := tenant(c) + "/" + c.Param("id") + "/" + c.Param("round")
+	s, ok := summaryCache.Get(key)
+	if !ok {
+		var err error
+		if s, err = roundSummary(tenant(c), c.Param("id"), c.Param("round")); err != nil {
+			log.Error().Err(err).Msg("failed to assemble the round summary")
+			return err
+		}
+		summaryCache.Set(key, s)
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(config.Cache.SummaryTTL.Seconds())))
+	return respond(c, http.StatusOK, s)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo"
+)
+
+const tenantKey = "tenant"
+
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// TenancyConfig says where the tenant (the company running a pool) of a
+// request comes from: the token claim, or the header for tokens without
+// it. Requests naming neither belong to the default tenant.
+type TenancyConfig struct {
+	Header  string
+	Claim   string
+	Default string
+	Tenants map[string]TenantConfig
+}
+
+// TenantConfig overrides the downstream services, the scoring rules and
+// the static championship of one tenant. Services is keyed by the
+// variable it overrides, e.g. MATCH_SVC.
+type TenantConfig struct {
+	Services     map[string]string   `json:"services"`
+	Scoring      *ScoringRules       `json:"scoring"`
+	Championship *StaticChampionship `json:"championship"`
+}
+
+// ScoringRules are the points of an exact score and of the right outcome,
+// and the bonus, per leg, of an accumulator whose every leg scored. Rules
+// without the bonus, as those written before accumulators, keep the
+// default one.
+type ScoringRules struct {
+	ExactScore       int  `json:"exactScore"`
+	Outcome          int  `json:"outcome"`
+	AccumulatorBonus *int `json:"accumulatorBonus,omitempty"`
+}
+
+func (r ScoringRules) accumulatorBonus() int {
+	if r.AccumulatorBonus == nil {
+		return accumulatorBonusPoints
+	}
+	return *r.AccumulatorBonus
+}
+
+var defaultScoring = ScoringRules{ExactScore: exactScorePoints, Outcome: outcomePoints}
+
+// loadTenants reads the per-tenant overrides, a JSON object keyed by
+// tenant id.
+func loadTenants(file string) map[string]TenantConfig {
+	tenants := map[string]TenantConfig{}
+	if file == "" {
+		return tenants
+	}
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(b, &tenants)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the tenants file " + file)
+	}
+	return tenants
+}
+
+// Tenancy resolves the tenant of every request, rejecting malformed ids.
+// Requests to a pool's custom domain belong to the pool's tenant.
+func Tenancy(cfg TenancyConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			t := ""
+			if d, ok := c.Get(domainKey).(*PoolDomain); ok {
+				t = d.Tenant
+			} else if id, ok := identity(c); ok {
+				t = id.Tenant
+			}
+			if t == "" {
+				t = c.Request().Header.Get(cfg.Header)
+			}
+			if t == "" {
+				t = cfg.Default
+			}
+			if !validTenant.MatchString(t) {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid tenant "+t)
+			}
+			c.Set(tenantKey, t)
+			return next(c)
+		}
+	}
+}
+
+// tenant is the tenant of the request; background work without one
+// (a nil context) runs as the default tenant.
+func tenant(c echo.Context) string {
+	if c != nil {
+		if t, ok := c.Get(tenantKey).(string); ok {
+			return t
+		}
+	}
+	return config.Tenancy.Default
+}
+
+func scoring(tenant string) ScoringRules {
+	if t, ok := config.Tenancy.Tenants[tenant]; ok && t.Scoring != nil {
+		return *t.Scoring
+	}
+	if s := staticChampionship(tenant); s != nil && s.Scoring != nil {
+		return *s.Scoring
+	}
+	return defaultScoring
+}
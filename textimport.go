@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// TextImport is pasted text to read predictions from, e.g. a WhatsApp
+// chat export. The fixtures the predictions are matched against are the
+// listed matches, and those already bet on in the round of the
+// championship when both are given. Players maps the names used in the
+// text to emails.
+type TextImport struct {
+	Text         string            `json:"text"`
+	Matches      []string          `json:"matches,omitempty"`
+	Championship string            `json:"championship,omitempty"`
+	Round        string            `json:"round,omitempty"`
+	Players      map[string]string `json:"players,omitempty"`
+}
+
+// ParsedBet is a prediction read from a line of text, matched to a fixture
+// with the confidence of the weakest of its team names. Issues are what
+// keeps it from being placed as is, or what a reviewer should check.
+type ParsedBet struct {
+	Line          int      `json:"line"`
+	Text          string   `json:"text"`
+	Player        string   `json:"player,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	HomeTeam      string   `json:"homeTeam"`
+	AwayTeam      string   `json:"awayTeam"`
+	MatchID       string   `json:"matchId,omitempty"`
+	Match         string   `json:"match,omitempty"`
+	Championship  string   `json:"championship,omitempty"`
+	HomeTeamScore string   `json:"homeTeamScore"`
+	AwayTeamScore string   `json:"awayTeamScore"`
+	Confidence    float64  `json:"confidence"`
+	Issues        []string `json:"issues,omitempty"`
+}
+
+// ParsedText is the review of a text import: the predictions read, and the
+// lines that looked like none.
+type ParsedText struct {
+	Bets     []ParsedBet `json:"bets"`
+	Unparsed []string    `json:"unparsed,omitempty"`
+}
+
+// minMatchConfidence is the confidence below which the fixture a
+// prediction was matched to is flagged for review.
+const minMatchConfidence = 0.6
+
+var (
+	// chatTimestamp is the prefix of exported WhatsApp messages, as
+	// "[14/10/26, 18:02:11] " or "14/10/2026 18:02 - ".
+	chatTimestamp = regexp.MustCompile(`^\[?\d{1,4}[/.-]\d{1,2}[/.-]\d{1,4},? \d{1,2}:\d{2}(:\d{2})?( ?[AaPp][Mm])?\]?( -)? `)
+	// chatSender is the "João: " starting a message.
+	chatSender = regexp.MustCompile(`^([^:\d]{1,40}?)\s*:(?:\s+(.*))?$`)
+	// predictionLine is "BRA 2x1 ARG", also with "-", ":" or "×" between
+	// the scores.
+	predictionLine = regexp.MustCompile(`^(.+?)\s*(\d{1,2})\s*(?:x|X|×|-|:)\s*(\d{1,2})\s*(.+?)$`)
+)
+
+// parseText reads the predictions of a text, a message per line. A line
+// without sender belongs to the sender of the previous one, and a message
+// may hold several predictions separated by commas or semicolons.
+func parseText(text string) ([]ParsedBet, []string) {
+	var parsed []ParsedBet
+	var unparsed []string
+	player := ""
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(chatTimestamp.ReplaceAllString(strings.TrimSpace(line), ""))
+		if line == "" {
+			continue
+		}
+		if m := chatSender.FindStringSubmatch(line); m != nil {
+			player, line = strings.TrimSpace(m[1]), m[2]
+		}
+		found := false
+		for _, part := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ';' }) {
+			m := predictionLine.FindStringSubmatch(strings.TrimSpace(part))
+			if m == nil {
+				continue
+			}
+			found = true
+			parsed = append(parsed, ParsedBet{
+				Line: i + 1, Text: strings.TrimSpace(part), Player: player,
+				HomeTeam: m[1], HomeTeamScore: strconv.Itoa(atoi(m[2])),
+				AwayTeam: m[4], AwayTeamScore: strconv.Itoa(atoi(m[3])),
+			})
+		}
+		if !found && !strings.HasSuffix(line, ":") {
+			unparsed = append(unparsed, line)
+		}
+	}
+	return parsed, unparsed
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// accents folds the accented letters of team and player names.
+var accents = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n", "ß", "ss",
+)
+
+// foldName lowercases a name to its letters and digits, without accents.
+func foldName(s string) string {
+	s = accents.Replace(strings.ToLower(s))
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// teamSimilarity tells how likely a team name as written refers to a
+// team: 1 for the same name, 0.9 for a prefix of it such as "BRA" for
+// Brazil, its initials such as "PSG", or otherwise how few edits apart the
+// two are.
+func teamSimilarity(written, team string) float64 {
+	w, t := foldName(written), foldName(team)
+	if w == "" || t == "" {
+		return 0
+	}
+	if w == t {
+		return 1
+	}
+	if len(w) >= 3 && strings.HasPrefix(t, w) {
+		return 0.9
+	}
+	initials := ""
+	for _, word := range strings.Fields(team) {
+		if f := foldName(word); f != "" {
+			initials += f[:1]
+		}
+	}
+	if len(w) >= 2 && w == initials {
+		return 0.9
+	}
+	longest := len(w)
+	if len(t) > longest {
+		longest = len(t)
+	}
+	return 1 - float64(editDistance(w, t))/float64(longest)
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// matchFixture picks the fixture both teams of the prediction most likely
+// name. Teams written the other way round swap the scores.
+func matchFixture(p *ParsedBet, fixtures []*Match) {
+	var best *Match
+	bestScore, swapped := 0.0, false
+	for _, m := range fixtures {
+		home, away := m.Teams.Home.Name, m.Teams.Away.Name
+		if s := minFloat(teamSimilarity(p.HomeTeam, home), teamSimilarity(p.AwayTeam, away)); s > bestScore {
+			best, bestScore, swapped = m, s, false
+		}
+		if s := minFloat(teamSimilarity(p.HomeTeam, away), teamSimilarity(p.AwayTeam, home)); s > bestScore {
+			best, bestScore, swapped = m, s, true
+		}
+	}
+	if best == nil {
+		p.Issues = append(p.Issues, "no fixture found")
+		return
+	}
+	if swapped {
+		p.HomeTeamScore, p.AwayTeamScore = p.AwayTeamScore, p.HomeTeamScore
+	}
+	p.MatchID, p.Match, p.Confidence = best.ID, best.String(), bestScore
+	if bestScore < minMatchConfidence {
+		p.Issues = append(p.Issues, "fixture matched with low confidence")
+	}
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fixtures looks up the matches of an import.
+func (t *TextImport) fixtures(c echo.Context) ([]*Match, error) {
+	seen := map[string]bool{}
+	var list []*Match
+	add := func(id string, m *Match) {
+		if m.ID == "" {
+			m.ID = id
+		}
+		if !seen[m.ID] {
+			seen[m.ID] = true
+			list = append(list, m)
+		}
+	}
+	for _, id := range t.Matches {
+		m, _, err := match(c, id)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, "match "+id+" can't be looked up: "+err.Error())
+		}
+		// copied, as the cache holds it
+		fixture := *m
+		add(id, &fixture)
+	}
+	if t.Championship != "" && t.Round != "" {
+		placed, err := bets.List(BetFilter{Tenant: tenant(c), ChampionshipID: t.Championship, Round: t.Round})
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range placed {
+			if b.MatchInfo != nil {
+				m := *b.MatchInfo
+				add(b.MatchID, &m)
+			}
+		}
+	}
+	return list, nil
+}
+
+// player resolves the email of a name used in the text, through the
+// players of the import, case and accents aside; names that are emails
+// are their own.
+func (t *TextImport) player(name string) string {
+	if strings.Contains(name, "@") {
+		return normalizeEmail(name)
+	}
+	for n, email := range t.Players {
+		if foldName(n) == foldName(name) {
+			return normalizeEmail(email)
+		}
+	}
+	return ""
+}
+
+// ParseTextBets reads the predictions of pasted text for review. Each bet
+// found is matched to a fixture and dry run as its player would place it;
+// the issues tell which need fixing before confirming them with
+// POST /admin/bets/parse-text/confirm. Nothing is stored.
+func ParseTextBets(c echo.Context) error {
+	t := &TextImport{}
+	if err := decodeJSON(c, t); err != nil {
+		return err
+	}
+	fixtures, err := t.fixtures(c)
+	if err != nil {
+		return err
+	}
+	parsed, unparsed := parseText(t.Text)
+	predicted := map[string]bool{}
+	for i := range parsed {
+		p := &parsed[i]
+		p.Championship = t.Championship
+		if p.Email = t.player(p.Player); p.Email == "" {
+			p.Issues = append(p.Issues, "unknown player")
+		}
+		matchFixture(p, fixtures)
+		if p.Email == "" || p.MatchID == "" {
+			continue
+		}
+		if key := p.Email + "/" + p.MatchID; predicted[key] {
+			p.Issues = append(p.Issues, "the player already predicted this match")
+		} else {
+			predicted[key] = true
+		}
+		bet := &Bet{Match: p.MatchID, Championship: p.Championship, HomeTeamScore: p.HomeTeamScore, AwayTeamScore: p.AwayTeamScore}
+		if _, _, err := placeBet(c, bet, betOptions{round: t.Round, dryRun: true, player: p.Email}); err != nil {
+			p.Issues = append(p.Issues, betIssue(err))
+		}
+	}
+	if parsed == nil {
+		parsed = []ParsedBet{}
+	}
+	return c.JSON(http.StatusOK, &ParsedText{Bets: parsed, Unparsed: unparsed})
+}
+
+func betIssue(err error) string {
+	switch e := betError(err).(type) {
+	case *echo.HTTPError:
+		return fmt.Sprint(e.Message)
+	case *Problem:
+		return e.Title
+	}
+	return err.Error()
+}
+
+// ConfirmTextBets places the reviewed bets of a text import, each for its
+// player, answering as POST /bets/batch does.
+func ConfirmTextBets(c echo.Context) error {
+	req := struct {
+		Round string      `json:"round"`
+		Bets  []ParsedBet `json:"bets"`
+	}{}
+	if err := decodeJSON(c, &req); err != nil {
+		return err
+	}
+	if len(req.Bets) == 0 || len(req.Bets) > maxBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "an import places between 1 and 50 bets")
+	}
+	results := make([]BatchResult, len(req.Bets))
+	status := http.StatusCreated
+	for i, p := range req.Bets {
+		if p.Email == "" || p.MatchID == "" {
+			results[i] = BatchResult{Status: http.StatusBadRequest, Error: "a bet needs an email and a matchId"}
+			status = http.StatusMultiStatus
+			continue
+		}
+		bet := &Bet{Match: p.MatchID, Championship: p.Championship, HomeTeamScore: p.HomeTeamScore, AwayTeamScore: p.AwayTeamScore}
+		b, warnings, err := placeBet(c, bet, betOptions{round: req.Round, player: p.Email})
+		results[i] = batchResult(b, warnings, err)
+		if err != nil {
+			status = http.StatusMultiStatus
+		}
+	}
+	return c.JSON(status, results)
+}
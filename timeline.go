@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Timeline pages hold timelineLimit items unless ?limit= asks for up to
+// timelineMaxLimit.
+const (
+	timelineLimit    = 50
+	timelineMaxLimit = 200
+)
+
+// PlayerEvent is something that happened to a player outside of the audit
+// trail of their bets: a login, or a notification about a bet. Players
+// are pseudonymous keys, as in the warehouse.
+type PlayerEvent struct {
+	ID     string          `json:"id"`
+	Tenant string          `json:"-"`
+	Player string          `json:"-"`
+	At     time.Time       `json:"at"`
+	Kind   string          `json:"kind"`
+	BetID  string          `json:"betId,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+type PlayerEventStore interface {
+	// Add ignores events whose id is stored already.
+	Add(e *PlayerEvent) error
+	// List returns the events of the player in chronological order.
+	List(tenant, player string) ([]*PlayerEvent, error)
+}
+
+// recordPlayerEvent stores an event for the player with email; failures
+// are logged, the player's request carries on.
+func recordPlayerEvent(tenant, email, id, kind, betID string, at time.Time, data interface{}) {
+	e := &PlayerEvent{ID: id, Tenant: tenant, Player: playerKey(email), At: at, Kind: kind, BetID: betID}
+	if data != nil {
+		e.Data, _ = json.Marshal(data)
+	}
+	if err := playerEvents.Add(e); err != nil {
+		log.Error().Err(err).Str("kind", kind).Msg("failed to record the player event")
+	}
+}
+
+// loginsSeen keeps the sessions recorded lately, sparing a write per
+// request.
+var loginsSeen = NewCache(24*time.Hour, 100000)
+
+// TrackLogins records a login the first time a session of a player shows
+// up. Tokens are issued by the identity provider, so a new session, its
+// sid claim or else its issue time, is the closest we get to a login.
+func TrackLogins(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, ok := identity(c)
+		if !ok || id.Email == "" || id.Session == "" {
+			return next(c)
+		}
+		sum := sha256.Sum256([]byte(tenant(c) + "/" + id.Subject + "/" + id.Session))
+		key := "login-" + hex.EncodeToString(sum[:16])
+		if _, seen := loginsSeen.Get(key); !seen {
+			at := clock.Now()
+			if id.IssuedAt > 0 {
+				at = time.Unix(id.IssuedAt, 0).UTC()
+			}
+			recordPlayerEvent(tenant(c), id.Email, key, "login", "", at, map[string]string{"ip": c.RealIP(), "userAgent": c.Request().UserAgent()})
+			loginsSeen.Set(key, true)
+		}
+		return next(c)
+	}
+}
+
+// TimelineItem is one entry of a player's timeline: an audit entry of one
+// of their bets (bet.created, bet.updated, bet.deleted, bet.settled) or a
+// player event (login, notification).
+type TimelineItem struct {
+	ID    string          `json:"id"`
+	At    time.Time       `json:"at"`
+	Kind  string          `json:"kind"`
+	BetID string          `json:"betId,omitempty"`
+	Actor string          `json:"actor,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type Timeline struct {
+	Items []*TimelineItem `json:"items"`
+	// Next is the cursor of the next page, absent on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+func (i *TimelineItem) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(i.At.Format(time.RFC3339Nano) + "|" + i.ID))
+}
+
+func (i *TimelineItem) before(at time.Time, id string) bool {
+	if !i.At.Equal(at) {
+		return i.At.Before(at)
+	}
+	return i.ID < id
+}
+
+func parseTimelineCursor(s string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	parts := strings.SplitN(string(raw), "|", 2)
+	if err != nil || len(parts) != 2 {
+		return time.Time{}, "", echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+	}
+	at, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+	}
+	return at, parts[1], nil
+}
+
+// GetPlayerTimeline merges the audit trail of a player's bets, deleted
+// ones included, with their logins and notifications into one feed,
+// oldest first. ?cursor= continues after the page that returned it.
+func GetPlayerTimeline(c echo.Context) error {
+	limit := timelineLimit
+	if s := c.QueryParam("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > timelineMaxLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(timelineMaxLimit))
+		}
+		limit = n
+	}
+	var afterAt time.Time
+	var afterID string
+	if s := c.QueryParam("cursor"); s != "" {
+		var err error
+		if afterAt, afterID, err = parseTimelineCursor(s); err != nil {
+			return err
+		}
+	}
+	items, err := playerTimeline(tenant(c), c.Param("email"))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to build the player timeline")
+		return err
+	}
+	t := &Timeline{Items: []*TimelineItem{}}
+	for _, item := range items {
+		if afterID != "" && !(&TimelineItem{At: afterAt, ID: afterID}).before(item.At, item.ID) {
+			continue
+		}
+		if len(t.Items) == limit {
+			t.Next = t.Items[limit-1].cursor()
+			break
+		}
+		t.Items = append(t.Items, item)
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+func playerTimeline(tenant, email string) ([]*TimelineItem, error) {
+	list, err := bets.List(BetFilter{Tenant: tenant, Email: email, IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+	items := []*TimelineItem{}
+	for _, b := range list {
+		entries, err := audit.store.List(b.ID)
+		if err != nil {
+			return nil, err
+		}
+		created := false
+		for _, e := range entries {
+			created = created || e.Action == "bet.created"
+			items = append(items, &TimelineItem{ID: "audit-" + strconv.FormatInt(e.Seq, 10), At: e.At, Kind: e.Action, BetID: e.BetID, Actor: e.Actor, Data: e.Data})
+		}
+		if !created {
+			// bets placed before the audit trail
+			data, _ := json.Marshal(map[string]string{"matchId": b.MatchID, "homeTeamScore": b.HomeTeamScore, "awayTeamScore": b.AwayTeamScore})
+			items = append(items, &TimelineItem{ID: "bet-" + b.ID, At: b.CreatedAt, Kind: "bet.created", BetID: b.ID, Data: data})
+		}
+	}
+	events, err := playerEvents.List(tenant, playerKey(email))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		items = append(items, &TimelineItem{ID: e.ID, At: e.At, Kind: e.Kind, BetID: e.BetID, Data: e.Data})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].before(items[j].At, items[j].ID) })
+	return items, nil
+}
+
+type memoryPlayerEvents struct {
+	mu     sync.Mutex
+	ids    map[string]bool
+	events []*PlayerEvent
+}
+
+func newMemoryPlayerEvents() *memoryPlayerEvents {
+	return &memoryPlayerEvents{ids: map[string]bool{}}
+}
+
+func (m *memoryPlayerEvents) Add(e *PlayerEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ids[e.ID] {
+		return nil
+	}
+	c := *e
+	m.ids[e.ID] = true
+	m.events = append(m.events, &c)
+	return nil
+}
+
+func (m *memoryPlayerEvents) List(tenant, player string) ([]*PlayerEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*PlayerEvent{}
+	for _, e := range m.events {
+		if e.Tenant == tenant && e.Player == player {
+			c := *e
+			r = append(r, &c)
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].At.Before(r[j].At) })
+	return r, nil
+}
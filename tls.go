@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serve serves plain HTTP, or HTTPS when the server TLS config is enabled.
+func serve(e *echo.Echo, address string, srv ServerConfig, cfg ServerTLSConfig) error {
+	tuneServer(e.Server, srv)
+	tuneServer(e.TLSServer, srv)
+	e.DisableHTTP2 = !srv.HTTP2
+	if !cfg.Enabled() {
+		return e.Start(address)
+	}
+	// custom domains with their own certificate get it, the others the
+	// server or ACME certificate
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: domainCertificate}
+	if len(cfg.AutocertHosts) > 0 {
+		whitelist := autocert.HostWhitelist(cfg.AutocertHosts...)
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = func(ctx context.Context, host string) error {
+			if !startup.done() {
+				return whitelist(ctx, host)
+			}
+			if d, err := domains.lookup(host); err == nil && d != nil {
+				return nil
+			}
+			return whitelist(ctx, host)
+		}
+		e.AutoTLSManager.Cache = autocert.DirCache(cfg.AutocertCache)
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, err := domainCertificate(hello); cert != nil || err != nil {
+				return cert, err
+			}
+			return e.AutoTLSManager.GetCertificate(hello)
+		}
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, "acme-tls/1")
+	} else {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if !e.DisableHTTP2 {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2")
+	}
+	s := e.TLSServer
+	s.Addr = address
+	s.TLSConfig = tlsConfig
+	log.Info().Msg("serving HTTPS on " + address)
+	return e.StartServer(s)
+}
+
+func tuneServer(s *http.Server, cfg ServerConfig) {
+	s.ReadHeaderTimeout = cfg.ReadHeaderTimeout
+	s.ReadTimeout = cfg.ReadTimeout
+	s.WriteTimeout = cfg.WriteTimeout
+	s.IdleTimeout = cfg.IdleTimeout
+	s.MaxHeaderBytes = cfg.MaxHeaderBytes
+	s.SetKeepAlivesEnabled(cfg.KeepAlive)
+	if !cfg.HTTP2 {
+		// a non-nil empty map keeps net/http from configuring HTTP/2
+		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
+
+// domainCertificate is the certificate of a custom domain; none while the
+// domains are not loaded yet.
+func domainCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !startup.done() {
+		return nil, nil
+	}
+	return domains.certificate(hello)
+}
+
+// upstreamTLS builds the client side TLS config used on calls to the
+// downstream services. It returns nil when nothing is configured, leaving
+// the transport defaults in place.
+func upstreamTLS(cfg UpstreamTLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
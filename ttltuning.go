@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TTLTuningConfig drives the tuning of the match and championship cache
+// TTLs. Every Interval, a cache whose service failed at least ErrorRate of
+// its calls has its TTL doubled, riding out the outage on cached answers;
+// otherwise the TTL grows by a quarter while the cache answers less than
+// TargetHitRate of its lookups, and shrinks by a quarter, for fresher
+// data, once it answers more. The TTL stays between MinTTL and MaxTTL.
+type TTLTuningConfig struct {
+	Enabled       bool
+	Interval      time.Duration
+	MinTTL        time.Duration
+	MaxTTL        time.Duration
+	TargetHitRate float64
+	ErrorRate     float64
+}
+
+// minTuningSamples are the lookups, or calls, an interval needs for its
+// rates to mean anything.
+const minTuningSamples = 20
+
+// upstreamOutcomes counts the calls to each downstream service and those
+// that failed, as the breakers count them, for the TTL tuner.
+type upstreamOutcomes struct {
+	mu    sync.Mutex
+	calls map[string]*outcomeCount
+}
+
+type outcomeCount struct {
+	calls, failures uint64
+}
+
+var upstreamCalls = &upstreamOutcomes{calls: map[string]*outcomeCount{}}
+
+func (u *upstreamOutcomes) record(service string, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, found := u.calls[service]
+	if !found {
+		c = &outcomeCount{}
+		u.calls[service] = c
+	}
+	c.calls++
+	if !ok {
+		c.failures++
+	}
+}
+
+func (u *upstreamOutcomes) get(service string) outcomeCount {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.calls[service]; ok {
+		return *c
+	}
+	return outcomeCount{}
+}
+
+// tunedCache is a cache and the service it stands in front of, with the
+// counters seen on the previous tick.
+type tunedCache struct {
+	name    string
+	service string
+	cache   *ShardedCache
+	stats   CacheStats
+	calls   outcomeCount
+}
+
+type ttlTuner struct {
+	cfg    TTLTuningConfig
+	caches []*tunedCache
+}
+
+func newTTLTuner(cfg TTLTuningConfig) *ttlTuner {
+	t := &ttlTuner{cfg: cfg}
+	for _, c := range []*tunedCache{
+		{name: "matches", service: "matches", cache: matchCache},
+		{name: "championships", service: "championships", cache: championshipCache},
+	} {
+		c.stats, c.calls = c.cache.Stats(), upstreamCalls.get(c.service)
+		t.caches = append(t.caches, c)
+	}
+	return t
+}
+
+func (t *ttlTuner) Run(ctx context.Context) {
+	tick := time.NewTicker(t.cfg.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			for _, c := range t.caches {
+				t.tune(c)
+			}
+		}
+	}
+}
+
+// tune adjusts the TTL of the cache to the lookups and calls made since
+// the previous tick, logging every change.
+func (t *ttlTuner) tune(c *tunedCache) {
+	stats, calls := c.cache.Stats(), upstreamCalls.get(c.service)
+	hits, misses := stats.Hits-c.stats.Hits, stats.Misses-c.stats.Misses
+	made, failed := calls.calls-c.calls.calls, calls.failures-c.calls.failures
+	c.stats, c.calls = stats, calls
+
+	var hitRate, errorRate float64
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+	if made > 0 {
+		errorRate = float64(failed) / float64(made)
+	}
+	ttl := stats.TTL
+	var reason string
+	switch {
+	case made >= minTuningSamples && errorRate >= t.cfg.ErrorRate:
+		ttl, reason = ttl*2, "upstream failing"
+	case hits+misses < minTuningSamples:
+		return
+	case hitRate < t.cfg.TargetHitRate:
+		ttl, reason = ttl+ttl/4, "hit rate below target"
+	default:
+		ttl, reason = ttl-ttl/4, "hit rate above target"
+	}
+	if ttl < t.cfg.MinTTL {
+		ttl = t.cfg.MinTTL
+	}
+	if ttl > t.cfg.MaxTTL {
+		ttl = t.cfg.MaxTTL
+	}
+	if ttl == stats.TTL {
+		return
+	}
+	c.cache.SetTTL(ttl)
+	log.Info().Str("cache", c.name).Dur("from", stats.TTL).Dur("to", ttl).
+		Float64("hitRate", hitRate).Float64("errorRate", errorRate).
+		Uint64("lookups", hits+misses).Uint64("calls", made).
+		Msg("adjusted cache TTL: " + reason)
+}
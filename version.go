@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/labstack/echo"
+)
+
+// Build metadata, injected at build time:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+	// RequestedVersion echoes the x-version header that routed the request,
+	// telling apart a canary that was asked for from one that was hit.
+	RequestedVersion string `json:"requestedVersion,omitempty"`
+}
+
+func buildInfo(c echo.Context) *BuildInfo {
+	return &BuildInfo{
+		Version:          version,
+		Commit:           commit,
+		BuildTime:        buildTime,
+		GoVersion:        runtime.Version(),
+		RequestedVersion: c.Request().Header.Get("x-version"),
+	}
+}
+
+func Info(c echo.Context) error {
+	return c.JSON(http.StatusOK, buildInfo(c))
+}
+
+// VersionHeaders stamps every response with the version that served it.
+func VersionHeaders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := c.Response().Header()
+		h.Set("X-App-Version", version)
+		h.Set("X-App-Commit", commit)
+		return next(c)
+	}
+}
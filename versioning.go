@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	apiVersionKey = "apiVersion"
+	latestAPI     = 1
+)
+
+// vendorType is the Accept media type pinning an API version, e.g.
+// application/vnd.bets.v1+json.
+var vendorType = regexp.MustCompile(`application/vnd\.bets\.v(\d+)\+json`)
+
+// APIVersion marks the requests of a versioned route group.
+func APIVersion(v int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			setAPIVersion(c, v)
+			return next(c)
+		}
+	}
+}
+
+// LegacyAPI serves the unversioned routes. Clients that can't change their
+// paths pick a version with the vendor Accept type; the others get v1 with
+// Deprecation and successor Link headers, and Sunset when it is set.
+func LegacyAPI(successor, sunset string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if m := vendorType.FindStringSubmatch(c.Request().Header.Get(echo.HeaderAccept)); m != nil {
+				v, _ := strconv.Atoi(m[1])
+				if v < 1 || v > latestAPI {
+					return echo.NewHTTPError(http.StatusNotAcceptable, "unsupported API version "+m[1])
+				}
+				setAPIVersion(c, v)
+				return next(c)
+			}
+			h := c.Response().Header()
+			h.Set("Deprecation", "true")
+			h.Set("Link", "<"+successor+strings.TrimPrefix(c.Request().URL.Path, "/api")+`>; rel="successor-version"`)
+			if sunset != "" {
+				h.Set("Sunset", sunset)
+			}
+			setAPIVersion(c, 1)
+			return next(c)
+		}
+	}
+}
+
+func setAPIVersion(c echo.Context, v int) {
+	c.Set(apiVersionKey, v)
+	c.Response().Header().Set("X-API-Version", strconv.Itoa(v))
+}
+
+// apiRoute is the route path without its /api or /api/vN prefix, for
+// settings shared by every version of a route.
+func apiRoute(path string) string {
+	path = strings.TrimPrefix(path, "/api")
+	if strings.HasPrefix(path, "/v") {
+		if i := strings.Index(path[1:], "/"); i > 0 {
+			if _, err := strconv.Atoi(path[2 : i+1]); err == nil {
+				return path[i+1:]
+			}
+		}
+	}
+	return path
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// warehouseTables are exported incrementally, each with its own watermark.
+var warehouseTables = []string{"bets", "audit"}
+
+// WarehouseWriter loads the rows of one export run into the warehouse, as
+// NDJSON. A run failing after the write is retried with the same rows, so
+// writers must tolerate a batch arriving twice.
+type WarehouseWriter interface {
+	Write(table string, until time.Time, rows io.Reader) error
+}
+
+// blobWarehouse lays batches out in the blob store the way BigQuery and
+// Redshift load them from GCS or S3:
+// <prefix>/<table>/dt=<day>/<until>.ndjson.
+type blobWarehouse struct {
+	store  BlobStore
+	prefix string
+}
+
+func (w *blobWarehouse) Write(table string, until time.Time, rows io.Reader) error {
+	key := w.prefix + "/" + table + "/dt=" + until.UTC().Format("2006-01-02") + "/" + strconv.FormatInt(until.UnixNano(), 10) + ".ndjson"
+	return w.store.Put(key, rows)
+}
+
+type WatermarkStore interface {
+	// Get returns the zero time for a table never exported.
+	Get(table string) (time.Time, error)
+	Set(table string, at time.Time) error
+}
+
+// warehouseExporter ships the bets changed, and the audit entries recorded,
+// since the table's watermark. Runs stop Lag short of now, so rows saved
+// by transactions still in flight are not skipped.
+type warehouseExporter struct {
+	cfg        WarehouseConfig
+	writer     WarehouseWriter
+	watermarks WatermarkStore
+}
+
+// Run queues an export every interval; the export lock keeps replicas from
+// exporting at the same time.
+func (x *warehouseExporter) Run(ctx context.Context) {
+	t := time.NewTicker(x.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			x.enqueue()
+		}
+	}
+}
+
+func (x *warehouseExporter) enqueue() Job {
+	return jobs.Enqueue("warehouse-export", 3, func(ctx context.Context) error {
+		err := withLock("warehouse", "export", time.Hour, func(context.Context) error { return x.export() })
+		if err == errLockBusy {
+			return nil
+		}
+		return err
+	})
+}
+
+func (x *warehouseExporter) export() error {
+	until := clock.Now().Add(-x.cfg.Lag)
+	for _, table := range warehouseTables {
+		since, err := x.watermarks.Get(table)
+		if err != nil {
+			return err
+		}
+		if !until.After(since) {
+			continue
+		}
+		n, err := x.exportTable(table, since, until)
+		if err != nil {
+			return err
+		}
+		if err := x.watermarks.Set(table, until); err != nil {
+			return err
+		}
+		log.Info().Str("table", table).Int("rows", n).Time("until", until).Msg("exported to the warehouse")
+	}
+	return nil
+}
+
+// exportTable spools the rows changed in (since, until] to a temporary
+// file, keeping memory flat, and writes them unless there are none.
+func (x *warehouseExporter) exportTable(table string, since, until time.Time) (int, error) {
+	f, err := ioutil.TempFile("", "warehouse-"+table+"-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	n := 0
+	write := func(row interface{}) error {
+		n++
+		return enc.Encode(row)
+	}
+	switch table {
+	case "bets":
+		err = bets.Each(BetFilter{ChangedAfter: since, ChangedUntil: until, IncludeDeleted: true}, func(b *Bet) error {
+			return write(warehouseBet(b))
+		})
+	case "audit":
+		err = audit.store.Range(since, until, func(e *AuditEntry) error {
+			return write(e)
+		})
+	default:
+		err = errors.New("unknown warehouse table " + table)
+	}
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return n, x.writer.Write(table, until, f)
+}
+
+// WarehouseBet is a bet as analytics sees it: the player is a pseudonymous
+// key instead of the email.
+type WarehouseBet struct {
+	ID             string      `json:"id"`
+	Tenant         string      `json:"tenant"`
+	ExternalRef    string      `json:"externalRef,omitempty"`
+	Player         string      `json:"player"`
+	Championship   string      `json:"championship"`
+	ChampionshipID string      `json:"championshipId"`
+	Round          string      `json:"round"`
+	MatchID        string      `json:"matchId"`
+	MatchDate      *time.Time  `json:"matchDate,omitempty"`
+	HomeTeamScore  string      `json:"homeTeamScore"`
+	AwayTeamScore  string      `json:"awayTeamScore"`
+	Stake          int64       `json:"stake,omitempty"`
+	Shootout       string      `json:"shootout,omitempty"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	UpdatedAt      time.Time   `json:"updatedAt"`
+	DeletedAt      *time.Time  `json:"deletedAt,omitempty"`
+	Settlement     *Settlement `json:"settlement,omitempty"`
+}
+
+func warehouseBet(b *Bet) *WarehouseBet {
+	w := &WarehouseBet{
+		ID:             b.ID,
+		Tenant:         b.Tenant,
+		ExternalRef:    b.ExternalRef,
+		Player:         playerKey(b.Email),
+		Championship:   b.Championship,
+		ChampionshipID: b.ChampionshipID,
+		Round:          b.Round,
+		MatchID:        b.MatchID,
+		HomeTeamScore:  b.HomeTeamScore,
+		AwayTeamScore:  b.AwayTeamScore,
+		Stake:          b.Stake,
+		Shootout:       b.Shootout,
+		CreatedAt:      b.CreatedAt,
+		UpdatedAt:      b.UpdatedAt,
+		DeletedAt:      b.DeletedAt,
+		Settlement:     b.Settlement,
+	}
+	if b.MatchInfo != nil {
+		w.MatchDate = &b.MatchInfo.Date
+	}
+	return w
+}
+
+// playerKey pseudonymizes an email. With PII encryption on it is the blind
+// index, so analysts can join with lookups made through the index.
+func playerKey(email string) string {
+	var h hash.Hash = sha256.New()
+	if config.PII.IndexKey != "" {
+		h = hmac.New(sha256.New, []byte(config.PII.IndexKey))
+	}
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetWarehouse reports the watermark of each table.
+func GetWarehouse(c echo.Context) error {
+	r := map[string]time.Time{}
+	for _, table := range warehouseTables {
+		at, err := warehouse.watermarks.Get(table)
+		if err != nil {
+			return err
+		}
+		r[table] = at
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+type backfillRequest struct {
+	Table string    `json:"table"`
+	Since time.Time `json:"since"`
+}
+
+// BackfillWarehouse rewinds the watermark of a table, e.g. to the zero
+// time for a full reload, and queues an export from there.
+func BackfillWarehouse(c echo.Context) error {
+	req := &backfillRequest{}
+	if err := decodeJSON(c, req); err != nil {
+		return err
+	}
+	known := false
+	for _, table := range warehouseTables {
+		known = known || table == req.Table
+	}
+	if !known {
+		return echo.NewHTTPError(http.StatusBadRequest, "table must be one of "+strings.Join(warehouseTables, ", "))
+	}
+	if err := warehouse.watermarks.Set(req.Table, req.Since); err != nil {
+		return err
+	}
+	log.Info().Str("table", req.Table).Time("since", req.Since).Str("actor", auditActor(c)).Msg("warehouse backfill requested")
+	return c.JSON(http.StatusAccepted, warehouse.enqueue())
+}
+
+type memoryWatermarks struct {
+	mu    sync.Mutex
+	marks map[string]time.Time
+}
+
+func newMemoryWatermarks() *memoryWatermarks {
+	return &memoryWatermarks{marks: map[string]time.Time{}}
+}
+
+func (m *memoryWatermarks) Get(table string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.marks[table], nil
+}
+
+func (m *memoryWatermarks) Set(table string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.marks[table] = at
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Webhook headers. The signature is "sha256=" followed by the
+// hex HMAC-SHA256 of "<timestamp>.<nonce>.<body>" keyed with the secret
+// shared with the sender.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookNonceHeader     = "X-Webhook-Nonce"
+	maxWebhookBody         = 1 << 20
+)
+
+// WebhookVerifier authenticates the requests of one webhook sender and
+// rejects replays: the timestamp must be within the tolerance and each
+// nonce is accepted once while it could still pass the timestamp check.
+type WebhookVerifier struct {
+	name      string
+	secret    []byte
+	tolerance time.Duration
+	nonces    *Cache
+}
+
+func NewWebhookVerifier(name, secret string, tolerance time.Duration) *WebhookVerifier {
+	return &WebhookVerifier{
+		name:      name,
+		secret:    []byte(secret),
+		tolerance: tolerance,
+		nonces:    NewCache(2*tolerance, 100000),
+	}
+}
+
+func (v *WebhookVerifier) sign(timestamp, nonce string, body []byte) string {
+	return signWebhook(v.secret, timestamp, nonce, body)
+}
+
+// signWebhook computes the signature header of a webhook request; inbound
+// and outbound webhooks share the scheme.
+func signWebhook(secret []byte, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (v *WebhookVerifier) verify(r *http.Request, body []byte) string {
+	h := r.Header
+	timestamp, nonce, signature := h.Get(webhookTimestampHeader), h.Get(webhookNonceHeader), h.Get(webhookSignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return "missing signature headers"
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "malformed timestamp"
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > v.tolerance || skew < -v.tolerance {
+		return "timestamp outside the tolerance"
+	}
+	if !hmac.Equal([]byte(signature), []byte(v.sign(timestamp, nonce, body))) {
+		return "invalid signature"
+	}
+	if _, seen := v.nonces.Get(nonce); seen {
+		return "replayed request"
+	}
+	v.nonces.Set(nonce, true)
+	return ""
+}
+
+// Middleware verifies the request before the handler runs; the body is
+// handed to the handler untouched.
+func (v *WebhookVerifier) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWebhookBody))
+		req.Body.Close()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed reading the request body")
+		}
+		if reason := v.verify(req, body); reason != "" {
+			log.Warn().Str("webhook", v.name).Str("remote", c.RealIP()).Msg("rejected webhook: " + reason)
+			return echo.NewHTTPError(http.StatusUnauthorized, reason)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return next(c)
+	}
+}
+
+// MatchResultsWebhook accepts match.finished events pushed over HTTP by
+// the matches service, for deployments without the event bus.
+func MatchResultsWebhook(consumer *settlementConsumer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		e := Event{}
+		if err := decodeJSON(c, &e); err != nil {
+			return err
+		}
+		if e.ID == "" || e.Type != "match.finished" {
+			return echo.NewHTTPError(http.StatusBadRequest, "expected a match.finished event with an id")
+		}
+		if err := consumer.Handle(e); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
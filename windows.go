@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// BetWindow is when the bets of a championship, or of one of its rounds,
+// may be placed, whatever the kickoff of the matches: from OpensAt until
+// ClosesAt, either unbounded when nil, outside the blackouts. A round's
+// window replaces its championship's. Windows are set by admins.
+type BetWindow struct {
+	Tenant         string     `json:"tenant"`
+	ChampionshipID string     `json:"championshipId"`
+	Round          string     `json:"round,omitempty"`
+	OpensAt        *time.Time `json:"opensAt,omitempty"`
+	ClosesAt       *time.Time `json:"closesAt,omitempty"`
+	Blackouts      []Blackout `json:"blackouts,omitempty"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+}
+
+// Blackout pauses betting, as during maintenance or a disputed fixture.
+type Blackout struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type BetWindowStore interface {
+	// List returns the windows of a championship, its own first.
+	List(tenant, championshipID string) ([]*BetWindow, error)
+	Put(w *BetWindow) error
+	Delete(tenant, championshipID, round string) error
+}
+
+var betWindows BetWindowStore
+
+// WindowStatus is whether betting is open now, and until when it stays so.
+type WindowStatus struct {
+	Round    string     `json:"round,omitempty"`
+	Open     bool       `json:"open"`
+	OpensAt  *time.Time `json:"opensAt,omitempty"`
+	ClosesAt *time.Time `json:"closesAt,omitempty"`
+	// Blackout is the current one, when betting is paused.
+	Blackout *Blackout `json:"blackout,omitempty"`
+	// NextChange is when Open flips next, nil when it never does.
+	NextChange *time.Time `json:"nextChange,omitempty"`
+}
+
+func (w *BetWindow) status(now time.Time) *WindowStatus {
+	s := &WindowStatus{Round: w.Round, OpensAt: w.OpensAt, ClosesAt: w.ClosesAt}
+	next := func(t time.Time) {
+		if t.After(now) && (s.NextChange == nil || t.Before(*s.NextChange)) {
+			at := t
+			s.NextChange = &at
+		}
+	}
+	switch {
+	case w.OpensAt != nil && now.Before(*w.OpensAt):
+		next(*w.OpensAt)
+	case w.ClosesAt != nil && !now.Before(*w.ClosesAt):
+	default:
+		s.Open = true
+		for i, b := range w.Blackouts {
+			if !now.Before(b.From) && now.Before(b.To) {
+				s.Open, s.Blackout = false, &w.Blackouts[i]
+				next(b.To)
+			}
+		}
+		if s.Open {
+			for _, b := range w.Blackouts {
+				next(b.From)
+			}
+			if w.ClosesAt != nil {
+				next(*w.ClosesAt)
+			}
+		}
+	}
+	return s
+}
+
+// openStatus is the status of championships and rounds without a window.
+var openStatus = &WindowStatus{Open: true}
+
+// bettingWindow is the window the bets on a round of a championship fall
+// in, nil for none.
+func bettingWindow(tenant, championshipID, round string) (*BetWindow, error) {
+	list, err := betWindows.List(tenant, championshipID)
+	if err != nil {
+		return nil, err
+	}
+	var w *BetWindow
+	for _, each := range list {
+		if round != "" && each.Round == round {
+			return each, nil
+		}
+		if each.Round == "" {
+			w = each
+		}
+	}
+	return w, nil
+}
+
+// checkBetWindow rejects bets placed at now outside the window of their
+// round or championship.
+func checkBetWindow(tenant, championshipID, round string, now time.Time) error {
+	w, err := bettingWindow(tenant, championshipID, round)
+	if err != nil || w == nil {
+		return err
+	}
+	s := w.status(now)
+	switch {
+	case s.Open:
+		return nil
+	case s.Blackout != nil:
+		return echo.NewHTTPError(http.StatusConflict, "betting on championship "+championshipID+" is paused until "+s.Blackout.To.Format(time.RFC3339))
+	case w.OpensAt != nil && now.Before(*w.OpensAt):
+		return echo.NewHTTPError(http.StatusConflict, "betting on championship "+championshipID+" opens at "+w.OpensAt.Format(time.RFC3339))
+	}
+	return echo.NewHTTPError(http.StatusConflict, "betting on championship "+championshipID+" is closed")
+}
+
+// ChampionshipView is a championship with its betting windows, the
+// championship's own and those of the rounds having one.
+type ChampionshipView struct {
+	*Championship
+	Window       *WindowStatus   `json:"window"`
+	RoundWindows []*WindowStatus `json:"roundWindows,omitempty"`
+}
+
+// GetChampionship returns a championship of the caller's tenant and
+// whether betting on it is open, for clients to disable their forms.
+func GetChampionship(c echo.Context) error {
+	id := c.Param("id")
+	start := time.Now()
+	champ, status, err := championship(c, id)
+	if status == http.StatusNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "championship not found")
+	}
+	if err != nil {
+		return betError(&dependencyError{calls: map[string]dependencyCall{"championships": callSince(start, status, err)}})
+	}
+	list, err := betWindows.List(tenant(c), id)
+	if err != nil {
+		return err
+	}
+	v := &ChampionshipView{Championship: champ, Window: openStatus}
+	now := requestClock(c).Now()
+	for _, w := range list {
+		if w.Round == "" {
+			v.Window = w.status(now)
+		} else {
+			v.RoundWindows = append(v.RoundWindows, w.status(now))
+		}
+	}
+	return c.JSON(http.StatusOK, v)
+}
+
+// ListBetWindows lists the windows of a championship.
+func ListBetWindows(c echo.Context) error {
+	list, err := betWindows.List(tenant(c), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// PutBetWindow sets the window of a championship, or of a round when the
+// path names one.
+func PutBetWindow(c echo.Context) error {
+	w := &BetWindow{}
+	if err := decodeJSON(c, w); err != nil {
+		return err
+	}
+	if w.OpensAt != nil && w.ClosesAt != nil && !w.OpensAt.Before(*w.ClosesAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "opensAt must be before closesAt")
+	}
+	for _, b := range w.Blackouts {
+		if !b.From.Before(b.To) {
+			return echo.NewHTTPError(http.StatusBadRequest, "blackouts must end after they start")
+		}
+	}
+	sort.Slice(w.Blackouts, func(i, j int) bool { return w.Blackouts[i].From.Before(w.Blackouts[j].From) })
+	w.Tenant, w.ChampionshipID, w.Round, w.UpdatedAt = tenant(c), c.Param("id"), c.Param("round"), clock.Now()
+	if err := betWindows.Put(w); err != nil {
+		return err
+	}
+	log.Info().Str("championship", w.ChampionshipID).Str("round", w.Round).Str("actor", auditActor(c)).Msg("bet window changed")
+	return c.JSON(http.StatusOK, w)
+}
+
+// DeleteBetWindow drops the window of a championship or round; a round
+// falls back to its championship's.
+func DeleteBetWindow(c echo.Context) error {
+	if err := betWindows.Delete(tenant(c), c.Param("id"), c.Param("round")); err != nil {
+		return err
+	}
+	log.Info().Str("championship", c.Param("id")).Str("round", c.Param("round")).Str("actor", auditActor(c)).Msg("bet window dropped")
+	return c.NoContent(http.StatusNoContent)
+}
+
+type memoryBetWindows struct {
+	mu      sync.Mutex
+	windows map[string]*BetWindow
+}
+
+func newMemoryBetWindows() *memoryBetWindows {
+	return &memoryBetWindows{windows: map[string]*BetWindow{}}
+}
+
+func (m *memoryBetWindows) List(tenant, championshipID string) ([]*BetWindow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := []*BetWindow{}
+	for _, w := range m.windows {
+		if w.Tenant == tenant && w.ChampionshipID == championshipID {
+			c := *w
+			r = append(r, &c)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Round < r[j].Round })
+	return r, nil
+}
+
+func (m *memoryBetWindows) Put(w *BetWindow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *w
+	m.windows[w.Tenant+"/"+w.ChampionshipID+"/"+w.Round] = &c
+	return nil
+}
+
+func (m *memoryBetWindows) Delete(tenant, championshipID, round string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.windows, tenant+"/"+championshipID+"/"+round)
+	return nil
+}